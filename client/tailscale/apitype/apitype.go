@@ -5,8 +5,12 @@
 package apitype
 
 import (
+	"net/netip"
+	"time"
+
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/wgengine/filter/filtertype"
 )
 
 // LocalAPIHost is the Host header value used by the LocalAPI.
@@ -76,3 +80,72 @@ type DNSQueryResponse struct {
 	// Resolvers is the list of resolvers that the forwarder deemed able to resolve the query.
 	Resolvers []*dnstype.Resolver
 }
+
+// DNSCacheStatus is the state of the internal DNS forwarder's response
+// cache, as returned via LocalAPI.
+type DNSCacheStatus struct {
+	// MaxEntries is the maximum number of cached responses.
+	MaxEntries int
+	// Hits and Misses are the numbers of forwarded queries answered and
+	// not answered from the cache since tailscaled started.
+	Hits, Misses int64
+	// Entries are the unexpired cached responses, most recently used
+	// first.
+	Entries []DNSCacheEntry
+}
+
+// DNSCacheEntry is a cached DNS response in a DNSCacheStatus.
+type DNSCacheEntry struct {
+	Name     string    // the question's name, without a trailing dot
+	Type     string    // the question's type, such as "A"
+	RCode    string    // the response code, such as "Success" or "NameError"
+	Negative bool      // whether it's an NXDOMAIN or NODATA response
+	Answers  int       // the number of answer records
+	Expires  time.Time // when the response expires from the cache
+}
+
+// DNSQueryLogEntry is a DNS query handled by the internal DNS resolver, as
+// returned by the LocalAPI's dns-query-log endpoint.
+type DNSQueryLogEntry struct {
+	Time   time.Time      // when the query arrived
+	Client netip.AddrPort // the querying address, if known
+
+	// PeerNode and PeerUser are the node name and user login name of the
+	// peer that sent the query, for queries from peers using this node as
+	// an exit node or app connector.
+	PeerNode string `json:",omitempty"`
+	PeerUser string `json:",omitempty"`
+
+	Name string // the question's name, without a trailing dot
+	Type string // the question's type, such as "A"
+
+	Local    bool   `json:",omitempty"` // answered by the resolver itself (MagicDNS)
+	Route    string `json:",omitempty"` // suffix of the DNS route used to forward it, such as "." or "corp.example."
+	Upstream string `json:",omitempty"` // the upstream resolver that answered it
+	Cached   bool   `json:",omitempty"` // answered from the forwarder's cache
+
+	RCode    string        `json:",omitempty"` // the response code, such as "Success"; empty on error
+	Error    string        `json:",omitempty"` // the error handling the query, if any
+	Duration time.Duration // how long it took to answer
+}
+
+// FilterCheckResponse is the response to a LocalAPI debug-filter-check
+// request, reporting whether this node's packet filter allows traffic from
+// Src to Dst:Port.
+type FilterCheckResponse struct {
+	Src   netip.Addr
+	Dst   netip.Addr
+	Port  uint16
+	Proto string // the IP protocol, such as "tcp"
+
+	Verdict string // "Accept" or "Drop"
+	Reason  string // why, as used in the packet filter's logs, such as "tcp ok"
+
+	// Match is the packet filter rule that allowed the traffic, limited to
+	// the traffic's address family. It's nil if the traffic was dropped or
+	// allowed without a rule.
+	Match *filtertype.Match `json:",omitempty"`
+
+	// Caps are the peer capabilities granted to Src when talking to Dst.
+	Caps tailcfg.PeerCapMap `json:",omitempty"`
+}
@@ -888,6 +888,49 @@ func (lc *LocalClient) QueryDNS(ctx context.Context, name string, queryType stri
 	return res.Bytes, res.Resolvers, nil
 }
 
+// DNSCache returns the state of the internal DNS forwarder's response cache.
+func (lc *LocalClient) DNSCache(ctx context.Context) (*apitype.DNSCacheStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/dns-cache")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.DNSCacheStatus](body)
+}
+
+// FlushDNSCache removes all responses from the internal DNS forwarder's
+// response cache.
+func (lc *LocalClient) FlushDNSCache(ctx context.Context) error {
+	_, err := lc.send(ctx, "DELETE", "/localapi/v0/dns-cache", http.StatusNoContent, nil)
+	return err
+}
+
+// StreamDNSQueryLog returns the queries in the internal DNS resolver's
+// query log as newline-delimited JSON apitype.DNSQueryLogEntry values. If
+// follow is true, the stream continues with new queries as they're handled,
+// until ctx is done. The caller must close the returned ReadCloser.
+func (lc *LocalClient) StreamDNSQueryLog(ctx context.Context, follow bool) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/dns-query-log?follow="+strconv.FormatBool(follow), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, errors.New(res.Status)
+	}
+	return res.Body, nil
+}
+
+// SetDNSQueryLogEnabled sets whether the internal DNS resolver logs the
+// queries it handles. Disabling the log clears it.
+func (lc *LocalClient) SetDNSQueryLogEnabled(ctx context.Context, enabled bool) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/dns-query-log?enabled="+strconv.FormatBool(enabled), http.StatusNoContent, nil)
+	return err
+}
+
 // StartLoginInteractive starts an interactive login.
 func (lc *LocalClient) StartLoginInteractive(ctx context.Context) error {
 	_, err := lc.send(ctx, "POST", "/localapi/v0/login-interactive", http.StatusNoContent, nil)
@@ -1535,6 +1578,26 @@ func (lc *LocalClient) DebugPacketFilterRules(ctx context.Context) ([]tailcfg.Fi
 	return decodeJSON[[]tailcfg.FilterRule](body)
 }
 
+// DebugFilterCheck reports whether the node's packet filter allows traffic
+// from src to dst:port using proto (such as "tcp", "udp" or "icmp"), along
+// with the rule that allowed it and the capabilities granted to src. If dst
+// is the zero value, the node's own Tailscale address is used. If proto is
+// empty, it's TCP.
+func (lc *LocalClient) DebugFilterCheck(ctx context.Context, src, dst netip.Addr, port uint16, proto string) (*apitype.FilterCheckResponse, error) {
+	v := url.Values{"src": {src.String()}, "port": {fmt.Sprint(port)}}
+	if dst.IsValid() {
+		v.Set("dst", dst.String())
+	}
+	if proto != "" {
+		v.Set("proto", proto)
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-filter-check?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error %w: %s", err, body)
+	}
+	return decodeJSON[*apitype.FilterCheckResponse](body)
+}
+
 // DebugSetExpireIn marks the current node key to expire in d.
 //
 // This is meant primarily for debug and testing.
@@ -1549,7 +1612,38 @@ func (lc *LocalClient) DebugSetExpireIn(ctx context.Context, d time.Duration) er
 // The provided context does not determine the lifetime of the
 // returned io.ReadCloser.
 func (lc *LocalClient) StreamDebugCapture(ctx context.Context) (io.ReadCloser, error) {
-	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+"/localapi/v0/debug-capture", nil)
+	return lc.StreamDebugCaptureWithOpts(ctx, nil)
+}
+
+// DebugCaptureOpts contains options for StreamDebugCaptureWithOpts.
+type DebugCaptureOpts struct {
+	// Format is the format of the capture: "pcap" or "pcapng". The empty
+	// string means "pcap".
+	Format string
+
+	// Filter, if non-empty, is a filter expression selecting which
+	// packets are captured, such as "tcp and port 443" or "peer foo".
+	// See tailscale.com/wgengine/capture.ParseFilter for the syntax.
+	Filter string
+}
+
+// StreamDebugCaptureWithOpts is like StreamDebugCapture, but with the
+// format and filter of the capture given by opts, which may be nil.
+func (lc *LocalClient) StreamDebugCaptureWithOpts(ctx context.Context, opts *DebugCaptureOpts) (io.ReadCloser, error) {
+	v := url.Values{}
+	if opts != nil {
+		if opts.Format != "" {
+			v.Set("format", opts.Format)
+		}
+		if opts.Filter != "" {
+			v.Set("filter", opts.Filter)
+		}
+	}
+	path := "/localapi/v0/debug-capture"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+apitype.LocalAPIHost+path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,56 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derpadmit"
+)
+
+// keysFileWatchInterval is how often the --admit-keys-file is checked for
+// changes.
+const keysFileWatchInterval = 5 * time.Second
+
+// configureAdmission configures s's client admission policies from flags.
+func configureAdmission(ctx context.Context, s *derp.Server) error {
+	s.SetVerifyClient(*verifyClients)
+
+	if *verifyClientURL != "" {
+		if *verifyCacheTTL > 0 || *verifyNegativeCacheTTL > 0 {
+			s.AddClientAdmitter(&derpadmit.Webhook{
+				URL:             *verifyClientURL,
+				FailOpen:        *verifyFailOpen,
+				TTL:             *verifyCacheTTL,
+				NegativeTTL:     *verifyNegativeCacheTTL,
+				RetryAfterError: *verifyRetryAfterError,
+				Logf:            log.Printf,
+			})
+		} else {
+			s.SetVerifyClientURL(*verifyClientURL)
+			s.SetVerifyClientURLFailOpen(*verifyFailOpen)
+		}
+	}
+
+	if *admitKeysFile != "" {
+		kl, err := derpadmit.NewKeyList(*admitKeysFile, log.Printf)
+		if err != nil {
+			return err
+		}
+		go kl.Watch(ctx, keysFileWatchInterval)
+		s.AddClientAdmitter(kl)
+	}
+
+	if *admitCIDRs != "" {
+		cl, err := derpadmit.ParseCIDRAllowList(*admitCIDRs)
+		if err != nil {
+			return err
+		}
+		s.AddClientAdmitter(cl)
+	}
+	return nil
+}
@@ -70,6 +70,16 @@
 	verifyClientURL = flag.String("verify-client-url", "", "if non-empty, an admission controller URL for permitting client connections; see tailcfg.DERPAdmitClientRequest")
 	verifyFailOpen  = flag.Bool("verify-client-url-fail-open", true, "whether we fail open if --verify-client-url is unreachable")
 
+	verifyCacheTTL         = flag.Duration("verify-client-url-cache-ttl", 0, "if non-zero, how long to cache --verify-client-url decisions to admit a client")
+	verifyNegativeCacheTTL = flag.Duration("verify-client-url-negative-cache-ttl", 0, "if non-zero, how long to cache --verify-client-url decisions to reject a client")
+	verifyRetryAfterError  = flag.Duration("verify-client-url-retry-after-error", 10*time.Second, "when --verify-client-url caching is enabled, how long to stop querying it after a failure, using cached decisions or --verify-client-url-fail-open instead")
+	admitKeysFile          = flag.String("admit-keys-file", "", "if non-empty, path to a file of \"allow <nodekey>\" and \"deny <nodekey>\" lines controlling which clients may connect; changes are picked up automatically")
+	admitCIDRs             = flag.String("admit-cidrs", "", "if non-empty, comma-separated list of CIDR prefixes; clients connecting from other source IPs are rejected")
+
+	clientBytesPerSec   = flag.Float64("client-bytes-per-sec", 0, "if non-zero, the default limit on packet bytes per second each client node key may relay")
+	clientPacketsPerSec = flag.Float64("client-packets-per-sec", 0, "if non-zero, the default limit on packets per second each client node key may relay")
+	rateLimitConfigPath = flag.String("rate-limit-config", "", "if non-empty, path to a JSON file of client rate limits, including per-source-IP limits and per-node-key overrides")
+
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
 
@@ -170,9 +180,12 @@ func main() {
 	serveTLS := tsweb.IsProd443(*addr) || *certMode == "manual"
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
-	s.SetVerifyClient(*verifyClients)
-	s.SetVerifyClientURL(*verifyClientURL)
-	s.SetVerifyClientURLFailOpen(*verifyFailOpen)
+	if err := configureAdmission(ctx, s); err != nil {
+		log.Fatalf("derper: client admission: %v", err)
+	}
+	if err := configureRateLimits(s); err != nil {
+		log.Fatalf("derper: rate limits: %v", err)
+	}
 
 	if *meshPSKFile != "" {
 		b, err := os.ReadFile(*meshPSKFile)
@@ -242,6 +255,7 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
+	debug.Handle("conn-events", "Connection event stream (JSON lines)", http.HandlerFunc(s.ServeConnEvents))
 	debug.Handle("set-mutex-profile-fraction", "SetMutexProfileFraction", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s := r.FormValue("rate")
 		if s == "" || r.Header.Get("Sec-Debug") != "derp" {
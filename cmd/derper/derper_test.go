@@ -8,11 +8,16 @@
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
+	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/tstest/deptest"
+	"tailscale.com/types/key"
 )
 
 func TestProdAutocertHostPolicy(t *testing.T) {
@@ -138,3 +143,28 @@ func TestTemplate(t *testing.T) {
 		t.Error("Output is missing debug info")
 	}
 }
+
+func TestLoadRateLimitConfig(t *testing.T) {
+	k := key.NewNode().Public()
+	path := filepath.Join(t.TempDir(), "limits.json")
+	conf := `{
+		"Client": {"BytesPerSecond": 1e6},
+		"SourceIP": {"PacketsPerSecond": 500, "PacketsBurst": 1000},
+		"Overrides": {"` + k.String() + `": {}}
+	}`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadRateLimitConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &rateLimitConfig{
+		Client:    derp.RateLimit{BytesPerSecond: 1e6},
+		SourceIP:  derp.RateLimit{PacketsPerSecond: 500, PacketsBurst: 1000},
+		Overrides: map[key.NodePublic]derp.RateLimit{k: {}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
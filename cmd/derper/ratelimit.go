@@ -0,0 +1,73 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// rateLimitConfig is the JSON format of the --rate-limit-config file.
+type rateLimitConfig struct {
+	// Client is the default limit for each client node key. If
+	// non-zero, it replaces the limit set by --client-bytes-per-sec and
+	// --client-packets-per-sec.
+	Client derp.RateLimit `json:",omitempty"`
+
+	// SourceIP is the limit for all clients connecting from a single
+	// source IP address.
+	SourceIP derp.RateLimit `json:",omitempty"`
+
+	// Overrides are per-node-key limits replacing Client. An override
+	// with no limits set exempts that node key from limiting.
+	Overrides map[key.NodePublic]derp.RateLimit `json:",omitempty"`
+}
+
+// loadRateLimitConfig reads the rate limit config file at path.
+func loadRateLimitConfig(path string) (*rateLimitConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(rateLimitConfig)
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// configureRateLimits sets s's rate limits from flags and, if set, the
+// --rate-limit-config file.
+func configureRateLimits(s *derp.Server) error {
+	cfg := &rateLimitConfig{
+		Client: derp.RateLimit{
+			BytesPerSecond:   *clientBytesPerSec,
+			PacketsPerSecond: *clientPacketsPerSec,
+		},
+	}
+	if *rateLimitConfigPath != "" {
+		fileCfg, err := loadRateLimitConfig(*rateLimitConfigPath)
+		if err != nil {
+			return err
+		}
+		if fileCfg.Client.IsZero() {
+			fileCfg.Client = cfg.Client
+		}
+		cfg = fileCfg
+	}
+	s.SetClientRateLimit(cfg.Client)
+	s.SetSourceIPRateLimit(cfg.SourceIP)
+	for k, rl := range cfg.Overrides {
+		s.SetClientRateLimitOverride(k, rl)
+	}
+	if !cfg.Client.IsZero() || !cfg.SourceIP.IsZero() || len(cfg.Overrides) > 0 {
+		log.Printf("DERP client rate limits configured: client=%+v source-ip=%+v overrides=%d", cfg.Client, cfg.SourceIP, len(cfg.Overrides))
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+)
+
+// errAllocStoreConflict is returned by allocStore.save when the stored
+// allocations changed since they were loaded.
+var errAllocStoreConflict = errors.New("allocation store modified concurrently")
+
+// allocStore persists the connector's address allocations, so that they
+// survive restarts and are shared by connectors with the same site ID.
+type allocStore interface {
+	// load returns the stored allocations and an opaque version for use
+	// with save. If nothing is stored, it returns nil data.
+	load(ctx context.Context) (data []byte, version string, err error)
+
+	// save stores data, provided the stored allocations are still at
+	// version. Otherwise, it returns errAllocStoreConflict.
+	save(ctx context.Context, data []byte, version string) error
+}
+
+// newAllocStore returns the allocStore described by spec: either
+// "kube:<secret-name>" or a file path. The siteID is used to keep
+// allocations of different sites apart in a kube Secret.
+func newAllocStore(spec string, siteID uint16) (allocStore, error) {
+	if secretName, ok := strings.CutPrefix(spec, "kube:"); ok {
+		c, err := kubeclient.New("natc")
+		if err != nil {
+			return nil, err
+		}
+		return &kubeAllocStore{
+			client:     c,
+			secretName: secretName,
+			key:        fmt.Sprintf("natc-allocations-site-%d", siteID),
+		}, nil
+	}
+	return fileAllocStore{path: spec}, nil
+}
+
+// fileAllocStore is an allocStore backed by a file, which may be on a
+// volume shared by several connectors.
+//
+// Its conflict detection is best-effort: a concurrent write between save's
+// check and its write goes undetected.
+type fileAllocStore struct {
+	path string
+}
+
+func (s fileAllocStore) load(ctx context.Context) ([]byte, string, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return b, fileVersion(b), nil
+}
+
+func (s fileAllocStore) save(ctx context.Context, data []byte, version string) error {
+	cur, curVersion, err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+	if cur != nil && curVersion != version {
+		return errAllocStoreConflict
+	}
+	return atomicfile.WriteFile(s.path, data, 0600)
+}
+
+// fileVersion returns the version of a fileAllocStore with contents b.
+func fileVersion(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// kubeAllocStore is an allocStore backed by a key in a Kubernetes Secret,
+// using the Secret's resourceVersion for conflict detection.
+type kubeAllocStore struct {
+	client     kubeclient.Client
+	secretName string
+	key        string // in the Secret's data
+}
+
+func (s *kubeAllocStore) load(ctx context.Context) ([]byte, string, error) {
+	secret, err := s.client.GetSecret(ctx, s.secretName)
+	if kubeclient.IsNotFoundErr(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return secret.Data[s.key], secret.ResourceVersion, nil
+}
+
+func (s *kubeAllocStore) save(ctx context.Context, data []byte, version string) error {
+	secret := &kubeapi.Secret{
+		TypeMeta: kubeapi.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: kubeapi.ObjectMeta{
+			Name:            s.secretName,
+			ResourceVersion: version,
+		},
+	}
+	if version == "" {
+		// The Secret didn't exist when loaded.
+		secret.Data = map[string][]byte{s.key: data}
+		err := s.client.CreateSecret(ctx, secret)
+		if isKubeConflict(err) {
+			return errAllocStoreConflict
+		}
+		return err
+	}
+	// Preserve the Secret's other keys, such as other sites' allocations.
+	cur, err := s.client.GetSecret(ctx, s.secretName)
+	if err != nil {
+		return err
+	}
+	if cur.ResourceVersion != version {
+		return errAllocStoreConflict
+	}
+	secret.Data = cur.Data
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[s.key] = data
+	err = s.client.UpdateSecret(ctx, secret)
+	if isKubeConflict(err) {
+		return errAllocStoreConflict
+	}
+	return err
+}
+
+// isKubeConflict reports whether err is a Kubernetes API conflict, as
+// returned for a stale resourceVersion or an existing object.
+func isKubeConflict(err error) bool {
+	var st *kubeapi.Status
+	return errors.As(err, &st) && st.Code == 409
+}
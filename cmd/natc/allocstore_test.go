@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+)
+
+func TestFileAllocStore(t *testing.T) {
+	ctx := context.Background()
+	s := fileAllocStore{path: filepath.Join(t.TempDir(), "allocs.json")}
+
+	b, v0, err := s.load(ctx)
+	if err != nil || b != nil || v0 != "" {
+		t.Fatalf("load of missing file = %q, %q, %v; want nil, \"\", nil", b, v0, err)
+	}
+	if err := s.save(ctx, []byte("one"), v0); err != nil {
+		t.Fatalf("save to missing file: %v", err)
+	}
+	b, v1, err := s.load(ctx)
+	if err != nil || string(b) != "one" || v1 == "" {
+		t.Fatalf("load = %q, %q, %v; want \"one\", non-empty version, nil", b, v1, err)
+	}
+
+	// Another connector creating the file first is a conflict.
+	if err := s.save(ctx, []byte("other"), v0); !errors.Is(err, errAllocStoreConflict) {
+		t.Fatalf("save at stale empty version: got %v; want errAllocStoreConflict", err)
+	}
+	if err := s.save(ctx, []byte("two"), v1); err != nil {
+		t.Fatalf("save at current version: %v", err)
+	}
+	if err := s.save(ctx, []byte("three"), v1); !errors.Is(err, errAllocStoreConflict) {
+		t.Fatalf("save at stale version: got %v; want errAllocStoreConflict", err)
+	}
+	if b, _, _ := s.load(ctx); string(b) != "two" {
+		t.Fatalf("after conflicting save, stored %q; want \"two\"", b)
+	}
+}
+
+// fakeKube is a kubeclient.Client holding a single Secret, which checks
+// resourceVersions like the API server.
+type fakeKube struct {
+	kubeclient.FakeClient
+
+	mu     sync.Mutex
+	secret *kubeapi.Secret // or nil if not created
+	rv     int
+	// beforeWrite, if non-nil, is called before the Secret is created or
+	// updated, to simulate a concurrent writer.
+	beforeWrite func()
+}
+
+func kubeStatus(code int) error {
+	return &kubeapi.Status{Code: code, Message: strconv.Itoa(code)}
+}
+
+func (fk *fakeKube) GetSecret(ctx context.Context, name string) (*kubeapi.Secret, error) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	if fk.secret == nil || fk.secret.Name != name {
+		return nil, kubeStatus(404)
+	}
+	s := *fk.secret
+	s.Data = maps.Clone(fk.secret.Data)
+	return &s, nil
+}
+
+func (fk *fakeKube) CreateSecret(ctx context.Context, s *kubeapi.Secret) error {
+	fk.runBeforeWrite()
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	if fk.secret != nil {
+		return kubeStatus(409)
+	}
+	fk.storeLocked(s)
+	return nil
+}
+
+func (fk *fakeKube) UpdateSecret(ctx context.Context, s *kubeapi.Secret) error {
+	fk.runBeforeWrite()
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	if fk.secret == nil {
+		return kubeStatus(404)
+	}
+	if s.ResourceVersion != fk.secret.ResourceVersion {
+		return kubeStatus(409)
+	}
+	fk.storeLocked(s)
+	return nil
+}
+
+func (fk *fakeKube) runBeforeWrite() {
+	fk.mu.Lock()
+	f := fk.beforeWrite
+	fk.beforeWrite = nil
+	fk.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+func (fk *fakeKube) storeLocked(s *kubeapi.Secret) {
+	fk.rv++
+	c := *s
+	c.Data = maps.Clone(s.Data)
+	c.ResourceVersion = strconv.Itoa(fk.rv)
+	fk.secret = &c
+}
+
+func TestKubeAllocStore(t *testing.T) {
+	ctx := context.Background()
+	fk := &fakeKube{}
+	s := &kubeAllocStore{client: fk, secretName: "natc", key: "natc-allocations-site-1"}
+	other := &kubeAllocStore{client: fk, secretName: "natc", key: "natc-allocations-site-2"}
+
+	b, v0, err := s.load(ctx)
+	if err != nil || b != nil || v0 != "" {
+		t.Fatalf("load of missing Secret = %q, %q, %v; want nil, \"\", nil", b, v0, err)
+	}
+
+	// Another connector creates the Secret between our load and save.
+	fk.beforeWrite = func() {
+		if err := other.save(ctx, []byte("site2"), ""); err != nil {
+			t.Errorf("concurrent create: %v", err)
+		}
+	}
+	if err := s.save(ctx, []byte("one"), v0); !errors.Is(err, errAllocStoreConflict) {
+		t.Fatalf("create of existing Secret: got %v; want errAllocStoreConflict", err)
+	}
+
+	b, v1, err := s.load(ctx)
+	if err != nil || b != nil || v1 == "" {
+		t.Fatalf("load of Secret without key = %q, %q, %v; want nil, non-empty version, nil", b, v1, err)
+	}
+	if err := s.save(ctx, []byte("one"), v1); err != nil {
+		t.Fatalf("save at current version: %v", err)
+	}
+	if err := s.save(ctx, []byte("two"), v1); !errors.Is(err, errAllocStoreConflict) {
+		t.Fatalf("save at stale version: got %v; want errAllocStoreConflict", err)
+	}
+
+	// Another connector updates the Secret between save's check of the
+	// resourceVersion and its update, which the server rejects with a 409.
+	_, v2, _ := s.load(ctx)
+	fk.beforeWrite = func() {
+		_, ov, _ := other.load(ctx)
+		if err := other.save(ctx, []byte("site2-updated"), ov); err != nil {
+			t.Errorf("concurrent update: %v", err)
+		}
+	}
+	if err := s.save(ctx, []byte("two"), v2); !errors.Is(err, errAllocStoreConflict) {
+		t.Fatalf("update with stale resourceVersion: got %v; want errAllocStoreConflict", err)
+	}
+
+	if b, _, _ := s.load(ctx); string(b) != "one" {
+		t.Errorf("site 1 stored %q; want \"one\"", b)
+	}
+	if b, _, _ := other.load(ctx); string(b) != "site2-updated" {
+		t.Errorf("site 2 stored %q; want \"site2-updated\"", b)
+	}
+
+	if err := s.save(ctx, []byte("x"), "bogus"); !errors.Is(err, errAllocStoreConflict) {
+		t.Errorf("save at unknown version: got %v; want errAllocStoreConflict", err)
+	}
+	fk.secret = nil
+	if err := s.save(ctx, []byte("x"), v2); err == nil || errors.Is(err, errAllocStoreConflict) {
+		t.Errorf("save to deleted Secret: got %v; want a non-conflict error", err)
+	}
+}
@@ -7,19 +7,25 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
-	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gaissmai/bart"
@@ -30,12 +36,15 @@
 	"tailscale.com/envknob"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
+	"tailscale.com/metrics"
 	"tailscale.com/net/netutil"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 	"tailscale.com/tsweb"
+	"tailscale.com/types/nettype"
 	"tailscale.com/util/dnsname"
+	"tailscale.com/util/domainmatch"
 	"tailscale.com/util/mak"
 )
 
@@ -56,6 +65,10 @@ func main() {
 		printULA        = fs.Bool("print-ula", false, "print the ULA prefix and exit")
 		ignoreDstPfxStr = fs.String("ignore-destinations", "", "comma-separated list of prefixes to ignore")
 		wgPort          = fs.Uint("wg-port", 0, "udp port for wireguard and peer to peer traffic")
+		allocStoreSpec  = fs.String("alloc-store", "", "where to persist address allocations so they survive restarts and are shared by connectors with the same site-id: a file path or \"kube:<secret-name>\"; if empty, allocations are kept in memory only")
+		leaseDuration   = fs.Duration("lease-duration", 24*time.Hour, "how long an address allocation lasts after its last use before its addresses may be reclaimed")
+		udpIdleTimeout  = fs.Duration("udp-idle-timeout", 2*time.Minute, "how long a proxied UDP flow may be idle before its state is discarded")
+		domainsStr      = fs.String("domains", "", "comma-separated list of domain patterns to serve, such as \"*.example.com:443\" (see package tailscale.com/util/domainmatch); if empty, all domains are served")
 	)
 	ff.Parse(fs, os.Args[1:], ff.WithEnvVarPrefix("TS_NATC"))
 
@@ -116,10 +129,42 @@ func main() {
 		ts.Logf = log.Printf
 	}
 
+	domains := domainmatch.MustParse("*")
+	if *domainsStr != "" {
+		var err error
+		domains, err = domainmatch.Parse(strings.Split(*domainsStr, ","))
+		if err != nil {
+			log.Fatalf("invalid -domains: %v", err)
+		}
+	}
+
+	var allocs allocStore
+	if *allocStoreSpec != "" {
+		var err error
+		allocs, err = newAllocStore(*allocStoreSpec, uint16(*siteID))
+		if err != nil {
+			log.Fatalf("opening allocation store: %v", err)
+		}
+	}
+
+	c := &connector{
+		ts:             ts,
+		dnsAddr:        dnsAddr,
+		v4Ranges:       v4Prefixes,
+		v6ULA:          ula(uint16(*siteID)),
+		ignoreDsts:     ignoreDstTable,
+		domains:        domains,
+		allocs:         allocs,
+		leaseDuration:  *leaseDuration,
+		udpIdleTimeout: *udpIdleTimeout,
+	}
+
 	// Start special-purpose listeners: dns, http promotion, debug server
 	if *debugPort != 0 {
 		mux := http.NewServeMux()
-		tsweb.Debugger(mux)
+		debug := tsweb.Debugger(mux)
+		debug.Handle("allocations", "Address allocations by peer (JSON)", http.HandlerFunc(c.serveAllocations))
+		debug.KVFunc("Active UDP flows", func() any { return c.udpFlows.Load() })
 		dln, err := ts.Listen("tcp", fmt.Sprintf(":%d", *debugPort))
 		if err != nil {
 			log.Fatalf("failed listening on debug port: %v", err)
@@ -137,14 +182,7 @@ func main() {
 		log.Fatalf("ts.Up: %v", err)
 	}
 
-	c := &connector{
-		ts:         ts,
-		lc:         lc,
-		dnsAddr:    dnsAddr,
-		v4Ranges:   v4Prefixes,
-		v6ULA:      ula(uint16(*siteID)),
-		ignoreDsts: ignoreDstTable,
-	}
+	c.lc = lc
 	c.run(ctx)
 }
 
@@ -175,8 +213,54 @@ type connector struct {
 	// return a dns response that contains the ip addresses we discovered with the lookup (ie not the
 	// natc behavior, which would return a dummy ip address pointing at natc).
 	ignoreDsts *bart.Table[bool]
+
+	// domains is the set of domains (and ports) the connector serves,
+	// from --domains. DNS queries for other domains get empty responses
+	// and flows to them aren't intercepted.
+	domains *domainmatch.Matcher
+
+	// allocs, if non-nil, persists the address allocations in perPeerMap.
+	allocs allocStore
+	// leaseDuration is how long an allocation lasts after its last use
+	// before its addresses may be reclaimed.
+	leaseDuration time.Duration
+
+	allocMu     sync.Mutex // serializes loading and saving allocations
+	lastLoad    time.Time  // when allocations were last loaded; guarded by allocMu
+	savePending atomic.Bool
+
+	// udpIdleTimeout is how long a proxied UDP flow may be idle before
+	// it's closed.
+	udpIdleTimeout time.Duration
+	// udpFlows is the number of active proxied UDP flows.
+	udpFlows atomic.Int64
+}
+
+// natcMetrics are the connector's metrics, published as the "natc" expvar.
+type natcMetrics struct {
+	// dnsAnswersByPattern counts A and AAAA queries answered with
+	// connector addresses, by the --domains pattern the name matched.
+	dnsAnswersByPattern metrics.LabelMap
+	// tcpFlowsByPattern and udpFlowsByPattern count intercepted flows by
+	// the --domains pattern their destination matched.
+	tcpFlowsByPattern metrics.LabelMap
+	udpFlowsByPattern metrics.LabelMap
 }
 
+var getMetrics = sync.OnceValue(func() *natcMetrics {
+	m := &natcMetrics{
+		dnsAnswersByPattern: metrics.LabelMap{Label: "pattern"},
+		tcpFlowsByPattern:   metrics.LabelMap{Label: "pattern"},
+		udpFlowsByPattern:   metrics.LabelMap{Label: "pattern"},
+	}
+	stats := new(metrics.Set)
+	stats.Set("dns_answers_by_pattern", &m.dnsAnswersByPattern)
+	stats.Set("tcp_flows_by_pattern", &m.tcpFlowsByPattern)
+	stats.Set("udp_flows_by_pattern", &m.udpFlowsByPattern)
+	expvar.Publish("natc", stats)
+	return m
+})
+
 // v6ULA is the ULA prefix used by the app connector to assign IPv6 addresses.
 // The 8th and 9th bytes are used to encode the site ID which allows for
 // multiple proxies to act in a HA configuration.
@@ -195,6 +279,14 @@ func ula(siteID uint16) netip.Prefix {
 // The passed in context is only used for the initial setup. The connector runs
 // forever.
 func (c *connector) run(ctx context.Context) {
+	if c.allocs != nil {
+		c.allocMu.Lock()
+		_, _, err := c.loadAllocationsLocked(ctx)
+		c.allocMu.Unlock()
+		if err != nil {
+			log.Fatalf("failed to load address allocations: %v", err)
+		}
+	}
 	if _, err := c.lc.EditPrefs(ctx, &ipn.MaskedPrefs{
 		AdvertiseRoutesSet: true,
 		Prefs: ipn.Prefs{
@@ -204,6 +296,7 @@ func (c *connector) run(ctx context.Context) {
 		log.Fatalf("failed to advertise routes: %v", err)
 	}
 	c.ts.RegisterFallbackTCPHandler(c.handleTCPFlow)
+	c.ts.RegisterFallbackUDPHandler(c.handleUDPFlow)
 	c.serveDNS()
 }
 
@@ -252,8 +345,9 @@ func lookupDestinationIP(domain string) ([]netip.Addr, error) {
 // It generates a response based on the request and the node that sent it.
 //
 // Each node is assigned a unique pair of IP addresses for each domain it
-// queries. This assignment is done lazily and is not persisted across restarts.
-// A per-peer assignment allows the connector to reuse a limited number of IP
+// queries. This assignment is done lazily and, if an allocation store is
+// configured, persisted across restarts and shared with other connectors
+// with the same site ID. A per-peer assignment allows the connector to reuse a limited number of IP
 // addresses across multiple nodes and domains. It also allows for clear
 // failover behavior when an app connector is restarted.
 //
@@ -307,6 +401,11 @@ func (c *connector) handleDNS(pc net.PacketConn, buf []byte, remoteAddr *net.UDP
 	// the natc thing.
 
 	resp, err := c.generateDNSResponse(&msg, who.Node.ID)
+	if errors.Is(err, errAllocationNotSaved) {
+		log.Printf("HandleDNS: %v", err)
+		// Have the client retry.
+		resp, err = dnsServerFailure(&msg)
+	}
 	// TODO (fran): treat as SERVFAIL
 	if err != nil {
 		log.Printf("HandleDNS: connector handling failed: %v\n", err)
@@ -332,13 +431,20 @@ func (c *connector) handleDNS(pc net.PacketConn, buf []byte, remoteAddr *net.UDP
 // generateDNSResponse generates a DNS response for the given request. The from
 // argument is the NodeID of the node that sent the request.
 func (c *connector) generateDNSResponse(req *dnsmessage.Message, from tailcfg.NodeID) ([]byte, error) {
-	pm, _ := c.perPeerMap.LoadOrStore(from, &perPeerState{c: c})
+	pm := c.peerState(from)
 	var addrs []netip.Addr
 	if len(req.Questions) > 0 {
 		switch req.Questions[0].Type {
 		case dnsmessage.TypeAAAA, dnsmessage.TypeA:
+			name := req.Questions[0].Name.String()
+			pattern, ok := c.domains.Match(name)
+			if !ok {
+				// Not a domain we serve.
+				return dnsResponse(req, nil)
+			}
+			getMetrics().dnsAnswersByPattern.Add(pattern, 1)
 			var err error
-			addrs, err = pm.ipForDomain(req.Questions[0].Name.String())
+			addrs, err = pm.ipForDomain(name)
 			if err != nil {
 				return nil, err
 			}
@@ -347,6 +453,25 @@ func (c *connector) generateDNSResponse(req *dnsmessage.Message, from tailcfg.No
 	return dnsResponse(req, addrs)
 }
 
+// dnsServerFailure makes a SERVFAIL response to req.
+func dnsServerFailure(req *dnsmessage.Message) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil,
+		dnsmessage.Header{
+			ID:       req.Header.ID,
+			Response: true,
+			RCode:    dnsmessage.RCodeServerFailure,
+		})
+	if len(req.Questions) > 0 {
+		if err := b.StartQuestions(); err != nil {
+			return nil, err
+		}
+		if err := b.Question(req.Questions[0]); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
 // dnsResponse makes a DNS response for the natc. If the dnsmessage is requesting TypeAAAA
 // or TypeA the provided addrs of the requested type will be used.
 func dnsResponse(req *dnsmessage.Message, addrs []netip.Addr) ([]byte, error) {
@@ -429,21 +554,64 @@ func (c *connector) handleTCPFlow(src, dst netip.AddrPort) (handler func(net.Con
 	}
 
 	from := who.Node.ID
-	ps, ok := c.perPeerMap.Load(from)
+	domain, ok := c.domainForIP(from, dst.Addr())
+	if !ok && c.maybeReloadAllocations() {
+		// The address may have been allocated by another connector
+		// with the same site ID, such as before a failover.
+		domain, ok = c.domainForIP(from, dst.Addr())
+	}
 	if !ok {
-		log.Printf("handleTCPFlow: no perPeerState for %v", from)
+		log.Printf("handleTCPFlow: no domain for IP %v from %v\n", dst.Addr(), from)
 		return nil, false
 	}
-	domain, ok := ps.domainForIP(dst.Addr())
+	pattern, ok := c.domains.MatchPort(domain, dst.Port())
 	if !ok {
-		log.Printf("handleTCPFlow: no domain for IP %v\n", dst.Addr())
+		log.Printf("handleTCPFlow: port %v of %q not allowed for %v\n", dst.Port(), domain, from)
 		return nil, false
 	}
+	getMetrics().tcpFlowsByPattern.Add(pattern, 1)
 	return func(conn net.Conn) {
 		proxyTCPConn(conn, domain)
 	}, true
 }
 
+// handleUDPFlow handles a UDP flow from the given source to the given
+// destination, like handleTCPFlow does for TCP. Each flow gets its own
+// upstream socket, so replies are naturally routed back to the flow's
+// source; the flow's state is discarded after c.udpIdleTimeout without
+// traffic in either direction.
+func (c *connector) handleUDPFlow(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	who, err := c.lc.WhoIs(ctx, src.Addr().String())
+	cancel()
+	if err != nil {
+		log.Printf("HandleUDPFlow: WhoIs failed: %v\n", err)
+		return nil, false
+	}
+
+	from := who.Node.ID
+	domain, ok := c.domainForIP(from, dst.Addr())
+	if !ok && c.maybeReloadAllocations() {
+		domain, ok = c.domainForIP(from, dst.Addr())
+	}
+	if !ok {
+		log.Printf("handleUDPFlow: no domain for IP %v from %v\n", dst.Addr(), from)
+		return nil, false
+	}
+	pattern, ok := c.domains.MatchPort(domain, dst.Port())
+	if !ok {
+		log.Printf("handleUDPFlow: port %v of %q not allowed for %v\n", dst.Port(), domain, from)
+		return nil, false
+	}
+	getMetrics().udpFlowsByPattern.Add(pattern, 1)
+	return func(conn nettype.ConnPacketConn) {
+		c.udpFlows.Add(1)
+		defer c.udpFlows.Add(-1)
+		proxyUDPConn(conn, net.JoinHostPort(domain, strconv.Itoa(int(dst.Port()))), c.udpIdleTimeout)
+	}, true
+}
+
 // ignoreDestination reports whether any of the provided dstAddrs match the prefixes configured
 // in --ignore-destinations
 func (c *connector) ignoreDestination(dstAddrs []netip.Addr) bool {
@@ -480,24 +648,116 @@ func proxyTCPConn(c net.Conn, dest string) {
 	p.Start()
 }
 
+// peerState returns the perPeerState for the peer with the given ID,
+// creating it if needed.
+func (c *connector) peerState(id tailcfg.NodeID) *perPeerState {
+	ps, _ := c.perPeerMap.LoadOrStore(id, &perPeerState{c: c, id: id})
+	return ps
+}
+
+// domainForIP returns the domain name assigned to the given IP address for
+// the given peer and whether it was found. It renews the allocation's lease.
+func (c *connector) domainForIP(from tailcfg.NodeID, ip netip.Addr) (_ string, ok bool) {
+	ps, ok := c.perPeerMap.Load(from)
+	if !ok {
+		return "", false
+	}
+	return ps.domainForIP(ip)
+}
+
+// allocation is the assignment of addresses to a domain for a peer.
+type allocation struct {
+	Domain string
+	// Addrs are an IPv4 address and the corresponding IPv6 address.
+	Addrs []netip.Addr
+	// Expires is when the allocation's lease expires, after which its
+	// addresses may be reclaimed if the peer runs out of addresses. The
+	// lease is renewed when the allocation is used.
+	Expires time.Time
+}
+
+// allocState is the JSON form of all allocations, as persisted in the
+// allocStore and served by the debug handler.
+type allocState struct {
+	Peers map[tailcfg.NodeID][]allocation
+}
+
+// has reports whether st has allocation a for peer id. st may be nil.
+func (st *allocState) has(id tailcfg.NodeID, a *allocation) bool {
+	if st == nil {
+		return false
+	}
+	return slices.ContainsFunc(st.Peers[id], func(sa allocation) bool {
+		return sa.Domain == a.Domain && slices.Equal(sa.Addrs, a.Addrs)
+	})
+}
+
+// proxyUDPConn proxies datagrams between the flow c and dest until the
+// flow has been idle for idleTimeout. It closes c when done.
+func proxyUDPConn(c net.Conn, dest string, idleTimeout time.Duration) {
+	defer c.Close()
+	up, err := net.Dial("udp", dest)
+	if err != nil {
+		log.Printf("proxyUDPConn: dial %v: %v", dest, err)
+		return
+	}
+	defer up.Close()
+
+	var lastActive atomic.Int64 // unix nanos
+	lastActive.Store(time.Now().UnixNano())
+	errc := make(chan error, 2)
+	copyPackets := func(dst, src net.Conn) {
+		buf := make([]byte, 65535)
+		for {
+			src.SetReadDeadline(time.Now().Add(idleTimeout))
+			n, err := src.Read(buf)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					// Only give up if the other direction was
+					// idle too.
+					if idle := time.Since(time.Unix(0, lastActive.Load())); idle < idleTimeout {
+						continue
+					}
+				}
+				errc <- err
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	go copyPackets(up, c)
+	go copyPackets(c, up)
+	// Closing both conns on return unblocks the other direction.
+	<-errc
+}
+
 // perPeerState holds the state for a single peer.
 type perPeerState struct {
-	c *connector
+	c  *connector
+	id tailcfg.NodeID
 
-	mu           sync.Mutex
-	domainToAddr map[string][]netip.Addr
-	addrToDomain *bart.Table[string]
+	mu            sync.Mutex
+	domainToAlloc map[string]*allocation
+	addrToDomain  *bart.Table[string]
 }
 
 // domainForIP returns the domain name assigned to the given IP address and
-// whether it was found.
+// whether it was found. It renews the allocation's lease.
 func (ps *perPeerState) domainForIP(ip netip.Addr) (_ string, ok bool) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	if ps.addrToDomain == nil {
 		return "", false
 	}
-	return ps.addrToDomain.Lookup(ip)
+	domain, ok := ps.addrToDomain.Lookup(ip)
+	if ok {
+		ps.renewLocked(ps.domainToAlloc[domain])
+	}
+	return domain, ok
 }
 
 // ipForDomain assigns a pair of unique IP addresses for the given domain and
@@ -511,65 +771,344 @@ func (ps *perPeerState) ipForDomain(domain string) ([]netip.Addr, error) {
 	domain = fqdn.WithoutTrailingDot()
 
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	if addrs, ok := ps.domainToAddr[domain]; ok {
-		return addrs, nil
+	if a, ok := ps.domainToAlloc[domain]; ok {
+		ps.renewLocked(a)
+		ps.mu.Unlock()
+		return a.Addrs, nil
 	}
-	addrs := ps.assignAddrsLocked(domain)
-	return addrs, nil
+	if ps.c.allocs == nil {
+		defer ps.mu.Unlock()
+		return ps.assignAddrsLocked(domain)
+	}
+	ps.mu.Unlock()
+	return ps.c.allocate(ps, domain)
+}
+
+// renewLocked extends a's lease, scheduling a save of the allocations if
+// more than half of the lease had elapsed.
+// ps.mu must be held.
+func (ps *perPeerState) renewLocked(a *allocation) {
+	now := time.Now()
+	exp := now.Add(ps.c.leaseDuration)
+	if a.Expires.Sub(now) < ps.c.leaseDuration/2 {
+		ps.c.saveAllocationsAsync()
+	}
+	a.Expires = exp
 }
 
 // isIPUsedLocked reports whether the given IP address is already assigned to a
 // domain.
 // ps.mu must be held.
 func (ps *perPeerState) isIPUsedLocked(ip netip.Addr) bool {
+	if ps.addrToDomain == nil {
+		return false
+	}
 	_, ok := ps.addrToDomain.Lookup(ip)
 	return ok
 }
 
 // unusedIPv4Locked returns an unused IPv4 address from the available ranges.
-func (ps *perPeerState) unusedIPv4Locked() netip.Addr {
-	// TODO: skip ranges that have been exhausted
+// The search starts at an address derived from domain, so that connectors
+// allocating for the same peer and domain tend to agree even before they
+// share their allocations.
+func (ps *perPeerState) unusedIPv4Locked(domain string) netip.Addr {
 	for _, r := range ps.c.v4Ranges {
-		ip := randV4(r)
-		for r.Contains(ip) {
+		start := hashV4(r, ps.id, domain)
+		ip := start
+		for {
 			if !ps.isIPUsedLocked(ip) && ip != ps.c.dnsAddr {
 				return ip
 			}
 			ip = ip.Next()
+			if !r.Contains(ip) {
+				ip = r.Addr()
+			}
+			if ip == start {
+				break // range exhausted
+			}
 		}
 	}
 	return netip.Addr{}
 }
 
-// randV4 returns a random IPv4 address within the given prefix.
-func randV4(maskedPfx netip.Prefix) netip.Addr {
+// hashV4 returns an IPv4 address within the given prefix derived from the
+// peer and domain.
+func hashV4(maskedPfx netip.Prefix, id tailcfg.NodeID, domain string) netip.Addr {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%s", id, domain)
 	bits := 32 - maskedPfx.Bits()
-	randBits := rand.Uint32N(1 << uint(bits))
+	hashBits := h.Sum32()
+	if bits < 32 {
+		hashBits &= 1<<uint(bits) - 1
+	}
 
 	ip4 := maskedPfx.Addr().As4()
 	pn := binary.BigEndian.Uint32(ip4[:])
-	binary.BigEndian.PutUint32(ip4[:], randBits|pn)
+	binary.BigEndian.PutUint32(ip4[:], hashBits|pn)
 	return netip.AddrFrom4(ip4)
 }
 
+// reclaimLocked frees the addresses of the allocation whose lease expired
+// longest ago, reporting whether there was one.
+// ps.mu must be held.
+func (ps *perPeerState) reclaimLocked() bool {
+	now := time.Now()
+	var oldest *allocation
+	for _, a := range ps.domainToAlloc {
+		if a.Expires.Before(now) && (oldest == nil || a.Expires.Before(oldest.Expires)) {
+			oldest = a
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	log.Printf("reclaiming %v from %q for %v; lease expired at %v", oldest.Addrs, oldest.Domain, ps.id, oldest.Expires)
+	ps.removeLocked(oldest)
+	return true
+}
+
+// removeLocked removes allocation a.
+// ps.mu must be held.
+func (ps *perPeerState) removeLocked(a *allocation) {
+	delete(ps.domainToAlloc, a.Domain)
+	for _, ip := range a.Addrs {
+		ps.addrToDomain.Delete(netip.PrefixFrom(ip, ip.BitLen()))
+	}
+}
+
+// insertLocked adds allocation a, which must not conflict with an existing
+// allocation.
+// ps.mu must be held.
+func (ps *perPeerState) insertLocked(a *allocation) {
+	if ps.addrToDomain == nil {
+		ps.addrToDomain = &bart.Table[string]{}
+	}
+	mak.Set(&ps.domainToAlloc, a.Domain, a)
+	for _, ip := range a.Addrs {
+		ps.addrToDomain.Insert(netip.PrefixFrom(ip, ip.BitLen()), a.Domain)
+	}
+}
+
 // assignAddrsLocked assigns a pair of unique IP addresses for the given domain
 // and returns them. The first address is an IPv4 address and the second is an
 // IPv6 address. It does not check if the domain already has assigned addresses.
+// If all addresses are in use, it reclaims those of an expired allocation.
 // ps.mu must be held.
-func (ps *perPeerState) assignAddrsLocked(domain string) []netip.Addr {
-	if ps.addrToDomain == nil {
-		ps.addrToDomain = &bart.Table[string]{}
+func (ps *perPeerState) assignAddrsLocked(domain string) ([]netip.Addr, error) {
+	v4 := ps.unusedIPv4Locked(domain)
+	if !v4.IsValid() && ps.reclaimLocked() {
+		v4 = ps.unusedIPv4Locked(domain)
+	}
+	if !v4.IsValid() {
+		return nil, fmt.Errorf("no addresses available for %v", ps.id)
 	}
-	v4 := ps.unusedIPv4Locked()
 	as16 := ps.c.v6ULA.Addr().As16()
 	as4 := v4.As4()
 	copy(as16[12:], as4[:])
 	v6 := netip.AddrFrom16(as16)
-	addrs := []netip.Addr{v4, v6}
-	mak.Set(&ps.domainToAddr, domain, addrs)
-	for _, a := range addrs {
-		ps.addrToDomain.Insert(netip.PrefixFrom(a, a.BitLen()), domain)
+	a := &allocation{
+		Domain:  domain,
+		Addrs:   []netip.Addr{v4, v6},
+		Expires: time.Now().Add(ps.c.leaseDuration),
+	}
+	ps.insertLocked(a)
+	return a.Addrs, nil
+}
+
+// mergeLocked merges the stored allocations into ps. Stored allocations
+// take precedence over conflicting ones in ps, as they were saved first.
+// ps.mu must be held.
+func (ps *perPeerState) mergeLocked(stored []allocation) {
+	for _, sa := range stored {
+		if a, ok := ps.domainToAlloc[sa.Domain]; ok {
+			if slices.Equal(a.Addrs, sa.Addrs) {
+				if sa.Expires.After(a.Expires) {
+					a.Expires = sa.Expires
+				}
+				continue
+			}
+			ps.removeLocked(a)
+		}
+		for _, ip := range sa.Addrs {
+			if ps.addrToDomain == nil {
+				break
+			}
+			if d, ok := ps.addrToDomain.Lookup(ip); ok {
+				ps.removeLocked(ps.domainToAlloc[d])
+			}
+		}
+		ps.insertLocked(&sa)
+	}
+}
+
+// snapshot returns a copy of ps's allocations, sorted by domain.
+func (ps *perPeerState) snapshot() []allocation {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	allocs := make([]allocation, 0, len(ps.domainToAlloc))
+	for _, a := range ps.domainToAlloc {
+		allocs = append(allocs, *a)
+	}
+	slices.SortFunc(allocs, func(a, b allocation) int { return cmp.Compare(a.Domain, b.Domain) })
+	return allocs
+}
+
+// snapshot returns a copy of all allocations.
+func (c *connector) snapshot() *allocState {
+	st := &allocState{Peers: map[tailcfg.NodeID][]allocation{}}
+	for id, ps := range c.perPeerMap.All() {
+		if allocs := ps.snapshot(); len(allocs) > 0 {
+			st.Peers[id] = allocs
+		}
+	}
+	return st
+}
+
+// errAllocationNotSaved is returned by allocate when an allocation
+// couldn't be saved. The allocation isn't used, so it can be retried.
+var errAllocationNotSaved = errors.New("address allocation not saved; try again")
+
+// allocate assigns addresses to domain for ps's peer, saving the
+// allocation to c.allocs before returning it. Allocations made by other
+// connectors sharing the store are loaded first, so that they're reused
+// rather than conflicted with. If the allocation can't be saved, allocate
+// returns an error wrapping errAllocationNotSaved.
+func (c *connector) allocate(ps *perPeerState, domain string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.allocMu.Lock()
+	defer c.allocMu.Unlock()
+	for attempt := 1; ; attempt++ {
+		stored, version, err := c.loadAllocationsLocked(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w: loading allocations: %v", errAllocationNotSaved, err)
+		}
+		ps.mu.Lock()
+		a, ok := ps.domainToAlloc[domain]
+		if ok && stored.has(ps.id, a) {
+			// Allocated by another connector, or by us earlier.
+			ps.mu.Unlock()
+			return a.Addrs, nil
+		}
+		if !ok {
+			if _, err := ps.assignAddrsLocked(domain); err != nil {
+				ps.mu.Unlock()
+				return nil, err
+			}
+			a = ps.domainToAlloc[domain]
+		}
+		ps.mu.Unlock()
+		err = c.saveAllocationsLocked(ctx, version)
+		if err == nil {
+			return a.Addrs, nil
+		}
+		if !errors.Is(err, errAllocStoreConflict) || attempt == 3 {
+			// Drop the unsaved allocation, so that it's not handed out
+			// before it's saved.
+			ps.mu.Lock()
+			if ps.domainToAlloc[domain] == a {
+				ps.removeLocked(a)
+			}
+			ps.mu.Unlock()
+			return nil, fmt.Errorf("%w: saving allocations: %v", errAllocationNotSaved, err)
+		}
+	}
+}
+
+// loadAllocationsLocked loads the stored allocations, merging them into
+// perPeerMap, and returns them, or nil if there are none, along with the
+// store's version.
+// c.allocMu must be held.
+func (c *connector) loadAllocationsLocked(ctx context.Context) (_ *allocState, version string, err error) {
+	b, version, err := c.allocs.load(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	c.lastLoad = time.Now()
+	if b == nil {
+		return nil, version, nil
 	}
-	return addrs
+	st := new(allocState)
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, "", err
+	}
+	for id, allocs := range st.Peers {
+		ps := c.peerState(id)
+		ps.mu.Lock()
+		ps.mergeLocked(allocs)
+		ps.mu.Unlock()
+	}
+	return st, version, nil
+}
+
+// saveAllocationsLocked saves all allocations if the store is still at
+// version.
+// c.allocMu must be held.
+func (c *connector) saveAllocationsLocked(ctx context.Context, version string) error {
+	b, err := json.Marshal(c.snapshot())
+	if err != nil {
+		return err
+	}
+	return c.allocs.save(ctx, b, version)
+}
+
+// saveAllocationsAsync saves the allocations in the background, to record
+// renewed leases. It does nothing if no store is configured or a save is
+// already pending.
+func (c *connector) saveAllocationsAsync() {
+	if c.allocs == nil || !c.savePending.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c.allocMu.Lock()
+		defer c.allocMu.Unlock()
+		c.savePending.Store(false)
+		for attempt := 1; attempt <= 3; attempt++ {
+			_, version, err := c.loadAllocationsLocked(ctx)
+			if err == nil {
+				err = c.saveAllocationsLocked(ctx, version)
+			}
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, errAllocStoreConflict) {
+				log.Printf("saving allocations: %v", err)
+				return
+			}
+		}
+	}()
+}
+
+// minReloadInterval is the minimum time between reloads of the stored
+// allocations on a miss, to bound the load on the store from unknown flows.
+const minReloadInterval = time.Second
+
+// maybeReloadAllocations reloads the stored allocations, unless they were
+// loaded recently, and reports whether it did.
+func (c *connector) maybeReloadAllocations() bool {
+	if c.allocs == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.allocMu.Lock()
+	defer c.allocMu.Unlock()
+	if time.Since(c.lastLoad) < minReloadInterval {
+		return false
+	}
+	if _, _, err := c.loadAllocationsLocked(ctx); err != nil {
+		log.Printf("reloading allocations: %v", err)
+		return false
+	}
+	return true
+}
+
+// serveAllocations serves the current allocations as JSON.
+func (c *connector) serveAllocations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.snapshot())
 }
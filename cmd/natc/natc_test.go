@@ -0,0 +1,268 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func newTestConnector(t *testing.T, v4Range string, allocs allocStore) *connector {
+	t.Helper()
+	return &connector{
+		v4Ranges:      []netip.Prefix{netip.MustParsePrefix(v4Range)},
+		v6ULA:         ula(1),
+		allocs:        allocs,
+		leaseDuration: time.Hour,
+	}
+}
+
+func TestReclaimExpired(t *testing.T) {
+	c := newTestConnector(t, "100.64.1.0/31", nil)
+	ps := c.peerState(1)
+
+	a, err := ps.ipForDomain("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ps.ipForDomain("b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a[0] == b[0] {
+		t.Fatalf("a and b both assigned %v", a[0])
+	}
+	if _, err := ps.ipForDomain("c.example.com"); err == nil {
+		t.Fatal("allocation from exhausted range with no expired leases succeeded")
+	}
+
+	// Expire both leases, b's first, then renew a's by using it.
+	ps.mu.Lock()
+	ps.domainToAlloc["a.example.com"].Expires = time.Now().Add(-time.Minute)
+	ps.domainToAlloc["b.example.com"].Expires = time.Now().Add(-2 * time.Minute)
+	ps.mu.Unlock()
+	if d, ok := c.domainForIP(1, a[0]); !ok || d != "a.example.com" {
+		t.Fatalf("domainForIP(%v) = %q, %v; want a.example.com", a[0], d, ok)
+	}
+	ps.mu.Lock()
+	exp := ps.domainToAlloc["a.example.com"].Expires
+	ps.mu.Unlock()
+	if !exp.After(time.Now().Add(c.leaseDuration / 2)) {
+		t.Fatalf("a's lease wasn't renewed by use; expires %v", exp)
+	}
+
+	cAddrs, err := ps.ipForDomain("c.example.com")
+	if err != nil {
+		t.Fatalf("allocation after lease expiry: %v", err)
+	}
+	if cAddrs[0] != b[0] {
+		t.Errorf("c assigned %v; want b's reclaimed %v", cAddrs[0], b[0])
+	}
+	if d, ok := c.domainForIP(1, b[1]); !ok || d != "c.example.com" {
+		t.Errorf("domainForIP(%v) = %q, %v; want c.example.com", b[1], d, ok)
+	}
+	if _, ok := ps.domainToAlloc["b.example.com"]; ok {
+		t.Error("b's allocation wasn't removed")
+	}
+
+	ps.mu.Lock()
+	reclaimed := ps.reclaimLocked()
+	ps.mu.Unlock()
+	if reclaimed {
+		t.Error("reclaimLocked with no expired leases reported a reclaim")
+	}
+}
+
+func TestMergeLocked(t *testing.T) {
+	v4 := func(i byte) netip.Addr { return netip.AddrFrom4([4]byte{100, 64, 1, i}) }
+	now := time.Now().Truncate(time.Second)
+	alloc := func(domain string, i byte, exp time.Time) allocation {
+		return allocation{Domain: domain, Addrs: []netip.Addr{v4(i)}, Expires: exp}
+	}
+
+	tests := []struct {
+		name   string
+		local  []allocation
+		stored []allocation
+		want   []allocation // sorted by domain
+	}{
+		{
+			name:   "new",
+			local:  []allocation{alloc("a", 1, now)},
+			stored: []allocation{alloc("b", 2, now)},
+			want:   []allocation{alloc("a", 1, now), alloc("b", 2, now)},
+		},
+		{
+			name:   "same-addrs-later-lease",
+			local:  []allocation{alloc("a", 1, now)},
+			stored: []allocation{alloc("a", 1, now.Add(time.Hour))},
+			want:   []allocation{alloc("a", 1, now.Add(time.Hour))},
+		},
+		{
+			name:   "same-addrs-earlier-lease",
+			local:  []allocation{alloc("a", 1, now.Add(time.Hour))},
+			stored: []allocation{alloc("a", 1, now)},
+			want:   []allocation{alloc("a", 1, now.Add(time.Hour))},
+		},
+		{
+			name:   "domain-conflict",
+			local:  []allocation{alloc("a", 1, now)},
+			stored: []allocation{alloc("a", 2, now)},
+			want:   []allocation{alloc("a", 2, now)},
+		},
+		{
+			name:   "addr-conflict",
+			local:  []allocation{alloc("a", 1, now), alloc("c", 3, now)},
+			stored: []allocation{alloc("b", 1, now)},
+			want:   []allocation{alloc("b", 1, now), alloc("c", 3, now)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := &perPeerState{c: newTestConnector(t, "100.64.1.0/24", nil), id: 1}
+			ps.mu.Lock()
+			for _, a := range tt.local {
+				ps.insertLocked(&a)
+			}
+			ps.mergeLocked(tt.stored)
+			ps.mu.Unlock()
+
+			got := ps.snapshot()
+			if !slices.EqualFunc(got, tt.want, func(a, b allocation) bool {
+				return a.Domain == b.Domain && slices.Equal(a.Addrs, b.Addrs) && a.Expires.Equal(b.Expires)
+			}) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+			for _, a := range got {
+				for _, ip := range a.Addrs {
+					if d, ok := ps.domainForIP(ip); !ok || d != a.Domain {
+						t.Errorf("domainForIP(%v) = %q, %v; want %q", ip, d, ok, a.Domain)
+					}
+				}
+			}
+		})
+	}
+}
+
+// hookStore is an allocStore that calls beforeSave before its first save.
+type hookStore struct {
+	allocStore
+	beforeSave func()
+}
+
+func (s *hookStore) save(ctx context.Context, data []byte, version string) error {
+	if f := s.beforeSave; f != nil {
+		s.beforeSave = nil
+		f()
+	}
+	return s.allocStore.save(ctx, data, version)
+}
+
+func TestAllocateRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allocs.json")
+	// Both connectors share a /31, so they have one address each to give
+	// to peer 1.
+	other := newTestConnector(t, "100.64.1.0/31", fileAllocStore{path: path})
+	hs := &hookStore{allocStore: fileAllocStore{path: path}}
+	c := newTestConnector(t, "100.64.1.0/31", hs)
+
+	// The other connector saves an allocation for the same peer between
+	// c's load and save, so c's first save conflicts.
+	var otherAddrs []netip.Addr
+	hs.beforeSave = func() {
+		var err error
+		otherAddrs, err = other.peerState(1).ipForDomain("b.example.com")
+		if err != nil {
+			t.Errorf("other allocate: %v", err)
+		}
+	}
+	addrs, err := c.peerState(1).ipForDomain("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherAddrs == nil {
+		t.Fatal("beforeSave wasn't called")
+	}
+	if addrs[0] == otherAddrs[0] {
+		t.Fatalf("both connectors assigned %v", addrs[0])
+	}
+
+	b, _, err := fileAllocStore{path: path}.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st allocState
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]netip.Addr{}
+	for _, a := range st.Peers[tailcfg.NodeID(1)] {
+		got[a.Domain] = a.Addrs
+	}
+	if !slices.Equal(got["a.example.com"], addrs) || !slices.Equal(got["b.example.com"], otherAddrs) {
+		t.Errorf("stored %v; want a.example.com=%v, b.example.com=%v", got, addrs, otherAddrs)
+	}
+
+	// The other connector picks up c's allocation on reload.
+	other.lastLoad = time.Time{}
+	if !other.maybeReloadAllocations() {
+		t.Fatal("reload didn't happen")
+	}
+	if d, ok := other.domainForIP(1, addrs[0]); !ok || d != "a.example.com" {
+		t.Errorf("other.domainForIP(%v) = %q, %v; want a.example.com", addrs[0], d, ok)
+	}
+}
+
+// failStore is an allocStore whose saves fail with err while it's non-nil.
+type failStore struct {
+	allocStore
+	err error
+}
+
+func (s *failStore) save(ctx context.Context, data []byte, version string) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.allocStore.save(ctx, data, version)
+}
+
+func TestAllocateNotSaved(t *testing.T) {
+	for _, saveErr := range []error{errAllocStoreConflict, errors.New("store down")} {
+		t.Run(saveErr.Error(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "allocs.json")
+			fs := &failStore{allocStore: fileAllocStore{path: path}, err: saveErr}
+			c := newTestConnector(t, "100.64.1.0/24", fs)
+			ps := c.peerState(1)
+
+			if _, err := ps.ipForDomain("a.example.com"); !errors.Is(err, errAllocationNotSaved) {
+				t.Fatalf("allocate with failing store: got %v; want errAllocationNotSaved", err)
+			}
+			if got := ps.snapshot(); len(got) != 0 {
+				t.Fatalf("unsaved allocations kept: %+v", got)
+			}
+
+			// Once the store recovers, a retry allocates and saves.
+			fs.err = nil
+			addrs, err := ps.ipForDomain("a.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _, err := c.loadAllocationsLocked(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.has(1, &allocation{Domain: "a.example.com", Addrs: addrs}) {
+				t.Errorf("allocation %v not stored", addrs)
+			}
+		})
+	}
+}
@@ -1,13 +1,17 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-// netlogfmt parses a stream of JSON log messages from stdin and
-// formats the network traffic logs produced by "tailscale.com/wgengine/netlog"
-// according to the schema in "tailscale.com/types/netlogtype.Message"
-// in a more humanly readable format.
+// netlogfmt parses a stream of JSON log messages from stdin, or from the
+// files named as arguments, and formats the network traffic logs produced
+// by "tailscale.com/wgengine/netlog" according to the schema in
+// "tailscale.com/types/netlogtype.Message" in a more humanly readable format.
+//
+// The files may be those written by tailscaled's local "file:" netlog sinks,
+// including rotated ones, which are read in the order given.
 //
 // Example usage:
 //
+//	$ go run tailscale.com/cmd/netlogfmt /var/log/tailscale/netlog.json.1 /var/log/tailscale/netlog.json
 //	$ cat netlog.json | go run tailscale.com/cmd/netlogfmt
 //	=========================================================================================
 //	NodeID: n123456CNTRL
@@ -66,17 +70,40 @@ func main() {
 	// The logic handles a stream of arbitrary JSON.
 	// So long as a JSON object seems like a network log message,
 	// then this will unmarshal and print it.
-	if err := processStream(os.Stdin); err != nil {
-		if err == io.EOF {
-			return
+	if flag.NArg() == 0 {
+		if err := processStream(os.Stdin); err != nil {
+			log.Fatalf("processStream: %v", err)
+		}
+		return
+	}
+	for _, name := range flag.Args() {
+		if err := processFile(name); err != nil {
+			log.Fatalf("processFile: %v", err)
 		}
-		log.Fatalf("processStream: %v", err)
 	}
 }
 
+func processFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := processStream(f); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// processStream processes all JSON values in r, returning nil at EOF.
 func processStream(r io.Reader) (err error) {
+	defer func() {
+		if err == io.EOF {
+			err = nil
+		}
+	}()
 	defer try.Handle(&err)
-	dec := jsontext.NewDecoder(os.Stdin)
+	dec := jsontext.NewDecoder(r)
 	for {
 		processValue(dec)
 	}
@@ -12,6 +12,8 @@
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
@@ -21,7 +23,9 @@
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"tailscale.com/client/tailscale"
@@ -34,8 +38,10 @@
 	hostname     = flag.String("hostname", "", "Tailscale hostname to serve on")
 	port         = flag.Int("port", 5432, "Listening port for client connections")
 	debugPort    = flag.Int("debug-port", 80, "Listening port for debug/metrics endpoint")
-	upstreamAddr = flag.String("upstream-addr", "", "Address of the upstream Postgres server, in host:port format")
-	upstreamCA   = flag.String("upstream-ca-file", "", "File containing the PEM-encoded CA certificate for the upstream server")
+	upstreamAddr = flag.String("upstream-addr", "", "Address of the upstream Postgres server, in host:port format, or a comma-separated list of primary servers in order of preference for failover")
+	replicaAddrs = flag.String("replica-addrs", "", "Comma-separated list of addresses of read-only replica Postgres servers, in host:port format, to which read-only sessions are routed")
+	upstreamCA   = flag.String("upstream-ca-file", "", "File containing the PEM-encoded CA certificate for the upstream servers")
+	healthCheck  = flag.Duration("health-check-interval", 10*time.Second, "How often to check that the upstream servers are reachable, or 0 to disable health checks")
 	tailscaleDir = flag.String("state-dir", "", "Directory in which to store the Tailscale auth state")
 )
 
@@ -68,15 +74,22 @@ func main() {
 		log.Fatalf("getting tsnet API client: %v", err)
 	}
 
-	p, err := newProxy(*upstreamAddr, *upstreamCA, tsclient)
+	p, err := newProxy(splitAddrs(*upstreamAddr), splitAddrs(*replicaAddrs), *upstreamCA, tsclient)
 	if err != nil {
 		log.Fatal(err)
 	}
 	expvar.Publish("pgproxy", p.Expvar())
+	if *healthCheck > 0 {
+		p.healthChecks = true
+		for _, u := range p.upstreams() {
+			go p.checkHealth(context.Background(), u, *healthCheck)
+		}
+	}
 
 	if *debugPort != 0 {
 		mux := http.NewServeMux()
-		tsweb.Debugger(mux)
+		debug := tsweb.Debugger(mux)
+		debug.Handle("upstreams", "Upstream servers and their health (JSON)", http.HandlerFunc(p.serveUpstreams))
 		srv := &http.Server{
 			Handler: mux,
 		}
@@ -93,29 +106,60 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("serving access to %s on port %d", *upstreamAddr, *port)
+	log.Printf("serving access to %s on port %d", strings.Join(upstreamAddrs(p.upstreams()), ","), *port)
 	log.Fatal(p.Serve(ln))
 }
 
+// splitAddrs splits a comma-separated list of addresses.
+func splitAddrs(s string) []string {
+	var ret []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+// upstreamAddrs returns the addresses of us.
+func upstreamAddrs(us []*upstream) []string {
+	ret := make([]string, len(us))
+	for i, u := range us {
+		ret[i] = u.addr
+	}
+	return ret
+}
+
 // proxy is a postgres wire protocol proxy, which strictly enforces
-// the security of the TLS connection to its upstream regardless of
+// the security of the TLS connection to its upstreams regardless of
 // what the client's TLS configuration is.
 type proxy struct {
-	upstreamAddr     string // "my.database.com:5432"
-	upstreamHost     string // "my.database.com"
+	primaries        []*upstream // in order of preference
+	replicas         []*upstream
+	downstreamHost   string // "my.database.com", of the first primary
 	upstreamCertPool *x509.CertPool
 	downstreamCert   []tls.Certificate
 	client           *tailscale.LocalClient
 
-	activeSessions  expvar.Int
-	startedSessions expvar.Int
-	errors          metrics.LabelMap
+	healthChecks bool          // whether upstreams' health is checked periodically
+	nextReplica  atomic.Uint32 // for spreading sessions across replicas
+
+	activeSessions   expvar.Int
+	startedSessions  expvar.Int
+	readOnlySessions expvar.Int
+	failovers        expvar.Int
+	upstreamSessions metrics.LabelMap
+	errors           metrics.LabelMap
 }
 
-// newProxy returns a proxy that forwards connections to
-// upstreamAddr. The upstream's TLS session is verified using the CA
-// cert(s) in upstreamCAPath.
-func newProxy(upstreamAddr, upstreamCAPath string, client *tailscale.LocalClient) (*proxy, error) {
+// newProxy returns a proxy that forwards connections to the first
+// reachable of primaryAddrs, or to replicaAddrs for read-only sessions.
+// The upstreams' TLS sessions are verified using the CA cert(s) in
+// upstreamCAPath.
+func newProxy(primaryAddrs, replicaAddrs []string, upstreamCAPath string, client *tailscale.LocalClient) (*proxy, error) {
+	if len(primaryAddrs) == 0 {
+		return nil, errors.New("no upstream addresses")
+	}
 	bs, err := os.ReadFile(upstreamCAPath)
 	if err != nil {
 		return nil, err
@@ -125,23 +169,39 @@ func newProxy(upstreamAddr, upstreamCAPath string, client *tailscale.LocalClient
 		return nil, fmt.Errorf("invalid CA cert in %q", upstreamCAPath)
 	}
 
-	h, _, err := net.SplitHostPort(upstreamAddr)
-	if err != nil {
-		return nil, err
+	p := &proxy{
+		upstreamCertPool: upstreamCertPool,
+		client:           client,
+		upstreamSessions: metrics.LabelMap{Label: "upstream"},
+		errors:           metrics.LabelMap{Label: "kind"},
+	}
+	for _, addr := range primaryAddrs {
+		u, err := newUpstream(addr, false)
+		if err != nil {
+			return nil, err
+		}
+		p.primaries = append(p.primaries, u)
+	}
+	for _, addr := range replicaAddrs {
+		u, err := newUpstream(addr, true)
+		if err != nil {
+			return nil, err
+		}
+		p.replicas = append(p.replicas, u)
 	}
-	downstreamCert, err := mkSelfSigned(h)
+
+	p.downstreamHost = p.primaries[0].host
+	downstreamCert, err := mkSelfSigned(p.downstreamHost)
 	if err != nil {
 		return nil, err
 	}
+	p.downstreamCert = []tls.Certificate{downstreamCert}
+	return p, nil
+}
 
-	return &proxy{
-		upstreamAddr:     upstreamAddr,
-		upstreamHost:     h,
-		upstreamCertPool: upstreamCertPool,
-		downstreamCert:   []tls.Certificate{downstreamCert},
-		client:           client,
-		errors:           metrics.LabelMap{Label: "kind"},
-	}, nil
+// upstreams returns all of p's upstreams, primaries first.
+func (p *proxy) upstreams() []*upstream {
+	return append(slices.Clip(p.primaries), p.replicas...)
 }
 
 // Expvar returns p's monitoring metrics.
@@ -149,12 +209,15 @@ func (p *proxy) Expvar() expvar.Var {
 	ret := &metrics.Set{}
 	ret.Set("sessions_active", &p.activeSessions)
 	ret.Set("sessions_started", &p.startedSessions)
+	ret.Set("sessions_read_only", &p.readOnlySessions)
+	ret.Set("sessions_by_upstream", &p.upstreamSessions)
+	ret.Set("upstream_failovers", &p.failovers)
 	ret.Set("session_errors", &p.errors)
 	return ret
 }
 
 // Serve accepts postgres client connections on ln and proxies them to
-// the configured upstream. ln can be any net.Listener, but all client
+// the configured upstreams. ln can be any net.Listener, but all client
 // connections must originate from tailscale IPs that can be verified
 // with WhoIs.
 func (p *proxy) Serve(ln net.Listener) error {
@@ -186,14 +249,10 @@ func (p *proxy) Serve(ln net.Listener) error {
 	// that they want to do a TLS handshake. Servers should respond with
 	// the single byte "S" before starting a normal TLS handshake.
 	sslStart = [8]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
-	// plaintextStart is the magic bytes that postgres clients use to
-	// indicate that they're starting a plaintext authentication
-	// handshake.
-	plaintextStart = [8]byte{0, 0, 0, 86, 0, 3, 0, 0}
 )
 
-// serve proxies the postgres client on c to the proxy's upstream,
-// enforcing strict TLS to the upstream.
+// serve proxies the postgres client on c to one of the proxy's
+// upstreams, enforcing strict TLS to the upstream.
 func (p *proxy) serve(sessionID int64, c net.Conn) error {
 	defer c.Close()
 
@@ -243,68 +302,71 @@ func (p *proxy) serve(sessionID int64, c net.Conn) error {
 	switch {
 	case buf == sslStart:
 		clientIsTLS = true
-	case buf == plaintextStart:
+	case binary.BigEndian.Uint32(buf[4:]) == protocolVersion3:
+		// A plaintext startup message.
 		clientIsTLS = false
 	default:
 		p.errors.Add("client-bad-protocol", 1)
 		return fmt.Errorf("unrecognized initial packet = % 02x", buf)
 	}
 
-	// Dial & verify upstream connection.
-	var d net.Dialer
-	d.Timeout = 10 * time.Second
-	upc, err := d.Dial("tcp", p.upstreamAddr)
-	if err != nil {
-		p.errors.Add("network-error", 1)
-		return fmt.Errorf("upstream dial: %v", err)
-	}
-	defer upc.Close()
-	if _, err := upc.Write(sslStart[:]); err != nil {
-		p.errors.Add("network-error", 1)
-		return fmt.Errorf("upstream write of start-ssl magic: %v", err)
-	}
-	if _, err := io.ReadFull(upc, buf[:1]); err != nil {
-		p.errors.Add("network-error", 1)
-		return fmt.Errorf("reading upstream start-ssl response: %v", err)
-	}
-	if buf[0] != 'S' {
-		p.errors.Add("upstream-bad-protocol", 1)
-		return fmt.Errorf("upstream didn't acknowledge start-ssl, said %q", buf[0])
-	}
-	tlsConf := &tls.Config{
-		ServerName: p.upstreamHost,
-		RootCAs:    p.upstreamCertPool,
-		MinVersion: tls.VersionTLS12,
-	}
-	uptc := tls.Client(upc, tlsConf)
-	if err = uptc.HandshakeContext(ctx); err != nil {
-		p.errors.Add("upstream-tls", 1)
-		return fmt.Errorf("upstream TLS handshake: %v", err)
-	}
-
 	// Accept the client conn and set it up the way the client wants.
 	var clientConn net.Conn
 	if clientIsTLS {
 		io.WriteString(c, "S") // yeah, we're good to speak TLS
 		s := tls.Server(c, &tls.Config{
-			ServerName:   p.upstreamHost,
+			ServerName:   p.downstreamHost,
 			Certificates: p.downstreamCert,
 			MinVersion:   tls.VersionTLS12,
 		})
-		if err = uptc.HandshakeContext(ctx); err != nil {
+		if err = s.HandshakeContext(ctx); err != nil {
 			p.errors.Add("client-tls", 1)
 			return fmt.Errorf("client TLS handshake: %v", err)
 		}
-		clientConn = s
-	} else {
-		// Repeat the header we read earlier up to the server.
-		if _, err := uptc.Write(plaintextStart[:]); err != nil {
+		if _, err := io.ReadFull(s, buf[:]); err != nil {
 			p.errors.Add("network-error", 1)
-			return fmt.Errorf("sending initial client bytes to upstream: %v", err)
+			return fmt.Errorf("startup message read: %v", err)
 		}
+		clientConn = s
+	} else {
 		clientConn = c
 	}
 
+	// Read the rest of the startup message, to pick an upstream by
+	// whether the session is read-only.
+	startup, err := readStartupMessage(clientConn, buf)
+	if err != nil {
+		p.errors.Add("client-bad-protocol", 1)
+		return fmt.Errorf("reading startup message: %v", err)
+	}
+	readOnly := startup.wantsReadOnly()
+	if !readOnly {
+		readOnly, err = capReadOnly(whois.CapMap)
+		if err != nil {
+			p.errors.Add("bad-capability", 1)
+			return fmt.Errorf("parsing %s capability: %v", peerCapPgproxy, err)
+		}
+	}
+
+	// Dial & verify upstream connection.
+	uptc, up, errKind, err := p.dialUpstream(ctx, readOnly)
+	if err != nil {
+		p.errors.Add(errKind, 1)
+		return err
+	}
+	defer uptc.Close()
+	p.upstreamSessions.Add(up.addr, 1)
+	if readOnly {
+		p.readOnlySessions.Add(1)
+	}
+	log.Printf("%d: session routed to %s (read-only %v)", sessionID, up.addr, readOnly)
+
+	// Repeat the startup message we read earlier up to the server.
+	if _, err := uptc.Write(startup.raw); err != nil {
+		p.errors.Add("network-error", 1)
+		return fmt.Errorf("sending startup message to upstream: %v", err)
+	}
+
 	// Finally, proxy the client to the upstream.
 	errc := make(chan error, 1)
 	go func() {
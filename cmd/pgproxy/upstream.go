@@ -0,0 +1,350 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// upstream is one of the proxy's upstream postgres servers.
+type upstream struct {
+	addr    string // "my.database.com:5432"
+	host    string // "my.database.com"
+	replica bool   // whether it's a read-only replica
+
+	// healthy is whether the last health check or session dial
+	// succeeded. Upstreams start out healthy.
+	healthy atomic.Bool
+
+	mu         sync.Mutex
+	lastCheck  time.Time // of the last health check
+	lastFailed time.Time // of the last failed health check or session dial
+	lastErr    error     // of the last health check or session dial, or nil
+}
+
+// unhealthyRetryInterval is how long an upstream whose session dial failed
+// is tried last when health checks are disabled. After that, it's
+// preferred again, so that the next successful session dial marks it
+// healthy.
+const unhealthyRetryInterval = 30 * time.Second
+
+func newUpstream(addr string, replica bool) (*upstream, error) {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	u := &upstream{addr: addr, host: h, replica: replica}
+	u.healthy.Store(true)
+	return u, nil
+}
+
+// setHealth records the result of a health check or session dial.
+func (u *upstream) setHealth(err error, checked bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if checked {
+		u.lastCheck = time.Now()
+	}
+	u.lastErr = err
+	if err != nil {
+		u.lastFailed = time.Now()
+	}
+	u.healthy.Store(err == nil)
+}
+
+// preferred reports whether u should be tried before the unhealthy
+// upstreams. When healthChecks is false, nothing but session dials
+// updates u's health, so an unhealthy u is given another try once
+// unhealthyRetryInterval has passed since it last failed.
+func (u *upstream) preferred(healthChecks bool) bool {
+	if u.healthy.Load() {
+		return true
+	}
+	if healthChecks {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Since(u.lastFailed) >= unhealthyRetryInterval
+}
+
+// dial connects to u and negotiates strict TLS with it. On error, it also
+// returns the kind of error for the proxy's session_errors metric.
+func (u *upstream) dial(ctx context.Context, roots *x509.CertPool) (_ *tls.Conn, errKind string, _ error) {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	upc, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, "network-error", fmt.Errorf("upstream dial: %v", err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			upc.Close()
+		}
+	}()
+	if _, err := upc.Write(sslStart[:]); err != nil {
+		return nil, "network-error", fmt.Errorf("upstream write of start-ssl magic: %v", err)
+	}
+	var buf [1]byte
+	if _, err := io.ReadFull(upc, buf[:]); err != nil {
+		return nil, "network-error", fmt.Errorf("reading upstream start-ssl response: %v", err)
+	}
+	if buf[0] != 'S' {
+		return nil, "upstream-bad-protocol", fmt.Errorf("upstream didn't acknowledge start-ssl, said %q", buf[0])
+	}
+	tlsConf := &tls.Config{
+		ServerName: u.host,
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+	uptc := tls.Client(upc, tlsConf)
+	if err = uptc.HandshakeContext(ctx); err != nil {
+		return nil, "upstream-tls", fmt.Errorf("upstream TLS handshake: %v", err)
+	}
+	ok = true
+	return uptc, "", nil
+}
+
+// candidates returns the upstreams to try for a session, in order of
+// preference.
+//
+// Read-write sessions go to the first healthy primary, so that the
+// primaries after the first act as failover targets. Read-only sessions
+// are spread across the healthy replicas, falling back to the primaries.
+// Unhealthy upstreams are tried last, in case they recovered since they
+// were last checked.
+func (p *proxy) candidates(readOnly bool) []*upstream {
+	var ordered []*upstream
+	if readOnly && len(p.replicas) > 0 {
+		start := int(p.nextReplica.Add(1)) % len(p.replicas)
+		for i := range p.replicas {
+			ordered = append(ordered, p.replicas[(start+i)%len(p.replicas)])
+		}
+	}
+	ordered = append(ordered, p.primaries...)
+
+	ret := make([]*upstream, 0, len(ordered))
+	var unhealthy []*upstream
+	for _, u := range ordered {
+		if u.preferred(p.healthChecks) {
+			ret = append(ret, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	return append(ret, unhealthy...)
+}
+
+// dialUpstream connects to the most preferred reachable upstream for a
+// session, failing over to the next candidate when one can't be reached.
+// A session that ends up on a candidate other than the first counts as
+// one failover. On error, it returns the kind of the last error for the
+// proxy's session_errors metric.
+func (p *proxy) dialUpstream(ctx context.Context, readOnly bool) (_ *tls.Conn, _ *upstream, errKind string, err error) {
+	for i, u := range p.candidates(readOnly) {
+		var c *tls.Conn
+		c, errKind, err = u.dial(ctx, p.upstreamCertPool)
+		u.setHealth(err, false)
+		if err == nil {
+			if i > 0 {
+				p.failovers.Add(1)
+			}
+			return c, u, "", nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, errKind, err
+}
+
+// checkHealth runs health checks of u every interval until ctx is done. A
+// check connects to u and completes a TLS handshake, without logging in.
+func (p *proxy) checkHealth(ctx context.Context, u *upstream, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		c, _, err := u.dial(checkCtx, p.upstreamCertPool)
+		cancel()
+		if err == nil {
+			c.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if was := u.healthy.Load(); was != (err == nil) {
+			if err != nil {
+				log.Printf("upstream %s is unhealthy: %v", u.addr, err)
+			} else {
+				log.Printf("upstream %s is healthy again", u.addr)
+			}
+		}
+		u.setHealth(err, true)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// upstreamStatus is the JSON form of an upstream's state, for the
+// "upstreams" debug handler.
+type upstreamStatus struct {
+	Addr      string
+	Replica   bool
+	Healthy   bool
+	LastCheck time.Time
+	LastError string `json:",omitempty"`
+}
+
+// serveUpstreams serves the state of p's upstreams as JSON.
+func (p *proxy) serveUpstreams(w http.ResponseWriter, r *http.Request) {
+	var ret []upstreamStatus
+	for _, u := range p.upstreams() {
+		u.mu.Lock()
+		st := upstreamStatus{
+			Addr:      u.addr,
+			Replica:   u.replica,
+			Healthy:   u.healthy.Load(),
+			LastCheck: u.lastCheck,
+		}
+		if u.lastErr != nil {
+			st.LastError = u.lastErr.Error()
+		}
+		u.mu.Unlock()
+		ret = append(ret, st)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// maxStartupMessageLen is the maximum length of a startup message that
+// postgres accepts.
+const maxStartupMessageLen = 10000
+
+// protocolVersion3 is the version of the postgres protocol in startup
+// messages.
+const protocolVersion3 = 3 << 16
+
+// startupMessage is a client's StartupMessage.
+type startupMessage struct {
+	raw    []byte            // the whole message, to forward upstream
+	params map[string]string // e.g. "user", "database", "options"
+}
+
+// readStartupMessage reads the rest of a startup message from r, whose
+// first 8 bytes (the length and protocol version) are hdr.
+func readStartupMessage(r io.Reader, hdr [8]byte) (*startupMessage, error) {
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < uint32(len(hdr)) || n > maxStartupMessageLen {
+		return nil, fmt.Errorf("invalid startup message length %d", n)
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != protocolVersion3 {
+		return nil, fmt.Errorf("unsupported protocol version %#x", v)
+	}
+	raw := make([]byte, n)
+	copy(raw, hdr[:])
+	if _, err := io.ReadFull(r, raw[len(hdr):]); err != nil {
+		return nil, err
+	}
+
+	m := &startupMessage{raw: raw, params: map[string]string{}}
+	rest := raw[len(hdr):]
+	for len(rest) > 0 && rest[0] != 0 {
+		parts := strings.SplitN(string(rest), "\x00", 3)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("malformed startup message parameters")
+		}
+		m.params[parts[0]] = parts[1]
+		rest = rest[len(parts[0])+len(parts[1])+2:]
+	}
+	return m, nil
+}
+
+// readOnlyParam is the postgres setting that marks a session as
+// read-only when it's set in the startup message.
+const readOnlyParam = "default_transaction_read_only"
+
+// wantsReadOnly reports whether the client asked for a read-only session,
+// by setting readOnlyParam either as a startup parameter or with
+// "-c default_transaction_read_only=on" in the options parameter.
+func (m *startupMessage) wantsReadOnly() bool {
+	if v, ok := m.params[readOnlyParam]; ok {
+		return isTrue(v)
+	}
+	fields := strings.Fields(m.params["options"])
+	for i, f := range fields {
+		var setting string
+		switch {
+		case f == "-c" && i+1 < len(fields):
+			setting = fields[i+1]
+		case strings.HasPrefix(f, "-c"):
+			setting = f[len("-c"):]
+		case strings.HasPrefix(f, "--"):
+			setting = f[len("--"):]
+		default:
+			continue
+		}
+		k, v, ok := strings.Cut(setting, "=")
+		if ok && strings.ReplaceAll(k, "-", "_") == readOnlyParam {
+			return isTrue(v)
+		}
+	}
+	return false
+}
+
+// isTrue reports whether v is a true postgres boolean value.
+func isTrue(v string) bool {
+	switch strings.ToLower(v) {
+	case "on", "true", "yes", "1", "t", "y":
+		return true
+	}
+	return false
+}
+
+// peerCapPgproxy is the peer capability with which pgproxy sessions from
+// a peer can be routed to replicas. Its values are capRules.
+const peerCapPgproxy tailcfg.PeerCapability = "tailscale.com/cap/pgproxy"
+
+// capRule is a value of the peerCapPgproxy capability.
+type capRule struct {
+	// ReadOnly is whether to route the peer's sessions to replicas, as if
+	// they asked for read-only sessions. It's a routing preference, not
+	// an access control: sessions fall back to the primary when no
+	// replica is available, so use database roles to restrict writes.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// capReadOnly reports whether the peer capabilities in cm route the
+// peer's sessions to replicas.
+func capReadOnly(cm tailcfg.PeerCapMap) (bool, error) {
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](cm, peerCapPgproxy)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rules {
+		if r.ReadOnly {
+			return true, nil
+		}
+	}
+	return false, nil
+}
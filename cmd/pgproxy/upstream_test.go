@@ -0,0 +1,520 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"math/big"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+)
+
+// startupBytes returns a StartupMessage with the given parameters, which
+// alternate between names and values.
+func startupBytes(params ...string) []byte {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 0) // length, filled in below
+	b = binary.BigEndian.AppendUint32(b, protocolVersion3)
+	for _, p := range params {
+		b = append(b, p...)
+		b = append(b, 0)
+	}
+	b = append(b, 0)
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func TestReadStartupMessage(t *testing.T) {
+	tooLong := make([]byte, 8)
+	binary.BigEndian.PutUint32(tooLong, maxStartupMessageLen+1)
+	binary.BigEndian.PutUint32(tooLong[4:], protocolVersion3)
+	badVersion := startupBytes("user", "alice")
+	binary.BigEndian.PutUint32(badVersion[4:], 2<<16)
+	malformed := startupBytes()
+	malformed = append(malformed[:len(malformed)-1], "user\x00alice"...)
+	binary.BigEndian.PutUint32(malformed, uint32(len(malformed)))
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "params",
+			msg:  startupBytes("user", "alice", "database", "prod", "options", "-c default_transaction_read_only=on"),
+			want: map[string]string{"user": "alice", "database": "prod", "options": "-c default_transaction_read_only=on"},
+		},
+		{
+			name: "no-params",
+			msg:  startupBytes(),
+			want: map[string]string{},
+		},
+		{
+			name:    "too-long",
+			msg:     tooLong,
+			wantErr: true,
+		},
+		{
+			name:    "too-short",
+			msg:     []byte{0, 0, 0, 4, 0, 3, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "bad-version",
+			msg:     badVersion,
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			msg:     startupBytes("user", "alice")[:12],
+			wantErr: true,
+		},
+		{
+			name:    "malformed-params",
+			msg:     malformed,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hdr [8]byte
+			copy(hdr[:], tt.msg)
+			m, err := readStartupMessage(bytes.NewReader(tt.msg[8:]), hdr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v; want error", m.params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(m.raw, tt.msg) {
+				t.Errorf("raw = %q; want %q", m.raw, tt.msg)
+			}
+			if !maps.Equal(m.params, tt.want) {
+				t.Errorf("params = %v; want %v", m.params, tt.want)
+			}
+		})
+	}
+}
+
+func TestWantsReadOnly(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		want   bool
+	}{
+		{map[string]string{"user": "alice"}, false},
+		{map[string]string{readOnlyParam: "on"}, true},
+		{map[string]string{readOnlyParam: "TRUE"}, true},
+		{map[string]string{readOnlyParam: "off"}, false},
+		// The startup parameter takes precedence over options.
+		{map[string]string{readOnlyParam: "off", "options": "-c default_transaction_read_only=on"}, false},
+		{map[string]string{"options": "-c default_transaction_read_only=on"}, true},
+		{map[string]string{"options": "-cdefault_transaction_read_only=1"}, true},
+		{map[string]string{"options": "--default-transaction-read-only=yes"}, true},
+		{map[string]string{"options": "-c search_path=foo -c default_transaction_read_only=off"}, false},
+		{map[string]string{"options": "-c search_path=default_transaction_read_only"}, false},
+		{map[string]string{"options": "-c"}, false},
+	}
+	for _, tt := range tests {
+		m := &startupMessage{params: tt.params}
+		if got := m.wantsReadOnly(); got != tt.want {
+			t.Errorf("wantsReadOnly(%v) = %v; want %v", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestCapReadOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		cm      tailcfg.PeerCapMap
+		want    bool
+		wantErr bool
+	}{
+		{name: "none", cm: nil, want: false},
+		{
+			name: "other-cap",
+			cm:   tailcfg.PeerCapMap{"example.com/cap/other": {`{"readOnly":true}`}},
+			want: false,
+		},
+		{
+			name: "read-only",
+			cm:   tailcfg.PeerCapMap{peerCapPgproxy: {`{}`, `{"readOnly":true}`}},
+			want: true,
+		},
+		{
+			name: "read-write",
+			cm:   tailcfg.PeerCapMap{peerCapPgproxy: {`{"readOnly":false}`}},
+			want: false,
+		},
+		{
+			name:    "invalid",
+			cm:      tailcfg.PeerCapMap{peerCapPgproxy: {`{"readOnly":"yes"}`}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := capReadOnly(tt.cm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustUpstream(t *testing.T, addr string, replica, healthy bool) *upstream {
+	t.Helper()
+	u, err := newUpstream(addr, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !healthy {
+		u.setHealth(errors.New("unhealthy"), false)
+	}
+	return u
+}
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		name      string
+		primaries []bool // healthy
+		replicas  []bool // healthy
+		readOnly  bool
+		want      []string
+	}{
+		{
+			name:      "read-write",
+			primaries: []bool{true, true},
+			replicas:  []bool{true},
+			want:      []string{"p0", "p1"},
+		},
+		{
+			name:      "read-write-failover",
+			primaries: []bool{false, true},
+			want:      []string{"p1", "p0"},
+		},
+		{
+			name:      "read-only",
+			primaries: []bool{true},
+			replicas:  []bool{true, true},
+			readOnly:  true,
+			want:      []string{"r1", "r0", "p0"}, // the first session starts at replica 1
+		},
+		{
+			name:      "read-only-unhealthy-replica",
+			primaries: []bool{true},
+			replicas:  []bool{true, false},
+			readOnly:  true,
+			want:      []string{"r0", "p0", "r1"},
+		},
+		{
+			name:      "read-only-no-replicas",
+			primaries: []bool{true, false},
+			readOnly:  true,
+			want:      []string{"p0", "p1"},
+		},
+		{
+			name:      "all-unhealthy",
+			primaries: []bool{false, false},
+			want:      []string{"p0", "p1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := new(proxy)
+			names := map[*upstream]string{}
+			for i, healthy := range tt.primaries {
+				u := mustUpstream(t, "p.example:5432", false, healthy)
+				names[u] = "p" + strconv.Itoa(i)
+				p.primaries = append(p.primaries, u)
+			}
+			for i, healthy := range tt.replicas {
+				u := mustUpstream(t, "r.example:5432", true, healthy)
+				names[u] = "r" + strconv.Itoa(i)
+				p.replicas = append(p.replicas, u)
+			}
+			var got []string
+			for _, u := range p.candidates(tt.readOnly) {
+				got = append(got, names[u])
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Read-only sessions are spread across the replicas.
+	p := &proxy{primaries: []*upstream{mustUpstream(t, "p.example:5432", false, true)}}
+	r0 := mustUpstream(t, "r0.example:5432", true, true)
+	r1 := mustUpstream(t, "r1.example:5432", true, true)
+	p.replicas = []*upstream{r0, r1}
+	first := []*upstream{p.candidates(true)[0], p.candidates(true)[0], p.candidates(true)[0]}
+	if want := []*upstream{r1, r0, r1}; !slices.Equal(first, want) {
+		t.Errorf("first candidates = %v; want r1, r0, r1", upstreamAddrs(first))
+	}
+
+	// Without health checks, an upstream whose session dial failed a while
+	// ago is preferred again, so that a successful dial can clear its state.
+	p0 := mustUpstream(t, "p0.example:5432", false, false)
+	p1 := mustUpstream(t, "p1.example:5432", false, true)
+	p = &proxy{primaries: []*upstream{p0, p1}}
+	if got := p.candidates(false); !slices.Equal(got, []*upstream{p1, p0}) {
+		t.Errorf("candidates after recent failure = %v; want p1, p0", upstreamAddrs(got))
+	}
+	p0.mu.Lock()
+	p0.lastFailed = time.Now().Add(-unhealthyRetryInterval)
+	p0.mu.Unlock()
+	if got := p.candidates(false); !slices.Equal(got, []*upstream{p0, p1}) {
+		t.Errorf("candidates after retry interval = %v; want p0, p1", upstreamAddrs(got))
+	}
+	// With health checks, only a passing check makes it preferred again.
+	p.healthChecks = true
+	if got := p.candidates(false); !slices.Equal(got, []*upstream{p1, p0}) {
+		t.Errorf("candidates with health checks = %v; want p1, p0", upstreamAddrs(got))
+	}
+}
+
+// testCA returns a self-signed CA certificate valid for 127.0.0.1, and a
+// pool containing it.
+func testCA(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, pool
+}
+
+// fakeUpstream is a postgres server that accepts TLS connections and
+// records the first 8 bytes each client sends after the handshake.
+type fakeUpstream struct {
+	ln       net.Listener
+	startups chan []byte
+}
+
+// startFakeUpstream starts a fakeUpstream that answers start-ssl requests
+// with sslReply.
+func startFakeUpstream(t *testing.T, cert tls.Certificate, sslReply byte) *fakeUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUpstream{ln: ln, startups: make(chan []byte, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var buf [8]byte
+				if _, err := io.ReadFull(c, buf[:]); err != nil || buf != sslStart {
+					return
+				}
+				c.Write([]byte{sslReply})
+				if sslReply != 'S' {
+					return
+				}
+				tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if _, err := io.ReadFull(tc, buf[:]); err != nil {
+					return
+				}
+				f.startups <- buf[:]
+			}()
+		}
+	}()
+	return f
+}
+
+func (f *fakeUpstream) addr() string { return f.ln.Addr().String() }
+
+// closedAddr returns the address of a TCP port nothing is listening on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestDialUpstreamFailover(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cert, pool := testCA(t)
+	primary := startFakeUpstream(t, cert, 'S')
+	replica := startFakeUpstream(t, cert, 'S')
+	down := mustUpstream(t, closedAddr(t), false, true)
+	p := &proxy{
+		primaries:        []*upstream{down, mustUpstream(t, primary.addr(), false, true)},
+		replicas:         []*upstream{mustUpstream(t, replica.addr(), true, true)},
+		upstreamCertPool: pool,
+		upstreamSessions: metrics.LabelMap{Label: "upstream"},
+		errors:           metrics.LabelMap{Label: "kind"},
+	}
+
+	dial := func(readOnly bool) *upstream {
+		t.Helper()
+		c, u, errKind, err := p.dialUpstream(ctx, readOnly)
+		if err != nil {
+			t.Fatalf("dialUpstream(readOnly=%v) = %v (%s)", readOnly, err, errKind)
+		}
+		defer c.Close()
+		if _, err := c.Write(sslStart[:]); err != nil { // any 8 bytes
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// The first primary is down, so read-write sessions fail over to the
+	// second, and the first is marked unhealthy.
+	if u := dial(false); u.addr != primary.addr() {
+		t.Errorf("read-write session went to %s; want %s", u.addr, primary.addr())
+	}
+	if got := p.failovers.Value(); got != 1 {
+		t.Errorf("failovers = %d; want 1", got)
+	}
+	if down.healthy.Load() {
+		t.Error("unreachable primary still healthy")
+	}
+	<-primary.startups
+
+	// Now that it's known to be unhealthy, it's tried last.
+	if u := dial(false); u.addr != primary.addr() {
+		t.Errorf("read-write session went to %s; want %s", u.addr, primary.addr())
+	}
+	if got := p.failovers.Value(); got != 1 {
+		t.Errorf("failovers = %d; want still 1", got)
+	}
+	<-primary.startups
+
+	// Read-only sessions go to the replica, and fail over to the
+	// healthy primary when it's down.
+	if u := dial(true); u.addr != replica.addr() {
+		t.Errorf("read-only session went to %s; want %s", u.addr, replica.addr())
+	}
+	<-replica.startups
+	replica.ln.Close()
+	if u := dial(true); u.addr != primary.addr() {
+		t.Errorf("read-only session with replica down went to %s; want %s", u.addr, primary.addr())
+	}
+	<-primary.startups
+
+	// A session that gets past several unreachable upstreams is one
+	// failover, and a session that fails altogether is none.
+	p.failovers.Set(0)
+	p.primaries = []*upstream{
+		mustUpstream(t, closedAddr(t), false, true),
+		mustUpstream(t, closedAddr(t), false, true),
+		mustUpstream(t, primary.addr(), false, true),
+	}
+	p.replicas = nil
+	if u := dial(false); u.addr != primary.addr() {
+		t.Errorf("read-write session went to %s; want %s", u.addr, primary.addr())
+	}
+	<-primary.startups
+	if got := p.failovers.Value(); got != 1 {
+		t.Errorf("failovers = %d; want 1", got)
+	}
+
+	// With no reachable upstream, the last error's kind is reported.
+	p.primaries = []*upstream{
+		mustUpstream(t, closedAddr(t), false, true),
+		mustUpstream(t, startFakeUpstream(t, cert, 'N').addr(), false, true),
+	}
+	if _, _, errKind, err := p.dialUpstream(ctx, false); err == nil || errKind != "upstream-bad-protocol" {
+		t.Errorf("dialUpstream with no good upstreams = %v (%q); want upstream-bad-protocol error", err, errKind)
+	}
+	if got := p.failovers.Value(); got != 1 {
+		t.Errorf("failovers = %d; want still 1", got)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	tstest.ResourceCheck(t)
+	cert, pool := testCA(t)
+	f := startFakeUpstream(t, cert, 'S')
+	p := &proxy{upstreamCertPool: pool}
+
+	waitHealth := func(u *upstream, want bool) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.checkHealth(ctx, u, 10*time.Millisecond)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for u.healthy.Load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s healthy = %v; want %v", u.addr, !want, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.lastCheck.IsZero() || (u.lastErr == nil) != want {
+			t.Errorf("lastCheck = %v, lastErr = %v", u.lastCheck, u.lastErr)
+		}
+	}
+
+	// An unhealthy upstream recovers once it passes a check.
+	waitHealth(mustUpstream(t, f.addr(), false, false), true)
+	// A healthy upstream that goes away is marked unhealthy.
+	waitHealth(mustUpstream(t, closedAddr(t), false, true), false)
+}
@@ -10,10 +10,11 @@
 	"math/rand/v2"
 	"net"
 	"net/netip"
-	"slices"
+	"strconv"
 
 	"github.com/inetaf/tcpproxy"
 	"tailscale.com/net/netutil"
+	"tailscale.com/util/domainmatch"
 )
 
 type tcpRoundRobinHandler struct {
@@ -58,9 +59,9 @@ func (h *tcpRoundRobinHandler) Handle(c net.Conn) {
 }
 
 type tcpSNIHandler struct {
-	// Allowlist enumerates the FQDNs which may be proxied via SNI. An
-	// empty slice means all domains are permitted.
-	Allowlist []string
+	// Allowlist matches the FQDNs and ports which may be proxied via SNI.
+	// A nil Allowlist means all domains are permitted.
+	Allowlist *domainmatch.Matcher
 
 	// DialContext is used to make the outgoing TCP connection.
 	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
@@ -88,11 +89,13 @@ func (h *tcpSNIHandler) Handle(c net.Conn) {
 		return netutil.NewOneConnListener(c, nil), nil
 	}
 	p.AddSNIRouteFunc(addrPortStr, func(ctx context.Context, sniName string) (t tcpproxy.Target, ok bool) {
-		if len(h.Allowlist) > 0 {
-			// TODO(tom): handle subdomains
-			if slices.Index(h.Allowlist, sniName) < 0 {
+		if h.Allowlist != nil {
+			portNum, _ := strconv.ParseUint(port, 10, 16)
+			pattern, ok := h.Allowlist.MatchPort(sniName, uint16(portNum))
+			if !ok {
 				return nil, false
 			}
+			getMetrics().sniConnsByPattern.Add(pattern, 1)
 		}
 
 		return &tcpproxy.DialProxy{
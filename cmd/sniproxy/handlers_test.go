@@ -14,6 +14,7 @@
 	"testing"
 
 	"tailscale.com/net/memnet"
+	"tailscale.com/util/domainmatch"
 )
 
 func echoConnOnce(conn net.Conn) {
@@ -120,7 +121,7 @@ func fakeSNIHeader() []byte {
 
 func TestTCPSNIHandler(t *testing.T) {
 	h := tcpSNIHandler{
-		Allowlist: []string{"pkgs.tailscale.com"},
+		Allowlist: domainmatch.MustParse("pkgs.tailscale.com"),
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			if network != "tcp" {
 				t.Errorf("network = %s, want %s", network, "tcp")
@@ -8,6 +8,7 @@
 	"log"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +19,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/nettype"
 	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/domainmatch"
 	"tailscale.com/util/mak"
 )
 
@@ -42,14 +44,21 @@ type appcMetrics struct {
 	tcpConns       expvar.Int
 	sniConns       expvar.Int
 	unhandledConns expvar.Int
+
+	// sniConnsByPattern counts TLS sessions by the AllowedDomains
+	// pattern their SNI name matched.
+	sniConnsByPattern metrics.LabelMap
 }
 
 var getMetrics = sync.OnceValue[*appcMetrics](func() *appcMetrics {
-	m := appcMetrics{}
+	m := appcMetrics{
+		sniConnsByPattern: metrics.LabelMap{Label: "pattern"},
+	}
 
 	stats := new(metrics.Set)
 	stats.Set("tls_sessions", &m.sniConns)
 	clientmetric.NewCounterFunc("sniproxy_tls_sessions", m.sniConns.Value)
+	stats.Set("tls_sessions_by_pattern", &m.sniConnsByPattern)
 	stats.Set("tcp_sessions", &m.tcpConns)
 	clientmetric.NewCounterFunc("sniproxy_tcp_sessions", m.tcpConns.Value)
 	stats.Set("dns_responses", &m.dnsResponses)
@@ -289,10 +298,15 @@ func installDNATHandler(d *appctype.DNATConfig, out *connector) {
 }
 
 func installSNIHandler(c *appctype.SNIProxyConfig, out *connector) {
+	allow, err := allowedDomainsMatcher(c.AllowedDomains)
+	if err != nil {
+		log.Printf("installSNIHandler: not installing: %v", err)
+		return
+	}
 	var dialer net.Dialer
 	dialer.Timeout = 5 * time.Second
 	h := tcpSNIHandler{
-		Allowlist:    c.AllowedDomains,
+		Allowlist:    allow,
 		DialContext:  dialer.DialContext,
 		ReachableIPs: c.Addrs,
 	}
@@ -309,6 +323,29 @@ func installSNIHandler(c *appctype.SNIProxyConfig, out *connector) {
 	}
 }
 
+// allowedDomainsMatcher returns a matcher for the valid patterns of an
+// SNIProxyConfig's AllowedDomains, logging and skipping the invalid ones,
+// or nil (allowing all domains) if there are no patterns. An invalid
+// exclusion is an error instead, as skipping it would allow domains that
+// were meant to be excluded.
+func allowedDomainsMatcher(patterns []string) (*domainmatch.Matcher, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	var valid []string
+	for _, p := range patterns {
+		if _, err := domainmatch.Parse([]string{p}); err != nil {
+			if strings.HasPrefix(strings.TrimSpace(p), "!") {
+				return nil, err
+			}
+			log.Printf("installSNIHandler: skipping invalid allowed domain: %v", err)
+			continue
+		}
+		valid = append(valid, p)
+	}
+	return domainmatch.Parse(valid)
+}
+
 func makeConnectorsFromConfig(cfg *appctype.AppConnectorConfig) map[appctype.ConfigID]connector {
 	var connectors map[appctype.ConfigID]connector
 
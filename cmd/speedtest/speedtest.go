@@ -9,6 +9,9 @@
 // This will connect to the server on 127.0.0.1:20333 and start a 5 second download speedtest.
 // Example usage for server command: go run cmd/speedtest -s -host :20333
 // This will start a speedtest server on port 20333.
+// Example usage for a UDP test: go run cmd/speedtest -host 127.0.0.1:20333 -u -rate 100 -b
+// This will send and receive 100 packets per second in each direction and report
+// packet loss, jitter and round trip times.
 package main
 
 import (
@@ -49,7 +52,7 @@ func main() {
 // flags passed to it.
 var speedtestCmd = &ffcli.Command{
 	Name:       "speedtest",
-	ShortUsage: "speedtest [-host <host:port>] [-s] [-r] [-t <test duration>]",
+	ShortUsage: "speedtest [-host <host:port>] [-s] [-r] [-t <test duration>] [-u [-b] [-rate <pps>] [-size <bytes>]]",
 	ShortHelp:  "Run a speed test",
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("speedtest", flag.ExitOnError)
@@ -57,16 +60,24 @@ func main() {
 		fs.DurationVar(&speedtestArgs.testDuration, "t", speedtest.DefaultDuration, "duration of the speed test")
 		fs.BoolVar(&speedtestArgs.runServer, "s", false, "run a speedtest server")
 		fs.BoolVar(&speedtestArgs.reverse, "r", false, "run in reverse mode (server sends, client receives)")
+		fs.BoolVar(&speedtestArgs.udp, "u", false, "run a UDP test of packet loss, jitter and latency instead of throughput")
+		fs.BoolVar(&speedtestArgs.bidirectional, "b", false, "with -u, send in both directions at once")
+		fs.IntVar(&speedtestArgs.rate, "rate", speedtest.DefaultUDPRate, "with -u, packets per second to send")
+		fs.IntVar(&speedtestArgs.size, "size", speedtest.DefaultUDPPacketSize, "with -u, bytes of UDP payload per packet")
 		return fs
 	})(),
 	Exec: runSpeedtest,
 }
 
 var speedtestArgs struct {
-	host         string
-	testDuration time.Duration
-	runServer    bool
-	reverse      bool
+	host          string
+	testDuration  time.Duration
+	runServer     bool
+	reverse       bool
+	udp           bool
+	bidirectional bool
+	rate          int
+	size          int
 }
 
 func runSpeedtest(ctx context.Context, args []string) error {
@@ -99,6 +110,15 @@ func runSpeedtest(ctx context.Context, args []string) error {
 	if speedtestArgs.reverse {
 		dir = speedtest.Upload
 	}
+	if speedtestArgs.udp {
+		if speedtestArgs.bidirectional {
+			dir = speedtest.Bidirectional
+		}
+		return runUDPSpeedtest(dir)
+	}
+	if speedtestArgs.bidirectional {
+		return errors.New("-b requires -u")
+	}
 
 	fmt.Printf("Starting a %s test with %s\n", dir, speedtestArgs.host)
 	results, err := speedtest.RunClient(dir, speedtestArgs.testDuration, speedtestArgs.host)
@@ -119,3 +139,24 @@ func runSpeedtest(ctx context.Context, args []string) error {
 	w.Flush()
 	return nil
 }
+
+func runUDPSpeedtest(dir speedtest.Direction) error {
+	fmt.Printf("Starting a %s UDP test with %s at %d packets/sec\n", dir, speedtestArgs.host, speedtestArgs.rate)
+	res, err := speedtest.RunUDPClient(speedtest.UDPOptions{
+		Direction:  dir,
+		Duration:   speedtestArgs.testDuration,
+		Rate:       speedtestArgs.rate,
+		PacketSize: speedtestArgs.size,
+	}, speedtestArgs.host)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Results:")
+	if res.Upload != nil {
+		fmt.Printf("upload:   %v\n", res.Upload)
+	}
+	if res.Download != nil {
+		fmt.Printf("download: %v\n", res.Download)
+	}
+	return nil
+}
@@ -14,6 +14,7 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -23,6 +24,7 @@
 	"os/exec"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -37,6 +39,7 @@
 	"tailscale.com/internal/noiseconn"
 	"tailscale.com/ipn"
 	"tailscale.com/net/netmon"
+	"tailscale.com/net/speedtest"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/paths"
@@ -287,12 +290,28 @@
 		},
 		{
 			Name:       "capture",
-			ShortUsage: "tailscale debug capture",
+			ShortUsage: "tailscale debug capture [--format=pcapng] [--filter=<expr>]",
 			Exec:       runCapture,
 			ShortHelp:  "Streams pcaps for debugging",
+			LongHelp: strings.TrimSpace(`
+Streams a capture of the packets traversing tailscaled.
+
+The --filter expression selects which packets are captured, using a subset
+of tcpdump's syntax: "[src|dst] host <ip>", "[src|dst] net <prefix>",
+"[src|dst] port <port>", "proto <name>", "tcp", "udp", "icmp", "icmp6",
+"ip", "ip6", "peer <name|nodekey>" and "disco", combined with "and", "or",
+"not" and parentheses. For example:
+
+  tailscale debug capture --filter "peer myserver and tcp port 443"
+
+With --format=pcapng, each capture path is a separate interface and packets
+are commented with their peer's node key, name and DERP region.
+`),
 			FlagSet: (func() *flag.FlagSet {
 				fs := newFlagSet("capture")
 				fs.StringVar(&captureArgs.outFile, "o", "", "path to stream the pcap (or - for stdout), leave empty to start wireshark")
+				fs.StringVar(&captureArgs.format, "format", "pcap", `capture format; "pcap" or "pcapng"`)
+				fs.StringVar(&captureArgs.filter, "filter", "", "if non-empty, a filter expression selecting the packets to capture")
 				return fs
 			})(),
 		},
@@ -328,6 +347,56 @@
 				return fs
 			})(),
 		},
+		{
+			Name:       "filter-check",
+			ShortUsage: "tailscale debug filter-check [--dst=<IP>] [--proto=tcp] <src-hostname-or-IP> <port>",
+			Exec:       runDebugFilterCheck,
+			ShortHelp:  "Checks whether the packet filter allows traffic from a peer",
+			LongHelp: strings.TrimSpace(`
+Runs a connection from the given source to this node (or --dst) through the
+live packet filter, and prints the verdict, the filter rule that allowed it,
+and the capabilities granted to the source.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("filter-check")
+				fs.StringVar(&debugFilterCheckArgs.dst, "dst", "", "destination IP; defaults to this node's Tailscale IP")
+				fs.StringVar(&debugFilterCheckArgs.proto, "proto", "tcp", `IP protocol ("tcp", "udp", "icmp", etc.)`)
+				fs.BoolVar(&debugFilterCheckArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "speedtest",
+			ShortUsage: "tailscale debug speedtest [--udp [--bidirectional] [--rate=<pps>] [--size=<bytes>]] [--reverse] [--time=<duration>] <hostname-or-IP>[:port]\n  or: tailscale debug speedtest --listen [--port=<port>]",
+			Exec:       runDebugSpeedtest,
+			ShortHelp:  "Measures throughput, or UDP loss, jitter and latency, to a peer",
+			LongHelp: strings.TrimSpace(`
+Runs a speed test against a peer running "tailscale debug speedtest --listen"
+(or cmd/speedtest), over the tailnet.
+
+By default it measures TCP download throughput; --reverse measures upload.
+With --udp, it instead sends packets at a fixed rate and reports packet loss,
+one-way jitter, reordering and the distribution of round trip times, which
+matter more than throughput for voice, video and game traffic. Comparing runs
+over a direct path and over DERP shows what relaying costs.
+
+The test traffic uses the operating system's network stack, so both nodes
+must run tailscaled with a TUN device, not --tun=userspace-networking.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("speedtest")
+				fs.BoolVar(&debugSpeedtestArgs.listen, "listen", false, "run a speed test server on this node's Tailscale IPs")
+				fs.IntVar(&debugSpeedtestArgs.port, "port", speedtest.DefaultPort, "with --listen, port to listen on")
+				fs.BoolVar(&debugSpeedtestArgs.udp, "udp", false, "measure UDP packet loss, jitter and latency instead of throughput")
+				fs.BoolVar(&debugSpeedtestArgs.bidirectional, "bidirectional", false, "with --udp, send in both directions at once")
+				fs.BoolVar(&debugSpeedtestArgs.reverse, "reverse", false, "send from this node to the peer, instead of the reverse")
+				fs.IntVar(&debugSpeedtestArgs.rate, "rate", speedtest.DefaultUDPRate, "with --udp, packets per second to send")
+				fs.IntVar(&debugSpeedtestArgs.size, "size", speedtest.DefaultUDPPacketSize, "with --udp, bytes of UDP payload per packet")
+				fs.DurationVar(&debugSpeedtestArgs.duration, "time", speedtest.DefaultDuration, "duration of the test")
+				fs.BoolVar(&debugSpeedtestArgs.json, "json", false, "with --udp, output in JSON format")
+				return fs
+			})(),
+		},
 		{
 			Name:       "resolve",
 			ShortUsage: "tailscale debug resolve <hostname>",
@@ -1038,10 +1107,23 @@ func runSetExpire(ctx context.Context, args []string) error {
 
 var captureArgs struct {
 	outFile string
+	format  string
+	filter  string
 }
 
 func runCapture(ctx context.Context, args []string) error {
-	stream, err := localClient.StreamDebugCapture(ctx)
+	if _, err := capture.ParseFormat(captureArgs.format); err != nil {
+		return err
+	}
+	if captureArgs.filter != "" {
+		if _, err := capture.ParseFilter(captureArgs.filter); err != nil {
+			return fmt.Errorf("invalid --filter: %w", err)
+		}
+	}
+	stream, err := localClient.StreamDebugCaptureWithOpts(ctx, &tailscale.DebugCaptureOpts{
+		Format: captureArgs.format,
+		Filter: captureArgs.filter,
+	})
 	if err != nil {
 		return err
 	}
@@ -1248,6 +1330,65 @@ func runDebugDialTypes(ctx context.Context, args []string) error {
 	return nil
 }
 
+var debugFilterCheckArgs struct {
+	dst   string
+	proto string
+	json  bool
+}
+
+func runDebugFilterCheck(ctx context.Context, args []string) error {
+	if len(args) != 2 || args[0] == "" {
+		return errors.New("usage: tailscale debug filter-check [--dst=<IP>] [--proto=tcp] <src-hostname-or-IP> <port>")
+	}
+	port, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %w", args[1], err)
+	}
+	srcStr, _, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	src, err := netip.ParseAddr(srcStr)
+	if err != nil {
+		return err
+	}
+	var dst netip.Addr
+	if debugFilterCheckArgs.dst != "" {
+		if dst, err = netip.ParseAddr(debugFilterCheckArgs.dst); err != nil {
+			return fmt.Errorf("invalid --dst: %w", err)
+		}
+	}
+
+	res, err := localClient.DebugFilterCheck(ctx, src, dst, uint16(port), debugFilterCheckArgs.proto)
+	if err != nil {
+		return err
+	}
+	if debugFilterCheckArgs.json {
+		j, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	printf("%s %v => %v:%d: %s (%s)\n", res.Proto, res.Src, res.Dst, res.Port, res.Verdict, res.Reason)
+	if m := res.Match; m != nil {
+		printf("matched rule: %v => %v", m.Srcs, m.Dsts)
+		if len(m.SrcCaps) > 0 {
+			printf(" (sources with caps %v)", m.SrcCaps)
+		}
+		printf("\n")
+	}
+	for _, c := range slices.Sorted(maps.Keys(res.Caps)) {
+		printf("granted cap: %s", c)
+		for _, v := range res.Caps[c] {
+			printf(" %s", v)
+		}
+		printf("\n")
+	}
+	return nil
+}
+
 var resolveArgs struct {
 	net string // "ip", "ip4", "ip6""
 }
@@ -1270,3 +1411,135 @@ func runDebugResolve(ctx context.Context, args []string) error {
 	}
 	return nil
 }
+
+var debugSpeedtestArgs struct {
+	listen        bool
+	port          int
+	udp           bool
+	bidirectional bool
+	reverse       bool
+	rate          int
+	size          int
+	duration      time.Duration
+	json          bool
+}
+
+func runDebugSpeedtest(ctx context.Context, args []string) error {
+	if debugSpeedtestArgs.listen {
+		if len(args) != 0 {
+			return errors.New("usage: tailscale debug speedtest --listen [--port=<port>]")
+		}
+		return runDebugSpeedtestServer(ctx)
+	}
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("usage: tailscale debug speedtest [flags] <hostname-or-IP>[:port]")
+	}
+	if debugSpeedtestArgs.bidirectional && !debugSpeedtestArgs.udp {
+		return errors.New("--bidirectional requires --udp")
+	}
+
+	hostOrIP, port := args[0], strconv.Itoa(speedtest.DefaultPort)
+	if h, p, err := net.SplitHostPort(args[0]); err == nil {
+		hostOrIP, port = h, p
+	}
+	ip, self, err := tailscaleIPFromArg(ctx, hostOrIP)
+	if err != nil {
+		return err
+	}
+	if self {
+		return errors.New("can't run a speed test against this node")
+	}
+	addr := net.JoinHostPort(ip, port)
+
+	path := "unknown path"
+	if st, err := localClient.Status(ctx); err == nil {
+		for _, ps := range st.Peer {
+			if !slices.ContainsFunc(ps.TailscaleIPs, func(a netip.Addr) bool { return a.String() == ip }) {
+				continue
+			}
+			if ps.CurAddr != "" {
+				path = "direct " + ps.CurAddr
+			} else if ps.Relay != "" {
+				path = fmt.Sprintf("relay %q", ps.Relay)
+			}
+		}
+	}
+
+	dir := speedtest.Download
+	if debugSpeedtestArgs.reverse {
+		dir = speedtest.Upload
+	}
+	if !debugSpeedtestArgs.udp {
+		printf("Starting a %s test with %s (%s)\n", dir, addr, path)
+		results, err := speedtest.RunClient(dir, debugSpeedtestArgs.duration, addr)
+		if err != nil {
+			return err
+		}
+		start := results[0].IntervalStart
+		for _, r := range results {
+			if r.Total {
+				outln("---")
+			}
+			printf("%5.2f-%5.2f sec  %10.4f Mbits  %10.4f Mbits/sec\n",
+				r.IntervalStart.Sub(start).Seconds(), r.IntervalEnd.Sub(start).Seconds(), r.MegaBits(), r.MBitsPerSecond())
+		}
+		return nil
+	}
+
+	if debugSpeedtestArgs.bidirectional {
+		dir = speedtest.Bidirectional
+	}
+	if !debugSpeedtestArgs.json {
+		printf("Starting a %s UDP test with %s (%s) at %d packets/sec\n", dir, addr, path, debugSpeedtestArgs.rate)
+	}
+	res, err := speedtest.RunUDPClient(speedtest.UDPOptions{
+		Direction:  dir,
+		Duration:   debugSpeedtestArgs.duration,
+		Rate:       debugSpeedtestArgs.rate,
+		PacketSize: debugSpeedtestArgs.size,
+	}, addr)
+	if err != nil {
+		return err
+	}
+	if debugSpeedtestArgs.json {
+		j, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	if res.Upload != nil {
+		printf("upload:   %v\n", res.Upload)
+	}
+	if res.Download != nil {
+		printf("download: %v\n", res.Download)
+	}
+	return nil
+}
+
+func runDebugSpeedtestServer(ctx context.Context) error {
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if len(st.TailscaleIPs) == 0 {
+		return errors.New("this node has no Tailscale IPs; is it logged in?")
+	}
+	errc := make(chan error, len(st.TailscaleIPs))
+	for _, ip := range st.TailscaleIPs {
+		ln, err := net.Listen("tcp", netip.AddrPortFrom(ip, uint16(debugSpeedtestArgs.port)).String())
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		printf("listening on %v\n", ln.Addr())
+		go func() { errc <- speedtest.Serve(ln) }()
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// dnsCacheArgs are the arguments for the "dns cache" subcommand.
+var dnsCacheArgs struct {
+	flush bool
+	json  bool
+}
+
+func runDNSCache(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %q", args)
+	}
+	if dnsCacheArgs.flush {
+		if err := localClient.FlushDNSCache(ctx); err != nil {
+			return err
+		}
+		printf("DNS cache flushed.\n")
+		return nil
+	}
+
+	st, err := localClient.DNSCache(ctx)
+	if err != nil {
+		return err
+	}
+	if dnsCacheArgs.json {
+		j, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+
+	printf("%d cached responses (max %d); %d hits, %d misses\n", len(st.Entries), st.MaxEntries, st.Hits, st.Misses)
+	if len(st.Entries) == 0 {
+		return nil
+	}
+	printf("\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tTYPE\tRCODE\tANSWERS\tEXPIRES IN\n")
+	now := time.Now()
+	for _, e := range st.Entries {
+		rcode := e.RCode
+		if e.Negative && e.RCode == "Success" {
+			rcode = "NoData"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%v\n", e.Name, e.Type, rcode, e.Answers, e.Expires.Sub(now).Round(time.Second))
+	}
+	return w.Flush()
+}
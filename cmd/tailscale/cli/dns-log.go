@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// dnsLogArgs are the arguments for the "dns log" subcommand.
+var dnsLogArgs struct {
+	enable  bool
+	disable bool
+	follow  bool
+	json    bool
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %q", args)
+	}
+	if dnsLogArgs.enable && dnsLogArgs.disable {
+		return errors.New("--enable and --disable are mutually exclusive")
+	}
+	if dnsLogArgs.enable || dnsLogArgs.disable {
+		if err := localClient.SetDNSQueryLogEnabled(ctx, dnsLogArgs.enable); err != nil {
+			return err
+		}
+		if dnsLogArgs.enable {
+			printf("DNS query log enabled.\n")
+		} else {
+			printf("DNS query log disabled.\n")
+		}
+		if !dnsLogArgs.follow {
+			return nil
+		}
+	}
+
+	rc, err := localClient.StreamDNSQueryLog(ctx, dnsLogArgs.follow)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dec := json.NewDecoder(rc)
+	for {
+		var e apitype.DNSQueryLogEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if dnsLogArgs.json {
+			j, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			outln(string(j))
+			continue
+		}
+		outln(formatDNSQueryLogEntry(e))
+	}
+}
+
+// formatDNSQueryLogEntry formats e as a line of "tailscale dns log" output.
+func formatDNSQueryLogEntry(e apitype.DNSQueryLogEntry) string {
+	var b strings.Builder
+	b.WriteString(e.Time.Local().Format("15:04:05.000"))
+	if e.Client.IsValid() {
+		fmt.Fprintf(&b, " %v", e.Client)
+	}
+	if e.PeerNode != "" {
+		fmt.Fprintf(&b, " (%s, %s)", strings.TrimSuffix(e.PeerNode, "."), e.PeerUser)
+	}
+	fmt.Fprintf(&b, " %s %s", e.Type, e.Name)
+	if e.Error != "" {
+		fmt.Fprintf(&b, " error: %s", e.Error)
+	} else {
+		fmt.Fprintf(&b, " %s", e.RCode)
+	}
+	switch {
+	case e.Local:
+		b.WriteString(" local")
+	case e.Cached:
+		b.WriteString(" cached")
+	case e.Upstream != "":
+		fmt.Fprintf(&b, " from %s", e.Upstream)
+	}
+	if e.Route != "" {
+		fmt.Fprintf(&b, " route %s", e.Route)
+	}
+	fmt.Fprintf(&b, " in %v", e.Duration.Round(time.Millisecond/10))
+	return b.String()
+}
@@ -35,10 +35,34 @@
 			ShortHelp:  "Perform a DNS query",
 			LongHelp:   "The 'tailscale dns query' subcommand performs a DNS query for the specified name using the internal DNS forwarder (100.100.100.100).\n\nIt also provides information about the resolver(s) used to resolve the query.",
 		},
-
-		// TODO: implement `tailscale log` here
-
-		// The above work is tracked in https://github.com/tailscale/tailscale/issues/13326
+		{
+			Name:       "cache",
+			ShortUsage: "tailscale dns cache [--flush] [--json]",
+			Exec:       runDNSCache,
+			ShortHelp:  "Show or flush the DNS response cache",
+			LongHelp:   "The 'tailscale dns cache' subcommand shows the responses cached by the internal DNS forwarder (100.100.100.100), or flushes them with --flush.\n\nResponses from upstream resolvers are cached according to their TTLs, and negative responses according to their SOA records. The cache is flushed when the upstream resolvers change.",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("cache")
+				fs.BoolVar(&dnsCacheArgs.flush, "flush", false, "remove all cached responses")
+				fs.BoolVar(&dnsCacheArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "log",
+			ShortUsage: "tailscale dns log [--enable | --disable] [--follow] [--json]",
+			Exec:       runDNSLog,
+			ShortHelp:  "Show the log of DNS queries",
+			LongHelp:   "The 'tailscale dns log' subcommand shows the most recent DNS queries handled by the internal DNS forwarder (100.100.100.100), including the route and upstream resolver used for each, and how long it took to answer. For queries from peers using this node as an exit node, it also shows the peer.\n\nThe log is off by default. Enable it with --enable, or show queries as they're handled with --follow.",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("log")
+				fs.BoolVar(&dnsLogArgs.enable, "enable", false, "enable the query log")
+				fs.BoolVar(&dnsLogArgs.disable, "disable", false, "disable and clear the query log")
+				fs.BoolVar(&dnsLogArgs.follow, "follow", false, "show queries as they're handled, until interrupted")
+				fs.BoolVar(&dnsLogArgs.json, "json", false, "output in JSON format, one query per line")
+				return fs
+			})(),
+		},
 	},
 }
 
@@ -21,6 +21,7 @@
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -163,6 +164,24 @@ type serveEnv struct {
 	subcmd           serveMode // subcommand
 	yes              bool      // update without prompt
 
+	// v2 web handler flags
+	status          int         // HTTP status code for redirect: and text: targets
+	stripPrefix     string      // path prefix to strip before proxying
+	allowUsers      string      // comma-separated login names allowed access
+	allowTags       string      // comma-separated tags allowed access
+	allowCaps       string      // comma-separated peer capabilities allowed access
+	requestHeaders  headerFlags // headers to set on requests
+	responseHeaders headerFlags // headers to set on responses
+
+	// v2 load balancing flags
+	backends            stringsFlag   // further backends to balance across
+	lbPolicy            string        // load balancing policy
+	healthCheckInterval time.Duration // interval of active health checks
+	healthCheckPath     string        // HTTP path of health checks
+	healthCheckTimeout  time.Duration // timeout of health checks
+	maxFails            int           // consecutive failures before ejecting a backend
+	ejectDuration       time.Duration // how long to eject a backend for
+
 	lc localServeClient // localClient interface, specific to serve
 
 	// optional stuff for tests:
@@ -696,18 +715,6 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 		printf("%s://%s%s (%s)\n", scheme, hostname, portPart, fStatus)
 	}
 	printf("%s://%s%s (%s)\n", scheme, host, portPart, fStatus)
-	srvTypeAndDesc := func(h *ipn.HTTPHandler) (string, string) {
-		switch {
-		case h.Path != "":
-			return "path", h.Path
-		case h.Proxy != "":
-			return "proxy", h.Proxy
-		case h.Text != "":
-			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
-		}
-		return "", ""
-	}
-
 	mounts := slicesx.MapKeys(sc.Web[hp].Handlers)
 	sort.Slice(mounts, func(i, j int) bool {
 		return len(mounts[i]) < len(mounts[j])
@@ -716,7 +723,7 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 
 	for _, m := range mounts {
 		h := sc.Web[hp].Handlers[m]
-		t, d := srvTypeAndDesc(h)
+		t, d := serveHandlerTypeAndDesc(h)
 		printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
 	}
 
@@ -11,13 +11,16 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -55,6 +58,16 @@ type commandInfo struct {
   - Expose an HTTPS server with invalid or self-signed certificates at https://localhost:8443
     $ tailscale %[1]s https+insecure://localhost:8443
 
+  - Redirect requests for /docs elsewhere, or respond to them with a fixed status code:
+    $ tailscale %[1]s --bg --set-path /docs --status 301 'redirect:https://docs.example.com${REQUEST_URI}'
+    $ tailscale %[1]s --bg --set-path /docs status:410
+
+  - Only allow a user and nodes tagged tag:ci to access an HTTP server running at 127.0.0.1:3000:
+    $ tailscale %[1]s --bg --allow-users alice@example.com --allow-tags tag:ci 3000
+
+  - Balance requests across HTTP servers running at 127.0.0.1:3000 and 127.0.0.1:3001, checking their health:
+    $ tailscale %[1]s --bg --backend 3001 --health-check-interval 10s --health-check-path /healthz 3000
+
 For more examples and use cases visit our docs site https://tailscale.com/kb/1247/funnel-serve-use-cases
 `)
 
@@ -128,6 +141,22 @@ func newServeV2Command(e *serveEnv, subcmd serveMode) *ffcli.Command {
 			fs.UintVar(&e.tcp, "tcp", 0, "Expose a TCP forwarder to forward raw TCP packets at the specified port")
 			fs.UintVar(&e.tlsTerminatedTCP, "tls-terminated-tcp", 0, "Expose a TCP forwarder to forward TLS-terminated TCP packets at the specified port")
 			fs.BoolVar(&e.yes, "yes", false, "Update without interactive prompts (default false)")
+			fs.IntVar(&e.status, "status", 0, "HTTP status code to respond with for redirect: and text: targets")
+			fs.StringVar(&e.stripPrefix, "strip-prefix", "", "Strips the specified path prefix, after the mount point, from requests before proxying them")
+			fs.Var(&e.requestHeaders, "request-header", `Sets a header on requests, as "Name: value"; an empty value removes the header (can be repeated)`)
+			fs.Var(&e.responseHeaders, "response-header", `Sets a header on responses, as "Name: value"; an empty value removes the header (can be repeated)`)
+			fs.Var(&e.backends, "backend", "Adds a further backend to balance requests or connections across along with <target> (can be repeated)")
+			fs.StringVar(&e.lbPolicy, "lb-policy", "", `Load balancing policy across backends: "round-robin" or "least-conn" (default "round-robin")`)
+			fs.DurationVar(&e.healthCheckInterval, "health-check-interval", 0, "Actively health check backends at the specified interval (default no health checks)")
+			fs.StringVar(&e.healthCheckPath, "health-check-path", "", "Health check HTTP backends by requesting the specified path (default a TCP connection check)")
+			fs.DurationVar(&e.healthCheckTimeout, "health-check-timeout", 0, "Timeout of backend health checks (default 2s)")
+			fs.IntVar(&e.maxFails, "max-fails", 0, "Eject a backend after the specified number of consecutive failures to reach it (default never)")
+			fs.DurationVar(&e.ejectDuration, "eject-duration", 0, "How long to eject a failing backend for (default 30s)")
+			if subcmd == serve {
+				fs.StringVar(&e.allowUsers, "allow-users", "", "Comma-separated login names of the Tailscale users allowed access (default all)")
+				fs.StringVar(&e.allowTags, "allow-tags", "", "Comma-separated tags of the Tailscale nodes allowed access (default all)")
+				fs.StringVar(&e.allowCaps, "allow-caps", "", "Comma-separated peer capabilities granting Tailscale nodes access (default all)")
+			}
 		}),
 		UsageFunc: usageFuncNoDefaultValues,
 		Subcommands: []*ffcli.Command{
@@ -379,6 +408,9 @@ func (e *serveEnv) setServe(sc *ipn.ServeConfig, st *ipnstate.Status, dnsName st
 		if e.setPath != "" {
 			return fmt.Errorf("cannot mount a path for TCP serve")
 		}
+		if e.hasWebHandlerFlags() {
+			return fmt.Errorf("cannot set web handler options for TCP serve")
+		}
 
 		err := e.applyTCPServe(sc, dnsName, srvType, srvPort, target)
 		if err != nil {
@@ -427,18 +459,6 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 		portPart = ""
 	}
 
-	srvTypeAndDesc := func(h *ipn.HTTPHandler) (string, string) {
-		switch {
-		case h.Path != "":
-			return "path", h.Path
-		case h.Proxy != "":
-			return "proxy", h.Proxy
-		case h.Text != "":
-			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
-		}
-		return "", ""
-	}
-
 	if sc.Web[hp] != nil {
 		mounts := slicesx.MapKeys(sc.Web[hp].Handlers)
 		sort.Slice(mounts, func(i, j int) bool {
@@ -447,7 +467,7 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 
 		for _, m := range mounts {
 			h := sc.Web[hp].Handlers[m]
-			t, d := srvTypeAndDesc(h)
+			t, d := serveHandlerTypeAndDesc(h)
 			output.WriteString(fmt.Sprintf("%s://%s%s%s\n", scheme, dnsName, portPart, m))
 			output.WriteString(fmt.Sprintf("%s %-5s %s\n\n", "|--", t, d))
 		}
@@ -466,6 +486,9 @@ func (e *serveEnv) messageForPort(sc *ipn.ServeConfig, st *ipnstate.Status, dnsN
 			output.WriteString(fmt.Sprintf("|-- tcp://%s\n", ipp))
 		}
 		output.WriteString(fmt.Sprintf("|--> tcp://%s\n", h.TCPForward))
+		for _, b := range h.TCPForwardBackends {
+			output.WriteString(fmt.Sprintf("|--> tcp://%s\n", b))
+		}
 	}
 
 	if !e.bg {
@@ -493,6 +516,26 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 			return errors.New("unable to serve; text cannot be an empty string")
 		}
 		h.Text = text
+	case strings.HasPrefix(target, "redirect:"):
+		redirect := strings.TrimPrefix(target, "redirect:")
+		// Check the URL is valid with its placeholders expanded.
+		expanded := strings.NewReplacer("${HOST}", "example.com", "${REQUEST_URI}", "/").Replace(redirect)
+		if _, err := url.Parse(expanded); err != nil || redirect == "" {
+			return errors.New("unable to serve; invalid redirect URL")
+		}
+		if e.status != 0 && (e.status < 300 || e.status > 399) {
+			return fmt.Errorf("unable to serve; invalid redirect status %d", e.status)
+		}
+		h.Redirect = redirect
+	case strings.HasPrefix(target, "status:"):
+		if e.status != 0 {
+			return errors.New("unable to serve; --status cannot be used with a status: target")
+		}
+		code, err := strconv.Atoi(strings.TrimPrefix(target, "status:"))
+		if err != nil || code < 100 || code > 999 {
+			return errors.New("unable to serve; invalid status code")
+		}
+		h.Status = code
 	case filepath.IsAbs(target):
 		if version.IsMacAppStore() || version.IsMacSys() {
 			// The Tailscale network extension cannot serve arbitrary paths on macOS due to sandbox restrictions (2024-03-26)
@@ -520,6 +563,27 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 		h.Proxy = t
 	}
 
+	if err := e.applyWebHandlerFlags(h); err != nil {
+		return err
+	}
+	if len(e.backends) > 0 {
+		if h.Proxy == "" {
+			return errors.New("unable to serve; --backend can only be used when proxying")
+		}
+		for _, b := range e.backends {
+			t, err := ipn.ExpandProxyTargetValue(b, []string{"http", "https", "https+insecure"}, "http")
+			if err != nil {
+				return err
+			}
+			h.ProxyBackends = append(h.ProxyBackends, t)
+		}
+	}
+	lb, err := e.loadBalancing()
+	if err != nil {
+		return err
+	}
+	h.LoadBalancing = lb
+
 	// TODO: validation needs to check nested foreground configs
 	if sc.IsTCPForwardingOnPort(srvPort) {
 		return errors.New("cannot serve web; already serving TCP")
@@ -530,6 +594,115 @@ func (e *serveEnv) applyWebServe(sc *ipn.ServeConfig, dnsName string, srvPort ui
 	return nil
 }
 
+// applyWebHandlerFlags applies the web handler flags (--status,
+// --strip-prefix, --allow-* and the header flags) to h.
+func (e *serveEnv) applyWebHandlerFlags(h *ipn.HTTPHandler) error {
+	if e.status != 0 {
+		if h.Redirect == "" && h.Text == "" {
+			return errors.New("unable to serve; --status can only be used with redirect: and text: targets")
+		}
+		if e.status < 100 || e.status > 999 {
+			return fmt.Errorf("unable to serve; invalid status code %d", e.status)
+		}
+		h.Status = e.status
+	}
+	if e.stripPrefix != "" {
+		if h.Proxy == "" {
+			return errors.New("unable to serve; --strip-prefix can only be used when proxying")
+		}
+		p, err := cleanURLPath(e.stripPrefix)
+		if err != nil {
+			return fmt.Errorf("invalid --strip-prefix: %w", err)
+		}
+		h.StripPrefix = p
+	}
+	h.AllowUsers = splitCommaList(e.allowUsers)
+	h.AllowTags = splitCommaList(e.allowTags)
+	for _, tag := range h.AllowTags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return fmt.Errorf("invalid --allow-tags: %w", err)
+		}
+	}
+	for _, c := range splitCommaList(e.allowCaps) {
+		h.AllowCaps = append(h.AllowCaps, tailcfg.PeerCapability(c))
+	}
+	h.RequestHeaders = e.requestHeaders
+	h.ResponseHeaders = e.responseHeaders
+	return nil
+}
+
+// hasWebHandlerFlags reports whether any of the web handler flags were
+// set.
+func (e *serveEnv) hasWebHandlerFlags() bool {
+	return e.status != 0 || e.stripPrefix != "" ||
+		e.allowUsers != "" || e.allowTags != "" || e.allowCaps != "" ||
+		len(e.requestHeaders) > 0 || len(e.responseHeaders) > 0
+}
+
+// splitCommaList splits the comma-separated list s, dropping empty
+// elements. It returns nil if s has none.
+func splitCommaList(s string) []string {
+	var ret []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// stringsFlag is a flag.Value for repeatable string flags.
+type stringsFlag []string
+
+func (s stringsFlag) String() string { return strings.Join(s, ", ") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// headerFlags is a flag.Value for repeatable "Name: value" header flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(h)) {
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %s", k, h[k])
+	}
+	return b.String()
+}
+
+func (h *headerFlags) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" || strings.ContainsAny(k, " \t") {
+		return fmt.Errorf("invalid header %q; want \"Name: value\"", s)
+	}
+	mak.Set((*map[string]string)(h), http.CanonicalHeaderKey(k), strings.TrimSpace(v))
+	return nil
+}
+
+// serveHandlerTypeAndDesc returns the type of h and a description of what
+// it serves, for status output.
+func serveHandlerTypeAndDesc(h *ipn.HTTPHandler) (string, string) {
+	switch {
+	case h.Path != "":
+		return "path", h.Path
+	case h.Proxy != "":
+		return "proxy", strings.Join(append([]string{h.Proxy}, h.ProxyBackends...), ", ")
+	case h.Text != "":
+		return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+	case h.Redirect != "":
+		return "redirect", h.Redirect
+	case h.Status != 0:
+		return "status", strconv.Itoa(h.Status)
+	}
+	return "", ""
+}
+
 func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType serveType, srcPort uint16, target string) error {
 	var terminateTLS bool
 	switch srcType {
@@ -556,11 +729,65 @@ func (e *serveEnv) applyTCPServe(sc *ipn.ServeConfig, dnsName string, srcType se
 		return fmt.Errorf("cannot serve TCP; already serving web on %d", srcPort)
 	}
 
+	var backends []string
+	for _, b := range e.backends {
+		t, err := ipn.ExpandProxyTargetValue(b, []string{"tcp"}, "tcp")
+		if err != nil {
+			return fmt.Errorf("unable to expand backend: %v", err)
+		}
+		u, err := url.Parse(t)
+		if err != nil {
+			return fmt.Errorf("invalid TCP backend %q: %v", b, err)
+		}
+		backends = append(backends, u.Host)
+	}
+	lb, err := e.loadBalancing()
+	if err != nil {
+		return err
+	}
+
 	sc.SetTCPForwarding(srcPort, dstURL.Host, terminateTLS, dnsName)
+	sc.TCP[srcPort].TCPForwardBackends = backends
+	sc.TCP[srcPort].LoadBalancing = lb
 
 	return nil
 }
 
+// loadBalancing returns the load balancing configuration set by the load
+// balancing flags, or nil if none were set. They may only be set along with
+// --backend.
+func (e *serveEnv) loadBalancing() (*ipn.LoadBalancing, error) {
+	lb := ipn.LoadBalancing{
+		Policy:              ipn.LoadBalancingPolicy(e.lbPolicy),
+		HealthCheckInterval: e.healthCheckInterval,
+		HealthCheckPath:     e.healthCheckPath,
+		HealthCheckTimeout:  e.healthCheckTimeout,
+		MaxFails:            e.maxFails,
+		EjectDuration:       e.ejectDuration,
+	}
+	if lb == (ipn.LoadBalancing{}) {
+		return nil, nil
+	}
+	if len(e.backends) == 0 {
+		return nil, errors.New("load balancing flags can only be used with --backend")
+	}
+	switch lb.Policy {
+	case "", ipn.LoadBalanceRoundRobin, ipn.LoadBalanceLeastConn:
+	default:
+		return nil, fmt.Errorf("invalid --lb-policy %q", lb.Policy)
+	}
+	if lb.HealthCheckInterval < 0 || lb.HealthCheckTimeout < 0 || lb.MaxFails < 0 || lb.EjectDuration < 0 {
+		return nil, errors.New("load balancing flags cannot be negative")
+	}
+	if lb.HealthCheckInterval == 0 && (lb.HealthCheckPath != "" || lb.HealthCheckTimeout != 0) {
+		return nil, errors.New("--health-check-path and --health-check-timeout require --health-check-interval")
+	}
+	if lb.HealthCheckPath != "" && !strings.HasPrefix(lb.HealthCheckPath, "/") {
+		return nil, errors.New("--health-check-path must start with /")
+	}
+	return &lb, nil
+}
+
 func (e *serveEnv) applyFunnel(sc *ipn.ServeConfig, dnsName string, srvPort uint16, allowFunnel bool) {
 	hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(srvPort))))
 
@@ -14,11 +14,13 @@
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 )
 
 func TestServeDevConfigMutations(t *testing.T) {
@@ -296,6 +298,170 @@ type group struct {
 				},
 			}},
 		},
+		{
+			name: "https_handler_rules",
+			steps: []step{
+				{
+					command: cmd("serve --bg --allow-users=alice@example.com,bob@example.com --allow-tags=tag:ci --allow-caps=example.com/cap/serve --strip-prefix=/v1 --request-header=x-api:yes --request-header=Cookie: --response-header=X-Frame-Options:DENY 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:           "http://127.0.0.1:3000",
+									AllowUsers:      []string{"alice@example.com", "bob@example.com"},
+									AllowTags:       []string{"tag:ci"},
+									AllowCaps:       []tailcfg.PeerCapability{"example.com/cap/serve"},
+									RequestHeaders:  map[string]string{"X-Api": "yes", "Cookie": ""},
+									ResponseHeaders: map[string]string{"X-Frame-Options": "DENY"},
+									StripPrefix:     "/v1",
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/old --status=301 redirect:https://example.com${REQUEST_URI}"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:           "http://127.0.0.1:3000",
+									AllowUsers:      []string{"alice@example.com", "bob@example.com"},
+									AllowTags:       []string{"tag:ci"},
+									AllowCaps:       []tailcfg.PeerCapability{"example.com/cap/serve"},
+									RequestHeaders:  map[string]string{"X-Api": "yes", "Cookie": ""},
+									ResponseHeaders: map[string]string{"X-Frame-Options": "DENY"},
+									StripPrefix:     "/v1",
+								},
+								"/old": {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/gone status:410"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:           "http://127.0.0.1:3000",
+									AllowUsers:      []string{"alice@example.com", "bob@example.com"},
+									AllowTags:       []string{"tag:ci"},
+									AllowCaps:       []tailcfg.PeerCapability{"example.com/cap/serve"},
+									RequestHeaders:  map[string]string{"X-Api": "yes", "Cookie": ""},
+									ResponseHeaders: map[string]string{"X-Frame-Options": "DENY"},
+									StripPrefix:     "/v1",
+								},
+								"/old":  {Redirect: "https://example.com${REQUEST_URI}", Status: 301},
+								"/gone": {Status: 410},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --status=200 redirect:https://example.com"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --status=200 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --strip-prefix=/v1 text:hi"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --allow-tags=ci 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --request-header=nocolon 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --tcp=5432 --allow-users=alice@example.com localhost:5432"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "load_balancing",
+			steps: []step{
+				{
+					command: cmd("serve --bg --backend=3001 --backend=https+insecure://localhost:3002 --lb-policy=least-conn --health-check-interval=5s --health-check-path=/healthz --max-fails=3 3000"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:         "http://127.0.0.1:3000",
+									ProxyBackends: []string{"http://127.0.0.1:3001", "https+insecure://localhost:3002"},
+									LoadBalancing: &ipn.LoadBalancing{
+										Policy:              ipn.LoadBalanceLeastConn,
+										HealthCheckInterval: 5 * time.Second,
+										HealthCheckPath:     "/healthz",
+										MaxFails:            3,
+									},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --tcp=5432 --backend=tcp://localhost:5433 --health-check-interval=10s tcp://localhost:5432"),
+					want: &ipn.ServeConfig{
+						TCP: map[uint16]*ipn.TCPPortHandler{
+							443: {HTTPS: true},
+							5432: {
+								TCPForward:         "localhost:5432",
+								TCPForwardBackends: []string{"localhost:5433"},
+								LoadBalancing:      &ipn.LoadBalancing{HealthCheckInterval: 10 * time.Second},
+							},
+						},
+						Web: map[ipn.HostPort]*ipn.WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+								"/": {
+									Proxy:         "http://127.0.0.1:3000",
+									ProxyBackends: []string{"http://127.0.0.1:3001", "https+insecure://localhost:3002"},
+									LoadBalancing: &ipn.LoadBalancing{
+										Policy:              ipn.LoadBalanceLeastConn,
+										HealthCheckInterval: 5 * time.Second,
+										HealthCheckPath:     "/healthz",
+										MaxFails:            3,
+									},
+								},
+							}},
+						},
+					},
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --max-fails=3 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --backend=3001 --lb-policy=random 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --backend=3001 --health-check-path=/healthz 3000"),
+					wantErr: anyErr(),
+				},
+				{
+					command: cmd("serve --bg --set-path=/bad --backend=3001 text:hi"),
+					wantErr: anyErr(),
+				},
+			},
+		},
+		{
+			name: "funnel_no_access_rules",
+			steps: []step{{
+				command: cmd("funnel --bg --allow-users=alice@example.com 3000"),
+				wantErr: anyErr(),
+			}},
+		},
 		{
 			name: "handler_not_found",
 			steps: []step{{
@@ -66,6 +66,7 @@
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/netlog"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/wgengine/router"
 )
@@ -130,6 +131,7 @@ func defaultPort() uint16 {
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
 	disableLogs    bool
+	netlogSinks    string // comma-separated netlog.ParseSink specs
 }
 
 var (
@@ -173,6 +175,7 @@ func main() {
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	flag.BoolVar(&args.disableLogs, "no-logs-no-support", false, "disable log uploads; this also disables any technical support")
 	flag.StringVar(&args.confFile, "config", "", "path to config file, or 'vm:user-data' to use the VM's user-data (EC2)")
+	flag.StringVar(&args.netlogSinks, "netlog-sinks", "", `optional comma-separated local destinations for network flow logs: "file:<path>", "unix:<path>", "ipfix://<host>:<port>" or "netflow9://<host>:<port>"`)
 
 	if len(os.Args) > 0 && filepath.Base(os.Args[0]) == "tailscale" && beCLI != nil {
 		beCLI()
@@ -417,6 +420,11 @@ func run() (err error) {
 		debugMux = newDebugMux()
 	}
 
+	netLogSinks, err = netlog.ParseSinks(args.netlogSinks)
+	if err != nil {
+		return fmt.Errorf("--netlog-sinks: %w", err)
+	}
+
 	sys.Set(driveimpl.NewFileSystemForRemote(logf))
 
 	if app := envknob.App(); app != "" {
@@ -679,6 +687,9 @@ func handleSubnetsInNetstack() bool {
 
 var tstunNew = tstun.New
 
+// netLogSinks are the local network flow log sinks from --netlog-sinks.
+var netLogSinks []netlog.Sink
+
 func tryEngine(logf logger.Logf, sys *tsd.System, name string) (onlyNetstack bool, err error) {
 	conf := wgengine.Config{
 		ListenPort:    args.port,
@@ -689,6 +700,8 @@ func tryEngine(logf logger.Logf, sys *tsd.System, name string) (onlyNetstack boo
 		SetSubsystem:  sys.Set,
 		ControlKnobs:  sys.ControlKnobs(),
 		DriveForLocal: driveimpl.NewFileSystemForLocal(logf),
+
+		NetworkLogSinks: netLogSinks,
 	}
 
 	sys.HealthTracker().SetMetricsRegistry(sys.UserMetricsRegistry())
@@ -11,10 +11,13 @@
 	"context"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -22,12 +25,15 @@
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,6 +46,9 @@
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/ipn/store"
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 	"tailscale.com/types/key"
@@ -48,15 +57,26 @@
 	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
 	"tailscale.com/util/rands"
+	"tailscale.com/util/set"
 	"tailscale.com/version"
 )
 
 // ctxConn is a key to look up a net.Conn stored in an HTTP request's context.
 type ctxConn struct{}
 
-// funnelClientsFile is the file where client IDs and secrets for OIDC clients
-// accessing the IDP over Funnel are persisted.
-const funnelClientsFile = "oidc-funnel-clients.json"
+// State keys under which tsidp persists its state in its ipn.StateStore.
+const (
+	// signingKeysStateKey holds the OIDC token signing keys.
+	signingKeysStateKey ipn.StateKey = "tsidp-signing-keys"
+
+	// funnelClientsStateKey holds the client IDs and secrets for OIDC
+	// clients accessing the IDP over Funnel.
+	funnelClientsStateKey ipn.StateKey = "tsidp-funnel-clients"
+
+	// refreshTokensStateKey holds the outstanding refresh tokens, so that
+	// they survive restarts and are shared by replicas.
+	refreshTokensStateKey ipn.StateKey = "tsidp-refresh-tokens"
+)
 
 var (
 	flagVerbose            = flag.Bool("verbose", false, "be verbose")
@@ -65,6 +85,9 @@ type ctxConn struct{
 	flagUseLocalTailscaled = flag.Bool("use-local-tailscaled", false, "use local tailscaled instead of tsnet")
 	flagFunnel             = flag.Bool("funnel", false, "use Tailscale Funnel to make tsidp available on the public internet")
 	flagDir                = flag.String("dir", "", "tsnet state directory; a default one will be created if not provided")
+	flagState              = flag.String("state", "", "where to store signing keys and Funnel clients (and, in tsnet mode, node state): a file path, \"kube:<secret-name>\" or an AWS SSM ARN; if empty, files in the working directory are used")
+	flagKeyRotation        = flag.Duration("signing-key-rotation", 0, "if non-zero, how often to rotate the token signing key")
+	flagKeyGracePeriod     = flag.Duration("signing-key-grace-period", 24*time.Hour, "how long a rotated-out signing key remains published in the JWKS")
 )
 
 func main() {
@@ -83,6 +106,24 @@ func main() {
 
 		lns []net.Listener
 	)
+
+	var stateStore ipn.StateStore = legacyFileStore{}
+	if *flagState != "" {
+		stateStore, err = store.New(log.Printf, *flagState)
+		if err != nil {
+			log.Fatalf("opening state store: %v", err)
+		}
+	}
+	// Replicas sharing a kube Secret write the signing keys to it
+	// conditionally, which the caching kube store can't do itself.
+	idpStore := stateStore
+	if secretName, ok := strings.CutPrefix(*flagState, "kube:"); ok {
+		idpStore, err = newKubeStateStore(stateStore, secretName)
+		if err != nil {
+			log.Fatalf("opening state store: %v", err)
+		}
+	}
+
 	if *flagUseLocalTailscaled {
 		lc = &tailscale.LocalClient{}
 		st, err = lc.StatusWithoutPeers(ctx)
@@ -123,6 +164,9 @@ func main() {
 			Hostname: "idp",
 			Dir:      *flagDir,
 		}
+		if *flagState != "" {
+			ts.Store = stateStore
+		}
 		if *flagVerbose {
 			ts.Logf = log.Printf
 		}
@@ -150,9 +194,12 @@ func main() {
 	}
 
 	srv := &idpServer{
-		lc:          lc,
-		funnel:      *flagFunnel,
-		localTSMode: *flagUseLocalTailscaled,
+		lc:             lc,
+		funnel:         *flagFunnel,
+		localTSMode:    *flagUseLocalTailscaled,
+		stateStore:     idpStore,
+		keyRotation:    *flagKeyRotation,
+		keyGracePeriod: *flagKeyGracePeriod,
 	}
 	if *flagPort != 443 {
 		srv.serverURL = fmt.Sprintf("https://%s:%d", strings.TrimSuffix(st.Self.DNSName, "."), *flagPort)
@@ -160,14 +207,14 @@ func main() {
 		srv.serverURL = fmt.Sprintf("https://%s", strings.TrimSuffix(st.Self.DNSName, "."))
 	}
 	if *flagFunnel {
-		f, err := os.Open(funnelClientsFile)
+		b, err := stateStore.ReadState(funnelClientsStateKey)
 		if err == nil {
 			srv.funnelClients = make(map[string]*funnelClient)
-			if err := json.NewDecoder(f).Decode(&srv.funnelClients); err != nil {
-				log.Fatalf("could not parse %s: %v", funnelClientsFile, err)
+			if err := json.Unmarshal(b, &srv.funnelClients); err != nil {
+				log.Fatalf("could not parse funnel clients: %v", err)
 			}
-		} else if !errors.Is(err, os.ErrNotExist) {
-			log.Fatalf("could not open %s: %v", funnelClientsFile, err)
+		} else if !errors.Is(err, ipn.ErrStateNotExist) {
+			log.Fatalf("could not read funnel clients: %v", err)
 		}
 	}
 
@@ -183,6 +230,12 @@ func main() {
 		lns = append(lns, ln)
 	}
 
+	go func() {
+		for now := range time.Tick(tokenExpiryInterval) {
+			srv.expireTokens(now)
+		}
+	}()
+
 	for _, ln := range lns {
 		server := http.Server{
 			Handler: srv,
@@ -281,9 +334,27 @@ type idpServer struct {
 	funnel      bool
 	localTSMode bool
 
-	lazyMux        lazy.SyncValue[*http.ServeMux]
-	lazySigningKey lazy.SyncValue[*signingKey]
-	lazySigner     lazy.SyncValue[jose.Signer]
+	// stateStore persists the signing keys, funnel clients and refresh
+	// tokens.
+	stateStore ipn.StateStore
+
+	// keyRotation is how often to rotate the signing key, or zero to
+	// never rotate it. keyGracePeriod is how long a rotated-out key
+	// remains published in the JWKS, so that tokens it signed can still
+	// be verified.
+	keyRotation    time.Duration
+	keyGracePeriod time.Duration
+
+	lazyMux lazy.SyncValue[*http.ServeMux]
+
+	keyMu             sync.Mutex    // guards the fields below
+	signingKeys       []*signingKey // oldest first; the last is current; nil until loaded
+	signingKeysLoaded time.Time     // when signingKeys were last loaded
+	signer            jose.Signer   // for the current signing key; nil until needed
+
+	// refreshMu serializes updates of the refresh tokens in stateStore, so
+	// that write conflicts only come from other replicas.
+	refreshMu sync.Mutex
 
 	mu            sync.Mutex               // guards the fields below
 	code          map[string]*authRequest  // keyed by random hex
@@ -291,6 +362,20 @@ type idpServer struct {
 	funnelClients map[string]*funnelClient // keyed by client ID
 }
 
+const (
+	// codeLifetime is how long an authorization code may go unredeemed.
+	codeLifetime = 5 * time.Minute
+
+	// accessTokenLifetime is how long ID tokens and access tokens are
+	// valid.
+	accessTokenLifetime = 5 * time.Minute
+
+	// refreshTokenLifetime is how long a refresh token is valid. Refresh
+	// tokens are rotated on use, so this bounds how long a relying party
+	// may go without refreshing.
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
 type authRequest struct {
 	// localRP is true if the request is from a relying party running on the
 	// same machine as the idp server. It is mutually exclusive with rpNodeID
@@ -319,12 +404,41 @@ type authRequest struct {
 	// remoteUser is the user who is being authenticated.
 	remoteUser *apitype.WhoIsResponse
 
-	// validTill is the time until which the token is valid.
-	// As of 2023-11-14, it is 5 minutes.
-	// TODO: add routine to delete expired tokens.
+	// codeChallenge is the PKCE (RFC 7636) "code_challenge" presented in
+	// the request, if any. Only the S256 method is supported.
+	codeChallenge string
+
+	// grantID identifies the authorization grant. It's shared by the
+	// authRequests of all tokens derived from the same code, so that
+	// revoking a refresh token can revoke its access tokens too.
+	grantID string
+
+	// validTill is the time until which the code or token is valid: see
+	// codeLifetime, accessTokenLifetime and refreshTokenLifetime. Expired
+	// codes and tokens are deleted by expireTokens.
 	validTill time.Time
 }
 
+// verifyCodeVerifier checks the PKCE "code_verifier" presented when
+// redeeming the code against the code challenge in ar.
+func (ar *authRequest) verifyCodeVerifier(verifier string) error {
+	if ar.codeChallenge == "" {
+		if verifier != "" {
+			return errors.New("tsidp: code_verifier provided but no code_challenge was")
+		}
+		return nil
+	}
+	if verifier == "" {
+		return errors.New("tsidp: code_verifier is required")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	want := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(want), []byte(ar.codeChallenge)) != 1 {
+		return errors.New("tsidp: code_verifier mismatch")
+	}
+	return nil
+}
+
 // allowRelyingParty validates that a relying party identified either by a
 // known remoteAddr or a valid client ID/secret pair is allowed to proceed
 // with the authorization flow associated with this authRequest.
@@ -395,10 +509,17 @@ func (s *idpServer) authorize(w http.ResponseWriter, r *http.Request) {
 
 	code := rands.HexString(32)
 	ar := &authRequest{
-		nonce:       uq.Get("nonce"),
-		remoteUser:  who,
-		redirectURI: redirectURI,
-		clientID:    uq.Get("client_id"),
+		nonce:         uq.Get("nonce"),
+		remoteUser:    who,
+		redirectURI:   redirectURI,
+		clientID:      uq.Get("client_id"),
+		codeChallenge: uq.Get("code_challenge"),
+		grantID:       rands.HexString(16),
+		validTill:     time.Now().Add(codeLifetime),
+	}
+	if ar.codeChallenge != "" && uq.Get("code_challenge_method") != "S256" {
+		http.Error(w, "tsidp: code_challenge_method must be S256", http.StatusBadRequest)
+		return
 	}
 
 	if r.URL.Path == "/authorize/funnel" {
@@ -447,6 +568,8 @@ func (s *idpServer) newMux() *http.ServeMux {
 	mux.HandleFunc("/authorize/", s.authorize)
 	mux.HandleFunc("/userinfo", s.serveUserInfo)
 	mux.HandleFunc("/token", s.serveToken)
+	mux.HandleFunc("/revoke", s.serveRevoke)
+	mux.HandleFunc("/introspect", s.serveIntrospect)
 	mux.HandleFunc("/clients/", s.serveClients)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
@@ -487,6 +610,7 @@ func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 		s.mu.Lock()
 		delete(s.accessToken, tk)
 		s.mu.Unlock()
+		return
 	}
 
 	ui := userInfo{}
@@ -502,8 +626,20 @@ func (s *idpServer) serveUserInfo(w http.ResponseWriter, r *http.Request) {
 	// TODO(maisem): not sure if this is the right thing to do
 	ui.UserName, _, _ = strings.Cut(ar.remoteUser.UserProfile.LoginName, "@")
 
+	extraClaims, err := ar.extraClaims(true)
+	if err != nil {
+		log.Printf("Error getting extra claims: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := withExtraClaims(ui, extraClaims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(ui); err != nil {
+	if err := json.NewEncoder(w).Encode(res); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -521,10 +657,19 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if r.FormValue("grant_type") != "authorization_code" {
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		s.serveTokenAuthorizationCode(w, r)
+	case "refresh_token":
+		s.serveTokenRefresh(w, r)
+	default:
 		http.Error(w, "tsidp: grant_type not supported", http.StatusBadRequest)
-		return
 	}
+}
+
+// serveTokenAuthorizationCode serves the token endpoint for the
+// authorization_code grant, redeeming a code from authorize.
+func (s *idpServer) serveTokenAuthorizationCode(w http.ResponseWriter, r *http.Request) {
 	code := r.FormValue("code")
 	if code == "" {
 		http.Error(w, "tsidp: code is required", http.StatusBadRequest)
@@ -540,6 +685,10 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: code not found", http.StatusBadRequest)
 		return
 	}
+	if ar.validTill.Before(time.Now()) {
+		http.Error(w, "tsidp: code expired", http.StatusBadRequest)
+		return
+	}
 	if err := ar.allowRelyingParty(r, s.lc); err != nil {
 		log.Printf("Error allowing relying party: %v", err)
 		http.Error(w, err.Error(), http.StatusForbidden)
@@ -549,6 +698,97 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "tsidp: redirect_uri mismatch", http.StatusBadRequest)
 		return
 	}
+	if err := ar.verifyCodeVerifier(r.FormValue("code_verifier")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.issueTokens(w, ar)
+}
+
+// serveTokenRefresh serves the token endpoint for the refresh_token grant.
+// The presented refresh token is consumed and a new one issued.
+func (s *idpServer) serveTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	rt := r.FormValue("refresh_token")
+	if rt == "" {
+		http.Error(w, "tsidp: refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	ar, err := s.lookupRefreshToken(rt)
+	if err != nil {
+		log.Printf("Error looking up refresh token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ar == nil {
+		http.Error(w, "tsidp: invalid refresh_token", http.StatusBadRequest)
+		return
+	}
+	if err := ar.allowRelyingParty(r, s.lc); err != nil {
+		log.Printf("Error allowing relying party: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ok, err := s.deleteRefreshToken(rt)
+	if err != nil {
+		log.Printf("Error deleting refresh token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		// Lost a race with a concurrent refresh or revocation, possibly
+		// by another replica.
+		http.Error(w, "tsidp: invalid refresh_token", http.StatusBadRequest)
+		return
+	}
+	if ar.validTill.Before(time.Now()) {
+		http.Error(w, "tsidp: refresh_token expired", http.StatusBadRequest)
+		return
+	}
+	who, err := s.currentRemoteUser(r.Context(), ar)
+	if err != nil {
+		log.Printf("Error refreshing user: %v", err)
+		if errors.Is(err, errRemoteUserChanged) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	// Re-sign from the user's current identity and capabilities rather
+	// than those at authorization, which may be up to
+	// refreshTokenLifetime old.
+	fresh := *ar
+	fresh.remoteUser = who
+	s.issueTokens(w, &fresh)
+}
+
+// errRemoteUserChanged is returned by currentRemoteUser when the user node
+// of an authorization is gone or belongs to another user.
+var errRemoteUserChanged = errors.New("tsidp: user node no longer exists or changed owner")
+
+// currentRemoteUser looks up the user node being authenticated by ar again
+// and returns its current WhoIs.
+func (s *idpServer) currentRemoteUser(ctx context.Context, ar *authRequest) (*apitype.WhoIsResponse, error) {
+	old := ar.remoteUser
+	if len(old.Node.Addresses) == 0 {
+		return nil, errRemoteUserChanged
+	}
+	who, err := s.lc.WhoIs(ctx, old.Node.Addresses[0].Addr().String())
+	if errors.Is(err, tailscale.ErrPeerNotFound) {
+		return nil, errRemoteUserChanged
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tsidp: error getting WhoIs: %w", err)
+	}
+	if who.Node.ID != old.Node.ID || who.Node.User != old.Node.User || who.Node.IsTagged() {
+		return nil, errRemoteUserChanged
+	}
+	return who, nil
+}
+
+// issueTokens signs an ID token for the grant described by ar and writes
+// it to w along with a new access token and refresh token.
+func (s *idpServer) issueTokens(w http.ResponseWriter, ar *authRequest) {
 	signer, err := s.oidcSigner()
 	if err != nil {
 		log.Printf("Error getting signer: %v", err)
@@ -571,7 +811,7 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 	tsClaims := tailscaleClaims{
 		Claims: jwt.Claims{
 			Audience:  jwt.Audience{ar.clientID},
-			Expiry:    jwt.NewNumericDate(now.Add(5 * time.Minute)),
+			Expiry:    jwt.NewNumericDate(now.Add(accessTokenLifetime)),
 			ID:        jti,
 			IssuedAt:  jwt.NewNumericDate(now),
 			Issuer:    s.serverURL,
@@ -592,31 +832,199 @@ func (s *idpServer) serveToken(w http.ResponseWriter, r *http.Request) {
 		tsClaims.Issuer = s.loopbackURL
 	}
 
+	extraClaims, err := ar.extraClaims(false)
+	if err != nil {
+		log.Printf("Error getting extra claims: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Create an OIDC token using this issuer's signer.
-	token, err := jwt.Signed(signer).Claims(tsClaims).CompactSerialize()
+	token, err := jwt.Signed(signer).Claims(tsClaims).Claims(extraClaims).CompactSerialize()
 	if err != nil {
 		log.Printf("Error getting token: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Each token gets its own copy of ar, as they expire independently.
+	atReq := *ar
+	atReq.validTill = now.Add(accessTokenLifetime)
+	rtReq := *ar
+	rtReq.validTill = now.Add(refreshTokenLifetime)
+
 	at := rands.HexString(32)
+	rt := rands.HexString(32)
+	if err := s.storeRefreshToken(rt, &rtReq); err != nil {
+		log.Printf("Error storing refresh token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	s.mu.Lock()
-	ar.validTill = now.Add(5 * time.Minute)
-	mak.Set(&s.accessToken, at, ar)
+	mak.Set(&s.accessToken, at, &atReq)
 	s.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	if err := json.NewEncoder(w).Encode(oidcTokenResponse{
-		AccessToken: at,
-		TokenType:   "Bearer",
-		ExpiresIn:   5 * 60,
-		IDToken:     token,
+		AccessToken:  at,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenLifetime / time.Second),
+		IDToken:      token,
+		RefreshToken: rt,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// tokenExpiryInterval is how often expired codes and tokens are deleted.
+const tokenExpiryInterval = 5 * time.Minute
+
+// expireTokens deletes the codes and tokens that expired before now, which
+// would otherwise only be deleted when presented.
+func (s *idpServer) expireTokens(now time.Time) {
+	s.mu.Lock()
+	for _, m := range []map[string]*authRequest{s.code, s.accessToken} {
+		maps.DeleteFunc(m, func(_ string, ar *authRequest) bool {
+			return ar.validTill.Before(now)
+		})
+	}
+	s.mu.Unlock()
+
+	err := s.updateRefreshTokens(func(rts map[string]*storedRefreshToken) bool {
+		n := len(rts)
+		maps.DeleteFunc(rts, func(_ string, st *storedRefreshToken) bool {
+			return st.ValidTill.Before(now)
+		})
+		return len(rts) != n
+	})
+	if err != nil {
+		log.Printf("Error expiring refresh tokens: %v", err)
+	}
+}
+
+// lookupToken returns the authRequest for the access or refresh token tok,
+// per the RFC 7009 token_type_hint hint, which may be empty, or nil if tok
+// is neither. It reports whether tok is a refresh token.
+func (s *idpServer) lookupToken(tok, hint string) (ar *authRequest, isRefresh bool, err error) {
+	if hint != "refresh_token" {
+		s.mu.Lock()
+		ar, ok := s.accessToken[tok]
+		s.mu.Unlock()
+		if ok {
+			return ar, false, nil
+		}
+	}
+	ar, err = s.lookupRefreshToken(tok)
+	if ar != nil || err != nil || hint != "refresh_token" {
+		return ar, ar != nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accessToken[tok], false, nil
+}
+
+// serveRevoke implements the RFC 7009 token revocation endpoint. Revoking
+// a refresh token also revokes the access tokens of the same grant.
+func (s *idpServer) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tok := r.FormValue("token")
+	if tok == "" {
+		http.Error(w, "tsidp: token is required", http.StatusBadRequest)
+		return
+	}
+	ar, isRefresh, err := s.lookupToken(tok, r.FormValue("token_type_hint"))
+	if err != nil {
+		log.Printf("Error looking up token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ar == nil {
+		// Per RFC 7009 section 2.2, invalid tokens aren't an error.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := ar.allowRelyingParty(r, s.lc); err != nil {
+		log.Printf("Error allowing relying party: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if isRefresh {
+		if _, err := s.deleteRefreshToken(tok); err != nil {
+			log.Printf("Error deleting refresh token: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if isRefresh {
+		// Access tokens issued by other replicas live until they expire.
+		for at, atReq := range s.accessToken {
+			if atReq.grantID == ar.grantID {
+				delete(s.accessToken, at)
+			}
+		}
+	} else {
+		delete(s.accessToken, tok)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// introspectionResponse is the RFC 7662 token introspection response.
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	ClientID  string `json:"client_id,omitempty"`
+	UserName  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Expiry    int64  `json:"exp,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+}
+
+// serveIntrospect implements the RFC 7662 token introspection endpoint. A
+// relying party may only introspect its own tokens; other tokens are
+// reported as inactive.
+func (s *idpServer) serveIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "tsidp: method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tok := r.FormValue("token")
+	if tok == "" {
+		http.Error(w, "tsidp: token is required", http.StatusBadRequest)
+		return
+	}
+	ar, isRefresh, err := s.lookupToken(tok, r.FormValue("token_type_hint"))
+	if err != nil {
+		log.Printf("Error looking up token: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var res introspectionResponse
+	if ar != nil && ar.validTill.After(time.Now()) && ar.allowRelyingParty(r, s.lc) == nil {
+		n := ar.remoteUser.Node
+		res = introspectionResponse{
+			Active:    true,
+			ClientID:  ar.clientID,
+			TokenType: "Bearer",
+			Expiry:    ar.validTill.Unix(),
+			Subject:   n.User.String(),
+		}
+		if isRefresh {
+			res.TokenType = "refresh_token"
+		}
+		res.UserName, _, _ = strings.Cut(ar.remoteUser.UserProfile.LoginName, "@")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 type oidcTokenResponse struct {
 	IDToken      string `json:"id_token"`
 	TokenType    string `json:"token_type"`
@@ -630,45 +1038,176 @@ type oidcTokenResponse struct {
 	oidcConfigPath = "/.well-known/openid-configuration"
 )
 
+// oidcSigner returns the signer for the current signing key.
 func (s *idpServer) oidcSigner() (jose.Signer, error) {
-	return s.lazySigner.GetErr(func() (jose.Signer, error) {
-		sk, err := s.oidcPrivateKey()
-		if err != nil {
-			return nil, err
-		}
-		return jose.NewSigner(jose.SigningKey{
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if err := s.refreshSigningKeysLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	if s.signer == nil {
+		sk := s.signingKeys[len(s.signingKeys)-1]
+		signer, err := jose.NewSigner(jose.SigningKey{
 			Algorithm: jose.RS256,
 			Key:       sk.k,
 		}, &jose.SignerOptions{EmbedJWK: false, ExtraHeaders: map[jose.HeaderKey]any{
 			jose.HeaderType: "JWT",
 			"kid":           fmt.Sprint(sk.kid),
 		}})
-	})
+		if err != nil {
+			return nil, err
+		}
+		s.signer = signer
+	}
+	return s.signer, nil
 }
 
-func (s *idpServer) oidcPrivateKey() (*signingKey, error) {
-	return s.lazySigningKey.GetErr(func() (*signingKey, error) {
-		var sk signingKey
-		b, err := os.ReadFile("oidc-key.json")
-		if err == nil {
-			if err := sk.UnmarshalJSON(b); err == nil {
-				return &sk, nil
-			} else {
-				log.Printf("Error unmarshaling key: %v", err)
+// oidcSigningKeys returns the signing keys to publish in the JWKS: the
+// current key and any rotated-out keys still within their grace period.
+func (s *idpServer) oidcSigningKeys() ([]*signingKey, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if err := s.refreshSigningKeysLocked(time.Now()); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.signingKeys), nil
+}
+
+// signingKeysReloadInterval is how often the signing keys are reloaded
+// from the state store, to pick up keys rotated by other tsidp replicas
+// sharing it.
+const signingKeysReloadInterval = time.Minute
+
+// refreshSigningKeysLocked reloads the signing keys from the state store if
+// they're not loaded or are stale, generates a new key if there is none or
+// the current one is due for rotation, and drops keys whose grace period
+// has passed. Before changing the keys, it re-reads them, and it writes
+// them back only if the stored keys are unchanged, so that replicas sharing
+// the state store don't overwrite each other's keys.
+//
+// s.keyMu must be held.
+func (s *idpServer) refreshSigningKeysLocked(now time.Time) error {
+	var (
+		loaded   bool   // whether the keys were loaded by this call
+		version  string // of the loaded keys, for writeStateIfVersion
+		migrated bool   // whether the loaded keys need rewriting regardless
+	)
+	load := func() error {
+		keys, v, m, err := loadSigningKeys(s.stateStore, now)
+		if err != nil {
+			return err
+		}
+		s.setSigningKeysLocked(keys)
+		s.signingKeysLoaded = now
+		loaded, version, migrated = true, v, m
+		return nil
+	}
+	if s.signingKeys == nil || now.Sub(s.signingKeysLoaded) >= signingKeysReloadInterval {
+		if err := load(); err != nil {
+			if s.signingKeys == nil {
+				return err
+			}
+			log.Printf("Error reloading signing keys: %v", err)
+		}
+	}
+	for conflicts := 0; ; {
+		if !migrated && !s.signingKeysDueLocked(now) {
+			return nil
+		}
+		if !loaded {
+			// Another replica may have made the change already.
+			if err := load(); err != nil {
+				return err
 			}
+			continue
 		}
-		id, k := mustGenRSAKey(2048)
-		sk.k = k
-		sk.kid = id
-		b, err = sk.MarshalJSON()
+		keys := s.signingKeys
+		if len(keys) == 0 || (s.keyRotation > 0 && now.Sub(keys[len(keys)-1].created) >= s.keyRotation) {
+			id, k := mustGenRSAKey(2048)
+			keys = append(slices.Clip(keys), &signingKey{k: k, kid: id, created: now})
+			if len(keys) > 1 {
+				log.Printf("Rotated signing key; new key ID %d", id)
+			}
+		}
+		// A key is retired when its successor is created.
+		for len(keys) > 1 && now.Sub(keys[1].created) >= s.keyGracePeriod {
+			keys = keys[1:]
+		}
+		b, err := json.Marshal(signingKeysJSON{Keys: keys})
 		if err != nil {
-			log.Fatalf("Error marshaling key: %v", err)
+			return err
 		}
-		if err := os.WriteFile("oidc-key.json", b, 0600); err != nil {
-			log.Fatalf("Error writing key: %v", err)
+		err = writeStateIfVersion(s.stateStore, signingKeysStateKey, b, version)
+		if err == nil {
+			s.setSigningKeysLocked(keys)
+			return nil
 		}
-		return &sk, nil
-	})
+		if !errors.Is(err, errStateConflict) || conflicts == 2 {
+			return fmt.Errorf("writing signing keys: %w", err)
+		}
+		conflicts++
+		loaded = false
+	}
+}
+
+// signingKeysDueLocked reports whether a signing key is due to be created
+// or retired.
+//
+// s.keyMu must be held.
+func (s *idpServer) signingKeysDueLocked(now time.Time) bool {
+	keys := s.signingKeys
+	return len(keys) == 0 ||
+		(s.keyRotation > 0 && now.Sub(keys[len(keys)-1].created) >= s.keyRotation) ||
+		(len(keys) > 1 && now.Sub(keys[1].created) >= s.keyGracePeriod)
+}
+
+// setSigningKeysLocked sets the signing keys, resetting the signer if the
+// current key changed.
+//
+// s.keyMu must be held.
+func (s *idpServer) setSigningKeysLocked(keys []*signingKey) {
+	if len(keys) == 0 || len(s.signingKeys) == 0 || keys[len(keys)-1].kid != s.signingKeys[len(s.signingKeys)-1].kid {
+		s.signer = nil
+	}
+	s.signingKeys = keys
+}
+
+// loadSigningKeys reads the signing keys from st, along with their version
+// for use with writeStateIfVersion. If there are none, or they can't be
+// parsed, it returns an empty, non-nil slice. It reports whether the keys
+// were migrated from an older format and so should be written back.
+func loadSigningKeys(st ipn.StateStore, now time.Time) (keys []*signingKey, version string, migrated bool, err error) {
+	b, version, err := readStateVersion(st, signingKeysStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return []*signingKey{}, version, false, nil
+	}
+	if err != nil {
+		return nil, "", false, fmt.Errorf("reading signing keys: %w", err)
+	}
+	var sks signingKeysJSON
+	if err := json.Unmarshal(b, &sks); err != nil {
+		log.Printf("Error unmarshaling keys: %v", err)
+		return []*signingKey{}, version, false, nil
+	}
+	keys = sks.Keys
+	if len(keys) == 0 {
+		// Previously, a single key was stored.
+		var sk signingKey
+		if err := sk.UnmarshalJSON(b); err != nil || sk.k == nil {
+			log.Printf("Error unmarshaling key: %v", err)
+			return []*signingKey{}, version, false, nil
+		}
+		keys = []*signingKey{&sk}
+	}
+	for _, sk := range keys {
+		if sk.created.IsZero() {
+			// Keys from before rotation support have no creation
+			// time; count from when we first saw them.
+			sk.created = now
+			migrated = true
+		}
+	}
+	return keys, version, migrated, nil
 }
 
 func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
@@ -677,25 +1216,24 @@ func (s *idpServer) serveJWKS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	sk, err := s.oidcPrivateKey()
+	sks, err := s.oidcSigningKeys()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// TODO(maisem): maybe only marshal this once and reuse?
-	// TODO(maisem): implement key rotation.
+	var jwks jose.JSONWebKeySet
+	for _, sk := range sks {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{
+			Key:       sk.k.Public(),
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+			KeyID:     fmt.Sprint(sk.kid),
+		})
+	}
 	je := json.NewEncoder(w)
 	je.SetIndent("", "  ")
-	if err := je.Encode(jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{
-			{
-				Key:       sk.k.Public(),
-				Algorithm: string(jose.RS256),
-				Use:       "sig",
-				KeyID:     fmt.Sprint(sk.kid),
-			},
-		},
-	}); err != nil {
+	if err := je.Encode(jwks); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	return
@@ -714,6 +1252,10 @@ type openIDProviderMetadata struct {
 	SubjectTypesSupported            views.Slice[string] `json:"subject_types_supported"`
 	ClaimsSupported                  views.Slice[string] `json:"claims_supported"`
 	IDTokenSigningAlgValuesSupported views.Slice[string] `json:"id_token_signing_alg_values_supported"`
+	GrantTypesSupported              views.Slice[string] `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported    views.Slice[string] `json:"code_challenge_methods_supported,omitempty"`
+	RevocationEndpoint               string              `json:"revocation_endpoint,omitempty"`
+	IntrospectionEndpoint            string              `json:"introspection_endpoint,omitempty"`
 	// TODO(maisem): maybe add other fields?
 	// Currently we fill out the REQUIRED fields, scopes_supported and claims_supported.
 }
@@ -737,6 +1279,108 @@ type tailscaleClaims struct {
 	UserName string `json:"username,omitempty"`
 }
 
+// capRule is a rule in the tailcfg.PeerCapabilityTsIDP capability granted
+// to the user being authenticated, defining extra claims for them.
+//
+// For example, this grant gives members of group:eng a "groups" claim in
+// tokens issued to the relying party with client ID "grafana":
+//
+//	{
+//		"src": ["group:eng"],
+//		"dst": ["tag:tsidp"],
+//		"app": {
+//			"tailscale.com/cap/tsidp": [{
+//				"clients": ["grafana"],
+//				"extraClaims": {"groups": ["eng"]},
+//			}],
+//		},
+//	}
+type capRule struct {
+	// Clients are the client IDs of the relying parties that receive
+	// ExtraClaims. If empty or containing "*", all relying parties do.
+	Clients []string `json:"clients,omitempty"`
+
+	// ExtraClaims are the claims to add. Claims set by tsidp itself (see
+	// openIDSupportedClaims) can't be overridden.
+	ExtraClaims map[string]any `json:"extraClaims,omitempty"`
+
+	// IncludeInUserInfo is whether ExtraClaims are also returned by the
+	// userinfo endpoint.
+	IncludeInUserInfo bool `json:"includeInUserInfo,omitempty"`
+}
+
+// appliesTo reports whether r applies to the relying party with the
+// provided client ID.
+func (r *capRule) appliesTo(clientID string) bool {
+	return len(r.Clients) == 0 || slices.Contains(r.Clients, "*") || slices.Contains(r.Clients, clientID)
+}
+
+// extraClaims returns the extra claims granted to ar's user for ar's relying
+// party by the tailcfg.PeerCapabilityTsIDP capability, or just those to be
+// included in the userinfo response if forUserInfo is set.
+//
+// Claims from multiple rules are merged: array values are concatenated,
+// and other values must be equal.
+func (ar *authRequest) extraClaims(forUserInfo bool) (map[string]any, error) {
+	rules, err := tailcfg.UnmarshalCapJSON[capRule](ar.remoteUser.CapMap, tailcfg.PeerCapabilityTsIDP)
+	if err != nil {
+		return nil, fmt.Errorf("tsidp: invalid %s capability: %w", tailcfg.PeerCapabilityTsIDP, err)
+	}
+	claims := map[string]any{}
+	for _, r := range rules {
+		if !r.appliesTo(ar.clientID) || (forUserInfo && !r.IncludeInUserInfo) {
+			continue
+		}
+		for k, v := range r.ExtraClaims {
+			if reservedClaims.Contains(k) {
+				log.Printf("ignoring extra claim %q: reserved", k)
+				continue
+			}
+			old, ok := claims[k]
+			if !ok {
+				claims[k] = v
+				continue
+			}
+			oldSlice, ok1 := old.([]any)
+			newSlice, ok2 := v.([]any)
+			switch {
+			case ok1 && ok2:
+				for _, e := range newSlice {
+					if !slices.ContainsFunc(oldSlice, func(o any) bool { return reflect.DeepEqual(o, e) }) {
+						oldSlice = append(oldSlice, e)
+					}
+				}
+				claims[k] = oldSlice
+			case !reflect.DeepEqual(old, v):
+				return nil, fmt.Errorf("tsidp: conflicting values for claim %q", k)
+			}
+		}
+	}
+	return claims, nil
+}
+
+// withExtraClaims returns the JSON object v with extraClaims added. Keys
+// already in v aren't replaced.
+func withExtraClaims(v any, extraClaims map[string]any) (any, error) {
+	if len(extraClaims) == 0 {
+		return v, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range extraClaims {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
 var (
 	openIDSupportedClaims = views.SliceOf([]string{
 		// Standard claims, these correspond to fields in jwt.Claims.
@@ -759,6 +1403,15 @@ type tailscaleClaims struct {
 	// The algo used for signing. The OpenID spec says "The algorithm RS256 MUST be included."
 	// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
 	openIDSupportedSigningAlgos = views.SliceOf([]string{string(jose.RS256)})
+
+	// reservedClaims are the claims that capRule.ExtraClaims can't set.
+	reservedClaims = set.SetOf(append(openIDSupportedClaims.AsSlice(), "nonce", "name", "picture"))
+
+	openIDSupportedGrantTypes = views.SliceOf([]string{"authorization_code", "refresh_token"})
+
+	// PKCE (RFC 7636) code challenge methods. "plain" is deliberately
+	// not supported.
+	openIDSupportedCodeChallengeMethods = views.SliceOf([]string{"S256"})
 )
 
 func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
@@ -800,6 +1453,10 @@ func (s *idpServer) serveOpenIDConfig(w http.ResponseWriter, r *http.Request) {
 		SubjectTypesSupported:            openIDSupportedSubjectTypes,
 		ClaimsSupported:                  openIDSupportedClaims,
 		IDTokenSigningAlgValuesSupported: openIDSupportedSigningAlgos,
+		GrantTypesSupported:              openIDSupportedGrantTypes,
+		CodeChallengeMethodsSupported:    openIDSupportedCodeChallengeMethods,
+		RevocationEndpoint:               rpEndpoint + "/revoke",
+		IntrospectionEndpoint:            rpEndpoint + "/introspect",
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -944,7 +1601,313 @@ func (s *idpServer) storeFunnelClientsLocked() error {
 	if err := json.NewEncoder(&buf).Encode(s.funnelClients); err != nil {
 		return err
 	}
-	return os.WriteFile(funnelClientsFile, buf.Bytes(), 0600)
+	return s.stateStore.WriteState(funnelClientsStateKey, buf.Bytes())
+}
+
+// storedRefreshToken is the authRequest of a refresh token, as persisted
+// in the state store.
+type storedRefreshToken struct {
+	LocalRP        bool                   `json:"localRP,omitempty"`
+	RPNodeID       tailcfg.NodeID         `json:"rpNodeID,omitempty"`
+	FunnelClientID string                 `json:"funnelClientID,omitempty"`
+	ClientID       string                 `json:"clientID"`
+	Nonce          string                 `json:"nonce,omitempty"`
+	RedirectURI    string                 `json:"redirectURI"`
+	RemoteUser     *apitype.WhoIsResponse `json:"remoteUser"`
+	GrantID        string                 `json:"grantID"`
+	ValidTill      time.Time              `json:"validTill"`
+}
+
+// refreshTokenID returns the key under which refresh token rt is stored,
+// so that the state store doesn't hold usable tokens.
+func refreshTokenID(rt string) string {
+	sum := sha256.Sum256([]byte(rt))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadRefreshTokens reads the refresh tokens from st, keyed by
+// refreshTokenID, along with their version for use with
+// writeStateIfVersion.
+func loadRefreshTokens(st ipn.StateStore) (map[string]*storedRefreshToken, string, error) {
+	rts := make(map[string]*storedRefreshToken)
+	b, version, err := readStateVersion(st, refreshTokensStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return rts, version, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("reading refresh tokens: %w", err)
+	}
+	if err := json.Unmarshal(b, &rts); err != nil {
+		return nil, "", fmt.Errorf("reading refresh tokens: %w", err)
+	}
+	return rts, version, nil
+}
+
+// updateRefreshTokens calls f with the stored refresh tokens and, if f
+// reports that it changed them, writes them back, provided no other
+// replica changed them in the meantime. Otherwise it tries again.
+func (s *idpServer) updateRefreshTokens(f func(map[string]*storedRefreshToken) bool) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	for conflicts := 0; ; conflicts++ {
+		rts, version, err := loadRefreshTokens(s.stateStore)
+		if err != nil {
+			return err
+		}
+		if !f(rts) {
+			return nil
+		}
+		b, err := json.Marshal(rts)
+		if err != nil {
+			return err
+		}
+		err = writeStateIfVersion(s.stateStore, refreshTokensStateKey, b, version)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errStateConflict) || conflicts == 2 {
+			return fmt.Errorf("writing refresh tokens: %w", err)
+		}
+	}
+}
+
+// storeRefreshToken stores the refresh token rt for ar.
+func (s *idpServer) storeRefreshToken(rt string, ar *authRequest) error {
+	st := &storedRefreshToken{
+		LocalRP:     ar.localRP,
+		RPNodeID:    ar.rpNodeID,
+		ClientID:    ar.clientID,
+		Nonce:       ar.nonce,
+		RedirectURI: ar.redirectURI,
+		RemoteUser:  ar.remoteUser,
+		GrantID:     ar.grantID,
+		ValidTill:   ar.validTill,
+	}
+	if ar.funnelRP != nil {
+		st.FunnelClientID = ar.funnelRP.ID
+	}
+	id := refreshTokenID(rt)
+	return s.updateRefreshTokens(func(rts map[string]*storedRefreshToken) bool {
+		rts[id] = st
+		return true
+	})
+}
+
+// lookupRefreshToken returns the authRequest for the refresh token rt, or
+// nil if there is no such token or it was issued to a funnel client that
+// has since been deleted.
+func (s *idpServer) lookupRefreshToken(rt string) (*authRequest, error) {
+	rts, _, err := loadRefreshTokens(s.stateStore)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := rts[refreshTokenID(rt)]
+	if !ok {
+		return nil, nil
+	}
+	ar := &authRequest{
+		localRP:     st.LocalRP,
+		rpNodeID:    st.RPNodeID,
+		clientID:    st.ClientID,
+		nonce:       st.Nonce,
+		redirectURI: st.RedirectURI,
+		remoteUser:  st.RemoteUser,
+		grantID:     st.GrantID,
+		validTill:   st.ValidTill,
+	}
+	if st.FunnelClientID != "" {
+		s.mu.Lock()
+		ar.funnelRP = s.funnelClients[st.FunnelClientID]
+		s.mu.Unlock()
+		if ar.funnelRP == nil {
+			return nil, nil
+		}
+	}
+	return ar, nil
+}
+
+// deleteRefreshToken deletes the refresh token rt, reporting whether it
+// existed.
+func (s *idpServer) deleteRefreshToken(rt string) (deleted bool, err error) {
+	id := refreshTokenID(rt)
+	err = s.updateRefreshTokens(func(rts map[string]*storedRefreshToken) bool {
+		_, deleted = rts[id]
+		delete(rts, id)
+		return deleted
+	})
+	return deleted, err
+}
+
+// legacyFileStore is an ipn.StateStore keeping each of tsidp's state keys
+// in its own file in the working directory, where tsidp kept its state
+// before it supported other stores.
+type legacyFileStore struct{}
+
+// legacyStateFiles maps tsidp's state keys to the files used by
+// legacyFileStore.
+var legacyStateFiles = map[ipn.StateKey]string{
+	signingKeysStateKey:   "oidc-key.json",
+	funnelClientsStateKey: "oidc-funnel-clients.json",
+	refreshTokensStateKey: "oidc-refresh-tokens.json",
+}
+
+func (legacyFileStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	name, ok := legacyStateFiles[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ipn.ErrStateNotExist
+	}
+	return b, err
+}
+
+func (legacyFileStore) WriteState(id ipn.StateKey, bs []byte) error {
+	name, ok := legacyStateFiles[id]
+	if !ok {
+		return fmt.Errorf("unknown state key %q", id)
+	}
+	return os.WriteFile(name, bs, 0600)
+}
+
+// errStateConflict is returned by writeStateIfVersion when the state
+// changed since it was read.
+var errStateConflict = errors.New("state modified concurrently")
+
+// versionedStateStore is an optional interface for ipn.StateStores that
+// support conditional writes, so that tsidp replicas sharing the store
+// don't overwrite each other's changes.
+type versionedStateStore interface {
+	// readStateVersion is like ReadState, but reads the backing storage
+	// rather than any cache, and also returns an opaque version for use
+	// with writeStateIfVersion. If id has no state, it returns
+	// ipn.ErrStateNotExist along with the version to create it at.
+	readStateVersion(id ipn.StateKey) (bs []byte, version string, err error)
+
+	// writeStateIfVersion is like WriteState, but returns
+	// errStateConflict if the state isn't at version.
+	writeStateIfVersion(id ipn.StateKey, bs []byte, version string) error
+}
+
+// readStateVersion reads the state for id from st, along with its version
+// for use with writeStateIfVersion.
+func readStateVersion(st ipn.StateStore, id ipn.StateKey) ([]byte, string, error) {
+	if vs, ok := st.(versionedStateStore); ok {
+		return vs.readStateVersion(id)
+	}
+	b, err := st.ReadState(id)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(b)
+	return b, hex.EncodeToString(sum[:]), nil
+}
+
+// writeStateIfVersion writes bs as the state for id in st, provided it's
+// still at version, as returned by readStateVersion. Otherwise, it returns
+// errStateConflict.
+//
+// Unless st is a versionedStateStore, the check is best-effort: a
+// concurrent write between the check and the write goes undetected.
+func writeStateIfVersion(st ipn.StateStore, id ipn.StateKey, bs []byte, version string) error {
+	if vs, ok := st.(versionedStateStore); ok {
+		return vs.writeStateIfVersion(id, bs, version)
+	}
+	_, cur, err := readStateVersion(st, id)
+	if err != nil && !errors.Is(err, ipn.ErrStateNotExist) {
+		return err
+	}
+	if cur != version {
+		return errStateConflict
+	}
+	return st.WriteState(id, bs)
+}
+
+// kubeStateStore wraps the ipn.StateStore for a Kubernetes Secret, which
+// caches the Secret's contents, to implement versionedStateStore by
+// accessing the Secret directly and using its resourceVersion.
+//
+// tsidp's state keys are valid Secret keys as is, so are stored under the
+// same keys as the wrapped store uses.
+type kubeStateStore struct {
+	ipn.StateStore
+	client     kubeclient.Client
+	secretName string
+}
+
+// newKubeStateStore returns a kubeStateStore wrapping st, which must be
+// the store for the named Secret.
+func newKubeStateStore(st ipn.StateStore, secretName string) (*kubeStateStore, error) {
+	c, err := kubeclient.New("tsidp")
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv("TS_KUBERNETES_READ_API_SERVER_ADDRESS_FROM_ENV") == "true" {
+		c.SetURL(fmt.Sprintf("https://%s:%s", os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT_HTTPS")))
+	}
+	return &kubeStateStore{StateStore: st, client: c, secretName: secretName}, nil
+}
+
+const kubeStateStoreTimeout = 10 * time.Second
+
+func (s *kubeStateStore) readStateVersion(id ipn.StateKey) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeStateStoreTimeout)
+	defer cancel()
+	secret, err := s.client.GetSecret(ctx, s.secretName)
+	if kubeclient.IsNotFoundErr(err) {
+		return nil, "", ipn.ErrStateNotExist
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	b, ok := secret.Data[string(id)]
+	if !ok {
+		return nil, secret.ResourceVersion, ipn.ErrStateNotExist
+	}
+	return b, secret.ResourceVersion, nil
+}
+
+func (s *kubeStateStore) writeStateIfVersion(id ipn.StateKey, bs []byte, version string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeStateStoreTimeout)
+	defer cancel()
+	if version == "" {
+		// The Secret didn't exist when read.
+		err := s.client.CreateSecret(ctx, &kubeapi.Secret{
+			TypeMeta: kubeapi.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "Secret",
+			},
+			ObjectMeta: kubeapi.ObjectMeta{
+				Name: s.secretName,
+			},
+			Data: map[string][]byte{string(id): bs},
+		})
+		if isKubeConflict(err) {
+			return errStateConflict
+		}
+		return err
+	}
+	secret, err := s.client.GetSecret(ctx, s.secretName)
+	if err != nil {
+		return err
+	}
+	if secret.ResourceVersion != version {
+		return errStateConflict
+	}
+	mak.Set(&secret.Data, string(id), bs)
+	err = s.client.UpdateSecret(ctx, secret)
+	if isKubeConflict(err) {
+		return errStateConflict
+	}
+	return err
+}
+
+// isKubeConflict reports whether err is a Kubernetes API conflict, as
+// returned for a stale resourceVersion or an existing object.
+func isKubeConflict(err error) bool {
+	var st *kubeapi.Status
+	return errors.As(err, &st) && st.Code == 409
 }
 
 const (
@@ -978,13 +1941,21 @@ func readUint64(r io.Reader) (uint64, error) {
 // rsaPrivateKeyJSONWrapper is the the JSON serialization
 // format used by RSAPrivateKey.
 type rsaPrivateKeyJSONWrapper struct {
-	Key string
-	ID  uint64
+	Key     string
+	ID      uint64
+	Created time.Time
+}
+
+// signingKeysJSON is the JSON serialization format of the signing keys
+// in the state store.
+type signingKeysJSON struct {
+	Keys []*signingKey `json:",omitempty"` // oldest first
 }
 
 type signingKey struct {
-	k   *rsa.PrivateKey
-	kid uint64
+	k       *rsa.PrivateKey
+	kid     uint64
+	created time.Time
 }
 
 func (sk *signingKey) MarshalJSON() ([]byte, error) {
@@ -994,8 +1965,9 @@ func (sk *signingKey) MarshalJSON() ([]byte, error) {
 	}
 	bts := pem.EncodeToMemory(&b)
 	return json.Marshal(rsaPrivateKeyJSONWrapper{
-		Key: base64.URLEncoding.EncodeToString(bts),
-		ID:  sk.kid,
+		Key:     base64.URLEncoding.EncodeToString(bts),
+		ID:      sk.kid,
+		Created: sk.created,
 	})
 }
 
@@ -1018,6 +1990,7 @@ func (sk *signingKey) UnmarshalJSON(b []byte) error {
 	}
 	sk.k = k
 	sk.kid = wrapper.ID
+	sk.created = wrapper.Created
 	return nil
 }
 
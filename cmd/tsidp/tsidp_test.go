@@ -0,0 +1,844 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+	"tailscale.com/net/memnet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+const (
+	testUserAddr = "100.64.0.1:1234" // the user being authenticated
+	testRPAddr   = "100.64.0.2:5678" // the relying party
+)
+
+// newTestServer returns an idpServer whose LocalClient talks to a fake
+// LocalAPI serving WhoIs for testUserAddr and testRPAddr.
+func newTestServer(t *testing.T) *idpServer {
+	t.Helper()
+	s, _ := newTestServerWhoIs(t)
+	return s
+}
+
+// testWhoIs is the fake LocalAPI's WhoIs data, which tests may change.
+type testWhoIs struct {
+	mu  sync.Mutex
+	res map[string]*apitype.WhoIsResponse // keyed by IP:port
+}
+
+// lookup returns the WhoIs response for addr, an IP:port or a node's IP.
+func (tw *testWhoIs) lookup(addr string) (*apitype.WhoIsResponse, bool) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if who, ok := tw.res[addr]; ok {
+		return who, true
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, false
+	}
+	for _, who := range tw.res {
+		if slices.Contains(who.Node.Addresses, netip.PrefixFrom(ip, ip.BitLen())) {
+			return who, true
+		}
+	}
+	return nil, false
+}
+
+// set sets the WhoIs response for addr, deleting it if who is nil.
+func (tw *testWhoIs) set(addr string, who *apitype.WhoIsResponse) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if who == nil {
+		delete(tw.res, addr)
+	} else {
+		tw.res[addr] = who
+	}
+}
+
+// newTestServerWhoIs is like newTestServer, but also returns the fake
+// LocalAPI's WhoIs data.
+func newTestServerWhoIs(t *testing.T) (*idpServer, *testWhoIs) {
+	t.Helper()
+	tw := &testWhoIs{res: map[string]*apitype.WhoIsResponse{
+		testUserAddr: {
+			Node: &tailcfg.Node{
+				ID:        1,
+				Name:      "laptop.tail-scale.ts.net.",
+				User:      100,
+				Key:       key.NewNode().Public(),
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			},
+			UserProfile: &tailcfg.UserProfile{ID: 100, LoginName: "alice@example.com"},
+			CapMap: tailcfg.PeerCapMap{
+				tailcfg.PeerCapabilityTsIDP: []tailcfg.RawMessage{
+					`{"extraClaims":{"groups":["eng"],"sub":"mallory"}}`,
+					`{"clients":["rp"],"extraClaims":{"groups":["ops","eng"],"roles":{"admin":true}},"includeInUserInfo":true}`,
+					`{"clients":["other"],"extraClaims":{"groups":["secret"]}}`,
+				},
+			},
+		},
+		testRPAddr: {
+			Node: &tailcfg.Node{
+				ID:        2,
+				Name:      "rp.tail-scale.ts.net.",
+				User:      200,
+				Key:       key.NewNode().Public(),
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+			},
+			UserProfile: &tailcfg.UserProfile{ID: 200, LoginName: "bob@example.com"},
+		},
+	}}
+	lal := memnet.Listen("local-tailscaled.sock:80")
+	localapi := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/whois" {
+			t.Errorf("unexpected LocalAPI call %q", r.URL.Path)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		who, ok := tw.lookup(r.URL.Query().Get("addr"))
+		if !ok {
+			http.Error(w, "not a node", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(who)
+	})}
+	go localapi.Serve(lal)
+	t.Cleanup(func() {
+		localapi.Close()
+		lal.Close()
+	})
+	return &idpServer{
+		lc:          &tailscale.LocalClient{Dial: lal.Dial},
+		serverURL:   "https://idp.tail-scale.ts.net",
+		loopbackURL: "http://localhost:443",
+		stateStore:  new(mem.Store),
+	}, tw
+}
+
+// do serves a request for target from remoteAddr, with form as the POST
+// body if non-nil.
+func do(s *idpServer, method, target, remoteAddr string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+const testRedirectURI = "https://rp.tail-scale.ts.net/callback"
+
+// authorize runs the authorization endpoint as the test user on behalf of
+// the test relying party and returns the code.
+func authorize(t *testing.T, s *idpServer, codeChallenge string) string {
+	t.Helper()
+	q := url.Values{
+		"redirect_uri": {testRedirectURI},
+		"client_id":    {"rp"},
+	}
+	if codeChallenge != "" {
+		q.Set("code_challenge", codeChallenge)
+		q.Set("code_challenge_method", "S256")
+	}
+	w := do(s, "GET", "/authorize/2?"+q.Encode(), testUserAddr, nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("authorize: %v %s", w.Code, w.Body.String())
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := u.Query().Get("code")
+	if code == "" {
+		t.Fatalf("no code in redirect %q", u)
+	}
+	return code
+}
+
+func tokenResponse(t *testing.T, w *httptest.ResponseRecorder) oidcTokenResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("token: %v %s", w.Code, w.Body.String())
+	}
+	var res oidcTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.IDToken == "" || res.AccessToken == "" || res.RefreshToken == "" {
+		t.Fatalf("incomplete token response: %+v", res)
+	}
+	return res
+}
+
+func TestPKCE(t *testing.T) {
+	s := newTestServer(t)
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	redeem := func(code, verifier string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {testRedirectURI},
+		}
+		if verifier != "" {
+			form.Set("code_verifier", verifier)
+		}
+		return do(s, "POST", "/token", testRPAddr, form)
+	}
+
+	if w := redeem(authorize(t, s, challenge), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("missing verifier: got %v; want 400", w.Code)
+	}
+	if w := redeem(authorize(t, s, challenge), "wrong"); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong verifier: got %v; want 400", w.Code)
+	}
+	if w := redeem(authorize(t, s, ""), verifier); w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected verifier: got %v; want 400", w.Code)
+	}
+	tokenResponse(t, redeem(authorize(t, s, challenge), verifier))
+	tokenResponse(t, redeem(authorize(t, s, ""), ""))
+
+	q := url.Values{
+		"redirect_uri":          {testRedirectURI},
+		"code_challenge":        {verifier},
+		"code_challenge_method": {"plain"},
+	}
+	if w := do(s, "GET", "/authorize/2?"+q.Encode(), testUserAddr, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("plain challenge: got %v; want 400", w.Code)
+	}
+}
+
+func TestRefreshRevokeIntrospect(t *testing.T) {
+	s := newTestServer(t)
+	tok := tokenResponse(t, do(s, "POST", "/token", testRPAddr, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorize(t, s, "")},
+		"redirect_uri": {testRedirectURI},
+	}))
+
+	introspect := func(tok, from string) introspectionResponse {
+		t.Helper()
+		w := do(s, "POST", "/introspect", from, url.Values{"token": {tok}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("introspect: %v %s", w.Code, w.Body.String())
+		}
+		var res introspectionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	refresh := func(rt string) *httptest.ResponseRecorder {
+		return do(s, "POST", "/token", testRPAddr, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {rt},
+		})
+	}
+
+	if res := introspect(tok.AccessToken, testRPAddr); !res.Active || res.TokenType != "Bearer" || res.UserName != "alice" || res.ClientID != "rp" {
+		t.Errorf("introspect access token = %+v", res)
+	}
+	if res := introspect(tok.RefreshToken, testRPAddr); !res.Active || res.TokenType != "refresh_token" {
+		t.Errorf("introspect refresh token = %+v", res)
+	}
+	if res := introspect(tok.AccessToken, testUserAddr); res.Active {
+		t.Errorf("introspect by other node = %+v; want inactive", res)
+	}
+	if res := introspect("bogus", testRPAddr); res.Active {
+		t.Errorf("introspect bogus = %+v; want inactive", res)
+	}
+
+	// Refreshing rotates the refresh token.
+	tok2 := tokenResponse(t, refresh(tok.RefreshToken))
+	if w := refresh(tok.RefreshToken); w.Code != http.StatusBadRequest {
+		t.Errorf("reused refresh token: got %v; want 400", w.Code)
+	}
+	if w := do(s, "POST", "/token", testUserAddr, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tok2.RefreshToken},
+	}); w.Code != http.StatusForbidden {
+		t.Errorf("refresh by other node: got %v; want 403", w.Code)
+	}
+
+	userInfo := func(at string) int {
+		r := httptest.NewRequest("GET", "/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+at)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := userInfo(tok2.AccessToken); code != http.StatusOK {
+		t.Errorf("userinfo: got %v; want 200", code)
+	}
+
+	// Revoking the refresh token revokes the grant's access tokens.
+	if w := do(s, "POST", "/revoke", testUserAddr, url.Values{"token": {tok2.RefreshToken}}); w.Code != http.StatusForbidden {
+		t.Errorf("revoke by other node: got %v; want 403", w.Code)
+	}
+	if w := do(s, "POST", "/revoke", testRPAddr, url.Values{"token": {tok2.RefreshToken}, "token_type_hint": {"refresh_token"}}); w.Code != http.StatusOK {
+		t.Errorf("revoke: got %v; want 200", w.Code)
+	}
+	for _, at := range []string{tok.AccessToken, tok2.AccessToken} {
+		if res := introspect(at, testRPAddr); res.Active {
+			t.Errorf("access token active after revocation: %+v", res)
+		}
+		if code := userInfo(at); code != http.StatusBadRequest {
+			t.Errorf("userinfo after revocation: got %v; want 400", code)
+		}
+	}
+	if w := refresh(tok2.RefreshToken); w.Code != http.StatusBadRequest {
+		t.Errorf("revoked refresh token: got %v; want 400", w.Code)
+	}
+	if w := do(s, "POST", "/revoke", testRPAddr, url.Values{"token": {"bogus"}}); w.Code != http.StatusOK {
+		t.Errorf("revoke bogus: got %v; want 200", w.Code)
+	}
+}
+
+func TestOpenIDConfig(t *testing.T) {
+	s := newTestServer(t)
+	w := do(s, "GET", oidcConfigPath, testRPAddr, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v %s", w.Code, w.Body.String())
+	}
+	type metadata struct {
+		AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+		GrantTypesSupported           []string `json:"grant_types_supported"`
+		CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+		RevocationEndpoint            string   `json:"revocation_endpoint"`
+		IntrospectionEndpoint         string   `json:"introspection_endpoint"`
+	}
+	var got metadata
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := metadata{
+		AuthorizationEndpoint:         s.serverURL + "/authorize/2",
+		GrantTypesSupported:           []string{"authorization_code", "refresh_token"},
+		CodeChallengeMethodsSupported: []string{"S256"},
+		RevocationEndpoint:            s.serverURL + "/revoke",
+		IntrospectionEndpoint:         s.serverURL + "/introspect",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("metadata mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExtraClaims(t *testing.T) {
+	s := newTestServer(t)
+	tok := tokenResponse(t, do(s, "POST", "/token", testRPAddr, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorize(t, s, "")},
+		"redirect_uri": {testRedirectURI},
+	}))
+	idt, err := jwt.ParseSigned(tok.IDToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]any
+	if err := idt.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := claims["groups"], []any{"eng", "ops"}; !cmp.Equal(got, want) {
+		t.Errorf("groups = %v; want %v", got, want)
+	}
+	if got, want := claims["roles"], map[string]any{"admin": true}; !cmp.Equal(got, want) {
+		t.Errorf("roles = %v; want %v", got, want)
+	}
+	if got, want := claims["sub"], "userid:64"; got != want {
+		t.Errorf("sub = %v; want %v", got, want)
+	}
+
+	r := httptest.NewRequest("GET", "/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var ui map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &ui); err != nil {
+		t.Fatalf("userinfo: %v: %s", err, w.Body.String())
+	}
+	// Only the rule with includeInUserInfo applies.
+	if got, want := ui["groups"], []any{"ops", "eng"}; !cmp.Equal(got, want) {
+		t.Errorf("userinfo groups = %v; want %v", got, want)
+	}
+	if got, want := ui["username"], "alice"; got != want {
+		t.Errorf("userinfo username = %v; want %v", got, want)
+	}
+}
+
+// currentKID returns the ID of s's current signing key.
+func currentKID(t *testing.T, s *idpServer) uint64 {
+	t.Helper()
+	keys := s.signingKeys
+	if len(keys) == 0 {
+		t.Fatal("no signing keys")
+	}
+	return keys[len(keys)-1].kid
+}
+
+// storedKIDs returns the IDs of the signing keys in st.
+func storedKIDs(t *testing.T, st ipn.StateStore) []uint64 {
+	t.Helper()
+	keys, _, _, err := loadSigningKeys(st, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, k := range keys {
+		ids = append(ids, k.kid)
+	}
+	return ids
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	st := new(mem.Store)
+	s := &idpServer{stateStore: st, keyRotation: time.Hour, keyGracePeriod: 30 * time.Minute}
+	refresh := func(now time.Time) {
+		t.Helper()
+		if err := s.refreshSigningKeysLocked(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t0 := time.Now()
+
+	refresh(t0)
+	k1 := currentKID(t, s)
+	refresh(t0.Add(59 * time.Minute))
+	if got := currentKID(t, s); got != k1 {
+		t.Fatalf("key rotated before due")
+	}
+
+	refresh(t0.Add(time.Hour))
+	k2 := currentKID(t, s)
+	if k2 == k1 {
+		t.Fatal("key not rotated when due")
+	}
+	if got, want := storedKIDs(t, st), []uint64{k1, k2}; !slices.Equal(got, want) {
+		t.Fatalf("after rotation, stored %v; want %v", got, want)
+	}
+
+	refresh(t0.Add(time.Hour + 29*time.Minute))
+	if got, want := storedKIDs(t, st), []uint64{k1, k2}; !slices.Equal(got, want) {
+		t.Fatalf("within grace period, stored %v; want %v", got, want)
+	}
+	refresh(t0.Add(time.Hour + 30*time.Minute))
+	if got, want := storedKIDs(t, st), []uint64{k2}; !slices.Equal(got, want) {
+		t.Fatalf("after grace period, stored %v; want %v", got, want)
+	}
+	if len(s.signingKeys) != 1 || currentKID(t, s) != k2 {
+		t.Fatalf("after grace period, serving %d keys, current %d; want only %d", len(s.signingKeys), currentKID(t, s), k2)
+	}
+}
+
+// hookStore is a versionedStateStore that calls beforeWrite before its
+// next conditional write.
+type hookStore struct {
+	ipn.StateStore
+	beforeWrite func()
+}
+
+func (s *hookStore) readStateVersion(id ipn.StateKey) ([]byte, string, error) {
+	return readStateVersion(s.StateStore, id)
+}
+
+func (s *hookStore) writeStateIfVersion(id ipn.StateKey, bs []byte, version string) error {
+	if f := s.beforeWrite; f != nil {
+		s.beforeWrite = nil
+		f()
+	}
+	return writeStateIfVersion(s.StateStore, id, bs, version)
+}
+
+func TestSigningKeysSharedStore(t *testing.T) {
+	st := new(mem.Store)
+	hs := &hookStore{StateStore: st}
+	s1 := &idpServer{stateStore: st, keyRotation: time.Hour, keyGracePeriod: 30 * time.Minute}
+	s2 := &idpServer{stateStore: hs, keyRotation: time.Hour, keyGracePeriod: 30 * time.Minute}
+	t0 := time.Now()
+
+	// Both replicas start at once; s1 writes a key between s2's read and
+	// its write, so s2 adopts s1's key rather than overwriting it.
+	hs.beforeWrite = func() {
+		if err := s1.refreshSigningKeysLocked(t0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s2.refreshSigningKeysLocked(t0); err != nil {
+		t.Fatal(err)
+	}
+	k1 := currentKID(t, s1)
+	if got := currentKID(t, s2); got != k1 {
+		t.Fatalf("s2 current key %d; want s1's %d", got, k1)
+	}
+
+	// s2 loads the keys just before rotation is due, then s1 rotates.
+	// s2 re-reads the keys before rotating, despite them being freshly
+	// loaded, and so adopts s1's new key.
+	due := t0.Add(time.Hour)
+	if err := s2.refreshSigningKeysLocked(due.Add(-10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.refreshSigningKeysLocked(due); err != nil {
+		t.Fatal(err)
+	}
+	k2 := currentKID(t, s1)
+	if err := s2.refreshSigningKeysLocked(due.Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentKID(t, s2); got != k2 {
+		t.Fatalf("after rotation, s2 current key %d; want s1's %d", got, k2)
+	}
+	if got, want := storedKIDs(t, st), []uint64{k1, k2}; !slices.Equal(got, want) {
+		t.Fatalf("stored %v; want %v", got, want)
+	}
+
+	// s1 retires k1 at the end of its grace period, as does s2.
+	retire := due.Add(30 * time.Minute)
+	if err := s1.refreshSigningKeysLocked(retire); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.refreshSigningKeysLocked(retire); err != nil {
+		t.Fatal(err)
+	}
+	if len(s2.signingKeys) != 1 || currentKID(t, s2) != k2 {
+		t.Fatalf("s2 serving %d keys after retirement; want only %d", len(s2.signingKeys), k2)
+	}
+	if got, want := storedKIDs(t, st), []uint64{k2}; !slices.Equal(got, want) {
+		t.Fatalf("stored %v; want %v", got, want)
+	}
+
+	// s1 rotates early, as if configured to rotate more often. s2 isn't
+	// due to change the keys itself, so picks up s1's key only once it
+	// reloads them.
+	s1.keyRotation = 10 * time.Minute
+	early := retire.Add(10 * time.Minute)
+	if err := s2.refreshSigningKeysLocked(early.Add(-30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.refreshSigningKeysLocked(early); err != nil {
+		t.Fatal(err)
+	}
+	k3 := currentKID(t, s1)
+	if err := s2.refreshSigningKeysLocked(early); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentKID(t, s2); got != k2 {
+		t.Fatalf("s2 reloaded keys before the reload interval")
+	}
+	if err := s2.refreshSigningKeysLocked(early.Add(-30*time.Second + signingKeysReloadInterval)); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentKID(t, s2); got != k3 {
+		t.Fatalf("after reload, s2 current key %d; want s1's %d", got, k3)
+	}
+}
+
+func TestSigningKeyMigration(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	// Before rotation support, a single key without a creation time
+	// was stored in oidc-key.json.
+	_, k := mustGenRSAKey(2048)
+	old, err := (&signingKey{k: k, kid: 42}).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old = bytes.Replace(old, []byte(`,"Created":"0001-01-01T00:00:00Z"`), nil, 1)
+	if err := os.WriteFile("oidc-key.json", old, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &idpServer{stateStore: legacyFileStore{}, keyRotation: time.Hour, keyGracePeriod: time.Hour}
+	now := time.Now().Truncate(time.Second)
+	if err := s.refreshSigningKeysLocked(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.signingKeys) != 1 || currentKID(t, s) != 42 || !s.signingKeys[0].k.Equal(k) {
+		t.Fatalf("migrated keys %+v; want the old key", s.signingKeys)
+	}
+
+	b, err := os.ReadFile("oidc-key.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sks signingKeysJSON
+	if err := json.Unmarshal(b, &sks); err != nil {
+		t.Fatal(err)
+	}
+	if len(sks.Keys) != 1 || sks.Keys[0].kid != 42 || !sks.Keys[0].created.Equal(now) {
+		t.Fatalf("stored %s; want the old key with creation time %v", b, now)
+	}
+
+	// The key's rotation is counted from the migration.
+	if err := s.refreshSigningKeysLocked(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if currentKID(t, s) == 42 {
+		t.Error("migrated key not rotated an hour after migration")
+	}
+}
+
+// fakeKube is a kubeclient.Client holding a single Secret, which checks
+// resourceVersions like the API server.
+type fakeKube struct {
+	kubeclient.FakeClient
+	secret *kubeapi.Secret // or nil if not created
+	rv     int
+}
+
+func (fk *fakeKube) GetSecret(ctx context.Context, name string) (*kubeapi.Secret, error) {
+	if fk.secret == nil {
+		return nil, &kubeapi.Status{Code: 404}
+	}
+	s := *fk.secret
+	s.Data = maps.Clone(fk.secret.Data)
+	return &s, nil
+}
+
+func (fk *fakeKube) CreateSecret(ctx context.Context, s *kubeapi.Secret) error {
+	if fk.secret != nil {
+		return &kubeapi.Status{Code: 409}
+	}
+	fk.store(s)
+	return nil
+}
+
+func (fk *fakeKube) UpdateSecret(ctx context.Context, s *kubeapi.Secret) error {
+	if fk.secret == nil || s.ResourceVersion != fk.secret.ResourceVersion {
+		return &kubeapi.Status{Code: 409}
+	}
+	fk.store(s)
+	return nil
+}
+
+func (fk *fakeKube) store(s *kubeapi.Secret) {
+	fk.rv++
+	c := *s
+	c.Data = maps.Clone(s.Data)
+	c.ResourceVersion = strconv.Itoa(fk.rv)
+	fk.secret = &c
+}
+
+func TestKubeStateStore(t *testing.T) {
+	fk := &fakeKube{}
+	s := &kubeStateStore{client: fk, secretName: "tsidp"}
+	const key = signingKeysStateKey
+
+	_, v0, err := s.readStateVersion(key)
+	if !errors.Is(err, ipn.ErrStateNotExist) || v0 != "" {
+		t.Fatalf("read of missing Secret = %q, %v; want \"\", ErrStateNotExist", v0, err)
+	}
+	if err := s.writeStateIfVersion(key, []byte("one"), v0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeStateIfVersion(key, []byte("other"), v0); !errors.Is(err, errStateConflict) {
+		t.Fatalf("create of existing Secret: got %v; want errStateConflict", err)
+	}
+	b, v1, err := s.readStateVersion(key)
+	if err != nil || string(b) != "one" {
+		t.Fatalf("read = %q, %v; want \"one\"", b, err)
+	}
+
+	// Other keys, such as tsnet's node state, are preserved.
+	fk.secret.Data["_machinekey"] = []byte("mk")
+	fk.rv++
+	fk.secret.ResourceVersion = strconv.Itoa(fk.rv)
+	if err := s.writeStateIfVersion(key, []byte("two"), v1); !errors.Is(err, errStateConflict) {
+		t.Fatalf("write at stale version: got %v; want errStateConflict", err)
+	}
+	_, v2, _ := s.readStateVersion(key)
+	if err := s.writeStateIfVersion(key, []byte("two"), v2); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, _ := s.readStateVersion(key); string(b) != "two" {
+		t.Errorf("stored %q; want \"two\"", b)
+	}
+	if got := string(fk.secret.Data["_machinekey"]); got != "mk" {
+		t.Errorf("other key = %q; want preserved", got)
+	}
+}
+
+func TestRefreshCurrentUser(t *testing.T) {
+	s, tw := newTestServerWhoIs(t)
+	issue := func() oidcTokenResponse {
+		t.Helper()
+		return tokenResponse(t, do(s, "POST", "/token", testRPAddr, url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {authorize(t, s, "")},
+			"redirect_uri": {testRedirectURI},
+		}))
+	}
+	refresh := func(rt string) *httptest.ResponseRecorder {
+		return do(s, "POST", "/token", testRPAddr, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {rt},
+		})
+	}
+	tok := issue()
+
+	// Capabilities changed since authorization are reflected in the
+	// refreshed ID token.
+	user, _ := tw.lookup(testUserAddr)
+	changed := *user
+	changed.CapMap = tailcfg.PeerCapMap{
+		tailcfg.PeerCapabilityTsIDP: []tailcfg.RawMessage{`{"extraClaims":{"groups":["sales"]}}`},
+	}
+	tw.set(testUserAddr, &changed)
+	tok2 := tokenResponse(t, refresh(tok.RefreshToken))
+	idt, err := jwt.ParseSigned(tok2.IDToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]any
+	if err := idt.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := claims["groups"], []any{"sales"}; !cmp.Equal(got, want) {
+		t.Errorf("refreshed groups = %v; want %v", got, want)
+	}
+	if _, ok := claims["roles"]; ok {
+		t.Errorf("refreshed token has revoked roles claim: %v", claims["roles"])
+	}
+
+	// The node now belongs to another user.
+	node := *changed.Node
+	node.User = 300
+	moved := changed
+	moved.Node = &node
+	tw.set(testUserAddr, &moved)
+	if w := refresh(tok2.RefreshToken); w.Code != http.StatusBadRequest {
+		t.Errorf("refresh after node changed user: got %v; want 400", w.Code)
+	}
+
+	// The node is gone.
+	tw.set(testUserAddr, &changed)
+	tok3 := issue()
+	tw.set(testUserAddr, nil)
+	if w := refresh(tok3.RefreshToken); w.Code != http.StatusBadRequest {
+		t.Errorf("refresh after node removed: got %v; want 400", w.Code)
+	}
+}
+
+func TestExpireTokens(t *testing.T) {
+	s := newTestServer(t)
+	tokenResponse(t, do(s, "POST", "/token", testRPAddr, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorize(t, s, "")},
+		"redirect_uri": {testRedirectURI},
+	}))
+	code := authorize(t, s, "")
+	count := func() (codes, access, refresh int) {
+		t.Helper()
+		rts, _, err := loadRefreshTokens(s.stateStore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.code), len(s.accessToken), len(rts)
+	}
+
+	now := time.Now()
+	s.expireTokens(now)
+	if c, a, r := count(); c != 1 || a != 1 || r != 1 {
+		t.Fatalf("before expiry, have %d codes, %d access and %d refresh tokens; want 1 each", c, a, r)
+	}
+	s.expireTokens(now.Add(accessTokenLifetime + time.Second))
+	if c, a, r := count(); c != 0 || a != 0 || r != 1 {
+		t.Fatalf("after code and access token expiry, have %d codes, %d access and %d refresh tokens; want 0, 0 and 1", c, a, r)
+	}
+	s.expireTokens(now.Add(refreshTokenLifetime + time.Second))
+	if c, a, r := count(); c != 0 || a != 0 || r != 0 {
+		t.Fatalf("after refresh token expiry, have %d codes, %d access and %d refresh tokens; want none", c, a, r)
+	}
+
+	if w := do(s, "POST", "/token", testRPAddr, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {testRedirectURI},
+	}); w.Code != http.StatusBadRequest {
+		t.Errorf("redeeming expired code: got %v; want 400", w.Code)
+	}
+}
+
+func TestRefreshTokenStored(t *testing.T) {
+	s1 := newTestServer(t)
+	tok := tokenResponse(t, do(s1, "POST", "/token", testRPAddr, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorize(t, s1, "")},
+		"redirect_uri": {testRedirectURI},
+	}))
+	b, err := s1.stateStore.ReadState(refreshTokensStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(tok.RefreshToken)) {
+		t.Errorf("state store holds the refresh token itself: %s", b)
+	}
+
+	// A replica sharing the state store, or s1 after a restart, can
+	// redeem the refresh token.
+	s2 := newTestServer(t)
+	s2.stateStore = s1.stateStore
+	refresh := func(s *idpServer, rt string) *httptest.ResponseRecorder {
+		return do(s, "POST", "/token", testRPAddr, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {rt},
+		})
+	}
+	tok2 := tokenResponse(t, refresh(s2, tok.RefreshToken))
+	if w := refresh(s1, tok.RefreshToken); w.Code != http.StatusBadRequest {
+		t.Errorf("refresh token reused on other replica: got %v; want 400", w.Code)
+	}
+
+	// Revocation on one replica applies to both.
+	if w := do(s1, "POST", "/revoke", testRPAddr, url.Values{"token": {tok2.RefreshToken}}); w.Code != http.StatusOK {
+		t.Fatalf("revoke: got %v; want 200", w.Code)
+	}
+	if w := refresh(s2, tok2.RefreshToken); w.Code != http.StatusBadRequest {
+		t.Errorf("refresh with token revoked on other replica: got %v; want 400", w.Code)
+	}
+}
@@ -28,6 +28,12 @@
 	//
 	// See https://github.com/tailscale/tailscale/issues/6973.
 	LocalBackendStartKeyOSNeutral
+
+	// LoginRegenNodeKey generates a new node key, sending the current one
+	// as the old node key, along with its Tailnet Lock signature re-signed
+	// for the new key, so that control can rotate the node's key without
+	// the user logging in again.
+	LoginRegenNodeKey
 )
 
 // Client represents a client connection to the control server.
@@ -97,8 +97,9 @@ type Direct struct {
 	persist      persist.PersistView
 	authKey      string
 	tryingNewKey key.NodePrivate
-	expiry       time.Time         // or zero value if none/unknown
-	hostinfo     *tailcfg.Hostinfo // always non-nil
+	expiry       time.Time                  // or zero value if none/unknown
+	keySignature tkatype.MarshaledSignature // of the current node key, from the netmap; or nil
+	hostinfo     *tailcfg.Hostinfo          // always non-nil
 	netinfo      *tailcfg.NetInfo
 	endpoints    []tailcfg.Endpoint
 	tkaHead      string
@@ -502,6 +503,7 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	hi := c.hostInfoLocked()
 	backendLogID := hi.BackendLogID
 	expired := !c.expiry.IsZero() && c.expiry.Before(c.clock.Now())
+	keySignature := c.keySignature
 	c.mu.Unlock()
 
 	machinePrivKey, err := c.getMachinePrivKey()
@@ -525,6 +527,16 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 			c.logf("LoginInteractive -> regen=true")
 			regen = true
 		}
+		if (opt.Flags & LoginRegenNodeKey) != 0 {
+			c.logf("LoginRegenNodeKey -> regen=true")
+			regen = true
+			if opt.OldNodeKeySignature == nil && len(keySignature) > 0 {
+				// Re-sign the current key's signature for the new key,
+				// as for a regen requested by control, so that the new
+				// key is authorized if Tailnet Lock is enabled.
+				opt.OldNodeKeySignature = keySignature
+			}
+		}
 	}
 
 	c.logf("doLogin(regen=%v, hasUrl=%v)", regen, opt.URL != "")
@@ -1009,6 +1021,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, isStreaming bool, nu Netmap
 			persist = c.persist
 		}
 		c.expiry = nm.Expiry
+		c.keySignature = nm.SelfNode.KeySignature().AsSlice()
 	}
 
 	// gotNonKeepAliveMessage is whether we've yet received a MapResponse message without
@@ -179,6 +179,16 @@ type Server struct {
 	verifyClientsURL         string
 	verifyClientsURLFailOpen bool
 
+	// admitters are additional admission policies that must all admit
+	// a non-mesh client for it to connect.
+	admitters []ClientAdmitter
+
+	// limits enforces per-client rate limits on relayed packets.
+	limits clientLimits
+
+	// events publishes ConnEvents to subscribers.
+	events connEvents
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -448,6 +458,7 @@ func genDroppedCounters() {
 		dropReasonQueueTail,
 		dropReasonWriteError,
 		dropReasonDupClient,
+		dropReasonRateLimited,
 	}
 
 	for _, dr := range dropReasons {
@@ -493,6 +504,26 @@ func (s *Server) SetVerifyClientURLFailOpen(v bool) {
 	s.verifyClientsURLFailOpen = v
 }
 
+// ClientAdmitter is an admission policy for clients connecting to a DERP
+// server. See package tailscale.com/derp/derpadmit for implementations.
+type ClientAdmitter interface {
+	// AdmitClient returns nil if the client with node key k, connecting
+	// from source IP src, may connect. It returns an error describing
+	// why the client was rejected otherwise. src is the zero value if
+	// the client's address is unknown.
+	AdmitClient(ctx context.Context, k key.NodePublic, src netip.Addr) error
+}
+
+// AddClientAdmitter adds an admission policy consulted for each client
+// connection, before the SetVerifyClient and SetVerifyClientURL checks.
+// A client must be admitted by all of them. Trusted mesh peers are always
+// admitted.
+//
+// It must be called before serving begins.
+func (s *Server) AddClientAdmitter(a ClientAdmitter) {
+	s.admitters = append(s.admitters, a)
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -682,6 +713,12 @@ func (s *Server) registerClient(c *sclient) {
 		s.curClientsNotIdeal.Add(1)
 	}
 	s.broadcastPeerStateChangeLocked(c.key, c.remoteIPPort, c.presentFlags(), true)
+
+	evType := ConnEventConnect
+	if c.canMesh {
+		evType = ConnEventMeshPeerUp
+	}
+	s.publishConnEvent(c.newConnEvent(evType))
 }
 
 // broadcastPeerStateChangeLocked enqueues a message to all watchers
@@ -706,6 +743,16 @@ func (s *Server) unregisterClient(c *sclient) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.hasConnEventSubscribers() {
+		evType := ConnEventDisconnect
+		if c.canMesh {
+			evType = ConnEventMeshPeerDown
+		}
+		ev := c.newConnEvent(evType)
+		ev.Duration = s.clock.Since(c.connectedAt)
+		s.publishConnEvent(ev)
+	}
+
 	set, ok := s.clients[c.key]
 	if !ok {
 		c.logf("[unexpected]; clients map is empty")
@@ -1112,6 +1159,9 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	}
 	s.packetsForwardedIn.Add(1)
 
+	// Forwarded packets aren't rate limited here: the mesh peer that
+	// received them from srcKey already applied its own limits.
+
 	var dstLen int
 	var dst *sclient
 
@@ -1151,6 +1201,12 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %v: recvPacket: %v", c.key, err)
 	}
 
+	if !c.canMesh && !s.limits.allow(s.clock.Now(), c.key, c.remoteIPPort.Addr(), len(contents)) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		c.debugLogf("SendPacket for %s, dropping with reason=%s", dstKey.ShortString(), dropReasonRateLimited)
+		return nil
+	}
+
 	var fwd PacketForwarder
 	var dstLen int
 	var dst *sclient
@@ -1218,6 +1274,7 @@ type dropReasonKindLabels struct {
 	dropReasonQueueTail        dropReason = "queue_tail"          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError       dropReason = "write_error"         // OS write() failed
 	dropReasonDupClient        dropReason = "dup_client"          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited      dropReason = "rate_limited"        // the source key or IP exceeded its configured RateLimit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1242,6 +1299,7 @@ func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, r
 		s.limitedLogf(msg)
 	}
 	s.debugLogf("dropping packet reason=%s dst=%s disco=%v", reason, dstKey, looksDisco)
+	s.noteDropForEvents(dstKey, reason)
 }
 
 func (c *sclient) sendPkt(dst *sclient, p pkt) error {
@@ -1339,6 +1397,20 @@ func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, inf
 		return nil
 	}
 
+	// Local admission policies run first, so that they still apply if the
+	// admission controller URL is unreachable and verifyClientsURLFailOpen
+	// is set.
+	for _, a := range s.admitters {
+		if err := a.AdmitClient(ctx, clientKey, clientIP); err != nil {
+			return err
+		}
+	}
+	return s.verifyClientExternal(ctx, clientKey, clientIP)
+}
+
+// verifyClientExternal checks whether the client is allowed to connect by
+// the local tailscaled and the admission controller URL, if configured.
+func (s *Server) verifyClientExternal(ctx context.Context, clientKey key.NodePublic, clientIP netip.Addr) error {
 	// tailscaled-based verification:
 	if s.verifyClientsLocalTailscaled {
 		_, err := localClient.WhoIsNodeKey(ctx, clientKey)
@@ -1389,7 +1461,6 @@ func (s *Server) verifyClient(ctx context.Context, clientKey key.NodePublic, inf
 		if !jres.Allow {
 			return fmt.Errorf("admission controller: %v/%v not allowed", clientKey, clientIP)
 		}
-		// TODO(bradfitz): add policy for configurable bandwidth rate per client?
 	}
 	return nil
 }
@@ -1471,7 +1542,15 @@ type serverInfo struct {
 }
 
 func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+	si := serverInfo{Version: ProtocolVersion}
+	if rl := s.limits.forKey(clientKey); rl.BytesPerSecond >= 1 {
+		// Ask well-behaved clients to drop excess packets themselves
+		// rather than sending them to us to drop. Clients also count
+		// the frame header and destination key against the bucket.
+		si.TokenBucketBytesPerSecond = int(rl.BytesPerSecond)
+		si.TokenBucketBytesBurst = rl.bytesBurst() + frameHeaderLen + keyLen
+	}
+	msg, err := json.Marshal(si)
 	if err != nil {
 		return err
 	}
@@ -1676,6 +1755,9 @@ func (c *sclient) setPreferred(v bool) {
 		return
 	}
 	c.preferred = v
+	ev := c.newConnEvent(ConnEventPreferred)
+	ev.Preferred = v
+	c.s.publishConnEvent(ev)
 	var homeMove *expvar.Int
 	if v {
 		c.s.curHomeClients.Add(1)
@@ -2167,6 +2249,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
 	m.Set("sclient_write_timeouts", &s.sclientWriteTimeouts)
+	m.Set("rate_limited_clients", expvar.Func(func() any { return s.limits.droppedByClient() }))
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
@@ -2234,11 +2317,10 @@ func (s *Server) checkVerifyClientsLocalTailscaled() error {
 	if err != nil {
 		return fmt.Errorf("localClient.Status: %w", err)
 	}
-	info := &clientInfo{
-		IsProber: true,
-	}
+	// Only check the tailscaled and URL verifiers: the admitters, such as
+	// CIDR allowlists, wouldn't admit our loopback address.
 	clientIP := netip.IPv6Loopback()
-	if err := s.verifyClient(ctx, status.Self.PublicKey, info, clientIP); err != nil {
+	if err := s.verifyClientExternal(ctx, status.Self.PublicKey, clientIP); err != nil {
 		return fmt.Errorf("verifyClient for self nodekey: %w", err)
 	}
 	return nil
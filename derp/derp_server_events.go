@@ -0,0 +1,283 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/types/key"
+	"tailscale.com/util/set"
+)
+
+// ConnEventType is the type of a ConnEvent.
+type ConnEventType string
+
+const (
+	// ConnEventConnect is a client connecting to the server.
+	ConnEventConnect ConnEventType = "connect"
+	// ConnEventDisconnect is a client disconnecting from the server.
+	ConnEventDisconnect ConnEventType = "disconnect"
+	// ConnEventPreferred is a client marking the server as its home
+	// (preferred) DERP server, or no longer doing so.
+	ConnEventPreferred ConnEventType = "preferred"
+	// ConnEventMeshPeerUp is a trusted mesh peer connecting to the server.
+	ConnEventMeshPeerUp ConnEventType = "mesh_peer_up"
+	// ConnEventMeshPeerDown is a trusted mesh peer disconnecting from the
+	// server.
+	ConnEventMeshPeerDown ConnEventType = "mesh_peer_down"
+	// ConnEventDropBurst is a burst of packets to one destination being
+	// dropped.
+	ConnEventDropBurst ConnEventType = "drop_burst"
+	// ConnEventLost is a synthetic event reporting that a subscriber
+	// fell behind and Lost events were discarded.
+	ConnEventLost ConnEventType = "lost"
+)
+
+// ConnEvent is an auditable event about a connection to a DERP server.
+type ConnEvent struct {
+	Time time.Time
+	Type ConnEventType
+
+	// Node is the node key of the client the event is about. For
+	// ConnEventDropBurst, it's the destination of the dropped packets.
+	Node key.NodePublic
+
+	// ConnNum is the server-unique number of the client's connection.
+	// It's zero for ConnEventDropBurst and ConnEventLost.
+	ConnNum int64 `json:",omitempty"`
+
+	// RemoteAddr is the client's IP address and port, if known.
+	RemoteAddr netip.AddrPort
+
+	// IsProber is whether the client identified itself as a prober.
+	IsProber bool `json:",omitempty"`
+
+	// NotIdeal is whether the client indicated that this server isn't
+	// its ideal node in the region.
+	NotIdeal bool `json:",omitempty"`
+
+	// Preferred, for ConnEventPreferred, is whether the client now
+	// prefers this server.
+	Preferred bool `json:",omitempty"`
+
+	// Duration, for ConnEventDisconnect and ConnEventMeshPeerDown, is
+	// how long the connection lasted.
+	Duration time.Duration `json:",omitempty"`
+
+	// DropReason, for ConnEventDropBurst, is the reason the packet that
+	// completed the burst was dropped.
+	DropReason string `json:",omitempty"`
+
+	// Drops, for ConnEventDropBurst, is the number of packets dropped.
+	Drops int `json:",omitempty"`
+
+	// Lost, for ConnEventLost, is the number of events discarded.
+	Lost int `json:",omitempty"`
+}
+
+const (
+	// maxQueuedConnEvents is the number of events a subscriber may fall
+	// behind by before events are discarded.
+	maxQueuedConnEvents = 4096
+
+	// dropBurstWindow and dropBurstThreshold define a drop burst: at
+	// least dropBurstThreshold packets dropped to the same destination
+	// within a dropBurstWindow epoch.
+	dropBurstWindow    = time.Second
+	dropBurstThreshold = 50
+)
+
+// ConnEventSubscription is a subscription to a Server's ConnEvents,
+// created by Server.SubscribeConnEvents.
+type ConnEventSubscription struct {
+	s      *Server
+	h      set.Handle
+	notify chan struct{} // buffered 1; non-blocking sends when queue grows
+
+	// Guarded by s.events.mu.
+	queue []ConnEvent
+	lost  int
+}
+
+// connEvents is the state for publishing ConnEvents to subscribers.
+type connEvents struct {
+	numSubs atomic.Int32 // len(subs), for lock-free fast paths
+
+	mu   sync.Mutex
+	subs set.HandleSet[*ConnEventSubscription]
+
+	// Drop burst tracking, reset every dropBurstWindow.
+	dropEpoch time.Time
+	dropCount map[key.NodePublic]int
+}
+
+// SubscribeConnEvents returns a new subscription to the server's
+// connection events. The caller must call Close on the subscription when
+// done.
+//
+// Events are queued for each subscriber; a subscriber that falls too far
+// behind loses events, which is reported by a ConnEventLost event.
+func (s *Server) SubscribeConnEvents() *ConnEventSubscription {
+	sub := &ConnEventSubscription{
+		s:      s,
+		notify: make(chan struct{}, 1),
+	}
+	ev := &s.events
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.subs == nil {
+		ev.subs = set.HandleSet[*ConnEventSubscription]{}
+	}
+	sub.h = ev.subs.Add(sub)
+	ev.numSubs.Store(int32(len(ev.subs)))
+	return sub
+}
+
+// Close unsubscribes sub. It's safe to call concurrently with Next.
+func (sub *ConnEventSubscription) Close() {
+	ev := &sub.s.events
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	delete(ev.subs, sub.h)
+	ev.numSubs.Store(int32(len(ev.subs)))
+}
+
+// Next blocks until at least one event is available or ctx is done, and
+// returns all events queued since the previous call.
+func (sub *ConnEventSubscription) Next(ctx context.Context) ([]ConnEvent, error) {
+	ev := &sub.s.events
+	for {
+		ev.mu.Lock()
+		q, lost := sub.queue, sub.lost
+		sub.queue, sub.lost = nil, 0
+		ev.mu.Unlock()
+		if lost > 0 {
+			q = append([]ConnEvent{{
+				Time: sub.s.clock.Now(),
+				Type: ConnEventLost,
+				Lost: lost,
+			}}, q...)
+		}
+		if len(q) > 0 {
+			return q, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-sub.notify:
+		}
+	}
+}
+
+// hasConnEventSubscribers reports whether there are any ConnEvent
+// subscribers, so that callers can skip constructing events otherwise.
+func (s *Server) hasConnEventSubscribers() bool {
+	return s.events.numSubs.Load() > 0
+}
+
+// publishConnEvent queues e for all subscribers.
+//
+// It may be called with or without s.mu held.
+func (s *Server) publishConnEvent(e ConnEvent) {
+	if !s.hasConnEventSubscribers() {
+		return
+	}
+	ev := &s.events
+	if e.Time.IsZero() {
+		e.Time = s.clock.Now()
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	for _, sub := range ev.subs {
+		if len(sub.queue) >= maxQueuedConnEvents {
+			sub.lost++
+			continue
+		}
+		sub.queue = append(sub.queue, e)
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// newConnEvent returns a ConnEvent of type typ about c.
+func (c *sclient) newConnEvent(typ ConnEventType) ConnEvent {
+	return ConnEvent{
+		Type:       typ,
+		Node:       c.key,
+		ConnNum:    c.connNum,
+		RemoteAddr: c.remoteIPPort,
+		IsProber:   c.info.IsProber,
+		NotIdeal:   c.isNotIdealConn,
+	}
+}
+
+// noteDropForEvents counts a dropped packet to dst, publishing a
+// ConnEventDropBurst if it completes a burst.
+func (s *Server) noteDropForEvents(dst key.NodePublic, reason dropReason) {
+	if !s.hasConnEventSubscribers() {
+		return
+	}
+	ev := &s.events
+	now := s.clock.Now()
+	ev.mu.Lock()
+	if now.Sub(ev.dropEpoch) >= dropBurstWindow {
+		ev.dropEpoch = now
+		clear(ev.dropCount)
+	}
+	if ev.dropCount == nil {
+		ev.dropCount = map[key.NodePublic]int{}
+	}
+	ev.dropCount[dst]++
+	n := ev.dropCount[dst]
+	ev.mu.Unlock()
+
+	if n == dropBurstThreshold {
+		s.publishConnEvent(ConnEvent{
+			Time:       now,
+			Type:       ConnEventDropBurst,
+			Node:       dst,
+			DropReason: string(reason),
+			Drops:      n,
+		})
+	}
+}
+
+// ServeConnEvents is an HTTP handler streaming the server's ConnEvents as
+// JSON lines until the client goes away.
+func (s *Server) ServeConnEvents(w http.ResponseWriter, r *http.Request) {
+	sub := s.SubscribeConnEvents()
+	defer sub.Close()
+
+	// Don't let the HTTP server's write timeout end the stream.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		events, err := sub.Next(r.Context())
+		if err != nil {
+			return
+		}
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derp
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/types/key"
+	"tailscale.com/util/mak"
+)
+
+// RateLimit is a token bucket configuration limiting the packets a DERP
+// client may relay through the server. Bytes and packets are limited
+// independently; a packet is relayed only if both buckets have room for it.
+//
+// The zero value imposes no limit.
+type RateLimit struct {
+	// BytesPerSecond is the sustained rate of relayed packet payload
+	// bytes permitted. Zero means unlimited.
+	BytesPerSecond float64 `json:",omitempty"`
+
+	// BytesBurst is the size of the byte token bucket. If zero, it
+	// defaults to the larger of BytesPerSecond and MaxPacketSize.
+	BytesBurst int `json:",omitempty"`
+
+	// PacketsPerSecond is the sustained rate of relayed packets
+	// permitted. Zero means unlimited.
+	PacketsPerSecond float64 `json:",omitempty"`
+
+	// PacketsBurst is the size of the packet token bucket. If zero, it
+	// defaults to the larger of PacketsPerSecond and 1.
+	PacketsBurst int `json:",omitempty"`
+}
+
+// IsZero reports whether rl imposes no limit.
+func (rl RateLimit) IsZero() bool {
+	return rl.BytesPerSecond <= 0 && rl.PacketsPerSecond <= 0
+}
+
+func (rl RateLimit) bytesBurst() int {
+	if rl.BytesBurst > 0 {
+		return rl.BytesBurst
+	}
+	return max(int(rl.BytesPerSecond), MaxPacketSize)
+}
+
+func (rl RateLimit) packetsBurst() int {
+	if rl.PacketsBurst > 0 {
+		return rl.PacketsBurst
+	}
+	return max(int(rl.PacketsPerSecond), 1)
+}
+
+// limiterIdleTimeout is how long a relayLimiter must go unused, with full
+// buckets, before it's forgotten.
+const limiterIdleTimeout = time.Minute
+
+// relayLimiter is the pair of token buckets for a single client key or
+// source IP.
+type relayLimiter struct {
+	bytes   *rate.Limiter // nil if unlimited
+	packets *rate.Limiter // nil if unlimited
+
+	// Guarded by clientLimits.mu.
+	lastUsed       time.Time
+	droppedPackets int64
+	droppedBytes   int64
+}
+
+func newRelayLimiter(rl RateLimit) *relayLimiter {
+	l := new(relayLimiter)
+	if rl.BytesPerSecond > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(rl.BytesPerSecond), rl.bytesBurst())
+	}
+	if rl.PacketsPerSecond > 0 {
+		l.packets = rate.NewLimiter(rate.Limit(rl.PacketsPerSecond), rl.packetsBurst())
+	}
+	return l
+}
+
+// reserve appends to rs the reservations needed to relay an n byte packet
+// at now. It reports false if either bucket lacks the tokens, in which case
+// the caller must cancel all reservations in rs.
+func (l *relayLimiter) reserve(rs []*rate.Reservation, now time.Time, n int) ([]*rate.Reservation, bool) {
+	l.lastUsed = now
+	for _, lim := range [...]*rate.Limiter{l.bytes, l.packets} {
+		if lim == nil {
+			continue
+		}
+		tokens := 1
+		if lim == l.bytes {
+			tokens = n
+		}
+		r := lim.ReserveN(now, tokens)
+		if !r.OK() {
+			return rs, false
+		}
+		rs = append(rs, r)
+		if r.DelayFrom(now) > 0 {
+			return rs, false
+		}
+	}
+	return rs, true
+}
+
+// idle reports whether l hasn't been used recently and its buckets are
+// full, such that forgetting it is equivalent to keeping it.
+func (l *relayLimiter) idle(now time.Time) bool {
+	if now.Sub(l.lastUsed) < limiterIdleTimeout {
+		return false
+	}
+	for _, lim := range [...]*rate.Limiter{l.bytes, l.packets} {
+		if lim != nil && lim.TokensAt(now) < float64(lim.Burst()) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientLimits enforces the per-client-key and per-source-IP RateLimits
+// configured on a Server.
+//
+// Its configuration fields are set before serving begins and are read-only
+// afterwards.
+type clientLimits struct {
+	enabled   bool
+	def       RateLimit
+	overrides map[key.NodePublic]RateLimit
+	perIP     RateLimit
+
+	mu        sync.Mutex
+	byKey     map[key.NodePublic]*relayLimiter
+	byIP      map[netip.Addr]*relayLimiter
+	lastPrune time.Time
+}
+
+func (l *clientLimits) updateEnabled() {
+	l.enabled = !l.def.IsZero() || len(l.overrides) > 0 || !l.perIP.IsZero()
+}
+
+// forKey returns the RateLimit that applies to packets from k.
+func (l *clientLimits) forKey(k key.NodePublic) RateLimit {
+	if rl, ok := l.overrides[k]; ok {
+		return rl
+	}
+	return l.def
+}
+
+// allow reports whether an n byte packet from the client k at ip (which
+// may be the zero value if unknown) may be relayed at now. If not, the drop
+// is charged to the limiter(s) that rejected it.
+func (l *clientLimits) allow(now time.Time, k key.NodePublic, ip netip.Addr, n int) bool {
+	if !l.enabled {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maybePruneLocked(now)
+
+	var rsArray [4]*rate.Reservation
+	rs := rsArray[:0]
+	var ok bool
+	if rl := l.forKey(k); !rl.IsZero() {
+		kl, found := l.byKey[k]
+		if !found {
+			kl = newRelayLimiter(rl)
+			mak.Set(&l.byKey, k, kl)
+		}
+		if rs, ok = kl.reserve(rs, now, n); !ok {
+			kl.droppedPackets++
+			kl.droppedBytes += int64(n)
+			cancelReservations(rs, now)
+			return false
+		}
+	}
+	if ip.IsValid() && !l.perIP.IsZero() {
+		il, found := l.byIP[ip]
+		if !found {
+			il = newRelayLimiter(l.perIP)
+			mak.Set(&l.byIP, ip, il)
+		}
+		if rs, ok = il.reserve(rs, now, n); !ok {
+			il.droppedPackets++
+			il.droppedBytes += int64(n)
+			cancelReservations(rs, now)
+			return false
+		}
+	}
+	return true
+}
+
+func cancelReservations(rs []*rate.Reservation, now time.Time) {
+	for _, r := range rs {
+		r.CancelAt(now)
+	}
+}
+
+// maybePruneLocked forgets idle limiters, at most once per
+// limiterIdleTimeout.
+//
+// l.mu must be held.
+func (l *clientLimits) maybePruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < limiterIdleTimeout {
+		return
+	}
+	l.lastPrune = now
+	for k, kl := range l.byKey {
+		if kl.idle(now) {
+			delete(l.byKey, k)
+		}
+	}
+	for ip, il := range l.byIP {
+		if il.idle(now) {
+			delete(l.byIP, ip)
+		}
+	}
+}
+
+// rateLimitedClientStats is the per-client expvar representation of
+// packets dropped by rate limiting.
+type rateLimitedClientStats struct {
+	PacketsDropped int64 `json:"packets_dropped"`
+	BytesDropped   int64 `json:"bytes_dropped"`
+}
+
+// droppedByClient returns the rate limiting drops of each client key and
+// source IP currently tracked, keyed by their string forms. Clients
+// without drops are omitted.
+func (l *clientLimits) droppedByClient() map[string]rateLimitedClientStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := map[string]rateLimitedClientStats{}
+	for k, kl := range l.byKey {
+		if kl.droppedPackets > 0 {
+			ret[k.String()] = rateLimitedClientStats{kl.droppedPackets, kl.droppedBytes}
+		}
+	}
+	for ip, il := range l.byIP {
+		if il.droppedPackets > 0 {
+			ret[ip.String()] = rateLimitedClientStats{il.droppedPackets, il.droppedBytes}
+		}
+	}
+	return ret
+}
+
+// SetClientRateLimit sets the default limit on packets each client node key
+// may send through the server. The zero value, the default, means
+// unlimited. Mesh peers are never limited, and neither are packets they
+// forward, which were already limited by the server that received them.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimit(rl RateLimit) {
+	s.limits.def = rl
+	s.limits.updateEnabled()
+}
+
+// SetClientRateLimitOverride sets the limit on packets sent by the client
+// with node key k, replacing the default set by SetClientRateLimit. A zero
+// rl exempts k from limiting.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimitOverride(k key.NodePublic, rl RateLimit) {
+	mak.Set(&s.limits.overrides, k, rl)
+	s.limits.updateEnabled()
+}
+
+// SetSourceIPRateLimit sets the limit on packets sent by all clients
+// connecting from a single source IP address, in addition to any per-key
+// limit. The zero value, the default, means unlimited.
+//
+// It must be called before serving begins.
+func (s *Server) SetSourceIPRateLimit(rl RateLimit) {
+	s.limits.perIP = rl
+	s.limits.updateEnabled()
+}
@@ -17,6 +17,7 @@
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"reflect"
 	"strconv"
@@ -1626,3 +1627,211 @@ func TestGetPerClientSendQueueDepth(t *testing.T) {
 		})
 	}
 }
+
+func TestClientLimits(t *testing.T) {
+	k1 := key.NewNode().Public()
+	k2 := key.NewNode().Public()
+	k3 := key.NewNode().Public()
+	ip1 := netip.MustParseAddr("192.0.2.1")
+	ip2 := netip.MustParseAddr("192.0.2.2")
+	now := time.Unix(1700000000, 0)
+
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	if !s.limits.allow(now, k1, ip1, MaxPacketSize) {
+		t.Fatal("unconfigured server rejected packet")
+	}
+
+	s.SetClientRateLimit(RateLimit{PacketsPerSecond: 1, PacketsBurst: 2})
+	s.SetClientRateLimitOverride(k2, RateLimit{})
+	s.SetSourceIPRateLimit(RateLimit{BytesPerSecond: 1000, BytesBurst: 3000})
+
+	// k1 may burst two packets, then must wait.
+	for i, want := range []bool{true, true, false} {
+		if got := s.limits.allow(now, k1, netip.Addr{}, 10); got != want {
+			t.Errorf("k1 packet %d: allow = %v; want %v", i, got, want)
+		}
+	}
+	if !s.limits.allow(now.Add(time.Second), k1, netip.Addr{}, 10) {
+		t.Error("k1 not allowed after refill")
+	}
+
+	// k2 is exempt from the per-key limit but not the per-IP limit.
+	for i := range 3 {
+		if !s.limits.allow(now, k2, ip1, 1000) {
+			t.Fatalf("k2 packet %d unexpectedly dropped", i)
+		}
+	}
+	if s.limits.allow(now, k2, ip1, 1000) {
+		t.Error("k2 exceeded per-IP limit")
+	}
+	if !s.limits.allow(now, k2, ip2, 1000) {
+		t.Error("per-IP limit applied to wrong IP")
+	}
+
+	// A packet rejected by the per-IP limit doesn't consume k3's
+	// per-key tokens.
+	if s.limits.allow(now, k3, ip1, 1000) {
+		t.Error("k3 exceeded per-IP limit")
+	}
+	if !s.limits.allow(now, k3, ip2, 10) || !s.limits.allow(now, k3, ip2, 10) {
+		t.Error("k3's per-key tokens were consumed by rejected packet")
+	}
+
+	got := s.limits.droppedByClient()
+	want := map[string]rateLimitedClientStats{
+		k1.String():  {PacketsDropped: 1, BytesDropped: 10},
+		ip1.String(): {PacketsDropped: 2, BytesDropped: 2000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("droppedByClient = %v; want %v", got, want)
+	}
+
+	// Idle limiters with full buckets are forgotten.
+	s.limits.allow(now.Add(time.Hour), k2, ip2, 10)
+	s.limits.mu.Lock()
+	nKeys, nIPs := len(s.limits.byKey), len(s.limits.byIP)
+	s.limits.mu.Unlock()
+	if nKeys != 0 || nIPs != 1 {
+		t.Errorf("after idle: %d key limiters, %d IP limiters; want 0, 1", nKeys, nIPs)
+	}
+}
+
+func TestForwardedPacketsNotRateLimited(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetClientRateLimit(RateLimit{PacketsPerSecond: 1, PacketsBurst: 1})
+
+	dst := newRegularClient(t, ts, "dst")
+	mesh := newTestWatcher(t, ts, "mesh")
+	src := key.NewNode().Public()
+
+	const n = 3
+	for i := range n {
+		if err := mesh.c.ForwardPacket(src, dst.pub, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range n {
+		m, err := dst.c.recvTimeout(time.Second)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		p, ok := m.(ReceivedPacket)
+		if !ok {
+			t.Fatalf("packet %d: got %T; want ReceivedPacket", i, m)
+		}
+		if p.Source != src || !bytes.Equal(p.Data, []byte{byte(i)}) {
+			t.Fatalf("packet %d: got %v %q", i, p.Source, p.Data)
+		}
+	}
+}
+
+type denyKeyAdmitter key.NodePublic
+
+func (a denyKeyAdmitter) AdmitClient(ctx context.Context, k key.NodePublic, src netip.Addr) error {
+	if k == key.NodePublic(a) {
+		return errors.New("denied")
+	}
+	return nil
+}
+
+func TestClientAdmitter(t *testing.T) {
+	ctx := context.Background()
+	denied := key.NewNode().Public()
+	other := key.NewNode().Public()
+	src := netip.MustParseAddr("192.0.2.1")
+
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("abc")
+	s.AddClientAdmitter(denyKeyAdmitter(denied))
+
+	if err := s.verifyClient(ctx, denied, &clientInfo{}, src); err == nil {
+		t.Error("denied key was admitted")
+	}
+	if err := s.verifyClient(ctx, other, &clientInfo{}, src); err != nil {
+		t.Errorf("other key rejected: %v", err)
+	}
+	if err := s.verifyClient(ctx, denied, &clientInfo{MeshKey: "abc"}, src); err != nil {
+		t.Errorf("mesh peer rejected: %v", err)
+	}
+
+	// An unreachable admission controller with fail-open set must not
+	// bypass the admitters.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := "http://" + ln.Addr().String() + "/admit"
+	ln.Close()
+	s.SetVerifyClientURL(unreachable)
+	s.SetVerifyClientURLFailOpen(true)
+	if err := s.verifyClient(ctx, denied, &clientInfo{}, src); err == nil {
+		t.Error("denied key was admitted with the admission controller down")
+	}
+	if err := s.verifyClient(ctx, other, &clientInfo{}, src); err != nil {
+		t.Errorf("other key rejected with fail-open admission controller: %v", err)
+	}
+}
+
+func TestConnEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	sub := ts.s.SubscribeConnEvents()
+	defer sub.Close()
+
+	var got []ConnEvent
+	wantNext := func(typ ConnEventType, node key.NodePublic) ConnEvent {
+		t.Helper()
+		for len(got) == 0 {
+			var err error
+			got, err = sub.Next(ctx)
+			if err != nil {
+				t.Fatalf("waiting for %v event: %v", typ, err)
+			}
+		}
+		e := got[0]
+		got = got[1:]
+		if e.Type != typ || e.Node != node {
+			t.Fatalf("got %v event for %v; want %v for %v", e.Type, e.Node.ShortString(), typ, node.ShortString())
+		}
+		return e
+	}
+
+	c1 := newRegularClient(t, ts, "c1")
+	connect := wantNext(ConnEventConnect, c1.pub)
+	if !connect.RemoteAddr.IsValid() || connect.ConnNum == 0 {
+		t.Errorf("connect event missing connection details: %+v", connect)
+	}
+
+	if err := c1.c.NotePreferred(true); err != nil {
+		t.Fatal(err)
+	}
+	if e := wantNext(ConnEventPreferred, c1.pub); !e.Preferred {
+		t.Errorf("preferred event has Preferred = false")
+	}
+
+	w := newTestWatcher(t, ts, "watcher")
+	wantNext(ConnEventMeshPeerUp, w.pub)
+
+	// Sending to an unknown destination drops packets.
+	unknown := key.NewNode().Public()
+	for range dropBurstThreshold {
+		ts.s.recordDrop([]byte("x"), c1.pub, unknown, dropReasonUnknownDest)
+	}
+	if e := wantNext(ConnEventDropBurst, unknown); e.Drops != dropBurstThreshold || e.DropReason != string(dropReasonUnknownDest) {
+		t.Errorf("unexpected drop burst event: %+v", e)
+	}
+
+	c1.close(t)
+	if e := wantNext(ConnEventDisconnect, c1.pub); e.ConnNum != connect.ConnNum {
+		t.Errorf("disconnect ConnNum = %v; want %v", e.ConnNum, connect.ConnNum)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package derpadmit contains admission policies for DERP servers,
+// implementing [derp.ClientAdmitter].
+package derpadmit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go4.org/netipx"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/set"
+)
+
+var (
+	_ derp.ClientAdmitter = (*KeyList)(nil)
+	_ derp.ClientAdmitter = (*CIDRAllowList)(nil)
+	_ derp.ClientAdmitter = (*Webhook)(nil)
+)
+
+// KeyList is a ClientAdmitter backed by a file of node keys to allow or
+// deny.
+//
+// Each non-empty line of the file is either a comment starting with '#',
+// or a verb ("allow" or "deny") followed by a node key in its
+// "nodekey:..." form. Denied keys are always rejected. If the file
+// contains any allowed keys, all other keys are rejected; otherwise, all
+// keys not denied are admitted.
+type KeyList struct {
+	path string
+	logf logger.Logf
+
+	mu      sync.Mutex
+	allow   set.Set[key.NodePublic]
+	deny    set.Set[key.NodePublic]
+	modTime time.Time
+	size    int64
+}
+
+// NewKeyList returns a KeyList reading the file at path. It returns an
+// error if the file can't be read or parsed.
+//
+// The file is read once. Use Watch to pick up later changes.
+func NewKeyList(path string, logf logger.Logf) (*KeyList, error) {
+	l := &KeyList{path: path, logf: logf}
+	if _, err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// AdmitClient implements [derp.ClientAdmitter].
+func (l *KeyList) AdmitClient(ctx context.Context, k key.NodePublic, src netip.Addr) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.deny.Contains(k) {
+		return fmt.Errorf("node key %v denied by %s", k.ShortString(), l.path)
+	}
+	if len(l.allow) > 0 && !l.allow.Contains(k) {
+		return fmt.Errorf("node key %v not allowed by %s", k.ShortString(), l.path)
+	}
+	return nil
+}
+
+// Watch polls the file every interval, reloading it when it changes,
+// until ctx is done. If a changed file fails to parse, the error is
+// logged and the previous contents remain in effect.
+func (l *KeyList) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed, err := l.reload()
+		if err != nil {
+			l.logf("derpadmit: reloading %s: %v", l.path, err)
+		} else if changed {
+			l.logf("derpadmit: reloaded %s", l.path)
+		}
+	}
+}
+
+// reload re-reads l's file if its size or modification time changed,
+// reporting whether it did.
+func (l *KeyList) reload() (changed bool, err error) {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	unchanged := fi.ModTime().Equal(l.modTime) && fi.Size() == l.size && l.allow != nil
+	l.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	b, err := os.ReadFile(l.path)
+	if err != nil {
+		return false, err
+	}
+	allow, deny, err := parseKeyList(bytes.NewReader(b))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", l.path, err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.allow, l.deny = allow, deny
+	l.modTime, l.size = fi.ModTime(), fi.Size()
+	return true, nil
+}
+
+// parseKeyList parses the KeyList file format. The returned sets are
+// non-nil.
+func parseKeyList(r io.Reader) (allow, deny set.Set[key.NodePublic], err error) {
+	allow, deny = set.Set[key.NodePublic]{}, set.Set[key.NodePublic]{}
+	bs := bufio.NewScanner(r)
+	for lineNum := 1; bs.Scan(); lineNum++ {
+		line := strings.TrimSpace(bs.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		verb, keyStr, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, nil, fmt.Errorf("line %d: want \"allow <nodekey>\" or \"deny <nodekey>\"", lineNum)
+		}
+		var k key.NodePublic
+		if err := k.UnmarshalText([]byte(strings.TrimSpace(keyStr))); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		switch verb {
+		case "allow":
+			allow.Add(k)
+		case "deny":
+			deny.Add(k)
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown verb %q", lineNum, verb)
+		}
+	}
+	return allow, deny, bs.Err()
+}
+
+// CIDRAllowList is a ClientAdmitter admitting only clients whose source IP
+// is within a set of prefixes.
+type CIDRAllowList struct {
+	ips *netipx.IPSet
+}
+
+// NewCIDRAllowList returns a CIDRAllowList admitting clients from the
+// provided prefixes.
+func NewCIDRAllowList(prefixes []netip.Prefix) (*CIDRAllowList, error) {
+	var b netipx.IPSetBuilder
+	for _, p := range prefixes {
+		b.AddPrefix(p)
+	}
+	ips, err := b.IPSet()
+	if err != nil {
+		return nil, err
+	}
+	return &CIDRAllowList{ips: ips}, nil
+}
+
+// ParseCIDRAllowList returns a CIDRAllowList from a comma-separated list
+// of prefixes, such as "10.0.0.0/8,2001:db8::/32".
+func ParseCIDRAllowList(s string) (*CIDRAllowList, error) {
+	var prefixes []netip.Prefix
+	for _, ps := range strings.Split(s, ",") {
+		p, err := netip.ParsePrefix(strings.TrimSpace(ps))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return NewCIDRAllowList(prefixes)
+}
+
+var errUnknownSource = errors.New("client source IP unknown")
+
+// AdmitClient implements [derp.ClientAdmitter].
+func (l *CIDRAllowList) AdmitClient(ctx context.Context, k key.NodePublic, src netip.Addr) error {
+	if !src.IsValid() {
+		return errUnknownSource
+	}
+	if !l.ips.Contains(src.Unmap()) {
+		return fmt.Errorf("source IP %v not in allowed CIDRs", src)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpadmit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+)
+
+func TestKeyList(t *testing.T) {
+	ctx := context.Background()
+	k1 := key.NewNode().Public()
+	k2 := key.NewNode().Public()
+	k3 := key.NewNode().Public()
+	path := filepath.Join(t.TempDir(), "keys")
+	write := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(l *KeyList, k key.NodePublic, want bool) {
+		t.Helper()
+		if got := l.AdmitClient(ctx, k, netip.Addr{}) == nil; got != want {
+			t.Errorf("admit %v = %v; want %v", k.ShortString(), got, want)
+		}
+	}
+
+	write("# only deny\ndeny " + k1.String() + "\n")
+	l, err := NewKeyList(path, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(l, k1, false)
+	check(l, k2, true)
+
+	write("allow " + k2.String() + "\n\ndeny " + k1.String() + "\n")
+	// Ensure the modification time differs even on coarse filesystems.
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := l.reload(); err != nil || !changed {
+		t.Fatalf("reload = %v, %v; want true, nil", changed, err)
+	}
+	check(l, k1, false)
+	check(l, k2, true)
+	check(l, k3, false)
+
+	if changed, err := l.reload(); err != nil || changed {
+		t.Fatalf("second reload = %v, %v; want false, nil", changed, err)
+	}
+
+	write("permit " + k3.String() + "\n")
+	if _, err := NewKeyList(path, t.Logf); err == nil {
+		t.Error("unexpected success parsing unknown verb")
+	}
+}
+
+func TestCIDRAllowList(t *testing.T) {
+	l, err := ParseCIDRAllowList("10.0.0.0/8, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := key.NewNode().Public()
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		var ip netip.Addr
+		if tt.ip != "" {
+			ip = netip.MustParseAddr(tt.ip)
+		}
+		if got := l.AdmitClient(context.Background(), k, ip) == nil; got != tt.want {
+			t.Errorf("admit %q = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+	if _, err := ParseCIDRAllowList("10.0.0.0/8,bogus"); err == nil {
+		t.Error("unexpected success parsing bogus prefix")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	allowed := key.NewNode().Public()
+	denied := key.NewNode().Public()
+	src := netip.MustParseAddr("192.0.2.1")
+
+	var hits atomic.Int32
+	var unreachable, failing atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if unreachable.Load() {
+			panic(http.ErrAbortHandler) // close the connection
+		}
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		var req tailcfg.DERPAdmitClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(tailcfg.DERPAdmitClientResponse{Allow: req.NodePublic == allowed})
+	}))
+	defer ts.Close()
+
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	w := &Webhook{
+		URL:             ts.URL,
+		TTL:             time.Minute,
+		NegativeTTL:     10 * time.Second,
+		RetryAfterError: 30 * time.Second,
+		Logf:            t.Logf,
+		clock:           clock,
+	}
+	check := func(k key.NodePublic, want bool, wantHits int32) {
+		t.Helper()
+		if got := w.AdmitClient(ctx, k, src) == nil; got != want {
+			t.Errorf("admit = %v; want %v", got, want)
+		}
+		if got := hits.Load(); got != wantHits {
+			t.Errorf("hits = %v; want %v", got, wantHits)
+		}
+	}
+
+	check(allowed, true, 1)
+	check(denied, false, 2)
+	check(allowed, true, 2) // cached
+	check(denied, false, 2) // negatively cached
+
+	clock.Advance(15 * time.Second)
+	check(denied, false, 3) // negative cache expired
+	check(allowed, true, 3)
+
+	// During an outage, stale decisions are used and the controller
+	// isn't queried again until RetryAfterError passes.
+	clock.Advance(time.Minute)
+	unreachable.Store(true)
+	check(allowed, true, 4)
+	check(allowed, true, 4)
+	stranger := key.NewNode().Public()
+	check(stranger, false, 4)
+	w.FailOpen = true
+	check(stranger, true, 4)
+
+	clock.Advance(time.Minute)
+	unreachable.Store(false)
+	check(stranger, false, 5)
+
+	// A non-200 response rejects the client, even with FailOpen and a
+	// stale decision to admit it, and doesn't stop queries.
+	clock.Advance(time.Minute)
+	failing.Store(true)
+	check(allowed, false, 6)
+	check(stranger, false, 7)
+}
@@ -0,0 +1,209 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package derpadmit
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/lru"
+)
+
+// defaultMaxWebhookCacheEntries is the default value of
+// Webhook.MaxCacheEntries.
+const defaultMaxWebhookCacheEntries = 10000
+
+// Webhook is a ClientAdmitter that asks an HTTP admission controller
+// whether to admit each client, using the same protocol as
+// [derp.Server.SetVerifyClientURL] (see [tailcfg.DERPAdmitClientRequest]).
+//
+// Unlike SetVerifyClientURL, Webhook caches decisions so that reconnecting
+// clients don't each cost a request, and stops querying an unreachable
+// controller for a while after a failure. During such an outage, expired
+// cached decisions are used in preference to FailOpen. A controller that
+// responds with a non-200 status isn't unreachable: the client is rejected.
+//
+// A Webhook must not be copied after first use.
+type Webhook struct {
+	// URL is the admission controller URL. It must be set.
+	URL string
+
+	// FailOpen is whether to admit clients when the admission
+	// controller can't be reached and there's no cached decision for
+	// the client. It doesn't apply to non-200 responses, which reject
+	// the client.
+	FailOpen bool
+
+	// TTL is how long a decision to admit a client is cached. Zero
+	// disables caching of admissions.
+	TTL time.Duration
+
+	// NegativeTTL is how long a decision to reject a client is cached.
+	// Zero disables caching of rejections.
+	NegativeTTL time.Duration
+
+	// RetryAfterError is how long to stop querying the admission
+	// controller after a failed request. Zero means to query it for
+	// every uncached client.
+	RetryAfterError time.Duration
+
+	// MaxCacheEntries is the maximum number of decisions cached. If
+	// zero, a default of 10,000 is used.
+	MaxCacheEntries int
+
+	// HTTPClient, if non-nil, is the client used to query URL. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Logf, if non-nil, logs admission controller failures.
+	Logf logger.Logf
+
+	clock tstime.Clock // or nil for the real clock
+
+	mu        sync.Mutex
+	cache     *lru.Cache[webhookCacheKey, webhookDecision] // lazily initialized
+	downUntil time.Time                                    // don't query URL before this time
+}
+
+type webhookCacheKey struct {
+	node key.NodePublic
+	src  netip.Addr
+}
+
+type webhookDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+func (w *Webhook) now() time.Time {
+	if w.clock != nil {
+		return w.clock.Now()
+	}
+	return time.Now()
+}
+
+func (w *Webhook) logf(format string, args ...any) {
+	if w.Logf != nil {
+		w.Logf(format, args...)
+	}
+}
+
+// AdmitClient implements [derp.ClientAdmitter].
+func (w *Webhook) AdmitClient(ctx context.Context, k key.NodePublic, src netip.Addr) error {
+	now := w.now()
+	ck := webhookCacheKey{k, src}
+
+	w.mu.Lock()
+	if w.cache == nil {
+		w.cache = &lru.Cache[webhookCacheKey, webhookDecision]{
+			MaxEntries: cmp.Or(w.MaxCacheEntries, defaultMaxWebhookCacheEntries),
+		}
+	}
+	cached, haveCached := w.cache.GetOk(ck)
+	down := now.Before(w.downUntil)
+	w.mu.Unlock()
+
+	if haveCached && now.Before(cached.expires) {
+		return w.decisionErr(k, src, cached.allow)
+	}
+	if !down {
+		allow, err := w.query(ctx, k, src)
+		if err == nil {
+			ttl := w.NegativeTTL
+			if allow {
+				ttl = w.TTL
+			}
+			if ttl > 0 {
+				w.mu.Lock()
+				w.cache.Set(ck, webhookDecision{allow: allow, expires: now.Add(ttl)})
+				w.mu.Unlock()
+			}
+			return w.decisionErr(k, src, allow)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		w.logf("derpadmit: admission controller failed for %v: %v", k.ShortString(), err)
+		if errors.As(err, new(webhookStatusError)) {
+			return err
+		}
+		if w.RetryAfterError > 0 {
+			w.mu.Lock()
+			w.downUntil = now.Add(w.RetryAfterError)
+			w.mu.Unlock()
+		}
+	}
+	if haveCached {
+		return w.decisionErr(k, src, cached.allow)
+	}
+	if w.FailOpen {
+		return nil
+	}
+	return fmt.Errorf("admission controller unavailable; rejecting %v", k)
+}
+
+// webhookStatusError is the error for a non-200 response from the
+// admission controller.
+type webhookStatusError struct {
+	status string
+}
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("admission controller: %v", e.status)
+}
+
+func (w *Webhook) decisionErr(k key.NodePublic, src netip.Addr, allow bool) error {
+	if allow {
+		return nil
+	}
+	return fmt.Errorf("admission controller: %v/%v not allowed", k, src)
+}
+
+// query asks the admission controller whether to admit k from src.
+func (w *Webhook) query(ctx context.Context, k key.NodePublic, src netip.Addr) (allow bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	jreq, err := json.Marshal(&tailcfg.DERPAdmitClientRequest{
+		NodePublic: k,
+		Source:     src,
+	})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(jreq))
+	if err != nil {
+		return false, err
+	}
+	hc := w.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return false, webhookStatusError{res.Status}
+	}
+	var jres tailcfg.DERPAdmitClientResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 4<<10)).Decode(&jres); err != nil {
+		return false, err
+	}
+	return jres.Allow, nil
+}
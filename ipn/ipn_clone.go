@@ -91,7 +91,7 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			if v == nil {
 				dst.TCP[k] = nil
 			} else {
-				dst.TCP[k] = ptr.To(*v)
+				dst.TCP[k] = v.Clone()
 			}
 		}
 	}
@@ -153,7 +153,7 @@ func (src *ServiceConfig) Clone() *ServiceConfig {
 			if v == nil {
 				dst.TCP[k] = nil
 			} else {
-				dst.TCP[k] = ptr.To(*v)
+				dst.TCP[k] = v.Clone()
 			}
 		}
 	}
@@ -185,15 +185,21 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 	}
 	dst := new(TCPPortHandler)
 	*dst = *src
+	dst.TCPForwardBackends = append(src.TCPForwardBackends[:0:0], src.TCPForwardBackends...)
+	if dst.LoadBalancing != nil {
+		dst.LoadBalancing = ptr.To(*src.LoadBalancing)
+	}
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerCloneNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	HTTP         bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS              bool
+	HTTP               bool
+	TCPForward         string
+	TerminateTLS       string
+	TCPForwardBackends []string
+	LoadBalancing      *LoadBalancing
 }{})
 
 // Clone makes a deep copy of HTTPHandler.
@@ -204,14 +210,33 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.AllowUsers = append(src.AllowUsers[:0:0], src.AllowUsers...)
+	dst.AllowTags = append(src.AllowTags[:0:0], src.AllowTags...)
+	dst.AllowCaps = append(src.AllowCaps[:0:0], src.AllowCaps...)
+	dst.RequestHeaders = maps.Clone(src.RequestHeaders)
+	dst.ResponseHeaders = maps.Clone(src.ResponseHeaders)
+	dst.ProxyBackends = append(src.ProxyBackends[:0:0], src.ProxyBackends...)
+	if dst.LoadBalancing != nil {
+		dst.LoadBalancing = ptr.To(*src.LoadBalancing)
+	}
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path            string
+	Proxy           string
+	Text            string
+	Redirect        string
+	Status          int
+	AllowUsers      []string
+	AllowTags       []string
+	AllowCaps       []tailcfg.PeerCapability
+	RequestHeaders  map[string]string
+	ResponseHeaders map[string]string
+	ProxyBackends   []string
+	LoadBalancing   *LoadBalancing
+	StripPrefix     string
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -228,7 +253,7 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 			if v == nil {
 				dst.Handlers[k] = nil
 			} else {
-				dst.Handlers[k] = ptr.To(*v)
+				dst.Handlers[k] = v.Clone()
 			}
 		}
 	}
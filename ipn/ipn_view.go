@@ -336,13 +336,22 @@ func (v TCPPortHandlerView) HTTPS() bool          { return v.ж.HTTPS }
 func (v TCPPortHandlerView) HTTP() bool           { return v.ж.HTTP }
 func (v TCPPortHandlerView) TCPForward() string   { return v.ж.TCPForward }
 func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
+func (v TCPPortHandlerView) TCPForwardBackends() views.Slice[string] {
+	return views.SliceOf(v.ж.TCPForwardBackends)
+}
+
+func (v TCPPortHandlerView) LoadBalancing() views.ValuePointer[LoadBalancing] {
+	return views.ValuePointerOf(v.ж.LoadBalancing)
+}
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerViewNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	HTTP         bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS              bool
+	HTTP               bool
+	TCPForward         string
+	TerminateTLS       string
+	TCPForwardBackends []string
+	LoadBalancing      *LoadBalancing
 }{})
 
 // View returns a read-only view of HTTPHandler.
@@ -390,15 +399,50 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string                    { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string                   { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string                    { return v.ж.Text }
+func (v HTTPHandlerView) Redirect() string                { return v.ж.Redirect }
+func (v HTTPHandlerView) Status() int                     { return v.ж.Status }
+func (v HTTPHandlerView) AllowUsers() views.Slice[string] { return views.SliceOf(v.ж.AllowUsers) }
+func (v HTTPHandlerView) AllowTags() views.Slice[string]  { return views.SliceOf(v.ж.AllowTags) }
+func (v HTTPHandlerView) AllowCaps() views.Slice[tailcfg.PeerCapability] {
+	return views.SliceOf(v.ж.AllowCaps)
+}
+
+func (v HTTPHandlerView) RequestHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.RequestHeaders)
+}
+
+func (v HTTPHandlerView) ResponseHeaders() views.Map[string, string] {
+	return views.MapOf(v.ж.ResponseHeaders)
+}
+
+func (v HTTPHandlerView) ProxyBackends() views.Slice[string] {
+	return views.SliceOf(v.ж.ProxyBackends)
+}
+
+func (v HTTPHandlerView) LoadBalancing() views.ValuePointer[LoadBalancing] {
+	return views.ValuePointerOf(v.ж.LoadBalancing)
+}
+
+func (v HTTPHandlerView) StripPrefix() string { return v.ж.StripPrefix }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path            string
+	Proxy           string
+	Text            string
+	Redirect        string
+	Status          int
+	AllowUsers      []string
+	AllowTags       []string
+	AllowCaps       []tailcfg.PeerCapability
+	RequestHeaders  map[string]string
+	ResponseHeaders map[string]string
+	ProxyBackends   []string
+	LoadBalancing   *LoadBalancing
+	StripPrefix     string
 }{})
 
 // View returns a read-only view of WebServerConfig.
@@ -359,11 +359,14 @@ func handleC2NPostureIdentityGet(b *LocalBackend, w http.ResponseWriter, r *http
 				b.logf("c2n: GetHardwareAddrs returned error: %v", err)
 			}
 		}
+		if r.FormValue("attrs") == "true" {
+			res.Attributes = posture.CollectAttributes(b.logf)
+		}
 	} else {
 		res.PostureDisabled = true
 	}
 
-	b.logf("c2n: posture identity disabled=%v reported %d serials %d hwaddrs", res.PostureDisabled, len(res.SerialNumbers), len(res.IfaceHardwareAddrs))
+	b.logf("c2n: posture identity disabled=%v reported %d serials %d hwaddrs %d attributes", res.PostureDisabled, len(res.SerialNumbers), len(res.IfaceHardwareAddrs), len(res.Attributes))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(res)
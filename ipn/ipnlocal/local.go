@@ -86,6 +86,7 @@
 	"tailscale.com/types/appctype"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/empty"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
@@ -325,6 +326,7 @@ type LocalBackend struct {
 
 	serveListeners     map[netip.AddrPort]*localListener // listeners for local serve traffic
 	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *reverseProxy
+	serveLoadBalancers sync.Map                          // string (serveLoadBalancerKey) => *serveLoadBalancer
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -698,6 +700,54 @@ func (b *LocalBackend) QueryDNS(name string, queryType dnsmessage.Type) (res []b
 	return res, rr, nil
 }
 
+// DNSCacheStatus returns the state of the internal DNS forwarder's
+// response cache.
+func (b *LocalBackend) DNSCacheStatus() (*apitype.DNSCacheStatus, error) {
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, errors.New("DNS manager not available")
+	}
+	st := manager.Resolver().CacheStatus()
+	if st == nil {
+		return nil, errors.New("DNS cache disabled")
+	}
+	return st, nil
+}
+
+// FlushDNSCache removes all responses from the internal DNS forwarder's
+// response cache.
+func (b *LocalBackend) FlushDNSCache() error {
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return errors.New("DNS manager not available")
+	}
+	manager.Resolver().FlushCache()
+	return nil
+}
+
+// SetDNSQueryLogEnabled sets whether the internal DNS resolver logs the
+// queries it handles.
+func (b *LocalBackend) SetDNSQueryLogEnabled(v bool) error {
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return errors.New("DNS manager not available")
+	}
+	manager.Resolver().SetQueryLogEnabled(v)
+	return nil
+}
+
+// RegisterDNSQueryLogTap registers dst to be sent the DNS queries handled
+// by the internal DNS resolver, returning those logged so far. See
+// resolver.Resolver.RegisterQueryLogTap.
+func (b *LocalBackend) RegisterDNSQueryLogTap(dst chan<- apitype.DNSQueryLogEntry) (past []apitype.DNSQueryLogEntry, unregister func(), _ error) {
+	manager, ok := b.sys.DNSManager.GetOK()
+	if !ok {
+		return nil, nil, errors.New("DNS manager not available")
+	}
+	past, unregister = manager.Resolver().RegisterQueryLogTap(dst)
+	return past, unregister, nil
+}
+
 // GetComponentDebugLogging gets the time that component's debug logging is
 // enabled until, or the zero time if component's time is not currently
 // enabled.
@@ -3532,6 +3582,30 @@ func (b *LocalBackend) StartLoginInteractiveAs(ctx context.Context, user ipnauth
 	return nil
 }
 
+// RotateNodeKey asks control to replace the node's key with a newly
+// generated one. It returns once the request has been started; the new key
+// is in use once the backend is Running with a different NodeKey.
+//
+// The new key is registered with the current one as its OldNodeKey, and, if
+// the current key has a Tailnet Lock signature, with that signature
+// re-signed for the new key by the node's network-lock key. Whether the
+// node keeps its identity without the user logging in again is up to
+// control: it must accept the OldNodeKey as proof of the node's identity,
+// as it does when a node regenerates an expired key. Otherwise the user
+// has to log in again.
+func (b *LocalBackend) RotateNodeKey() error {
+	b.mu.Lock()
+	cc := b.cc
+	hasKey := b.hasNodeKeyLocked()
+	b.mu.Unlock()
+	if cc == nil || !hasKey {
+		return errors.New("no node key to rotate; not logged in")
+	}
+	b.logf("RotateNodeKey")
+	cc.Login(b.loginFlags | controlclient.LoginRegenNodeKey)
+	return nil
+}
+
 func (b *LocalBackend) Ping(ctx context.Context, ip netip.Addr, pingType tailcfg.PingType, size int) (*ipnstate.PingResult, error) {
 	if pingType == tailcfg.PingPeerAPI {
 		t0 := b.clock.Now()
@@ -5993,6 +6067,8 @@ func (b *LocalBackend) setTCPPortsInterceptedFromNetmapAndPrefsLocked(prefs ipn.
 		}
 	}
 
+	b.setServeLoadBalancersLocked()
+
 	// Update funnel info in hostinfo and kick off control update if needed.
 	b.updateIngressLocked()
 	b.setTCPPortsIntercepted(handlePorts)
@@ -6035,25 +6111,26 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	var backends map[string]bool
 	for _, conf := range b.serveConfig.Webs() {
 		for _, h := range conf.Handlers().All() {
-			backend := h.Proxy()
-			if backend == "" {
+			if h.Proxy() == "" {
 				// Only create proxy handlers for servers with a proxy backend.
 				continue
 			}
-			mak.Set(&backends, backend, true)
-			if _, ok := b.serveProxyHandlers.Load(backend); ok {
-				continue
-			}
+			for _, backend := range serveProxyBackends(h) {
+				mak.Set(&backends, backend, true)
+				if _, ok := b.serveProxyHandlers.Load(backend); ok {
+					continue
+				}
 
-			b.logf("serve: creating a new proxy handler for %s", backend)
-			p, err := b.proxyHandlerForBackend(backend)
-			if err != nil {
-				// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
-				// in the CLI, so just log the error here.
-				b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
-				continue
+				b.logf("serve: creating a new proxy handler for %s", backend)
+				p, err := b.proxyHandlerForBackend(backend)
+				if err != nil {
+					// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
+					// in the CLI, so just log the error here.
+					b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+					continue
+				}
+				b.serveProxyHandlers.Store(backend, p)
 			}
-			b.serveProxyHandlers.Store(backend, p)
 		}
 	}
 
@@ -6070,6 +6147,50 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	})
 }
 
+// setServeLoadBalancersLocked ensures there is a load balancer for each
+// HTTPHandler and TCPPortHandler with several backends in serveConfig, and
+// closes those no longer needed. It expects serveConfig to be up-to-date, so
+// should be called after reloadServeConfigLocked.
+func (b *LocalBackend) setServeLoadBalancersLocked() {
+	var keys map[string]bool
+	add := func(backends []string, conf ipn.LoadBalancing, check func(context.Context, *serveBackend) error) {
+		key := serveLoadBalancerKey(backends, conf)
+		mak.Set(&keys, key, true)
+		if _, ok := b.serveLoadBalancers.Load(key); ok {
+			return
+		}
+		b.logf("serve: creating a new load balancer for %q", backends)
+		b.serveLoadBalancers.Store(key, newServeLoadBalancer(b.ctx, b.logf, backends, conf, check, b.goTracker.Go))
+	}
+	if b.serveConfig.Valid() {
+		for _, conf := range b.serveConfig.Webs() {
+			for _, h := range conf.Handlers().All() {
+				if h.Proxy() == "" || h.ProxyBackends().Len() == 0 {
+					continue
+				}
+				lbConf := h.LoadBalancing().GetOr(ipn.LoadBalancing{})
+				add(serveProxyBackends(h), lbConf, b.serveHTTPHealthCheck(lbConf.HealthCheckPath))
+			}
+		}
+		for _, h := range b.serveConfig.TCPs() {
+			if h.TCPForward() == "" || h.TCPForwardBackends().Len() == 0 {
+				continue
+			}
+			add(serveTCPForwardBackends(h), h.LoadBalancing().GetOr(ipn.LoadBalancing{}), func(ctx context.Context, be *serveBackend) error {
+				return b.serveTCPHealthCheck(ctx, be.addr)
+			})
+		}
+	}
+
+	b.serveLoadBalancers.Range(func(key, value any) bool {
+		if !keys[key.(string)] {
+			b.serveLoadBalancers.Delete(key)
+			value.(*serveLoadBalancer).close()
+		}
+		return true
+	})
+}
+
 // operatorUserName returns the current pref's OperatorUser's name, or the
 // empty string if none.
 func (b *LocalBackend) operatorUserName() string {
@@ -7034,13 +7155,15 @@ func (b *LocalBackend) ResetAuth() error {
 }
 
 // StreamDebugCapture writes a pcap stream of packets traversing
-// tailscaled to the provided response writer.
-func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) error {
+// tailscaled to the provided response writer, in the format and with the
+// filter given by opts.
+func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer, opts capture.OutputOptions) error {
 	var s *capture.Sink
 
 	b.mu.Lock()
 	if b.debugSink == nil {
 		s = capture.New()
+		s.SetPeerLookup(b.capturePeerLookup)
 		b.debugSink = s
 		b.e.InstallCaptureHook(s.LogPacket)
 	} else {
@@ -7048,7 +7171,7 @@ func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) erro
 	}
 	b.mu.Unlock()
 
-	unregister := s.RegisterOutput(w)
+	unregister := s.RegisterOutputWithOptions(w, opts)
 
 	select {
 	case <-ctx.Done():
@@ -7075,6 +7198,58 @@ func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) erro
 	return nil
 }
 
+// capturePeerLookup is the capture.PeerLookupFunc of b.debugSink. It
+// returns the peer that owns ip, either as one of its addresses or as a
+// subnet route.
+func (b *LocalBackend) capturePeerLookup(ip netip.Addr) (capture.PeerInfo, bool) {
+	pip, ok := b.e.PeerForIP(ip)
+	if !ok || pip.IsSelf || !pip.Node.Valid() {
+		return capture.PeerInfo{}, false
+	}
+	return capture.PeerInfo{
+		NodeKey:    pip.Node.Key(),
+		Name:       pip.Node.Name(),
+		DERPRegion: pip.Node.HomeDERP(),
+	}, true
+}
+
+// DebugFilterCheck reports whether the packet filter allows traffic from src
+// to dst:port using proto, and why. If dst is the zero value, the node's own
+// Tailscale address of src's family is used.
+func (b *LocalBackend) DebugFilterCheck(src, dst netip.Addr, port uint16, proto ipproto.Proto) (*apitype.FilterCheckResponse, error) {
+	if !dst.IsValid() {
+		nm := b.NetMap()
+		if nm == nil {
+			return nil, errors.New("no netmap")
+		}
+		addrs := nm.GetAddresses()
+		for i := range addrs.Len() {
+			if a := addrs.At(i); a.IsSingleIP() && a.Addr().BitLen() == src.BitLen() {
+				dst = a.Addr()
+				break
+			}
+		}
+		if !dst.IsValid() {
+			return nil, fmt.Errorf("no Tailscale address of the same family as %v", src)
+		}
+	}
+	filt := b.e.GetFilter()
+	if filt == nil {
+		return nil, errors.New("no packet filter")
+	}
+	res := filt.Explain(src, dst, port, proto)
+	return &apitype.FilterCheckResponse{
+		Src:     src,
+		Dst:     dst,
+		Port:    port,
+		Proto:   proto.String(),
+		Verdict: res.Response.String(),
+		Reason:  res.Why,
+		Match:   res.Match,
+		Caps:    res.Caps,
+	}, nil
+}
+
 func (b *LocalBackend) GetPeerEndpointChanges(ctx context.Context, ip netip.Addr) ([]magicsock.EndpointChange, error) {
 	pip, ok := b.e.PeerForIP(ip)
 	if !ok {
@@ -7250,20 +7425,13 @@ func (b *LocalBackend) UnadvertiseRoute(toRemove ...netip.Prefix) error {
 	return err
 }
 
-// namespace a key with the profile manager's current profile key, if any
-func namespaceKeyForCurrentProfile(pm *profileManager, key ipn.StateKey) ipn.StateKey {
-	return pm.CurrentProfile().Key + "||" + key
-}
-
-const routeInfoStateStoreKey ipn.StateKey = "_routeInfo"
-
 func (b *LocalBackend) storeRouteInfo(ri *appc.RouteInfo) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	if b.pm.CurrentProfile().ID == "" {
 		return nil
 	}
-	key := namespaceKeyForCurrentProfile(b.pm, routeInfoStateStoreKey)
+	key := ipn.RouteInfoKey(b.pm.CurrentProfile().Key)
 	bs, err := json.Marshal(ri)
 	if err != nil {
 		return err
@@ -7275,7 +7443,7 @@ func (b *LocalBackend) readRouteInfoLocked() (*appc.RouteInfo, error) {
 	if b.pm.CurrentProfile().ID == "" {
 		return &appc.RouteInfo{}, nil
 	}
-	key := namespaceKeyForCurrentProfile(b.pm, routeInfoStateStoreKey)
+	key := ipn.RouteInfoKey(b.pm.CurrentProfile().Key)
 	bs, err := b.pm.Store().ReadState(key)
 	ri := &appc.RouteInfo{}
 	if err != nil {
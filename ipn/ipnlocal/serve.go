@@ -36,8 +36,10 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/lazy"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/views"
 	"tailscale.com/util/ctxkey"
 	"tailscale.com/util/mak"
+	"tailscale.com/util/set"
 	"tailscale.com/version"
 )
 
@@ -274,6 +276,9 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string
 	if b.isConfigLocked_Locked() {
 		return errors.New("can't reconfigure tailscaled when using a config file; config file is locked")
 	}
+	if err := config.CheckHTTPStatuses(); err != nil {
+		return err
+	}
 
 	nm := b.netMap
 	if nm == nil {
@@ -477,9 +482,7 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 	if backDst := tcph.TCPForward(); backDst != "" {
 		return func(conn net.Conn) error {
 			defer conn.Close()
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
-			cancel()
+			backConn, err := b.dialTCPForward(tcph)
 			if err != nil {
 				b.logf("localbackend: failed to TCP proxy port %v (from %v) to %s: %v", dport, srcAddr, backDst, err)
 				return nil
@@ -521,6 +524,51 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort,
 	return nil
 }
 
+// dialTCPForward dials the backend that tcph forwards connections to. If
+// tcph has several backends, it dials the one picked by its load balancer,
+// falling back to the others in turn if it can't be reached.
+func (b *LocalBackend) dialTCPForward(tcph ipn.TCPPortHandlerView) (net.Conn, error) {
+	dial := func(addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return b.dialer.SystemDial(ctx, "tcp", addr)
+	}
+	if tcph.TCPForwardBackends().Len() == 0 {
+		return dial(tcph.TCPForward())
+	}
+	v, ok := b.serveLoadBalancers.Load(serveLoadBalancerKey(serveTCPForwardBackends(tcph), tcph.LoadBalancing().GetOr(ipn.LoadBalancing{})))
+	if !ok {
+		return nil, errors.New("no load balancer for backends")
+	}
+	lb := v.(*serveLoadBalancer)
+	var errs []error
+	tried := make(set.Set[*serveBackend])
+	for be := lb.pick(tried.Contains); be != nil; be = lb.pick(tried.Contains) {
+		tried.Add(be)
+		lb.acquire(be)
+		c, err := dial(be.addr)
+		if err != nil {
+			lb.release(be, err)
+			errs = append(errs, fmt.Errorf("%s: %w", be.addr, err))
+			continue
+		}
+		return &balancedConn{Conn: c, release: sync.OnceFunc(func() { lb.release(be, nil) })}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// balancedConn is a connection to a load-balanced backend, which is
+// released back to its load balancer when closed.
+type balancedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *balancedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
 func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
 	var z ipn.HTTPHandlerView // zero value
 
@@ -584,6 +632,11 @@ func (b *LocalBackend) proxyHandlerForBackend(backend string) (http.Handler, err
 	return p, nil
 }
 
+// serveProxyErrorKey is the context key for a func that a reverseProxy
+// calls, instead of responding with an error, when it can't reach its
+// backend.
+var serveProxyErrorKey ctxkey.Key[func(error)]
+
 // reverseProxy is a proxy that forwards a request to a backend host
 // (preconfigured via ipn.ServeConfig). If the host is configured with
 // http+insecure prefix, connection between proxy and backend will be over
@@ -644,6 +697,9 @@ func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		addProxyForwardedHeaders(r)
 		rp.lb.addTailscaleIdentityHeaders(r)
 	}}
+	if f, ok := serveProxyErrorKey.ValueOk(r.Context()); ok {
+		p.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) { f(err) }
+	}
 
 	// There is no way to autodetect h2c as per RFC 9113
 	// https://datatracker.ietf.org/doc/html/rfc9113#name-starting-http-2.
@@ -772,8 +828,34 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if !b.serveAccessAllowed(h, r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if h.ResponseHeaders().Len() > 0 {
+		w = &setHeadersResponseWriter{ResponseWriter: w, headers: h.ResponseHeaders()}
+	}
+	setHeaders(r.Header, h.RequestHeaders())
+	if err := h.CheckStatus(); err != nil {
+		// Serve configs are checked when they're set, but not when
+		// they're loaded from the state store.
+		b.logf("serve: %v", err)
+		http.Error(w, "invalid handler status", http.StatusInternalServerError)
+		return
+	}
+	if v := h.Redirect(); v != "" {
+		code := h.Status()
+		if code == 0 {
+			code = http.StatusFound
+		}
+		http.Redirect(w, r, expandRedirectTarget(v, r), code)
+		return
+	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if code := h.Status(); code != 0 {
+			w.WriteHeader(code)
+		}
 		io.WriteString(w, s)
 		return
 	}
@@ -782,23 +864,191 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if v := h.Proxy(); v != "" {
-		p, ok := b.serveProxyHandlers.Load(v)
-		if !ok {
-			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
+		if h.ProxyBackends().Len() > 0 {
+			b.serveBalancedProxy(w, r, h, mountPoint)
 			return
 		}
-		h := p.(http.Handler)
-		// Trim the mount point from the URL path before proxying. (#6571)
-		if r.URL.Path != "/" {
-			h = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), h)
-		}
-		h.ServeHTTP(w, r)
+		b.serveProxy(w, r, v, h, mountPoint)
+		return
+	}
+	if code := h.Status(); code != 0 {
+		w.WriteHeader(code)
 		return
 	}
 
 	http.Error(w, "empty handler", 500)
 }
 
+// serveProxy proxies the request r, handled by h at mountPoint, to backend.
+func (b *LocalBackend) serveProxy(w http.ResponseWriter, r *http.Request, backend string, h ipn.HTTPHandlerView, mountPoint string) {
+	p, ok := b.serveProxyHandlers.Load(backend)
+	if !ok {
+		http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
+		return
+	}
+	ph := p.(http.Handler)
+	if v := h.StripPrefix(); v != "" {
+		ph = stripPathPrefix(v, ph)
+	}
+	// Trim the mount point from the URL path before proxying. (#6571)
+	if r.URL.Path != "/" {
+		ph = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), ph)
+	}
+	ph.ServeHTTP(w, r)
+}
+
+// serveBalancedProxy proxies the request r, handled by h at mountPoint, to
+// one of h's backends as picked by its load balancer. Requests without a
+// body are retried on another backend if the picked one can't be reached.
+func (b *LocalBackend) serveBalancedProxy(w http.ResponseWriter, r *http.Request, h ipn.HTTPHandlerView, mountPoint string) {
+	backends := serveProxyBackends(h)
+	v, ok := b.serveLoadBalancers.Load(serveLoadBalancerKey(backends, h.LoadBalancing().GetOr(ipn.LoadBalancing{})))
+	if !ok {
+		http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
+		return
+	}
+	lb := v.(*serveLoadBalancer)
+	canRetry := r.Body == nil || r.Body == http.NoBody
+	tried := make(set.Set[*serveBackend])
+	for {
+		be := lb.pick(tried.Contains)
+		tried.Add(be)
+
+		var proxyErr error
+		ctx := serveProxyErrorKey.WithValue(r.Context(), func(err error) { proxyErr = err })
+		lb.acquire(be)
+		b.serveProxy(w, r.WithContext(ctx), be.addr, h, mountPoint)
+		if r.Context().Err() != nil {
+			// The client went away; that's not the backend's fault.
+			lb.release(be, nil)
+			return
+		}
+		lb.release(be, proxyErr)
+		if proxyErr == nil {
+			return
+		}
+		b.logf("serve: proxy error from %s: %v", be.addr, proxyErr)
+		if !canRetry || len(tried) == len(backends) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+}
+
+// serveAccessAllowed reports whether h's access rules, if any, permit the
+// request r.
+func (b *LocalBackend) serveAccessAllowed(h ipn.HTTPHandlerView, r *http.Request) bool {
+	if h.AllowUsers().Len() == 0 && h.AllowTags().Len() == 0 && h.AllowCaps().Len() == 0 {
+		return true
+	}
+	c, ok := serveHTTPContextKey.ValueOk(r.Context())
+	if !ok || c.Funnel != nil {
+		return false
+	}
+	node, user, ok := b.WhoIs("tcp", c.SrcAddr)
+	if !ok {
+		return false
+	}
+	if node.IsTagged() {
+		for _, tag := range node.Tags().All() {
+			if h.AllowTags().ContainsFunc(func(t string) bool { return t == tag }) {
+				return true
+			}
+		}
+	} else if h.AllowUsers().ContainsFunc(func(u string) bool { return strings.EqualFold(u, user.LoginName) }) {
+		return true
+	}
+	if h.AllowCaps().Len() > 0 {
+		caps := b.PeerCaps(c.SrcAddr.Addr())
+		for _, cap := range h.AllowCaps().All() {
+			if caps.HasCapability(cap) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setHeaders sets the headers in hs on dst, removing those with empty
+// values.
+func setHeaders(dst http.Header, hs views.Map[string, string]) {
+	for k, v := range hs.All() {
+		if v == "" {
+			dst.Del(k)
+		} else {
+			dst.Set(k, v)
+		}
+	}
+}
+
+// expandRedirectTarget returns the HTTPHandler.Redirect URL target with its
+// placeholders replaced for the request r.
+func expandRedirectTarget(target string, r *http.Request) string {
+	return strings.NewReplacer(
+		"${HOST}", r.Host,
+		"${REQUEST_URI}", r.URL.RequestURI(),
+	).Replace(target)
+}
+
+// stripPathPrefix returns a handler that serves requests by removing prefix
+// from the request URL's path, if present, and invoking h. Unlike
+// http.StripPrefix, prefix only matches whole path segments and requests
+// without it are passed to h unchanged.
+func stripPathPrefix(prefix string, h http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	strip := func(p string) (string, bool) {
+		rest, ok := strings.CutPrefix(p, prefix)
+		if !ok || rest != "" && rest[0] != '/' {
+			return p, false
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		return rest, true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := strip(r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath, _ = strip(r.URL.RawPath)
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// setHeadersResponseWriter is an http.ResponseWriter wrapper that sets
+// HTTPHandler.ResponseHeaders upon writing HTTP headers.
+type setHeadersResponseWriter struct {
+	http.ResponseWriter
+	headers     views.Map[string, string]
+	wroteHeader bool
+}
+
+func (w *setHeadersResponseWriter) WriteHeader(code int) {
+	setHeaders(w.ResponseWriter.Header(), w.headers)
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *setHeadersResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying ResponseWriter, for
+// http.ResponseController.
+func (w *setHeadersResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
@@ -0,0 +1,281 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+const (
+	defaultServeHealthCheckTimeout = 2 * time.Second
+	defaultServeEjectDuration      = 30 * time.Second
+)
+
+// serveLoadBalancer balances requests or connections across the backends of
+// an ipn.HTTPHandler (as ipn.HTTPHandler.Proxy values) or an
+// ipn.TCPPortHandler (as IP:port addresses).
+type serveLoadBalancer struct {
+	logf     logger.Logf
+	conf     ipn.LoadBalancing
+	backends []*serveBackend
+	// check, if non-nil, is the active health check of a backend.
+	check func(ctx context.Context, be *serveBackend) error
+
+	ctx    context.Context // canceled by close
+	cancel context.CancelFunc
+	next   atomic.Uint32 // round-robin counter
+
+	mu sync.Mutex // guards the mutable fields of backends
+}
+
+// serveBackend is one of the backends of a serveLoadBalancer.
+type serveBackend struct {
+	addr   string       // ipn.HTTPHandler.Proxy form or IP:port
+	active atomic.Int32 // requests or connections in flight
+
+	// The following are guarded by serveLoadBalancer.mu.
+	unhealthy    bool      // the latest active health check failed
+	fails        int       // consecutive failed requests or connections
+	ejectedUntil time.Time // when a passive ejection ends
+}
+
+// serveLoadBalancerKey returns the key in LocalBackend.serveLoadBalancers
+// of the load balancer for backends with conf.
+func serveLoadBalancerKey(backends []string, conf ipn.LoadBalancing) string {
+	return fmt.Sprintf("%q %+v", backends, conf)
+}
+
+// serveProxyBackends returns the backends h proxies to: h.Proxy followed by
+// h.ProxyBackends.
+func serveProxyBackends(h ipn.HTTPHandlerView) []string {
+	return append([]string{h.Proxy()}, h.ProxyBackends().AsSlice()...)
+}
+
+// serveTCPForwardBackends returns the backends h forwards to: h.TCPForward
+// followed by h.TCPForwardBackends.
+func serveTCPForwardBackends(h ipn.TCPPortHandlerView) []string {
+	return append([]string{h.TCPForward()}, h.TCPForwardBackends().AsSlice()...)
+}
+
+// newServeLoadBalancer returns a load balancer for backends. If conf
+// enables active health checks, they're run with check until ctx is done
+// or the load balancer is closed; start is used to start them.
+func newServeLoadBalancer(ctx context.Context, logf logger.Logf, backends []string, conf ipn.LoadBalancing, check func(context.Context, *serveBackend) error, start func(func())) *serveLoadBalancer {
+	lb := &serveLoadBalancer{
+		logf: logf,
+		conf: conf,
+	}
+	lb.ctx, lb.cancel = context.WithCancel(ctx)
+	for _, addr := range backends {
+		lb.backends = append(lb.backends, &serveBackend{addr: addr})
+	}
+	if conf.HealthCheckInterval > 0 && check != nil {
+		lb.check = check
+		start(lb.runHealthChecks)
+	}
+	return lb
+}
+
+// close stops the load balancer's health checks.
+func (lb *serveLoadBalancer) close() {
+	lb.cancel()
+}
+
+// pick returns the backend to use for the next request or connection,
+// skipping those for which tried reports true. It returns nil if every
+// backend has been tried.
+//
+// Backends that are down are only picked if all untried backends are down.
+func (lb *serveLoadBalancer) pick(tried func(*serveBackend) bool) *serveBackend {
+	now := time.Now()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	n := uint32(len(lb.backends))
+	start := lb.next.Add(1) - 1
+	var best, fallback *serveBackend
+	for i := range n {
+		be := lb.backends[(start+i)%n]
+		if tried != nil && tried(be) {
+			continue
+		}
+		if be.unhealthy || now.Before(be.ejectedUntil) {
+			if fallback == nil || be.active.Load() < fallback.active.Load() {
+				fallback = be
+			}
+			continue
+		}
+		if lb.conf.Policy != ipn.LoadBalanceLeastConn {
+			return be
+		}
+		if best == nil || be.active.Load() < best.active.Load() {
+			best = be
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return fallback
+}
+
+// acquire records the start of a request or connection to be.
+func (lb *serveLoadBalancer) acquire(be *serveBackend) {
+	be.active.Add(1)
+}
+
+// release records the end of a request or connection to be, with err being
+// non-nil if be couldn't be reached.
+func (lb *serveLoadBalancer) release(be *serveBackend, err error) {
+	be.active.Add(-1)
+	lb.record(be, err)
+}
+
+// record records whether a request or connection to be failed to reach it,
+// ejecting it after too many consecutive failures.
+func (lb *serveLoadBalancer) record(be *serveBackend, err error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if err == nil {
+		be.fails = 0
+		return
+	}
+	be.fails++
+	if lb.conf.MaxFails <= 0 || be.fails < lb.conf.MaxFails {
+		return
+	}
+	d := lb.conf.EjectDuration
+	if d <= 0 {
+		d = defaultServeEjectDuration
+	}
+	lb.logf("serve: ejecting backend %s for %v after %d failures; last error: %v", be.addr, d, be.fails, err)
+	be.fails = 0
+	be.ejectedUntil = time.Now().Add(d)
+}
+
+// runHealthChecks checks the health of each backend at
+// conf.HealthCheckInterval until lb is closed.
+func (lb *serveLoadBalancer) runHealthChecks() {
+	t := time.NewTicker(lb.conf.HealthCheckInterval)
+	defer t.Stop()
+	for {
+		lb.checkHealth()
+		select {
+		case <-lb.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkHealth runs a health check of each backend concurrently and waits
+// for them to finish.
+func (lb *serveLoadBalancer) checkHealth() {
+	timeout := lb.conf.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultServeHealthCheckTimeout
+	}
+	var wg sync.WaitGroup
+	for _, be := range lb.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(lb.ctx, timeout)
+			err := lb.check(ctx, be)
+			cancel()
+			if lb.ctx.Err() != nil {
+				return
+			}
+			lb.mu.Lock()
+			defer lb.mu.Unlock()
+			if unhealthy := err != nil; unhealthy != be.unhealthy {
+				if unhealthy {
+					lb.logf("serve: backend %s failed health check: %v", be.addr, err)
+				} else {
+					lb.logf("serve: backend %s passed health check", be.addr)
+				}
+				be.unhealthy = unhealthy
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// serveHealthCheckTransport returns an HTTP transport for the health checks
+// of HTTP backends, skipping TLS verification if insecure.
+func (b *LocalBackend) serveHealthCheckTransport(insecure bool) *http.Transport {
+	return &http.Transport{
+		DialContext:       b.dialer.SystemDial,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecure},
+		DisableKeepAlives: true,
+	}
+}
+
+// serveHTTPHealthCheck returns a health check for HTTP backends (in
+// ipn.HTTPHandler.Proxy form) that GETs path, or if path is empty, makes a
+// TCP connection.
+func (b *LocalBackend) serveHTTPHealthCheck(path string) func(context.Context, *serveBackend) error {
+	secureTransport, insecureTransport := b.serveHealthCheckTransport(false), b.serveHealthCheckTransport(true)
+	return func(ctx context.Context, be *serveBackend) error {
+		targetURL, insecure := expandProxyArg(be.addr)
+		u, err := url.Parse(targetURL)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			return b.serveTCPHealthCheck(ctx, hostPortForURL(u))
+		}
+		u = u.ResolveReference(&url.URL{Path: path})
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		tr := secureTransport
+		if insecure {
+			tr = insecureTransport
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 399 {
+			return fmt.Errorf("unhealthy status %v", res.Status)
+		}
+		return nil
+	}
+}
+
+// serveTCPHealthCheck reports whether a TCP connection can be made to
+// hostPort.
+func (b *LocalBackend) serveTCPHealthCheck(ctx context.Context, hostPort string) error {
+	c, err := b.dialer.SystemDial(ctx, "tcp", hostPort)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// hostPortForURL returns the host:port that u refers to, using the
+// scheme's default port if u has none.
+func hostPortForURL(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestServeLoadBalancerPick(t *testing.T) {
+	backends := []string{"a", "b", "c"}
+	pickAddrs := func(lb *serveLoadBalancer, n int) (got []string) {
+		for range n {
+			got = append(got, lb.pick(nil).addr)
+		}
+		return got
+	}
+	backend := func(lb *serveLoadBalancer, addr string) *serveBackend {
+		for _, be := range lb.backends {
+			if be.addr == addr {
+				return be
+			}
+		}
+		t.Fatalf("no backend %q", addr)
+		return nil
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		lb := newServeLoadBalancer(context.Background(), t.Logf, backends, ipn.LoadBalancing{}, nil, nil)
+		defer lb.close()
+		if got, want := pickAddrs(lb, 4), []string{"a", "b", "c", "a"}; !slices.Equal(got, want) {
+			t.Errorf("picked %q; want %q", got, want)
+		}
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		lb := newServeLoadBalancer(context.Background(), t.Logf, backends, ipn.LoadBalancing{Policy: ipn.LoadBalanceLeastConn}, nil, nil)
+		defer lb.close()
+		lb.acquire(backend(lb, "a"))
+		lb.acquire(backend(lb, "b"))
+		lb.acquire(backend(lb, "b"))
+		if got := lb.pick(nil).addr; got != "c" {
+			t.Errorf("picked %q; want c", got)
+		}
+		lb.acquire(backend(lb, "c"))
+		lb.acquire(backend(lb, "c"))
+		if got := lb.pick(nil).addr; got != "a" {
+			t.Errorf("picked %q; want a", got)
+		}
+	})
+
+	t.Run("passive-ejection", func(t *testing.T) {
+		lb := newServeLoadBalancer(context.Background(), t.Logf, backends, ipn.LoadBalancing{MaxFails: 2, EjectDuration: time.Hour}, nil, nil)
+		defer lb.close()
+		errDown := errors.New("down")
+		b := backend(lb, "b")
+		lb.record(b, errDown)
+		lb.record(b, nil)
+		lb.record(b, errDown)
+		if got, want := pickAddrs(lb, 3), []string{"a", "b", "c"}; !slices.Equal(got, want) {
+			t.Errorf("before ejection, picked %q; want %q", got, want)
+		}
+		lb.record(b, errDown)
+		if got, want := pickAddrs(lb, 3), []string{"a", "c", "c"}; !slices.Equal(got, want) {
+			t.Errorf("after ejection, picked %q; want %q", got, want)
+		}
+
+		// Ejected backends are still picked once all others are tried.
+		tried := func(be *serveBackend) bool { return be.addr != "b" }
+		if got := lb.pick(tried); got != b {
+			t.Errorf("picked %v; want ejected backend b", got)
+		}
+		if got := lb.pick(func(*serveBackend) bool { return true }); got != nil {
+			t.Errorf("picked %q with all tried; want nil", got.addr)
+		}
+	})
+
+	t.Run("health-checks", func(t *testing.T) {
+		check := func(ctx context.Context, be *serveBackend) error {
+			if be.addr == "a" {
+				return errors.New("unhealthy")
+			}
+			return nil
+		}
+		var started bool
+		conf := ipn.LoadBalancing{HealthCheckInterval: time.Hour}
+		lb := newServeLoadBalancer(context.Background(), t.Logf, backends, conf, check, func(func()) { started = true })
+		defer lb.close()
+		if !started {
+			t.Fatal("health checks not started")
+		}
+		lb.checkHealth()
+		if got, want := pickAddrs(lb, 3), []string{"b", "b", "c"}; !slices.Equal(got, want) {
+			t.Errorf("picked %q; want %q", got, want)
+		}
+	})
+}
+
+func TestServeHTTPLoadBalancing(t *testing.T) {
+	b := newTestBackend(t)
+
+	var hits [2]int
+	newServer := func(i int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+		}))
+	}
+	up0, up1 := newServer(0), newServer(1)
+	defer up0.Close()
+	defer up1.Close()
+	// A backend that refuses connections.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + ln.Addr().String()
+	ln.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {
+					Proxy:         up0.URL,
+					ProxyBackends: []string{down, up1.URL},
+					LoadBalancing: &ipn.LoadBalancing{MaxFails: 1, EjectDuration: time.Hour},
+				},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 6 {
+		req := &http.Request{
+			URL:  &url.URL{Path: "/"},
+			TLS:  &tls.ConnectionState{ServerName: "example.ts.net"},
+			Body: http.NoBody,
+		}
+		req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), &serveHTTPContext{
+			DestPort: 443,
+			SrcAddr:  netip.MustParseAddrPort("1.2.3.4:1234"), // random src
+		}))
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d; want 200", w.Code)
+		}
+	}
+	// The failed backend's request is retried on up1, and then it's
+	// ejected, so the two working backends share the requests.
+	if hits != [2]int{3, 3} {
+		t.Errorf("backend hits = %v; want [3 3]", hits)
+	}
+
+	// Removing the handler closes its load balancer.
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	b.serveLoadBalancers.Range(func(key, _ any) bool {
+		t.Errorf("load balancer %v not removed", key)
+		return true
+	})
+}
@@ -560,6 +560,206 @@ type headerCheck struct {
 	}
 }
 
+func TestServeHTTPHandlerRules(t *testing.T) {
+	b := newTestBackend(t)
+
+	// Start test serve endpoint, echoing the request path and headers.
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Path", r.URL.Path)
+			w.Header().Set("Server", "backend")
+			for key, val := range r.Header {
+				w.Header().Add("Echo-"+key, strings.Join(val, ","))
+			}
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/users/": {Proxy: testServ.URL, AllowUsers: []string{"someone@example.com"}},
+				"/tags/":  {Proxy: testServ.URL, AllowTags: []string{"tag:server"}},
+				"/nobody/": {
+					Proxy:     testServ.URL,
+					AllowTags: []string{"tag:other"},
+					AllowCaps: []tailcfg.PeerCapability{"example.com/cap/serve"},
+				},
+				"/api/": {
+					Proxy:           testServ.URL,
+					StripPrefix:     "/v1",
+					RequestHeaders:  map[string]string{"X-Api": "yes", "Cookie": ""},
+					ResponseHeaders: map[string]string{"Server": "", "X-Frame-Options": "DENY"},
+				},
+				"/old/":   {Redirect: "https://${HOST}/new${REQUEST_URI}", Status: http.StatusMovedPermanently},
+				"/gone":   {Status: http.StatusGone},
+				"/teapot": {Text: "short and stout", Status: http.StatusTeapot},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A handler with an invalid status is rejected, but such a config can
+	// still be loaded from the state store.
+	bad := conf.Clone()
+	bad.Web["example.ts.net:443"].Handlers["/bad-redirect"] = &ipn.HTTPHandler{Redirect: "https://example.com/", Status: http.StatusOK}
+	if err := b.SetServeConfig(bad, ""); err == nil {
+		t.Error("SetServeConfig with an invalid redirect status succeeded")
+	}
+	b.mu.Lock()
+	b.serveConfig = bad.View()
+	b.mu.Unlock()
+
+	tests := []struct {
+		name        string
+		srcIP       string
+		funnel      bool
+		path        string
+		header      http.Header
+		wantCode    int
+		wantHeaders map[string]string
+		wantBody    string
+	}{
+		{
+			name:        "user-allowed",
+			srcIP:       "100.150.151.152",
+			path:        "/users/foo",
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Path": "/foo"},
+		},
+		{
+			name:     "tagged-node-denied-by-user",
+			srcIP:    "100.150.151.153",
+			path:     "/users/foo",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "tag-allowed",
+			srcIP:    "100.150.151.153",
+			path:     "/tags/",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "user-denied-by-tag",
+			srcIP:    "100.150.151.152",
+			path:     "/tags/",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "outside-tailnet-denied",
+			srcIP:    "100.160.161.162",
+			path:     "/users/foo",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "funnel-denied",
+			srcIP:    "100.150.151.152",
+			funnel:   true,
+			path:     "/users/foo",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "cap-not-granted",
+			srcIP:    "100.150.151.152",
+			path:     "/nobody/",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "strip-prefix-and-headers",
+			srcIP:    "100.160.161.162",
+			path:     "/api/v1/things",
+			header:   http.Header{"Cookie": {"a=b"}, "X-Api": {"no"}},
+			wantCode: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Path":            "/things",
+				"Echo-X-Api":      "yes",
+				"Echo-Cookie":     "",
+				"Server":          "",
+				"X-Frame-Options": "DENY",
+			},
+		},
+		{
+			name:        "strip-prefix-not-matching",
+			srcIP:       "100.160.161.162",
+			path:        "/api/v10/things",
+			wantCode:    http.StatusOK,
+			wantHeaders: map[string]string{"Path": "/v10/things"},
+		},
+		{
+			name:        "redirect",
+			srcIP:       "100.160.161.162",
+			path:        "/old/page?q=1",
+			wantCode:    http.StatusMovedPermanently,
+			wantHeaders: map[string]string{"Location": "https://example.ts.net/new/old/page?q=1"},
+		},
+		{
+			name:     "status",
+			srcIP:    "100.160.161.162",
+			path:     "/gone",
+			wantCode: http.StatusGone,
+		},
+		{
+			name:     "text-with-status",
+			srcIP:    "100.160.161.162",
+			path:     "/teapot",
+			wantCode: http.StatusTeapot,
+			wantBody: "short and stout",
+		},
+		{
+			name:     "invalid-redirect-status",
+			srcIP:    "100.160.161.162",
+			path:     "/bad-redirect",
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{
+				Host:   "example.ts.net",
+				URL:    u,
+				Header: make(http.Header),
+				TLS:    &tls.ConnectionState{ServerName: "example.ts.net"},
+			}
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			sctx := &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort(tt.srcIP + ":1234"), // random src port for tests
+			}
+			if tt.funnel {
+				sctx.Funnel = &funnelFlow{Host: "example.ts.net"}
+			}
+			req = req.WithContext(serveHTTPContextKey.WithValue(req.Context(), sctx))
+
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+
+			res := w.Result()
+			if res.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d; want %d", res.StatusCode, tt.wantCode)
+			}
+			for k, want := range tt.wantHeaders {
+				if got := res.Header.Get(k); got != want {
+					t.Errorf("invalid %q header; want=%q, got=%q", k, want, got)
+				}
+			}
+			if tt.wantBody != "" {
+				if got := w.Body.String(); got != tt.wantBody {
+					t.Errorf("body = %q; want %q", got, tt.wantBody)
+				}
+			}
+		})
+	}
+}
+
 func Test_reverseProxyConfiguration(t *testing.T) {
 	b := newTestBackend(t)
 	type test struct {
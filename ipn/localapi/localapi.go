@@ -50,6 +50,7 @@
 	"tailscale.com/tka"
 	"tailscale.com/tstime"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
@@ -65,6 +66,7 @@
 	"tailscale.com/util/syspolicy/rsop"
 	"tailscale.com/util/syspolicy/setting"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/magicsock"
 )
 
@@ -93,6 +95,7 @@
 	"debug-capture":               (*Handler).serveDebugCapture,
 	"debug-derp-region":           (*Handler).serveDebugDERPRegion,
 	"debug-dial-types":            (*Handler).serveDebugDialTypes,
+	"debug-filter-check":          (*Handler).serveDebugFilterCheck,
 	"debug-log":                   (*Handler).serveDebugLog,
 	"debug-packet-filter-matches": (*Handler).serveDebugPacketFilterMatches,
 	"debug-packet-filter-rules":   (*Handler).serveDebugPacketFilterRules,
@@ -102,8 +105,10 @@
 	"dev-set-state-store":         (*Handler).serveDevSetStateStore,
 	"dial":                        (*Handler).serveDial,
 	"disconnect-control":          (*Handler).disconnectControl,
+	"dns-cache":                   (*Handler).serveDNSCache,
 	"dns-osconfig":                (*Handler).serveDNSOSConfig,
 	"dns-query":                   (*Handler).serveDNSQuery,
+	"dns-query-log":               (*Handler).serveDNSQueryLog,
 	"drive/fileserver-address":    (*Handler).serveDriveServerAddr,
 	"drive/shares":                (*Handler).serveShares,
 	"file-targets":                (*Handler).serveFileTargets,
@@ -733,6 +738,53 @@ func (h *Handler) serveDebugPacketFilterMatches(w http.ResponseWriter, r *http.R
 	enc.Encode(nm.PacketFilter)
 }
 
+// serveDebugFilterCheck reports whether the packet filter allows traffic
+// from the "src" IP to the "dst" IP (by default, this node) on "port" using
+// "proto" (by default, TCP).
+func (h *Handler) serveDebugFilterCheck(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	src, err := netip.ParseAddr(r.FormValue("src"))
+	if err != nil {
+		http.Error(w, "invalid or missing 'src' IP", http.StatusBadRequest)
+		return
+	}
+	var dst netip.Addr
+	if v := r.FormValue("dst"); v != "" {
+		if dst, err = netip.ParseAddr(v); err != nil {
+			http.Error(w, "invalid 'dst' IP", http.StatusBadRequest)
+			return
+		}
+	}
+	var port uint16
+	if v := r.FormValue("port"); v != "" {
+		p, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			http.Error(w, "invalid 'port'", http.StatusBadRequest)
+			return
+		}
+		port = uint16(p)
+	}
+	proto := ipproto.TCP
+	if v := r.FormValue("proto"); v != "" {
+		if err := proto.UnmarshalText([]byte(v)); err != nil {
+			http.Error(w, "invalid 'proto'", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := h.b.DebugFilterCheck(src, dst, port, proto)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(res)
+}
+
 func (h *Handler) serveDebugPortmap(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "debug access denied", http.StatusForbidden)
@@ -2698,10 +2750,22 @@ func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
 	}
+	var opts capture.OutputOptions
+	var err error
+	if opts.Format, err = capture.ParseFormat(r.FormValue("format")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f := r.FormValue("filter"); f != "" {
+		if opts.Filter, err = capture.ParseFilter(f); err != nil {
+			http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
-	h.b.StreamDebugCapture(r.Context(), w)
+	h.b.StreamDebugCapture(r.Context(), w, opts)
 }
 
 func (h *Handler) serveDebugLog(w http.ResponseWriter, r *http.Request) {
@@ -2887,6 +2951,108 @@ func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// serveDNSCache provides access to the internal DNS forwarder's response
+// cache. A GET returns its state as a DNSCacheStatus JSON object; a
+// DELETE flushes it.
+func (h *Handler) serveDNSCache(w http.ResponseWriter, r *http.Request) {
+	// Require write access for privacy reasons.
+	if !h.PermitWrite {
+		http.Error(w, "dns-cache access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case httpm.GET:
+		st, err := h.b.DNSCacheStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	case httpm.DELETE:
+		if err := h.b.FlushDNSCache(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "only GET or DELETE allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveDNSQueryLog provides access to the internal DNS resolver's query
+// log. A GET streams the logged queries as newline-delimited JSON
+// DNSQueryLogEntry values, followed by new ones as they're handled if the
+// "follow" parameter is true. A POST with an "enabled" parameter enables
+// or disables the log.
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// Require write access for privacy reasons.
+	if !h.PermitWrite {
+		http.Error(w, "dns-query-log access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case httpm.GET:
+	case httpm.POST:
+		v, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "invalid 'enabled' parameter", http.StatusBadRequest)
+			return
+		}
+		if err := h.b.SetDNSQueryLogEnabled(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "only GET or POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	follow := defBool(r.FormValue("follow"), false)
+	f, ok := w.(http.Flusher)
+	if follow && !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	entc := make(chan apitype.DNSQueryLogEntry, 64)
+	past, unregister, err := h.b.RegisterDNSQueryLogTap(entc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if follow {
+		defer unregister()
+	} else {
+		unregister()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for _, e := range past {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	if !follow {
+		return
+	}
+	f.Flush()
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-entc:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
 // serveDriveServerAddr handles updates of the Taildrive file server address.
 func (h *Handler) serveDriveServerAddr(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "PUT" {
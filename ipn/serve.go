@@ -13,6 +13,7 @@
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
@@ -149,19 +150,174 @@ type TCPPortHandler struct {
 	// SNI name with this value. It is only used if TCPForward is non-empty.
 	// (the HTTPS mode uses ServeConfig.Web)
 	TerminateTLS string `json:",omitempty"`
+
+	// TCPForwardBackends, if non-empty, are further IP:port addresses that
+	// connections are balanced across along with TCPForward, as configured
+	// by LoadBalancing. It is only used if TCPForward is non-empty.
+	TCPForwardBackends []string `json:",omitempty"`
+
+	// LoadBalancing configures how connections are balanced across
+	// TCPForward and TCPForwardBackends. If nil, the defaults are used.
+	LoadBalancing *LoadBalancing `json:",omitempty"`
 }
 
-// HTTPHandler is either a path or a proxy to serve.
+// LoadBalancingPolicy is how a backend is chosen for each request or
+// connection balanced across several backends.
+type LoadBalancingPolicy string
+
+const (
+	// LoadBalanceRoundRobin cycles through the backends in turn.
+	LoadBalanceRoundRobin LoadBalancingPolicy = "round-robin"
+	// LoadBalanceLeastConn picks the backend with the fewest requests or
+	// connections in flight.
+	LoadBalanceLeastConn LoadBalancingPolicy = "least-conn"
+)
+
+// LoadBalancing configures load balancing across the backends of an
+// HTTPHandler or TCPPortHandler.
+//
+// Backends that fail health checks, or are ejected after failing requests,
+// aren't picked until they recover; if every backend is down, they're all
+// tried anyway.
+type LoadBalancing struct {
+	// Policy is how a backend is picked. The default is
+	// LoadBalanceRoundRobin.
+	Policy LoadBalancingPolicy `json:",omitempty"`
+
+	// HealthCheckInterval, if non-zero, enables active health checks of
+	// each backend at this interval. A backend is down while its latest
+	// check failed.
+	HealthCheckInterval time.Duration `json:",omitempty"`
+
+	// HealthCheckPath is the path of an HTTP backend to GET as its health
+	// check, which passes for 2xx and 3xx responses. If empty, or for TCP
+	// backends, the check is whether a TCP connection can be made.
+	HealthCheckPath string `json:",omitempty"`
+
+	// HealthCheckTimeout is how long a health check may take. The default
+	// is 2 seconds.
+	HealthCheckTimeout time.Duration `json:",omitempty"`
+
+	// MaxFails, if non-zero, is the number of consecutive failed requests
+	// or connections after which a backend is ejected for EjectDuration.
+	// Only failures to reach a backend count, not error responses.
+	MaxFails int `json:",omitempty"`
+
+	// EjectDuration is how long a backend is ejected for after MaxFails
+	// failures. The default is 30 seconds.
+	EjectDuration time.Duration `json:",omitempty"`
+}
+
+// HTTPHandler is either a path or a proxy to serve, a redirect or a fixed
+// response.
 type HTTPHandler struct {
-	// Exactly one of the following may be set.
+	// Exactly one of the following may be set, or none if Status is set.
 
 	Path  string `json:",omitempty"` // absolute path to directory or file to serve
 	Proxy string `json:",omitempty"` // http://localhost:3000/, localhost:3030, 3030
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
+	// Redirect is the URL to redirect requests to. The placeholders
+	// ${HOST} and ${REQUEST_URI} are replaced with the request's host and
+	// its path and query, respectively.
+	Redirect string `json:",omitempty"`
+
+	// Status is the HTTP status code to respond with. It's used with
+	// Redirect, where it defaults to 302 (Found), and with Text, where it
+	// defaults to 200 (OK). If none of the above are set, requests get an
+	// empty response with this status.
+	Status int `json:",omitempty"`
+
+	// AllowUsers, AllowTags and AllowCaps restrict which tailnet peers may
+	// use the handler. If any of them are non-empty, a request is only
+	// served if it's from a user-owned node whose user's login name is in
+	// AllowUsers, from a tagged node with a tag in AllowTags, or from a
+	// node granted a capability in AllowCaps. Other requests, including all
+	// requests over Funnel, get a 403 (Forbidden) response.
+	AllowUsers []string                 `json:",omitempty"`
+	AllowTags  []string                 `json:",omitempty"`
+	AllowCaps  []tailcfg.PeerCapability `json:",omitempty"`
+
+	// RequestHeaders and ResponseHeaders are headers to set on requests
+	// before they're handled and on responses before they're sent,
+	// respectively. A header with an empty value is removed. The Tailscale
+	// identity headers set on proxied requests can't be overridden.
+	RequestHeaders  map[string]string `json:",omitempty"`
+	ResponseHeaders map[string]string `json:",omitempty"`
+
+	// ProxyBackends, if non-empty, are further backends, in the same forms
+	// as Proxy, that requests are balanced across along with Proxy, as
+	// configured by LoadBalancing. It's only used with Proxy.
+	ProxyBackends []string `json:",omitempty"`
+
+	// LoadBalancing configures how requests are balanced across Proxy and
+	// ProxyBackends. If nil, the defaults are used.
+	LoadBalancing *LoadBalancing `json:",omitempty"`
+
+	// StripPrefix, if non-empty, is a path prefix removed from requests'
+	// paths, after the mount point, before they're proxied. Paths that
+	// don't start with it are proxied unchanged. It's only used with Proxy.
+	StripPrefix string `json:",omitempty"`
+
 	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
-	// temporary ones? Error codes? Redirects?
+	// temporary ones?
+}
+
+// CheckStatus returns an error if h can't respond with its Status: it
+// must be a 3xx code with Redirect, and from 100 to 999 otherwise. A zero
+// Status, meaning the default, is always valid.
+func (h *HTTPHandler) CheckStatus() error {
+	switch {
+	case h.Status == 0:
+		return nil
+	case h.Redirect != "" && (h.Status < 300 || h.Status > 399):
+		return fmt.Errorf("invalid redirect status %d", h.Status)
+	case h.Status < 100 || h.Status > 999:
+		return fmt.Errorf("invalid status %d", h.Status)
+	}
+	return nil
+}
+
+// CheckStatus returns an error if h can't respond with its Status.
+//
+// View version of HTTPHandler.CheckStatus.
+func (v HTTPHandlerView) CheckStatus() error { return v.ж.CheckStatus() }
+
+// CheckHTTPStatuses returns an error if any of sc's HTTP handlers, including
+// those of its services and foreground configs, can't respond with its
+// Status. See HTTPHandler.CheckStatus.
+func (sc *ServeConfig) CheckHTTPStatuses() error {
+	if sc == nil {
+		return nil
+	}
+	webs := []map[HostPort]*WebServerConfig{sc.Web}
+	for _, svc := range sc.Services {
+		if svc != nil {
+			webs = append(webs, svc.Web)
+		}
+	}
+	for _, web := range webs {
+		for hp, ws := range web {
+			if ws == nil {
+				continue
+			}
+			for mount, h := range ws.Handlers {
+				if h == nil {
+					continue
+				}
+				if err := h.CheckStatus(); err != nil {
+					return fmt.Errorf("handler for %s%s: %w", hp, mount, err)
+				}
+			}
+		}
+	}
+	for _, fg := range sc.Foreground {
+		if err := fg.CheckHTTPStatuses(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
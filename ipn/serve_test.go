@@ -267,3 +267,45 @@ func TestIsFunnelOn(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckHTTPStatuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       *HTTPHandler
+		wantErr bool
+	}{
+		{"default", &HTTPHandler{Text: "hi"}, false},
+		{"text", &HTTPHandler{Text: "hi", Status: 418}, false},
+		{"status-only", &HTTPHandler{Status: 410}, false},
+		{"redirect", &HTTPHandler{Redirect: "https://example.com/", Status: 301}, false},
+		{"redirect-default", &HTTPHandler{Redirect: "https://example.com/"}, false},
+		{"redirect-not-3xx", &HTTPHandler{Redirect: "https://example.com/", Status: 200}, true},
+		{"too-low", &HTTPHandler{Status: 99}, true},
+		{"too-high", &HTTPHandler{Text: "hi", Status: 1000}, true},
+		{"negative", &HTTPHandler{Status: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.h.CheckStatus(); (err != nil) != tt.wantErr {
+				t.Errorf("CheckStatus = %v; want error %v", err, tt.wantErr)
+			}
+			// Invalid handlers are found in services and foreground
+			// configs too.
+			sc := &ServeConfig{
+				Services: map[string]*ServiceConfig{
+					"svc:foo": {},
+				},
+				Foreground: map[string]*ServeConfig{
+					"session": {
+						Web: map[HostPort]*WebServerConfig{
+							"foo.test.ts.net:443": {Handlers: map[string]*HTTPHandler{"/": tt.h}},
+						},
+					},
+				},
+			}
+			if err := sc.CheckHTTPStatuses(); (err != nil) != tt.wantErr {
+				t.Errorf("CheckHTTPStatuses = %v; want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -71,6 +71,12 @@ func CurrentProfileKey(userID string) StateKey {
 	return StateKey("_current/" + userID)
 }
 
+// RouteInfoKey returns the StateKey that stores the JSON-encoded app
+// connector routes for the profile whose LoginProfile.Key is profileKey.
+func RouteInfoKey(profileKey StateKey) StateKey {
+	return profileKey + "||_routeInfo"
+}
+
 // StateStore persists state, and produces it back on request.
 // Implementations of StateStore are expected to be safe for concurrent use.
 type StateStore interface {
@@ -37,6 +37,7 @@
 	"tailscale.com/log/filelogger"
 	"tailscale.com/logtail"
 	"tailscale.com/logtail/filch"
+	"tailscale.com/logtail/logsink"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/dnsfallback"
 	"tailscale.com/net/netknob"
@@ -71,6 +72,20 @@ func getLogTarget() string {
 	return getLogTargetOnce.v
 }
 
+// getLogSinks returns the specs of the local log sinks from the LogSinks
+// policy setting, or else the comma-separated TS_LOG_SINKS environment
+// variable.
+func getLogSinks() []string {
+	var envSinks []string
+	for _, spec := range strings.Split(os.Getenv("TS_LOG_SINKS"), ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			envSinks = append(envSinks, spec)
+		}
+	}
+	sinks, _ := syspolicy.GetStringArray(syspolicy.LogSinks, envSinks)
+	return sinks
+}
+
 // LogURL is the base URL for the configured logtail server, or the default.
 // It is guaranteed to not terminate with any forward slashes.
 func LogURL() string {
@@ -503,6 +518,13 @@ type Options struct {
 	// If nil, [TransportOptions.New] is used to construct a new client
 	// with that particular transport sending logs to the default logs server.
 	HTTPC *http.Client
+
+	// Sinks is an optional list of local destinations that logs are
+	// delivered to, in addition to the log server, in the syntax of
+	// [logsink.Parse]. If nil, the LogSinks policy setting or the
+	// TS_LOG_SINKS environment variable is used.
+	// Sinks are used even if uploading logs is disabled.
+	Sinks []string
 }
 
 // New returns a new log policy (a logger and its instance ID).
@@ -613,6 +635,17 @@ func (opts Options) New() *Policy {
 		conf.IncludeProcID = true
 		conf.IncludeProcSequence = true
 	}
+	if opts.Sinks == nil {
+		opts.Sinks = getLogSinks()
+	}
+	for _, spec := range opts.Sinks {
+		sink, err := logsink.Parse(spec, opts.CmdName)
+		if err != nil {
+			earlyLogf("logpolicy: %v", err)
+			continue
+		}
+		conf.Sinks = append(conf.Sinks, sink)
+	}
 
 	if envknob.NoLogsNoSupport() || testenv.InTest() {
 		opts.Logf("You have disabled logging. Tailscale will not be able to provide support.")
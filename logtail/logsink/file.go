@@ -0,0 +1,154 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package logsink
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultFileMaxSize    = 10 << 20
+	defaultFileMaxBackups = 5
+)
+
+// FileOptions are the options of a File sink.
+type FileOptions struct {
+	// MaxSize is the size in bytes at which the file is rotated. If zero,
+	// it's 10 MiB.
+	MaxSize int64
+	// MaxBackups is the number of rotated files to keep, named with the
+	// suffixes ".1" (the most recent) to ".<MaxBackups>". If zero, it's 5.
+	// If negative, rotated files aren't kept.
+	MaxBackups int
+}
+
+// ParseFileOptions returns the FileOptions given by the "max_size" and
+// "max_backups" parameters of q, as used in file sink specs.
+func ParseFileOptions(q url.Values) (FileOptions, error) {
+	var opts FileOptions
+	var err error
+	if v := q.Get("max_size"); v != "" {
+		if opts.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return FileOptions{}, errors.New("bad max_size")
+		}
+	}
+	if v := q.Get("max_backups"); v != "" {
+		if opts.MaxBackups, err = strconv.Atoi(v); err != nil {
+			return FileOptions{}, errors.New("bad max_backups")
+		}
+	}
+	return opts, nil
+}
+
+// File is a logtail.Sink that writes log entries as JSON lines to a file,
+// rotating it when it grows too large.
+type File struct {
+	path string
+	opts FileOptions
+
+	mu     sync.Mutex
+	f      *os.File // or nil if closed or reopening failed
+	size   int64    // of f
+	closed bool
+}
+
+// NewFile returns a File sink writing to path, which is created if needed
+// and appended to otherwise.
+func NewFile(path string, opts FileOptions) (*File, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultFileMaxSize
+	}
+	if opts.MaxBackups == 0 {
+		opts.MaxBackups = defaultFileMaxBackups
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	s := &File{path: path, opts: opts}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *File) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+// Write writes the log entry b to the file, first rotating it if b would
+// make it exceed its maximum size.
+func (s *File) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errClosed
+	}
+	if s.f == nil {
+		// A previous rotation failed to reopen the file; try again.
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(b)) > s.opts.MaxSize {
+		if err := s.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// rotateLocked moves the current file to the first backup, shifting older
+// backups along and deleting the oldest, and opens a new file.
+func (s *File) rotateLocked() error {
+	s.f.Close()
+	s.f = nil
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", s.path, i) }
+	if s.opts.MaxBackups < 0 {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	} else {
+		for i := s.opts.MaxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(backup(i), backup(i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, backup(1)); err != nil {
+			return err
+		}
+	}
+	return s.open()
+}
+
+// Close closes the file.
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
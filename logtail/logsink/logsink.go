@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package logsink contains logtail.Sink implementations that deliver logs
+// to local infrastructure: rotating files, syslog servers and OpenTelemetry
+// collectors.
+package logsink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"tailscale.com/logtail"
+)
+
+// Parse returns the sink described by spec, which is one of:
+//
+//	file:<path>[?max_size=<bytes>&max_backups=<n>]
+//	syslog+udp://<host>:<port>
+//	syslog+tcp://<host>:<port>
+//	syslog+unix://<path>
+//	otlp+http://<host>:<port>[/<path>]
+//	otlp+https://<host>:<port>[/<path>]
+//
+// The path of OTLP endpoints defaults to "/v1/logs". appName identifies the
+// program in syslog messages and as the OpenTelemetry service name.
+func Parse(spec, appName string) (logtail.Sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log sink %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, fmt.Errorf("invalid log sink %q: missing path", spec)
+		}
+		opts, err := ParseFileOptions(u.Query())
+		if err != nil {
+			return nil, fmt.Errorf("invalid log sink %q: %w", spec, err)
+		}
+		return NewFile(path, opts)
+	case "syslog+udp", "syslog+tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid log sink %q: missing address", spec)
+		}
+		return NewSyslog(strings.TrimPrefix(u.Scheme, "syslog+"), u.Host, appName), nil
+	case "syslog+unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid log sink %q: missing path", spec)
+		}
+		return NewSyslog("unix", u.Path, appName), nil
+	case "otlp+http", "otlp+https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid log sink %q: missing address", spec)
+		}
+		u.Scheme = strings.TrimPrefix(u.Scheme, "otlp+")
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/logs"
+		}
+		return NewOTLP(OTLPOptions{URL: u.String(), ServiceName: appName}), nil
+	}
+	return nil, fmt.Errorf("invalid log sink %q: unknown type %q", spec, u.Scheme)
+}
+
+var errClosed = errors.New("log sink closed")
+
+// entry is a decoded log entry in the Tailscale log format.
+type entry struct {
+	Time  time.Time // the client time, or the time it was decoded
+	Level int       // 0 for normal messages, 1+ for increasingly verbose ones
+	Text  string    // the text message, or the JSON object for structured logs
+}
+
+// parseEntry decodes the log entry b, a JSON object in the Tailscale log
+// format as written to a logtail.Sink.
+func parseEntry(b []byte) entry {
+	b = bytes.TrimSpace(b)
+	var v struct {
+		Logtail struct {
+			ClientTime time.Time `json:"client_time"`
+		} `json:"logtail"`
+		Text *string `json:"text"`
+		V    int     `json:"v"`
+	}
+	e := entry{Time: time.Now()}
+	if err := json.Unmarshal(b, &v); err != nil {
+		e.Text = string(b)
+		return e
+	}
+	if !v.Logtail.ClientTime.IsZero() {
+		e.Time = v.Logtail.ClientTime
+	}
+	e.Level = v.V
+	if v.Text != nil {
+		e.Text = strings.TrimRight(*v.Text, "\n")
+	} else {
+		e.Text = string(b)
+	}
+	return e
+}
@@ -0,0 +1,382 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package logsink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testEntry = `{"logtail":{"client_time":"2024-01-02T03:04:05.000006Z"},"text":"hello, world\n"}` + "\n"
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		in        string
+		wantText  string
+		wantLevel int
+	}{
+		{testEntry, "hello, world", 0},
+		{`{"text":"verbose","v":2}`, "verbose", 2},
+		{`{"logtail":{},"foo":1}`, `{"logtail":{},"foo":1}`, 0},
+		{`not json`, `not json`, 0},
+	}
+	for _, tt := range tests {
+		e := parseEntry([]byte(tt.in))
+		if e.Text != tt.wantText || e.Level != tt.wantLevel {
+			t.Errorf("parseEntry(%q) = %q, %d; want %q, %d", tt.in, e.Text, e.Level, tt.wantText, tt.wantLevel)
+		}
+	}
+	e := parseEntry([]byte(testEntry))
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC); !e.Time.Equal(want) {
+		t.Errorf("time = %v; want %v", e.Time, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		spec    string
+		wantErr bool
+		check   func(t *testing.T, s any)
+	}{
+		{spec: "file:" + filepath.Join(dir, "a.log") + "?max_size=100&max_backups=2", check: func(t *testing.T, s any) {
+			f := s.(*File)
+			if f.opts.MaxSize != 100 || f.opts.MaxBackups != 2 {
+				t.Errorf("opts = %+v", f.opts)
+			}
+		}},
+		{spec: "file://" + filepath.Join(dir, "b.log"), check: func(t *testing.T, s any) {
+			if f := s.(*File); f.path != filepath.Join(dir, "b.log") {
+				t.Errorf("path = %q", f.path)
+			}
+		}},
+		{spec: "file:" + filepath.Join(dir, "c.log") + "?max_size=big", wantErr: true},
+		{spec: "file:", wantErr: true},
+		{spec: "syslog+udp://127.0.0.1:514", check: func(t *testing.T, s any) {
+			if sl := s.(*Syslog); sl.sock.network != "udp" || sl.sock.addr != "127.0.0.1:514" {
+				t.Errorf("syslog = %v %v", sl.sock.network, sl.sock.addr)
+			}
+		}},
+		{spec: "syslog+tcp://[::1]:601", check: func(t *testing.T, s any) {
+			if sl := s.(*Syslog); sl.sock.network != "tcp" || sl.sock.addr != "[::1]:601" {
+				t.Errorf("syslog = %v %v", sl.sock.network, sl.sock.addr)
+			}
+		}},
+		{spec: "syslog+unix:///dev/log", check: func(t *testing.T, s any) {
+			if sl := s.(*Syslog); sl.sock.network != "unix" || sl.sock.addr != "/dev/log" {
+				t.Errorf("syslog = %v %v", sl.sock.network, sl.sock.addr)
+			}
+		}},
+		{spec: "syslog+udp://", wantErr: true},
+		{spec: "otlp+http://collector:4318", check: func(t *testing.T, s any) {
+			if o := s.(*OTLP); o.opts.URL != "http://collector:4318/v1/logs" || o.opts.ServiceName != "tailscaled" {
+				t.Errorf("otlp = %+v", o.opts)
+			}
+		}},
+		{spec: "otlp+https://collector/custom/path", check: func(t *testing.T, s any) {
+			if o := s.(*OTLP); o.opts.URL != "https://collector/custom/path" {
+				t.Errorf("otlp = %+v", o.opts)
+			}
+		}},
+		{spec: "kafka://broker:9092", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := Parse(tt.spec, "tailscaled")
+			if tt.wantErr {
+				if err == nil {
+					s.Close()
+					t.Fatal("unexpected success")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			tt.check(t, s)
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "tailscaled.log")
+	s, err := NewFile(path, FileOptions{MaxSize: int64(2 * len(testEntry)), MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 7 {
+		if _, err := s.Write([]byte(testEntry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte(testEntry)); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+
+	// 7 entries, 2 per file: the current file has 1, the backups 2 each,
+	// and the oldest 2 entries were deleted.
+	for suffix, want := range map[string]int{"": 1, ".1": 2, ".2": 2} {
+		b, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(string(b), testEntry); got != want {
+			t.Errorf("%s has %d entries; want %d", path+suffix, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("unexpected third backup: %v", err)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s := NewSyslog("udp", pc.LocalAddr().String(), "tailscaled")
+	defer s.Close()
+	if _, err := s.Write([]byte(testEntry)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte(`{"text":"debug","v":1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("<30>1 2024-01-02T03:04:05.000006Z %s tailscaled %d - - hello, world", s.hostname, os.Getpid())
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+	n, _, err = pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); !strings.HasPrefix(got, "<31>1 ") || !strings.HasSuffix(got, " - - debug") {
+		t.Errorf("got %q; want debug message", got)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	msgs := make(chan string, 2)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for {
+			// Octet-counting framing: "<len> <msg>".
+			l, err := br.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(l, " "))
+			if err != nil {
+				msgs <- "bad frame " + l
+				return
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(br, msg); err != nil {
+				return
+			}
+			msgs <- string(msg)
+		}
+	}()
+
+	s := NewSyslog("tcp", ln.Addr().String(), "tailscaled")
+	defer s.Close()
+	for range 2 {
+		if _, err := s.Write([]byte(testEntry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 2 {
+		select {
+		case got := <-msgs:
+			if !strings.HasPrefix(got, "<30>1 2024-01-02T03:04:05.000006Z ") || !strings.HasSuffix(got, " - - hello, world") {
+				t.Errorf("got %q", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	}
+}
+
+func TestSyslogDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := NewSyslog("tcp", addr, "tailscaled")
+	defer s.Close()
+	for range 2 {
+		if _, err := s.Write([]byte(testEntry)); err != nil {
+			t.Fatalf("Write with server down = %v; want dropped without error", err)
+		}
+	}
+}
+
+func TestSyslogNotReading(t *testing.T) {
+	// A server that accepts connections but never reads from them, so
+	// that sends block once the socket buffers fill.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	s := NewSyslog("tcp", ln.Addr().String(), "tailscaled")
+	big := fmt.Sprintf(`{"text":%q}`, strings.Repeat("x", 16<<10))
+	var slowest time.Duration
+	for range 2 * syslogQueueSize {
+		start := time.Now()
+		if _, err := s.Write([]byte(big)); err != nil {
+			t.Fatal(err)
+		}
+		slowest = max(slowest, time.Since(start))
+	}
+	if slowest >= socketWriteTimeout/2 {
+		t.Errorf("slowest Write took %v; want Writes not to block on the server", slowest)
+	}
+	s.Close()
+	if _, err := s.Write([]byte(testEntry)); err != errClosed {
+		t.Errorf("Write after Close = %v; want %v", err, errClosed)
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		got    []otlpExportRequest
+		fail   = true
+		failed = make(chan bool)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			// Fail the first export, to check that it's retried.
+			fail = false
+			close(failed)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var req otlpExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = append(got, req)
+	}))
+	defer ts.Close()
+
+	s := NewOTLP(OTLPOptions{
+		URL:           ts.URL + "/v1/logs",
+		ServiceName:   "tailscaled",
+		FlushInterval: 10 * time.Millisecond,
+	})
+	for range 3 {
+		if _, err := s.Write([]byte(testEntry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for first export")
+	}
+	if _, err := s.Write([]byte(`{"text":"debug","v":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte(testEntry)); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var recs []otlpLogRecord
+	for _, req := range got {
+		if len(req.ResourceLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs) != 1 {
+			t.Fatalf("unexpected request shape: %+v", req)
+		}
+		rl := req.ResourceLogs[0]
+		if a := rl.Resource.Attributes; len(a) == 0 || a[0].Key != "service.name" || a[0].Value.StringValue != "tailscaled" {
+			t.Errorf("resource attributes = %+v", a)
+		}
+		if name := rl.ScopeLogs[0].Scope.Name; name != "tailscale.com/logtail" {
+			t.Errorf("scope = %q", name)
+		}
+		recs = append(recs, rl.ScopeLogs[0].LogRecords...)
+	}
+	if len(recs) != 4 {
+		t.Fatalf("got %d records; want 4", len(recs))
+	}
+	if r := recs[0]; r.TimeUnixNano != "1704164645000006000" || r.SeverityNumber != otlpSeverityInfo || r.Body.StringValue != "hello, world" {
+		t.Errorf("first record = %+v", r)
+	}
+	if r := recs[3]; r.SeverityNumber != otlpSeverityDebug || r.SeverityText != "DEBUG" || r.Body.StringValue != "debug" {
+		t.Errorf("last record = %+v", r)
+	}
+}
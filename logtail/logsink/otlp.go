@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOTLPFlushInterval = time.Second
+	otlpExportTimeout        = 10 * time.Second
+
+	otlpMaxBatch   = 512  // records per export request
+	otlpMaxPending = 4096 // records kept while the collector is failing
+	otlpQueueSize  = 1024 // records queued between Write and the exporter
+
+	// Severity numbers, from the OpenTelemetry logs data model.
+	otlpSeverityDebug = 5
+	otlpSeverityInfo  = 9
+)
+
+// OTLPOptions are the options of an OTLP sink.
+type OTLPOptions struct {
+	// URL is the collector's OTLP/HTTP logs endpoint, such as
+	// "http://localhost:4318/v1/logs".
+	URL string
+	// ServiceName is the service.name resource attribute of the logs.
+	ServiceName string
+	// HTTPClient is the client used to export logs. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+	// FlushInterval is the longest that logs are batched before being
+	// exported. If zero, it's one second.
+	FlushInterval time.Duration
+}
+
+// OTLP is a logtail.Sink that exports log entries to an OpenTelemetry
+// collector using OTLP/HTTP with JSON encoding.
+//
+// Log entries are batched and exported in the background. If the collector
+// is unreachable, exports are retried at each flush interval, and the
+// oldest entries are dropped once too many are pending.
+type OTLP struct {
+	opts     OTLPOptions
+	resource otlpResource
+
+	queue     chan otlpLogRecord
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{} // closed when the exporter has stopped
+}
+
+// NewOTLP returns an OTLP sink with opts, and starts its exporter.
+func NewOTLP(opts OTLPOptions) *OTLP {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultOTLPFlushInterval
+	}
+	hostname, _ := os.Hostname()
+	s := &OTLP{
+		opts: opts,
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: opts.ServiceName}},
+			{Key: "host.name", Value: otlpAnyValue{StringValue: hostname}},
+		}},
+		queue:   make(chan otlpLogRecord, otlpQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues the log entry b for export. It doesn't block; if the queue
+// is full, b is dropped.
+func (s *OTLP) Write(b []byte) (int, error) {
+	select {
+	case <-s.closing:
+		return 0, errClosed
+	default:
+	}
+	e := parseEntry(b)
+	rec := otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(e.Time.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber:       otlpSeverityInfo,
+		SeverityText:         "INFO",
+		Body:                 otlpAnyValue{StringValue: e.Text},
+	}
+	if e.Level > 0 {
+		rec.SeverityNumber = otlpSeverityDebug
+		rec.SeverityText = "DEBUG"
+	}
+	select {
+	case s.queue <- rec:
+	default:
+	}
+	return len(b), nil
+}
+
+// Close exports any pending log entries, waiting a bounded time for the
+// collector, and stops the exporter.
+func (s *OTLP) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	<-s.done
+	return nil
+}
+
+// run is the exporter goroutine.
+func (s *OTLP) run() {
+	defer close(s.done)
+	t := time.NewTicker(s.opts.FlushInterval)
+	defer t.Stop()
+
+	var pending []otlpLogRecord
+	failing := false // whether the last export failed
+	for {
+		select {
+		case rec := <-s.queue:
+			pending = append(pending, rec)
+			if failing || len(pending) < otlpMaxBatch {
+				continue
+			}
+		case <-t.C:
+		case <-s.closing:
+			for {
+				select {
+				case rec := <-s.queue:
+					pending = append(pending, rec)
+					continue
+				default:
+				}
+				break
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+			defer cancel()
+			s.exportAll(ctx, pending)
+			return
+		}
+
+		var err error
+		pending, err = s.exportAll(context.Background(), pending)
+		failing = err != nil
+		if len(pending) > otlpMaxPending {
+			pending = append(pending[:0], pending[len(pending)-otlpMaxPending:]...)
+		}
+	}
+}
+
+// exportAll exports recs in batches, returning those it failed to export.
+func (s *OTLP) exportAll(ctx context.Context, recs []otlpLogRecord) ([]otlpLogRecord, error) {
+	for len(recs) > 0 {
+		n := min(len(recs), otlpMaxBatch)
+		if err := s.export(ctx, recs[:n]); err != nil {
+			return recs, err
+		}
+		recs = recs[n:]
+	}
+	return recs[:0], nil
+}
+
+// export sends one export request with recs to the collector.
+func (s *OTLP) export(ctx context.Context, recs []otlpLogRecord) error {
+	body, err := json.Marshal(otlpExportRequest{
+		ResourceLogs: []otlpResourceLogs{{
+			Resource: s.resource,
+			ScopeLogs: []otlpScopeLogs{{
+				Scope:      otlpScope{Name: "tailscale.com/logtail"},
+				LogRecords: recs,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, otlpExportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("OTLP export: unexpected status %v", res.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of an ExportLogsServiceRequest, per
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type (
+	otlpExportRequest struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpLogRecord struct {
+		TimeUnixNano         string       `json:"timeUnixNano"`
+		ObservedTimeUnixNano string       `json:"observedTimeUnixNano"`
+		SeverityNumber       int          `json:"severityNumber"`
+		SeverityText         string       `json:"severityText"`
+		Body                 otlpAnyValue `json:"body"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package logsink
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// socketWriteTimeout is how long a Socket waits for a connection or
+	// write before dropping the message.
+	socketWriteTimeout = 2 * time.Second
+	// socketRetryInterval is how long a Socket drops messages after
+	// failing to connect or write, before trying to reconnect.
+	socketRetryInterval = 10 * time.Second
+)
+
+var errSocketDown = errors.New("log socket unreachable; dropping message")
+
+// Socket is a connection to a log collector that's established lazily, on
+// the first write, and reestablished after failures. While the collector
+// is unreachable, writes fail fast rather than redialing every time.
+//
+// It's safe for concurrent use.
+type Socket struct {
+	network string // "udp", "tcp" or "unix"
+	addr    string
+
+	mu      sync.Mutex
+	conn    net.Conn  // or nil if not connected
+	stream  bool      // whether conn is a stream socket
+	retryAt time.Time // when to reconnect after a failure
+	closed  bool
+}
+
+// NewSocket returns a Socket for addr over network, which is "udp", "tcp"
+// or "unix". For "unix", addr is a socket path, which may be a datagram or
+// stream socket.
+func NewSocket(network, addr string) *Socket {
+	return &Socket{network: network, addr: addr}
+}
+
+// Connect connects the socket if it isn't already, and reports whether
+// it's a stream socket, for callers that frame messages differently on
+// streams. It fails without dialing if the collector was unreachable
+// within the retry interval.
+func (s *Socket) Connect() (stream bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connectLocked(); err != nil {
+		return false, err
+	}
+	return s.stream, nil
+}
+
+func (s *Socket) connectLocked() error {
+	if s.closed {
+		return errClosed
+	}
+	if s.conn != nil {
+		return nil
+	}
+	if time.Now().Before(s.retryAt) {
+		return errSocketDown
+	}
+	if err := s.dialLocked(); err != nil {
+		s.retryAt = time.Now().Add(socketRetryInterval)
+		return err
+	}
+	return nil
+}
+
+func (s *Socket) dialLocked() error {
+	var err error
+	if s.network == "unix" {
+		// Like log/syslog, try a datagram socket first.
+		for _, network := range []string{"unixgram", "unix"} {
+			if s.conn, err = net.DialTimeout(network, s.addr, socketWriteTimeout); err == nil {
+				s.stream = network == "unix"
+				return nil
+			}
+		}
+		return err
+	}
+	s.conn, err = net.DialTimeout(s.network, s.addr, socketWriteTimeout)
+	s.stream = s.network == "tcp"
+	return err
+}
+
+// Write writes b as a single message, connecting first if needed.
+func (s *Socket) Write(b []byte) (int, error) {
+	return s.WriteBefore(b, time.Now().Add(socketWriteTimeout))
+}
+
+// WriteBefore is like Write, but fails if writing doesn't finish by
+// deadline. After a failed write, the connection is closed and
+// reestablished once the retry interval has passed.
+func (s *Socket) WriteBefore(b []byte, deadline time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connectLocked(); err != nil {
+		return 0, err
+	}
+	s.conn.SetWriteDeadline(deadline)
+	n, err := s.conn.Write(b)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.retryAt = time.Now().Add(socketRetryInterval)
+	}
+	return n, err
+}
+
+// Close closes the connection, if any. Later writes fail.
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
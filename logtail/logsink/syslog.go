@@ -0,0 +1,163 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package logsink
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog severities and facilities, from RFC 5424 section 6.2.1.
+const (
+	syslogSeverityInfo   = 6
+	syslogSeverityDebug  = 7
+	syslogFacilityDaemon = 3
+)
+
+// syslogQueueSize is how many messages are queued between Write and the
+// sender before further messages are dropped.
+const syslogQueueSize = 1024
+
+// Syslog is a logtail.Sink that sends log entries to a syslog server as
+// RFC 5424 messages.
+//
+// Messages are sent in the background, one per datagram over UDP and unix
+// datagram sockets, and with octet-counting framing (RFC 6587) over TCP
+// and unix stream sockets. If the connection fails, messages are dropped
+// for a while before it's reestablished, as are messages written while
+// too many are queued.
+type Syslog struct {
+	sock     *Socket
+	hostname string
+	appName  string
+	procID   string
+
+	queue     chan entry
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{} // closed when the sender has stopped
+
+	buf []byte // reused by send; owned by the sender goroutine
+}
+
+// NewSyslog returns a Syslog sink sending to addr over network, which is
+// "udp", "tcp" or "unix". For "unix", addr is a socket path, such as
+// "/dev/log", which may be a datagram or stream socket. appName is the
+// APP-NAME of the messages.
+//
+// It starts the sender, which connects lazily, on the first message.
+func NewSyslog(network, addr, appName string) *Syslog {
+	hostname, _ := os.Hostname()
+	s := &Syslog{
+		sock:     NewSocket(network, addr),
+		hostname: syslogField(hostname, 255),
+		appName:  syslogField(appName, 48),
+		procID:   strconv.Itoa(os.Getpid()),
+		queue:    make(chan entry, syslogQueueSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// syslogField returns s as an RFC 5424 header field: printable ASCII
+// without spaces, at most n bytes long, or "-" if empty.
+func syslogField(s string, n int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > n {
+		s = s[:n]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Write queues the log entry b to be sent to the syslog server. It doesn't
+// block; if the queue is full, b is dropped.
+func (s *Syslog) Write(b []byte) (int, error) {
+	select {
+	case <-s.closing:
+		return 0, errClosed
+	default:
+	}
+	select {
+	case s.queue <- parseEntry(b):
+	default:
+	}
+	return len(b), nil
+}
+
+// run is the sender goroutine.
+func (s *Syslog) run() {
+	defer close(s.done)
+	for {
+		select {
+		case e := <-s.queue:
+			s.send(e, time.Now().Add(socketWriteTimeout))
+		case <-s.closing:
+			// Send what's queued, waiting a bounded time in total.
+			deadline := time.Now().Add(socketWriteTimeout)
+			for {
+				select {
+				case e := <-s.queue:
+					s.send(e, deadline)
+					continue
+				default:
+				}
+				break
+			}
+			s.sock.Close()
+			return
+		}
+	}
+}
+
+// send sends the message for e, connecting first if needed. It drops e if
+// the server is unreachable, or if sending fails or doesn't finish by
+// deadline.
+func (s *Syslog) send(e entry, deadline time.Time) {
+	stream, err := s.sock.Connect()
+	if err != nil {
+		return
+	}
+	s.buf = s.appendMessage(s.buf[:0], e, stream)
+	s.sock.WriteBefore(s.buf, deadline)
+}
+
+// appendMessage appends the RFC 5424 message for e to dst, framed for a
+// stream connection if stream is set.
+func (s *Syslog) appendMessage(dst []byte, e entry, stream bool) []byte {
+	severity := syslogSeverityInfo
+	if e.Level > 0 {
+		severity = syslogSeverityDebug
+	}
+	msg := fmt.Appendf(nil, "<%d>1 %s %s %s %s - - %s",
+		syslogFacilityDaemon*8+severity,
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, s.procID, e.Text)
+	if stream {
+		dst = strconv.AppendInt(dst, int64(len(msg)), 10)
+		dst = append(dst, ' ')
+	}
+	return append(dst, msg...)
+}
+
+// Close sends any queued log entries, waiting a bounded time for the
+// syslog server, and closes the connection to it.
+func (s *Syslog) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	<-s.done
+	return nil
+}
@@ -102,6 +102,22 @@ type Config struct {
 	// being included in the logs. The sequence number is incremented for each
 	// log message sent, but is not persisted across process restarts.
 	IncludeProcSequence bool
+
+	// Sinks are optional local destinations that get a copy of every log
+	// entry, even if uploads are disabled. They're closed by
+	// Logger.Shutdown.
+	Sinks []Sink
+}
+
+// Sink is a local destination for log entries, such as a file or a syslog
+// server.
+//
+// Write is called with one log entry at a time, as a newline-terminated JSON
+// object in the Tailscale log format, while holding a lock that blocks other
+// log writes. Sinks must not retain the slice, and should not block for
+// long. Write errors are ignored; sinks are responsible for any retries.
+type Sink interface {
+	io.WriteCloser
 }
 
 func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
@@ -166,6 +182,7 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 
 		procID:              procID,
 		includeProcSequence: cfg.IncludeProcSequence,
+		sinks:               cfg.Sinks,
 
 		shutdownStart: make(chan struct{}),
 		shutdownDone:  make(chan struct{}),
@@ -208,6 +225,7 @@ type Logger struct {
 
 	procID              uint32
 	includeProcSequence bool
+	sinks               []Sink
 
 	writeLock    sync.Mutex // guards procSequence, flushTimer, buffer.Write calls
 	procSequence uint64
@@ -283,6 +301,12 @@ func (l *Logger) Shutdown(ctx context.Context) error {
 	io.WriteString(l, "logger closing down\n")
 	<-done
 
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	for _, s := range l.sinks {
+		s.Close()
+	}
+	l.sinks = nil
 	return nil
 }
 
@@ -585,6 +609,9 @@ func (l *Logger) tryDrainWake() {
 
 func (l *Logger) sendLocked(jsonBlob []byte) (int, error) {
 	tapSend(jsonBlob)
+	for _, s := range l.sinks {
+		s.Write(jsonBlob)
+	}
 	if logtailDisabled.Load() {
 		return len(jsonBlob), nil
 	}
@@ -316,6 +316,27 @@ func TestLoggerWriteResult(t *testing.T) {
 		t.Errorf("mismatch.\n got: %#q\nwant: %#q", back, want)
 	}
 }
+
+type testSink struct{ bytes.Buffer }
+
+func (s *testSink) Close() error { return nil }
+
+func TestSinks(t *testing.T) {
+	sink := new(testSink)
+	lg := &Logger{
+		clock:  tstest.NewClock(tstest.ClockOpts{Start: time.Unix(123, 0)}),
+		buffer: NewMemoryBuffer(100),
+		sinks:  []Sink{sink},
+	}
+	lg.Write([]byte("[v1] foo"))
+	lg.Write([]byte("bar\n"))
+	want := `{"logtail":{"client_time":"1970-01-01T00:02:03Z"},"v":1,"text":"foo"}` + "\n" +
+		`{"logtail":{"client_time":"1970-01-01T00:02:03Z"},"text":"bar\n"}` + "\n"
+	if got := sink.String(); got != want {
+		t.Errorf("mismatch.\n got: %#q\nwant: %#q", got, want)
+	}
+}
+
 func TestRedact(t *testing.T) {
 	envknob.Setenv("TS_OBSCURE_LOGGED_IPS", "true")
 	tests := []struct {
@@ -0,0 +1,694 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recursive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/util/dnsname"
+)
+
+// ValidationStatus is the DNSSEC validation status of an answer, as
+// defined in RFC 4033, section 5.
+type ValidationStatus int
+
+const (
+	// Unvalidated means that the answer wasn't validated, because
+	// validation is disabled or there was no answer to validate.
+	Unvalidated ValidationStatus = iota
+	// Secure means that the answer was validated along an unbroken chain
+	// of trust from the root trust anchor.
+	Secure
+	// Insecure means that the answer is in a zone that is provably
+	// unsigned, so it couldn't be validated.
+	Insecure
+	// Bogus means that the answer should have been signed, but failed
+	// validation.
+	Bogus
+)
+
+func (s ValidationStatus) String() string {
+	switch s {
+	case Unvalidated:
+		return "unvalidated"
+	case Secure:
+		return "secure"
+	case Insecure:
+		return "insecure"
+	case Bogus:
+		return "bogus"
+	}
+	return fmt.Sprintf("ValidationStatus(%d)", int(s))
+}
+
+// combine returns the status of an answer made up of answers with the
+// statuses s and o: the weakest of the two.
+func (s ValidationStatus) combine(o ValidationStatus) ValidationStatus {
+	return max(s, o)
+}
+
+// ErrBogus is returned (wrapped) when an answer fails DNSSEC validation.
+var ErrBogus = errors.New("DNSSEC validation failed")
+
+const (
+	// dnssecUDPSize is the EDNS(0) UDP payload size advertised in queries
+	// when validating DNSSEC; 1232 bytes avoids IP fragmentation, per
+	// https://www.dnsflagday.net/2020/.
+	dnssecUDPSize = 1232
+
+	// maxNSEC3Iterations is the largest number of NSEC3 hash iterations
+	// that we'll compute. Denials using more are treated as insecure, per
+	// RFC 9276, section 3.2.
+	maxNSEC3Iterations = 150
+)
+
+// rootTrustAnchors are the DS records of the root zone's key signing keys,
+// as published by IANA at https://data.iana.org/root-anchors/.
+var rootTrustAnchors = []*dns.DS{
+	{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     20326,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	},
+	{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     38696,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	},
+}
+
+func (r *Resolver) rootTrustAnchors() []*dns.DS {
+	if r.trustAnchors != nil {
+		return r.trustAnchors
+	}
+	return rootTrustAnchors
+}
+
+// supportedAlgorithm reports whether we can verify signatures made with
+// the DNSSEC algorithm alg.
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// supportedDigest reports whether we can compute DS digests of type t.
+func supportedDigest(t uint8) bool {
+	switch t {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// zone is a signed zone whose DNSKEY RRset has been validated.
+type zone struct {
+	name dnsname.FQDN
+	keys []*dns.DNSKEY // the zone's keys, which sign its RRsets
+}
+
+// errInsecure is returned internally by validation steps that found a
+// provably unsigned zone, where validation stops.
+var errInsecure = errors.New("insecure delegation")
+
+// validate validates the chains that led to the result of resolving a
+// name, where err is the error resolving it. It returns a non-nil error
+// wrapping ErrBogus if and only if the status is Bogus.
+func (r *Resolver) validate(ctx context.Context, chains []chain, err error) (ValidationStatus, error) {
+	if !r.ValidateDNSSEC || len(chains) == 0 {
+		return Unvalidated, nil
+	}
+	if err != nil && !errors.Is(err, ErrAuthoritativeNoResponses) {
+		return Unvalidated, nil
+	}
+	status := Secure
+	for _, c := range chains {
+		err := r.validateChain(ctx, c)
+		switch {
+		case err == nil:
+		case errors.Is(err, errInsecure):
+			status = status.combine(Insecure)
+		default:
+			r.logf("DNSSEC validation of %q (type: %v) failed: %v", c.name, c.qtype, err)
+			return Bogus, fmt.Errorf("%w for %q: %v", ErrBogus, c.name, err)
+		}
+	}
+	return status, nil
+}
+
+// validateChain validates the last response in c, following the chain of
+// trust from the root through the referrals before it. It returns nil if
+// the response is secure, or an error wrapping errInsecure if it's from a
+// provably unsigned zone.
+func (r *Resolver) validateChain(ctx context.Context, c chain) error {
+	if len(c.steps) == 0 {
+		return errors.New("no responses")
+	}
+	z, err := r.zoneKeys(ctx, ".", r.rootTrustAnchors(), c.steps[0].nameserver)
+	if err != nil {
+		return fmt.Errorf("root: %w", err)
+	}
+	last := len(c.steps) - 1
+	for i, st := range c.steps[:last] {
+		child, ds, err := r.referralDS(z, st.resp)
+		if err != nil {
+			return fmt.Errorf("referral from %q: %w", z.name, err)
+		}
+		if child == z.name {
+			// A referral to another nameserver for the same zone.
+			continue
+		}
+		z, err = r.zoneKeys(ctx, child, ds, c.steps[i+1].nameserver)
+		if err != nil {
+			return fmt.Errorf("%q: %w", child, err)
+		}
+	}
+	return r.validateAnswer(ctx, z, c.steps[last], c.name, c.qtype)
+}
+
+// zoneKeys fetches the DNSKEY RRset of the zone name from nameserver, and
+// validates it with ds, the zone's DS records from its parent zone (or
+// the trust anchors for the root zone).
+func (r *Resolver) zoneKeys(ctx context.Context, name dnsname.FQDN, ds []*dns.DS, nameserver netip.Addr) (*zone, error) {
+	// A DS RRset with no algorithms we support is treated as if the zone
+	// were unsigned (RFC 4035, section 5.2).
+	var usable []*dns.DS
+	for _, d := range ds {
+		if supportedAlgorithm(d.Algorithm) && supportedDigest(d.DigestType) {
+			usable = append(usable, d)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("%w: no supported DS algorithms", errInsecure)
+	}
+
+	resp, err := r.queryNameserver(ctx, 0, name, nameserver, dns.Type(dns.TypeDNSKEY))
+	if err != nil {
+		return nil, fmt.Errorf("querying DNSKEY: %w", err)
+	}
+	rrsets, sigs := groupRRsets(resp.Answer)
+	keySet := rrsets[rrsetKey{name, dns.TypeDNSKEY}]
+	if len(keySet) == 0 {
+		return nil, errors.New("no DNSKEY records")
+	}
+	var keys, sepKeys []*dns.DNSKEY
+	for _, rr := range keySet {
+		k := rr.(*dns.DNSKEY)
+		if k.Flags&dns.ZONE == 0 || k.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		keys = append(keys, k)
+		for _, d := range usable {
+			if d.KeyTag != k.KeyTag() || d.Algorithm != k.Algorithm {
+				continue
+			}
+			if kds := k.ToDS(d.DigestType); kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+				sepKeys = append(sepKeys, k)
+				break
+			}
+		}
+	}
+	if len(sepKeys) == 0 {
+		return nil, errors.New("no DNSKEY matches the DS records")
+	}
+	// The DNSKEY RRset must be signed by a key that the DS records vouch
+	// for; that key then vouches for the rest.
+	if err := r.verifyRRset(keySet, sigs[rrsetKey{name, dns.TypeDNSKEY}], name, sepKeys); err != nil {
+		return nil, fmt.Errorf("DNSKEY: %w", err)
+	}
+	return &zone{name: name, keys: keys}, nil
+}
+
+// referralDS returns the child zone that resp, a referral from z, delegates
+// to, and the child's DS records. If the child is provably unsigned, it
+// returns an error wrapping errInsecure.
+func (r *Resolver) referralDS(z *zone, resp *dns.Msg) (child dnsname.FQDN, ds []*dns.DS, err error) {
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			child, err = dnsname.ToFQDN(strings.ToLower(rr.Header().Name))
+			if err != nil {
+				return "", nil, err
+			}
+			break
+		}
+	}
+	if child == "" {
+		return "", nil, errors.New("no NS records in referral")
+	}
+	if !isSubdomain(child, z.name) {
+		return "", nil, fmt.Errorf("referral to %q is outside the zone", child)
+	}
+	if child == z.name {
+		return child, nil, nil
+	}
+
+	rrsets, sigs := groupRRsets(resp.Ns)
+	key := rrsetKey{child, dns.TypeDS}
+	if dsSet := rrsets[key]; len(dsSet) > 0 {
+		if err := r.verifyRRset(dsSet, sigs[key], z.name, z.keys); err != nil {
+			return "", nil, fmt.Errorf("DS for %q: %w", child, err)
+		}
+		for _, rr := range dsSet {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return child, ds, nil
+	}
+
+	// No DS records: the referral must prove that there are none, so
+	// that the child is unsigned.
+	d, err := r.verifiedDenial(z, resp.Ns)
+	if err != nil {
+		return "", nil, err
+	}
+	if d.provesInsecureDelegation(child) {
+		return "", nil, fmt.Errorf("%w to %q", errInsecure, child)
+	}
+	return "", nil, fmt.Errorf("no DS records or proof of their absence for %q", child)
+}
+
+// validateAnswer validates the final response in a chain, st, which is
+// from a nameserver for z and answers a query for name and qtype.
+func (r *Resolver) validateAnswer(ctx context.Context, z *zone, st step, name dnsname.FQDN, qtype dns.Type) error {
+	resp := st.resp
+	rrsets, sigs := groupRRsets(resp.Answer)
+	signers := map[dnsname.FQDN]*zone{z.name: z}
+	var insecure error
+	for key, rrset := range rrsets {
+		rsigs := sigs[key]
+		if len(rsigs) == 0 {
+			return fmt.Errorf("no signatures for %q (type: %v)", key.name, dns.Type(key.typ))
+		}
+		// RRsets may be signed by a zone below z, if the nameserver
+		// is authoritative for both.
+		signer, err := dnsname.ToFQDN(strings.ToLower(rsigs[0].SignerName))
+		if err != nil {
+			return err
+		}
+		sz, ok := signers[signer]
+		if !ok {
+			sz, err = r.descend(ctx, z, signer, st.nameserver)
+			if errors.Is(err, errInsecure) {
+				insecure = err
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%q: %w", signer, err)
+			}
+			signers[signer] = sz
+		}
+		if err := r.verifyRRset(rrset, rsigs, sz.name, sz.keys); err != nil {
+			return fmt.Errorf("%q (type: %v): %w", key.name, dns.Type(key.typ), err)
+		}
+		// An answer synthesized from a wildcard needs proof that there
+		// was no exact match for the name (RFC 4035, section 5.3.4).
+		if labels := dns.CountLabel(string(key.name)); int(rsigs[0].Labels) < labels {
+			d, err := r.verifiedDenial(sz, resp.Ns)
+			if err != nil {
+				return err
+			}
+			if !d.provesWildcardExpansion(key.name, int(rsigs[0].Labels)) {
+				return fmt.Errorf("no proof of wildcard expansion for %q", key.name)
+			}
+		}
+	}
+	if insecure != nil {
+		return insecure
+	}
+	if len(rrsets) > 0 {
+		return nil
+	}
+
+	// No answers: the response must prove that there are none.
+	d, err := r.verifiedDenial(z, resp.Ns)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.Rcode == dns.RcodeNameError && d.provesNXDOMAIN(name):
+		return nil
+	case resp.Rcode == dns.RcodeSuccess && d.provesNODATA(name, qtype):
+		return nil
+	case d.insecure:
+		return fmt.Errorf("%w: NSEC3 opt-out or too many iterations", errInsecure)
+	}
+	return fmt.Errorf("no proof that %q (type: %v) doesn't exist", name, qtype)
+}
+
+// descend returns the signed zone child below z, by querying nameserver,
+// which is authoritative for z, for child's DS records.
+func (r *Resolver) descend(ctx context.Context, z *zone, child dnsname.FQDN, nameserver netip.Addr) (*zone, error) {
+	if !isSubdomain(child, z.name) {
+		return nil, fmt.Errorf("signer is outside the zone %q", z.name)
+	}
+	resp, err := r.queryNameserver(ctx, 0, child, nameserver, dns.Type(dns.TypeDS))
+	if err != nil {
+		return nil, fmt.Errorf("querying DS: %w", err)
+	}
+	rrsets, sigs := groupRRsets(resp.Answer)
+	key := rrsetKey{child, dns.TypeDS}
+	dsSet := rrsets[key]
+	if len(dsSet) == 0 {
+		d, err := r.verifiedDenial(z, resp.Ns)
+		if err != nil {
+			return nil, err
+		}
+		if d.provesNODATA(child, dns.Type(dns.TypeDS)) || d.insecure {
+			return nil, fmt.Errorf("%w to %q", errInsecure, child)
+		}
+		return nil, errors.New("no DS records or proof of their absence")
+	}
+	if err := r.verifyRRset(dsSet, sigs[key], z.name, z.keys); err != nil {
+		return nil, fmt.Errorf("DS: %w", err)
+	}
+	var ds []*dns.DS
+	for _, rr := range dsSet {
+		ds = append(ds, rr.(*dns.DS))
+	}
+	return r.zoneKeys(ctx, child, ds, nameserver)
+}
+
+// verifyRRset verifies that rrset is signed by one of sigs, made by one of
+// keys of the zone signer and valid now.
+func (r *Resolver) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, signer dnsname.FQDN, keys []*dns.DNSKEY) error {
+	if len(sigs) == 0 {
+		return errors.New("no signatures")
+	}
+	now := r.now()
+	err := errors.New("no signature by a zone key")
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, string(signer)) || !supportedAlgorithm(sig.Algorithm) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			err = errors.New("signature expired or not yet valid")
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if verr := sig.Verify(k, rrset); verr != nil {
+				err = verr
+				continue
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// rrsetKey identifies an RRset within a section of a response.
+type rrsetKey struct {
+	name dnsname.FQDN // lowercase
+	typ  uint16
+}
+
+// groupRRsets groups the records in rrs into RRsets, along with the
+// signatures covering each.
+func groupRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	rrsets := map[rrsetKey][]dns.RR{}
+	sigs := map[rrsetKey][]*dns.RRSIG{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		name, err := dnsname.ToFQDN(strings.ToLower(h.Name))
+		if err != nil {
+			continue
+		}
+		switch h.Rrtype {
+		case dns.TypeRRSIG:
+			sig := rr.(*dns.RRSIG)
+			k := rrsetKey{name, sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+		case dns.TypeOPT:
+		default:
+			k := rrsetKey{name, h.Rrtype}
+			rrsets[k] = append(rrsets[k], rr)
+		}
+	}
+	return rrsets, sigs
+}
+
+// isSubdomain reports whether name is parent or a subdomain of it.
+func isSubdomain(name, parent dnsname.FQDN) bool {
+	return parent == "." || name == parent || strings.HasSuffix(string(name), "."+string(parent))
+}
+
+// denial is the verified NSEC or NSEC3 records in the authority section
+// of a response, which prove that names or types don't exist.
+type denial struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+
+	// insecure is whether some NSEC3 records were ignored because they
+	// use more than maxNSEC3Iterations iterations.
+	insecure bool
+}
+
+// verifiedDenial returns the NSEC and NSEC3 records in ns, all of which
+// must be validly signed by z.
+func (r *Resolver) verifiedDenial(z *zone, ns []dns.RR) (*denial, error) {
+	rrsets, sigs := groupRRsets(ns)
+	d := new(denial)
+	for key, rrset := range rrsets {
+		if key.typ != dns.TypeNSEC && key.typ != dns.TypeNSEC3 {
+			continue
+		}
+		if err := r.verifyRRset(rrset, sigs[key], z.name, z.keys); err != nil {
+			return nil, fmt.Errorf("%v for %q: %w", dns.Type(key.typ), key.name, err)
+		}
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				d.nsec = append(d.nsec, rr)
+			case *dns.NSEC3:
+				if rr.Iterations > maxNSEC3Iterations {
+					d.insecure = true
+					continue
+				}
+				d.nsec3 = append(d.nsec3, rr)
+			}
+		}
+	}
+	return d, nil
+}
+
+// hasType reports whether the type bitmap of an NSEC or NSEC3 record
+// includes t.
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalCompare compares DNS names a and b in canonical order (RFC
+// 4034, section 6.1): label by label from the right, case-insensitively.
+func canonicalCompare(a, b string) int {
+	al := dns.SplitDomainName(strings.ToLower(a))
+	bl := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(al[i], bl[j]); c != 0 {
+			return c
+		}
+	}
+	return len(al) - len(bl)
+}
+
+// nsecMatches reports whether n is the NSEC record for name.
+func nsecMatches(n *dns.NSEC, name dnsname.FQDN) bool {
+	return canonicalCompare(n.Hdr.Name, string(name)) == 0
+}
+
+// nsecCovers reports whether n proves that name doesn't exist, because it
+// falls strictly between n's owner and next names.
+func nsecCovers(n *dns.NSEC, name dnsname.FQDN) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, string(name)) >= 0 {
+		return false
+	}
+	// A parent zone's NSEC at a delegation says nothing about the names
+	// in the child zone.
+	if dns.IsSubDomain(owner, string(name)) && hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA) {
+		return false
+	}
+	// The last NSEC in a zone wraps around to the zone apex.
+	return canonicalCompare(next, owner) <= 0 || canonicalCompare(string(name), next) < 0
+}
+
+// nsecClosestEncloser returns the closest encloser of name proven by n,
+// an NSEC covering name: the longest ancestor of name that's an ancestor
+// of n's owner or next name too.
+func nsecClosestEncloser(n *dns.NSEC, name dnsname.FQDN) dnsname.FQDN {
+	ce := dnsname.FQDN(".")
+	for _, other := range []string{n.Hdr.Name, n.NextDomain} {
+		labels := dns.CompareDomainName(string(name), other)
+		if c := ancestor(name, labels); len(c) > len(ce) {
+			ce = c
+		}
+	}
+	return ce
+}
+
+// ancestor returns the ancestor of name with the given number of labels.
+func ancestor(name dnsname.FQDN, labels int) dnsname.FQDN {
+	idx := dns.Split(string(name))
+	if labels <= 0 || len(idx) == 0 {
+		return "."
+	}
+	if labels >= len(idx) {
+		return name
+	}
+	return dnsname.FQDN(strings.ToLower(string(name)[idx[len(idx)-labels]:]))
+}
+
+// wildcard returns the wildcard name directly below ce.
+func wildcard(ce dnsname.FQDN) dnsname.FQDN {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// nsec3ClosestEncloser returns the closest encloser of name proven by the
+// NSEC3 records in d (RFC 5155, section 8.3), and the NSEC3 record covering
+// the next closer name. If name itself exists, it returns name and nil.
+func (d *denial) nsec3ClosestEncloser(name dnsname.FQDN) (ce dnsname.FQDN, nextCloser *dns.NSEC3, ok bool) {
+	labels := dns.CountLabel(string(name))
+	for n := labels; n >= 0; n-- {
+		candidate := ancestor(name, n)
+		if d.nsec3Match(candidate) == nil {
+			continue
+		}
+		if n == labels {
+			return candidate, nil, true
+		}
+		nc := d.nsec3Cover(ancestor(name, n+1))
+		if nc == nil {
+			return "", nil, false
+		}
+		return candidate, nc, true
+	}
+	return "", nil, false
+}
+
+// nsec3Match returns the NSEC3 record in d matching name, or nil.
+func (d *denial) nsec3Match(name dnsname.FQDN) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if n.Match(string(name)) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsec3Cover returns the NSEC3 record in d covering name, or nil.
+func (d *denial) nsec3Cover(name dnsname.FQDN) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if n.Cover(string(name)) {
+			return n
+		}
+	}
+	return nil
+}
+
+// provesNXDOMAIN reports whether d proves that name doesn't exist, and
+// that there's no wildcard that would match it.
+func (d *denial) provesNXDOMAIN(name dnsname.FQDN) bool {
+	for _, n := range d.nsec {
+		if !nsecCovers(n, name) {
+			continue
+		}
+		w := wildcard(nsecClosestEncloser(n, name))
+		for _, wn := range d.nsec {
+			if nsecCovers(wn, w) {
+				return true
+			}
+		}
+	}
+	ce, nc, ok := d.nsec3ClosestEncloser(name)
+	return ok && nc != nil && d.nsec3Cover(wildcard(ce)) != nil
+}
+
+// provesNODATA reports whether d proves that name exists but has no
+// records of type qtype (nor a CNAME), either directly or through a
+// wildcard.
+func (d *denial) provesNODATA(name dnsname.FQDN, qtype dns.Type) bool {
+	noType := func(bitmap []uint16) bool {
+		return !hasType(bitmap, uint16(qtype)) && !hasType(bitmap, dns.TypeCNAME)
+	}
+	for _, n := range d.nsec {
+		if nsecMatches(n, name) {
+			return noType(n.TypeBitMap)
+		}
+	}
+	for _, n := range d.nsec {
+		if !nsecCovers(n, name) {
+			continue
+		}
+		w := wildcard(nsecClosestEncloser(n, name))
+		for _, wn := range d.nsec {
+			if nsecMatches(wn, w) && noType(wn.TypeBitMap) {
+				return true
+			}
+		}
+	}
+	if n := d.nsec3Match(name); n != nil {
+		return noType(n.TypeBitMap)
+	}
+	ce, nc, ok := d.nsec3ClosestEncloser(name)
+	if !ok || nc == nil {
+		return false
+	}
+	if wn := d.nsec3Match(wildcard(ce)); wn != nil {
+		return noType(wn.TypeBitMap)
+	}
+	return false
+}
+
+// provesInsecureDelegation reports whether d proves that the delegation
+// to child has no DS records (RFC 4035, section 5.2), or is covered by an
+// NSEC3 opt-out span (RFC 5155, section 8.9), so that child is unsigned.
+func (d *denial) provesInsecureDelegation(child dnsname.FQDN) bool {
+	delegation := func(bitmap []uint16) bool {
+		return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeDS) && !hasType(bitmap, dns.TypeSOA)
+	}
+	for _, n := range d.nsec {
+		if nsecMatches(n, child) {
+			return delegation(n.TypeBitMap)
+		}
+	}
+	if n := d.nsec3Match(child); n != nil {
+		return delegation(n.TypeBitMap)
+	}
+	_, nc, ok := d.nsec3ClosestEncloser(child)
+	return (ok && nc != nil && nc.Flags&1 != 0) || d.insecure // opt-out flag
+}
+
+// provesWildcardExpansion reports whether d proves that name, answered by
+// expanding a wildcard whose signatures have the given number of labels,
+// doesn't exist itself.
+func (d *denial) provesWildcardExpansion(name dnsname.FQDN, labels int) bool {
+	for _, n := range d.nsec {
+		if nsecCovers(n, name) {
+			return true
+		}
+	}
+	// With NSEC3, the next closer name below the wildcard's parent must
+	// be covered (RFC 5155, section 8.8).
+	return d.nsec3Cover(ancestor(name, labels+1)) != nil
+}
@@ -0,0 +1,435 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package recursive
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/util/dnsname"
+)
+
+// testZone is a DNSSEC-signed zone for tests, with a key signing key and a
+// zone signing key generated on the fly.
+type testZone struct {
+	name    string
+	ksk     *dns.DNSKEY
+	kskPriv crypto.Signer
+	zsk     *dns.DNSKEY
+	zskPriv crypto.Signer
+}
+
+func newTestZone(tb testing.TB, name string) *testZone {
+	z := &testZone{name: name}
+	z.ksk, z.kskPriv = newTestKey(tb, name, dns.ZONE|dns.SEP)
+	z.zsk, z.zskPriv = newTestKey(tb, name, dns.ZONE)
+	return z
+}
+
+func newTestKey(tb testing.TB, name string, flags uint16) (*dns.DNSKEY, crypto.Signer) {
+	k := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return k, priv.(crypto.Signer)
+}
+
+func signRRset(tb testing.TB, signer string, key *dns.DNSKEY, priv crypto.Signer, rrset []dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		SignerName: signer,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(priv, rrset); err != nil {
+		tb.Fatal(err)
+	}
+	return sig
+}
+
+// sign returns the records of rrset followed by their signature by z.
+func (z *testZone) sign(tb testing.TB, rrset ...dns.RR) []dns.RR {
+	return append(slices.Clip(rrset), signRRset(tb, z.name, z.zsk, z.zskPriv, rrset))
+}
+
+// dnskeyReply is z's reply to a DNSKEY query.
+func (z *testZone) dnskeyReply(tb testing.TB) *dns.Msg {
+	keys := []dns.RR{z.ksk, z.zsk}
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{Authoritative: true},
+		Answer: append(keys, signRRset(tb, z.name, z.ksk, z.kskPriv, keys)),
+	}
+}
+
+// ds returns the DS record for z, signed by parent.
+func (z *testZone) ds(tb testing.TB, parent *testZone) []dns.RR {
+	ds := z.ksk.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	return parent.sign(tb, ds)
+}
+
+func nsecRR(name, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		NextDomain: next,
+		TypeBitMap: typeBitMap(append(types, dns.TypeRRSIG, dns.TypeNSEC)...),
+	}
+}
+
+// typeBitMap returns types in the order NSEC and NSEC3 records need.
+func typeBitMap(types ...uint16) []uint16 {
+	slices.Sort(types)
+	return types
+}
+
+// nsec3Chain returns the NSEC3 records for the names in zone, without
+// opt-out and with no salt or extra iterations, and with types for each
+// name.
+func nsec3Chain(zone string, types map[string][]uint16) []*dns.NSEC3 {
+	type hashed struct {
+		hash  string
+		types []uint16
+	}
+	var hs []hashed
+	for name, t := range types {
+		hs = append(hs, hashed{dns.HashName(name, dns.SHA1, 0, ""), t})
+	}
+	slices.SortFunc(hs, func(a, b hashed) int { return strings.Compare(a.hash, b.hash) })
+	var ret []*dns.NSEC3
+	for i, h := range hs {
+		ret = append(ret, &dns.NSEC3{
+			Hdr: dns.RR_Header{
+				Name:   strings.ToLower(h.hash) + "." + zone,
+				Rrtype: dns.TypeNSEC3,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			},
+			Hash:       dns.SHA1,
+			NextDomain: hs[(i+1)%len(hs)].hash,
+			HashLength: 20,
+			TypeBitMap: typeBitMap(append(h.types, dns.TypeRRSIG)...),
+		})
+	}
+	return ret
+}
+
+var (
+	exampleNSAddr  = netip.MustParseAddr("192.0.2.53")
+	unsignedNSAddr = netip.MustParseAddr("192.0.2.54")
+)
+
+// dnssecMock is a set of mock nameservers for a signed root, the signed
+// zones com. and example.com. below it, and the unsigned zone unsigned.com.
+type dnssecMock struct {
+	root, com, example *testZone
+	replies            map[netip.Addr][]mockReply
+}
+
+func newDNSSECMock(tb testing.TB) *dnssecMock {
+	m := &dnssecMock{
+		root:    newTestZone(tb, "."),
+		com:     newTestZone(tb, "com."),
+		example: newTestZone(tb, "example.com."),
+	}
+	root, com, example := m.root, m.com, m.example
+
+	comReferral := &dns.Msg{
+		Ns:    append([]dns.RR{nsRR("com.", "a.gtld-servers.net.")}, com.ds(tb, root)...),
+		Extra: []dns.RR{dnsIPRR("a.gtld-servers.net.", comNSAddr)},
+	}
+	exampleReferral := &dns.Msg{
+		Ns:    append([]dns.RR{nsRR("example.com.", "ns.example.com.")}, example.ds(tb, com)...),
+		Extra: []dns.RR{dnsIPRR("ns.example.com.", exampleNSAddr)},
+	}
+	unsignedReferral := &dns.Msg{
+		Ns: append([]dns.RR{nsRR("unsigned.com.", "ns.unsigned.com.")},
+			com.sign(tb, nsecRR("unsigned.com.", "zzz.com.", dns.TypeNS))...),
+		Extra: []dns.RR{dnsIPRR("ns.unsigned.com.", unsignedNSAddr)},
+	}
+
+	exampleNSEC3 := nsec3Chain("example.com.", map[string][]uint16{
+		"example.com.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"www.example.com.": {dns.TypeA},
+	})
+	var nxProof []dns.RR
+	for _, n := range exampleNSEC3 {
+		nxProof = append(nxProof, example.sign(tb, n)...)
+	}
+
+	m.replies = map[netip.Addr][]mockReply{
+		rootServerAddr: {
+			{name: ".", qtype: dns.Type(dns.TypeDNSKEY), resp: root.dnskeyReply(tb)},
+		},
+		comNSAddr: {
+			{name: "com.", qtype: dns.Type(dns.TypeDNSKEY), resp: com.dnskeyReply(tb)},
+		},
+		exampleNSAddr: {
+			{name: "example.com.", qtype: dns.Type(dns.TypeDNSKEY), resp: example.dnskeyReply(tb)},
+			{name: "www.example.com.", qtype: dns.Type(dns.TypeA), resp: &dns.Msg{
+				MsgHdr: dns.MsgHdr{Authoritative: true},
+				Answer: example.sign(tb, dnsIPRR("www.example.com.", netip.MustParseAddr("192.0.2.1"))),
+			}},
+			{name: "www.example.com.", qtype: dns.Type(dns.TypeAAAA), resp: &dns.Msg{
+				MsgHdr: dns.MsgHdr{Authoritative: true},
+				Ns:     example.sign(tb, exampleNSEC3[slices.IndexFunc(exampleNSEC3, func(n *dns.NSEC3) bool { return n.Match("www.example.com.") })]),
+			}},
+			{name: "nx.example.com.", qtype: dns.Type(dns.TypeA), resp: &dns.Msg{
+				MsgHdr: dns.MsgHdr{Authoritative: true, Rcode: dns.RcodeNameError},
+				Ns:     nxProof,
+			}},
+			{name: "nx.example.com.", qtype: dns.Type(dns.TypeAAAA), resp: &dns.Msg{
+				MsgHdr: dns.MsgHdr{Authoritative: true, Rcode: dns.RcodeNameError},
+				Ns:     nxProof,
+			}},
+		},
+		unsignedNSAddr: {
+			{name: "www.unsigned.com.", qtype: dns.Type(dns.TypeA), resp: &dns.Msg{
+				MsgHdr: dns.MsgHdr{Authoritative: true},
+				Answer: []dns.RR{dnsIPRR("www.unsigned.com.", netip.MustParseAddr("192.0.2.2"))},
+			}},
+			{name: "www.unsigned.com.", qtype: dns.Type(dns.TypeAAAA), resp: &dns.Msg{
+				MsgHdr: dns.MsgHdr{Authoritative: true},
+			}},
+		},
+	}
+	for _, name := range []string{"www.example.com.", "nx.example.com."} {
+		for _, qtype := range []dns.Type{qtypeA, qtypeAAAA} {
+			m.replies[rootServerAddr] = append(m.replies[rootServerAddr], mockReply{name: name, qtype: qtype, resp: comReferral})
+			m.replies[comNSAddr] = append(m.replies[comNSAddr], mockReply{name: name, qtype: qtype, resp: exampleReferral})
+		}
+	}
+	for _, qtype := range []dns.Type{qtypeA, qtypeAAAA} {
+		m.replies[rootServerAddr] = append(m.replies[rootServerAddr], mockReply{name: "www.unsigned.com.", qtype: qtype, resp: comReferral})
+		m.replies[comNSAddr] = append(m.replies[comNSAddr], mockReply{name: "www.unsigned.com.", qtype: qtype, resp: unsignedReferral})
+	}
+	return m
+}
+
+// set replaces the reply from nameserver to the query for name and qtype.
+func (m *dnssecMock) set(nameserver netip.Addr, name string, qtype dns.Type, resp *dns.Msg) {
+	for i, reply := range m.replies[nameserver] {
+		if reply.name == name && reply.qtype == qtype {
+			m.replies[nameserver][i].resp = resp
+		}
+	}
+}
+
+func (m *dnssecMock) resolver(t *testing.T) *Resolver {
+	mock := &replyMock{tb: t, replies: m.replies}
+	r := newResolver(t)
+	r.ValidateDNSSEC = true
+	r.rootServers = []netip.Addr{rootServerAddr}
+	r.trustAnchors = []*dns.DS{m.root.ksk.ToDS(dns.SHA256)}
+	r.testExchangeHook = func(nameserver netip.Addr, network string, req *dns.Msg) (*dns.Msg, error) {
+		if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+			t.Errorf("query for %q without the DNSSEC OK bit", req.Question[0].Name)
+		}
+		return mock.exchangeHook(nameserver, network, req)
+	}
+	return r
+}
+
+func TestDNSSECSecure(t *testing.T) {
+	m := newDNSSECMock(t)
+	r := m.resolver(t)
+
+	addrs, _, status, err := r.ResolveWithStatus(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("192.0.2.1")}; !slices.Equal(addrs, want) {
+		t.Errorf("got addrs=%v; want %v", addrs, want)
+	}
+	if status != Secure {
+		t.Errorf("got status=%v; want %v", status, Secure)
+	}
+}
+
+func TestDNSSECInsecure(t *testing.T) {
+	m := newDNSSECMock(t)
+	r := m.resolver(t)
+
+	addrs, _, status, err := r.ResolveWithStatus(context.Background(), "www.unsigned.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("192.0.2.2")}; !slices.Equal(addrs, want) {
+		t.Errorf("got addrs=%v; want %v", addrs, want)
+	}
+	if status != Insecure {
+		t.Errorf("got status=%v; want %v", status, Insecure)
+	}
+}
+
+func TestDNSSECNXDOMAIN(t *testing.T) {
+	m := newDNSSECMock(t)
+	r := m.resolver(t)
+
+	_, _, status, err := r.ResolveWithStatus(context.Background(), "nx.example.com")
+	if !errors.Is(err, ErrAuthoritativeNoResponses) {
+		t.Fatalf("got err=%v; want %v", err, ErrAuthoritativeNoResponses)
+	}
+	if status != Secure {
+		t.Errorf("got status=%v; want %v", status, Secure)
+	}
+}
+
+func TestDNSSECBogus(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		modify func(*testing.T, *dnssecMock)
+	}{
+		{
+			name:  "tampered-answer",
+			query: "www.example.com",
+			modify: func(t *testing.T, m *dnssecMock) {
+				answer := m.example.sign(t, dnsIPRR("www.example.com.", netip.MustParseAddr("192.0.2.1")))
+				answer[0] = dnsIPRR("www.example.com.", netip.MustParseAddr("192.0.2.66"))
+				m.set(exampleNSAddr, "www.example.com.", qtypeA, &dns.Msg{
+					MsgHdr: dns.MsgHdr{Authoritative: true},
+					Answer: answer,
+				})
+			},
+		},
+		{
+			name:  "unsigned-answer",
+			query: "www.example.com",
+			modify: func(t *testing.T, m *dnssecMock) {
+				m.set(exampleNSAddr, "www.example.com.", qtypeA, &dns.Msg{
+					MsgHdr: dns.MsgHdr{Authoritative: true},
+					Answer: []dns.RR{dnsIPRR("www.example.com.", netip.MustParseAddr("192.0.2.66"))},
+				})
+			},
+		},
+		{
+			name:  "wrong-zone-key",
+			query: "www.example.com",
+			modify: func(t *testing.T, m *dnssecMock) {
+				other := newTestZone(t, "example.com.")
+				m.set(exampleNSAddr, "www.example.com.", qtypeA, &dns.Msg{
+					MsgHdr: dns.MsgHdr{Authoritative: true},
+					Answer: other.sign(t, dnsIPRR("www.example.com.", netip.MustParseAddr("192.0.2.66"))),
+				})
+			},
+		},
+		{
+			name:  "wrong-dnskey",
+			query: "www.example.com",
+			modify: func(t *testing.T, m *dnssecMock) {
+				other := newTestZone(t, "example.com.")
+				m.set(exampleNSAddr, "example.com.", dns.Type(dns.TypeDNSKEY), other.dnskeyReply(t))
+			},
+		},
+		{
+			name:  "unproven-nodata",
+			query: "www.example.com",
+			modify: func(t *testing.T, m *dnssecMock) {
+				m.set(exampleNSAddr, "www.example.com.", qtypeAAAA, &dns.Msg{
+					MsgHdr: dns.MsgHdr{Authoritative: true},
+				})
+			},
+		},
+		{
+			name:  "unproven-insecure-delegation",
+			query: "www.unsigned.com",
+			modify: func(t *testing.T, m *dnssecMock) {
+				for _, qtype := range []dns.Type{qtypeA, qtypeAAAA} {
+					m.set(comNSAddr, "www.unsigned.com.", qtype, &dns.Msg{
+						Ns:    []dns.RR{nsRR("unsigned.com.", "ns.unsigned.com.")},
+						Extra: []dns.RR{dnsIPRR("ns.unsigned.com.", unsignedNSAddr)},
+					})
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newDNSSECMock(t)
+			tt.modify(t, m)
+			r := m.resolver(t)
+
+			addrs, _, status, err := r.ResolveWithStatus(context.Background(), tt.query)
+			if !errors.Is(err, ErrBogus) {
+				t.Errorf("got err=%v; want %v", err, ErrBogus)
+			}
+			if status != Bogus || len(addrs) > 0 {
+				t.Errorf("got status=%v, addrs=%v; want %v and no addrs", status, addrs, Bogus)
+			}
+		})
+	}
+}
+
+func TestDNSSECDisabled(t *testing.T) {
+	m := newDNSSECMock(t)
+	r := m.resolver(t)
+	r.ValidateDNSSEC = false
+	r.testExchangeHook = (&replyMock{tb: t, replies: m.replies}).exchangeHook
+
+	// Without validation, even an unsigned answer is accepted.
+	m.set(exampleNSAddr, "www.example.com.", qtypeA, &dns.Msg{
+		MsgHdr: dns.MsgHdr{Authoritative: true},
+		Answer: []dns.RR{dnsIPRR("www.example.com.", netip.MustParseAddr("192.0.2.66"))},
+	})
+	addrs, _, status, err := r.ResolveWithStatus(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || status != Unvalidated {
+		t.Errorf("got addrs=%v, status=%v; want 1 addr, %v", addrs, status, Unvalidated)
+	}
+}
+
+func TestNSECCovers(t *testing.T) {
+	tests := []struct {
+		owner, next, name string
+		want              bool
+	}{
+		{"a.example.", "d.example.", "b.example.", true},
+		{"a.example.", "d.example.", "a.example.", false},
+		{"a.example.", "d.example.", "d.example.", false},
+		{"a.example.", "d.example.", "x.b.example.", true},
+		{"a.example.", "d.example.", "e.example.", false},
+		{"y.example.", "example.", "z.example.", true}, // wraps around to the apex
+		{"y.example.", "example.", "b.example.", false},
+		{"A.example.", "D.example.", "c.EXAMPLE.", true},
+	}
+	for _, tt := range tests {
+		n := nsecRR(tt.owner, tt.next, dns.TypeA)
+		if got := nsecCovers(n, dnsname.FQDN(tt.name)); got != tt.want {
+			t.Errorf("NSEC %s -> %s covers %s = %v; want %v", tt.owner, tt.next, tt.name, got, tt.want)
+		}
+	}
+
+	// NSEC records at a delegation don't cover names in the child zone.
+	n := nsecRR("b.example.", "d.example.", dns.TypeNS)
+	if nsecCovers(n, "x.b.example.") {
+		t.Errorf("delegation NSEC covers a name below it")
+	}
+}
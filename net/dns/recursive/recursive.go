@@ -110,10 +110,18 @@ type Resolver struct {
 	// records and will avoid contacting nameservers over IPv6.
 	NoIPv6 bool
 
+	// ValidateDNSSEC, if set, makes the Resolver validate the DNSSEC
+	// signatures of the answers it gets, following the chain of trust
+	// from the built-in root trust anchor. Resolve then fails with
+	// ErrBogus for answers that don't validate, and ResolveWithStatus
+	// also reports whether the answers were signed.
+	ValidateDNSSEC bool
+
 	// Test mocks
 	testQueryHook    func(name dnsname.FQDN, nameserver netip.Addr, protocol string, qtype dns.Type) (*dns.Msg, error)
 	testExchangeHook func(nameserver netip.Addr, network string, msg *dns.Msg) (*dns.Msg, error)
 	rootServers      []netip.Addr
+	trustAnchors     []*dns.DS // or nil for rootTrustAnchors
 	timeNow          func() time.Time
 
 	// Caching
@@ -131,13 +139,45 @@ type queryState struct {
 	// rootServers are the root nameservers to start from
 	rootServers []netip.Addr
 
+	// chains are the chains of responses that led to the answers (or
+	// authoritative lack of answers) found so far, for DNSSEC
+	// validation. They're only recorded if ValidateDNSSEC is set.
+	chains []chain
+
 	// TODO: metrics?
 }
 
+// step is a response received while resolving a name.
+type step struct {
+	nameserver netip.Addr
+	resp       *dns.Msg
+}
+
+// chain is the sequence of responses, starting with one from a root
+// nameserver and following referrals, that answered a query for a name.
+type chain struct {
+	name  dnsname.FQDN
+	qtype dns.Type
+	steps []step
+}
+
+// addChain records that path answered the query for name and qtype.
+func (q *queryState) addChain(name dnsname.FQDN, qtype dns.Type, path []step) {
+	q.chains = append(q.chains, chain{name: name, qtype: qtype, steps: path})
+}
+
+// takeChains returns and clears the chains recorded so far.
+func (q *queryState) takeChains() []chain {
+	ret := q.chains
+	q.chains = nil
+	return ret
+}
+
 type dnsQuery struct {
 	nameserver netip.Addr
 	name       dnsname.FQDN
 	qtype      dns.Type
+	dnssec     bool // whether the DNSSEC OK bit was set
 }
 
 func (q dnsQuery) String() string {
@@ -215,37 +255,61 @@ func (r *Resolver) newState() *queryState {
 // responses as a slice of netip.Addrs along with the minimum TTL for the
 // returned records.
 func (r *Resolver) Resolve(ctx context.Context, name string) (addrs []netip.Addr, minTTL time.Duration, err error) {
+	addrs, minTTL, _, err = r.ResolveWithStatus(ctx, name)
+	return addrs, minTTL, err
+}
+
+// ResolveWithStatus is like Resolve, but also returns the DNSSEC validation
+// status of the answers, which is Unvalidated unless ValidateDNSSEC is set.
+//
+// If the answers are Bogus, it returns an error wrapping ErrBogus and no
+// addresses.
+func (r *Resolver) ResolveWithStatus(ctx context.Context, name string) (addrs []netip.Addr, minTTL time.Duration, status ValidationStatus, err error) {
 	dnsName, err := dnsname.ToFQDN(name)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, Unvalidated, err
 	}
 
 	qstate := r.newState()
 
 	r.logf("querying IPv4 addresses for: %q", name)
 	addrs4, minTTL4, err4 := r.resolveRecursiveFromRoot(ctx, qstate, 0, dnsName, qtypeA)
+	status4, verr4 := r.validate(ctx, qstate.takeChains(), err4)
 
 	var (
 		addrs6  []netip.Addr
 		minTTL6 time.Duration
 		err6    error
+		status6 ValidationStatus
+		verr6   error
 	)
 	if !r.NoIPv6 {
 		r.logf("querying IPv6 addresses for: %q", name)
 		addrs6, minTTL6, err6 = r.resolveRecursiveFromRoot(ctx, qstate, 0, dnsName, qtypeAAAA)
+		status6, verr6 = r.validate(ctx, qstate.takeChains(), err6)
+	}
+
+	// Any bogus answer, including a bogus proof that there are no
+	// answers of one type, fails the whole resolution.
+	if verr4 != nil {
+		return nil, 0, Bogus, verr4
+	}
+	if verr6 != nil {
+		return nil, 0, Bogus, verr6
 	}
+	status = status4.combine(status6)
 
 	if err4 != nil && err6 != nil {
 		if err4 == err6 {
-			return nil, 0, err4
+			return nil, 0, status, err4
 		}
 
-		return nil, 0, multierr.New(err4, err6)
+		return nil, 0, status, multierr.New(err4, err6)
 	}
 	if err4 != nil {
-		return addrs6, minTTL6, nil
+		return addrs6, minTTL6, status, nil
 	} else if err6 != nil {
-		return addrs4, minTTL4, nil
+		return addrs4, minTTL4, status, nil
 	}
 
 	minTTL = minTTL4
@@ -255,11 +319,11 @@ func (r *Resolver) Resolve(ctx context.Context, name string) (addrs []netip.Addr
 
 	addrs = append(addrs4, addrs6...)
 	if len(addrs) == 0 {
-		return nil, 0, ErrNoResponses
+		return nil, 0, status, ErrNoResponses
 	}
 
 	slicesx.Shuffle(addrs)
-	return addrs, minTTL, nil
+	return addrs, minTTL, status, nil
 }
 
 func (r *Resolver) resolveRecursiveFromRoot(
@@ -273,7 +337,7 @@ func (r *Resolver) resolveRecursiveFromRoot(
 
 	var depthError bool
 	for _, server := range qstate.rootServers {
-		addrs, minTTL, err := r.resolveRecursive(ctx, qstate, depth, name, server, qtype)
+		addrs, minTTL, err := r.resolveRecursive(ctx, qstate, depth, nil, name, server, qtype)
 		if err == nil {
 			return addrs, minTTL, err
 		} else if errors.Is(err, ErrAuthoritativeNoResponses) {
@@ -293,6 +357,7 @@ func (r *Resolver) resolveRecursive(
 	ctx context.Context,
 	qstate *queryState,
 	depth int,
+	path []step, // responses that led to nameserver, if validating DNSSEC
 	name dnsname.FQDN, // what we're querying
 	nameserver netip.Addr,
 	qtype dns.Type,
@@ -307,6 +372,9 @@ func (r *Resolver) resolveRecursive(
 	if err != nil {
 		return nil, 0, err
 	}
+	if r.ValidateDNSSEC {
+		path = append(slices.Clip(path), step{nameserver, resp})
+	}
 
 	// If we get an actual answer from the nameserver, then return it.
 	var (
@@ -341,6 +409,9 @@ func (r *Resolver) resolveRecursive(
 
 	if len(answers) > 0 {
 		r.depthlogf(depth, "got answers for %q: %v", name, answers)
+		if r.ValidateDNSSEC {
+			qstate.addChain(name, qtype, path)
+		}
 		return answers, time.Duration(minTTL) * time.Second, nil
 	}
 
@@ -357,6 +428,13 @@ func (r *Resolver) resolveRecursive(
 	var cnameDepthError bool
 	for _, cname := range cnames {
 		answers, minTTL, err := r.resolveRecursiveFromRoot(ctx, qstate, depth+1, cname, qtype)
+		if err == nil || errors.Is(err, ErrAuthoritativeNoResponses) {
+			// The CNAME itself needs validating along with what
+			// it points to.
+			if r.ValidateDNSSEC {
+				qstate.addChain(name, qtype, path)
+			}
+		}
 		if err == nil {
 			return answers, minTTL, nil
 		} else if errors.Is(err, ErrAuthoritativeNoResponses) {
@@ -377,6 +455,9 @@ func (r *Resolver) resolveRecursive(
 		}
 
 		r.depthlogf(depth, "got authoritative response with no answers; stopping")
+		if r.ValidateDNSSEC {
+			qstate.addChain(name, qtype, path)
+		}
 		return nil, 0, ErrAuthoritativeNoResponses
 	}
 
@@ -429,7 +510,7 @@ func (r *Resolver) resolveRecursive(
 	r.depthlogf(depth, "authorities with glue records for recursion: %v", authoritiesGlue)
 	for _, authority := range authoritiesGlue {
 		for _, nameserver := range glueRecords[authority] {
-			answers, minTTL, err := r.resolveRecursive(ctx, qstate, depth+1, name, nameserver, qtype)
+			answers, minTTL, err := r.resolveRecursive(ctx, qstate, depth+1, path, name, nameserver, qtype)
 			if err == nil {
 				return answers, minTTL, nil
 			} else if errors.Is(err, ErrAuthoritativeNoResponses) {
@@ -458,7 +539,7 @@ func (r *Resolver) resolveRecursive(
 
 			// Now, query this authority for the final address.
 			for _, nameserver := range answers {
-				answers, minTTL, err := r.resolveRecursive(ctx, qstate, depth+1, name, nameserver, qtype)
+				answers, minTTL, err := r.resolveRecursive(ctx, qstate, depth+1, path, name, nameserver, qtype)
 				if err == nil {
 					return answers, minTTL, nil
 				} else if errors.Is(err, ErrAuthoritativeNoResponses) {
@@ -530,6 +611,7 @@ func (r *Resolver) queryNameserverProto(
 		nameserver: nameserver,
 		name:       name,
 		qtype:      qtype,
+		dnssec:     r.ValidateDNSSEC,
 	}
 	cacheEntry, ok := r.queryCache[cacheKey]
 	if ok && cacheEntry.expiresAt.Before(now) {
@@ -548,6 +630,11 @@ func (r *Resolver) queryNameserverProto(
 	// for the name we're querying.
 	m := new(dns.Msg)
 	m.SetQuestion(name.WithTrailingDot(), uint16(qtype))
+	if r.ValidateDNSSEC {
+		// Ask for the DNSSEC records we need to validate the
+		// response, and for large enough responses to fit them.
+		m.SetEdns0(dnssecUDPSize, true)
+	}
 
 	// Allow mocking out the network components with our exchange hook.
 	if r.testExchangeHook != nil {
@@ -0,0 +1,289 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// dnsCacheMaxEntries is the maximum number of responses in the
+	// forwarder's cache. Responses are at most maxResponseBytes, and
+	// typically a few hundred bytes.
+	dnsCacheMaxEntries = 1000
+
+	// dnsCacheMaxTTL is the longest a response is cached, regardless of
+	// its TTL.
+	dnsCacheMaxTTL = time.Hour
+
+	// dnsCacheMaxNegativeTTL is the longest a negative (NXDOMAIN or
+	// NODATA) response is cached, regardless of its SOA record.
+	dnsCacheMaxNegativeTTL = 15 * time.Minute
+)
+
+// dnsCacheKey is the key of a cached response: the question it answers.
+type dnsCacheKey struct {
+	name  dnsname.FQDN // lowercase
+	typ   dns.Type
+	class dns.Class
+
+	// dnssecOK is whether the query set the EDNS DO bit, which affects
+	// whether upstreams include DNSSEC records in the response.
+	dnssecOK bool
+}
+
+// dnsCacheEntry is a cached response.
+type dnsCacheEntry struct {
+	msg      dns.Message
+	stored   time.Time
+	expires  time.Time
+	negative bool // NXDOMAIN or NODATA
+}
+
+// dnsCache is a size-bounded cache of upstream DNS responses, which
+// respects their TTLs and caches negative responses per RFC 2308.
+//
+// Its methods are safe for concurrent use.
+type dnsCache struct {
+	now func() time.Time // or nil for time.Now; for tests
+
+	mu      sync.Mutex
+	entries lru.Cache[dnsCacheKey, *dnsCacheEntry]
+	hits    int64
+	misses  int64
+}
+
+func newDNSCache() *dnsCache {
+	c := &dnsCache{}
+	c.entries.MaxEntries = dnsCacheMaxEntries
+	return c
+}
+
+func (c *dnsCache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// parseCacheQuery parses the cacheable DNS query in query, reporting
+// whether it is one. It also returns the largest UDP response the querier
+// accepts: 512 bytes, or more if advertised in an EDNS OPT record.
+func parseCacheQuery(query []byte) (key dnsCacheKey, hdr dns.Header, q dns.Question, hasOPT bool, udpSize int, ok bool) {
+	udpSize = minUDPResponseBytes
+	var p dns.Parser
+	hdr, err := p.Start(query)
+	if err != nil || hdr.Response || hdr.OpCode != 0 {
+		return key, hdr, q, false, udpSize, false
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 {
+		return key, hdr, q, false, udpSize, false
+	}
+	q = qs[0]
+	key = dnsCacheKey{
+		name:  dnsname.FQDN(strings.ToLower(q.Name.String())),
+		typ:   q.Type,
+		class: q.Class,
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return key, hdr, q, false, udpSize, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return key, hdr, q, false, udpSize, false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return key, hdr, q, false, udpSize, false
+		}
+		if h.Type == dns.TypeOPT {
+			hasOPT = true
+			key.dnssecOK = h.TTL&dnssecOKBit != 0
+			// The OPT record's class is the requester's UDP payload
+			// size (RFC 6891, section 6.2.3).
+			udpSize = max(minUDPResponseBytes, int(h.Class))
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return key, hdr, q, false, udpSize, false
+		}
+	}
+	return key, hdr, q, hasOPT, udpSize, true
+}
+
+// dnssecOKBit is the DO bit in the TTL field of an OPT record (RFC 3225).
+const dnssecOKBit = 1 << 15
+
+// minUDPResponseBytes is the largest DNS response over UDP that all
+// requesters accept (RFC 1035, section 4.2.1).
+const minUDPResponseBytes = 512
+
+// get returns the cached response to query, if any, with query's txid
+// and question and with TTLs reduced by the time it's been cached.
+//
+// The family is the query's transport, "udp" or "tcp". A response too
+// large for a UDP requester is returned truncated, with the TC bit set,
+// so that it retries over TCP.
+func (c *dnsCache) get(query []byte, family string) ([]byte, bool) {
+	key, hdr, q, hasOPT, udpSize, ok := parseCacheQuery(query)
+	if !ok {
+		return nil, false
+	}
+	now := c.timeNow()
+
+	c.mu.Lock()
+	e, ok := c.entries.GetOk(key)
+	if ok && !now.Before(e.expires) {
+		c.entries.Delete(key)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		metricDNSFwdCacheMiss.Add(1)
+		return nil, false
+	}
+	c.hits++
+	c.mu.Unlock()
+	metricDNSFwdCacheHit.Add(1)
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	age := func(rs []dns.Resource) []dns.Resource {
+		ret := make([]dns.Resource, 0, len(rs))
+		for _, r := range rs {
+			if r.Header.Type == dns.TypeOPT {
+				if !hasOPT {
+					continue
+				}
+			} else {
+				r.Header.TTL -= min(r.Header.TTL, elapsed)
+			}
+			ret = append(ret, r)
+		}
+		return ret
+	}
+	msg := e.msg
+	msg.Header.ID = hdr.ID
+	msg.Header.RecursionDesired = hdr.RecursionDesired
+	msg.Questions = []dns.Question{q} // preserving the query's case
+	msg.Answers = age(msg.Answers)
+	msg.Authorities = age(msg.Authorities)
+	msg.Additionals = age(msg.Additionals)
+	out, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	if family == "udp" && len(out) > udpSize {
+		msg.Truncated = true
+		msg.Answers = nil
+		msg.Authorities = nil
+		msg.Additionals = slices.DeleteFunc(msg.Additionals, func(r dns.Resource) bool {
+			return r.Header.Type != dns.TypeOPT
+		})
+		if out, err = msg.Pack(); err != nil {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// put caches resp as the response to query, if it's cacheable.
+func (c *dnsCache) put(query, resp []byte) {
+	key, _, _, _, _, ok := parseCacheQuery(query)
+	if !ok {
+		return
+	}
+	var msg dns.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.Truncated || len(msg.Questions) != 1 {
+		return
+	}
+	if rq := msg.Questions[0]; !strings.EqualFold(rq.Name.String(), string(key.name)) || rq.Type != key.typ || rq.Class != key.class {
+		return
+	}
+
+	var ttl time.Duration
+	var negative bool
+	switch {
+	case msg.RCode == dns.RCodeSuccess && len(msg.Answers) > 0:
+		ttl = dnsCacheMaxTTL
+		for _, rs := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+			for _, r := range rs {
+				if r.Header.Type != dns.TypeOPT {
+					ttl = min(ttl, time.Duration(r.Header.TTL)*time.Second)
+				}
+			}
+		}
+	case msg.RCode == dns.RCodeSuccess || msg.RCode == dns.RCodeNameError:
+		// A negative response is cached for the minimum of its SOA
+		// record's TTL and MINIMUM field (RFC 2308, section 5), and not
+		// at all without a SOA record.
+		negative = true
+		for _, r := range msg.Authorities {
+			if soa, ok := r.Body.(*dns.SOAResource); ok {
+				ttl = min(dnsCacheMaxNegativeTTL, time.Duration(r.Header.TTL)*time.Second, time.Duration(soa.MinTTL)*time.Second)
+				break
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := c.timeNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Set(key, &dnsCacheEntry{
+		msg:      msg,
+		stored:   now,
+		expires:  now.Add(ttl),
+		negative: negative,
+	})
+}
+
+// flush removes all cached responses.
+func (c *dnsCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Clear()
+}
+
+// status returns the cache's statistics and unexpired entries.
+func (c *dnsCache) status() *apitype.DNSCacheStatus {
+	now := c.timeNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &apitype.DNSCacheStatus{
+		MaxEntries: dnsCacheMaxEntries,
+		Hits:       c.hits,
+		Misses:     c.misses,
+	}
+	c.entries.ForEach(func(k dnsCacheKey, e *dnsCacheEntry) {
+		if !now.Before(e.expires) {
+			return
+		}
+		st.Entries = append(st.Entries, apitype.DNSCacheEntry{
+			Name:     k.name.WithoutTrailingDot(),
+			Type:     strings.TrimPrefix(k.typ.String(), "Type"),
+			RCode:    strings.TrimPrefix(e.msg.RCode.String(), "RCode"),
+			Negative: e.negative,
+			Answers:  len(e.msg.Answers),
+			Expires:  e.expires,
+		})
+	})
+	return st
+}
@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// makeTestNegativeResponse returns an NXDOMAIN response for domain, with a
+// SOA record with the provided TTL and MINIMUM field if soaTTL is non-zero.
+func makeTestNegativeResponse(tb testing.TB, domain string, soaTTL, soaMin uint32) []byte {
+	tb.Helper()
+	b := dns.NewBuilder(nil, dns.Header{Response: true, RCode: dns.RCodeNameError})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: dns.MustNewName(domain), Type: dns.TypeA, Class: dns.ClassINET})
+	if soaTTL != 0 {
+		b.StartAuthorities()
+		b.SOAResource(dns.ResourceHeader{
+			Name:  dns.MustNewName("tailscale.com."),
+			Class: dns.ClassINET,
+			TTL:   soaTTL,
+		}, dns.SOAResource{
+			NS:     dns.MustNewName("ns.tailscale.com."),
+			MBox:   dns.MustNewName("hostmaster.tailscale.com."),
+			MinTTL: soaMin,
+		})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return res
+}
+
+func answerTTLs(tb testing.TB, res []byte) (txid uint16, name string, ttls []uint32) {
+	tb.Helper()
+	var msg dns.Message
+	if err := msg.Unpack(res); err != nil {
+		tb.Fatal(err)
+	}
+	for _, a := range msg.Answers {
+		ttls = append(ttls, a.Header.TTL)
+	}
+	return msg.ID, msg.Questions[0].Name.String(), ttls
+}
+
+func TestDNSCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newDNSCache()
+	c.now = func() time.Time { return now }
+
+	const domain = "cache.tailscale.com."
+	query := makeTestRequest(t, domain)
+	if _, ok := c.get(query, "udp"); ok {
+		t.Fatal("hit in empty cache")
+	}
+	c.put(query, makeTestResponse(t, domain, dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1"))) // TTL 120
+
+	// A later query with a different txid and case gets the cached
+	// response, adjusted to match it.
+	now = now.Add(30 * time.Second)
+	query2 := makeTestRequest(t, "CACHE.tailscale.com.")
+	binary.BigEndian.PutUint16(query2, 42)
+	res, ok := c.get(query2, "udp")
+	if !ok {
+		t.Fatal("cache miss")
+	}
+	txid, name, ttls := answerTTLs(t, res)
+	if txid != 42 || name != "CACHE.tailscale.com." || len(ttls) != 1 || ttls[0] != 90 {
+		t.Errorf("cached response has txid %d, name %q, TTLs %v; want 42, %q, [90]", txid, name, ttls, "CACHE.tailscale.com.")
+	}
+
+	now = now.Add(90 * time.Second)
+	if _, ok := c.get(query, "udp"); ok {
+		t.Error("hit after expiry")
+	}
+
+	st := c.status()
+	if st.Hits != 1 || st.Misses != 2 || len(st.Entries) != 0 {
+		t.Errorf("status = %+v; want 1 hit, 2 misses, no entries", st)
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newDNSCache()
+	c.now = func() time.Time { return now }
+
+	const domain = "nx.tailscale.com."
+	query := makeTestRequest(t, domain)
+
+	// Without a SOA record, a negative response isn't cached.
+	c.put(query, makeTestNegativeResponse(t, domain, 0, 0))
+	if _, ok := c.get(query, "udp"); ok {
+		t.Fatal("cached negative response without SOA")
+	}
+
+	// Otherwise, it's cached for the minimum of the SOA's TTL and
+	// MINIMUM field.
+	c.put(query, makeTestNegativeResponse(t, domain, 300, 60))
+	now = now.Add(59 * time.Second)
+	res, ok := c.get(query, "udp")
+	if !ok {
+		t.Fatal("negative response not cached")
+	}
+	if got := getRCode(res); got != dns.RCodeNameError {
+		t.Errorf("cached rcode = %v; want NXDOMAIN", got)
+	}
+	if st := c.status(); len(st.Entries) != 1 || !st.Entries[0].Negative || st.Entries[0].Name != "nx.tailscale.com" {
+		t.Errorf("status entries = %+v", st.Entries)
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.get(query, "udp"); ok {
+		t.Error("hit after expiry")
+	}
+}
+
+func TestDNSCacheNotCached(t *testing.T) {
+	c := newDNSCache()
+	const domain = "cache.tailscale.com."
+	query := makeTestRequest(t, domain)
+
+	for _, res := range [][]byte{
+		makeTestResponse(t, domain, dns.RCodeServerFailure),
+		makeTestResponse(t, domain, dns.RCodeRefused),
+		makeTestResponse(t, "other.tailscale.com.", dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1")),
+		[]byte("bogus"),
+	} {
+		c.put(query, res)
+		if _, ok := c.get(query, "udp"); ok {
+			t.Errorf("cached response %x", res)
+		}
+	}
+}
+
+func TestDNSCacheTruncation(t *testing.T) {
+	c := newDNSCache()
+	const domain = "big.tailscale.com."
+	var addrs []netip.Addr
+	for i := range 40 {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{127, 0, 0, byte(i)}))
+	}
+	res := makeTestResponse(t, domain, dns.RCodeSuccess, addrs...)
+	if len(res) <= minUDPResponseBytes {
+		t.Fatalf("response is %d bytes; want more than %d", len(res), minUDPResponseBytes)
+	}
+
+	// makeEDNSRequest returns a query for domain advertising the given
+	// EDNS UDP payload size.
+	makeEDNSRequest := func(size uint16) []byte {
+		t.Helper()
+		b := dns.NewBuilder(nil, dns.Header{})
+		b.StartQuestions()
+		b.Question(dns.Question{Name: dns.MustNewName(domain), Type: dns.TypeA, Class: dns.ClassINET})
+		b.StartAdditionals()
+		var h dns.ResourceHeader
+		if err := h.SetEDNS0(int(size), dns.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.OPTResource(h, dns.OPTResource{}); err != nil {
+			t.Fatal(err)
+		}
+		query, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return query
+	}
+
+	// The response was cached from a query over TCP.
+	c.put(makeTestRequest(t, domain), res)
+
+	tests := []struct {
+		name          string
+		query         []byte
+		family        string
+		wantTruncated bool
+	}{
+		{"tcp", makeTestRequest(t, domain), "tcp", false},
+		{"udp", makeTestRequest(t, domain), "udp", true},
+		{"udp-edns-small", makeEDNSRequest(512), "udp", true},
+		{"udp-edns-large", makeEDNSRequest(1232), "udp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := c.get(tt.query, tt.family)
+			if !ok {
+				t.Fatal("cache miss")
+			}
+			var msg dns.Message
+			if err := msg.Unpack(got); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v; want %v", msg.Truncated, tt.wantTruncated)
+			}
+			if tt.wantTruncated {
+				if len(got) > minUDPResponseBytes || len(msg.Answers) != 0 {
+					t.Errorf("truncated response is %d bytes with %d answers", len(got), len(msg.Answers))
+				}
+			} else if len(msg.Answers) != len(addrs) {
+				t.Errorf("got %d answers; want %d", len(msg.Answers), len(addrs))
+			}
+		})
+	}
+}
+
+func TestForwarderCacheFlushOnRouteChange(t *testing.T) {
+	f := newTestForwarder(t)
+	if f.cache == nil {
+		t.Skip("cache disabled")
+	}
+	const domain = "cache.tailscale.com."
+	query := makeTestRequest(t, domain)
+	routes := map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: "127.0.0.1:53"}},
+	}
+
+	f.setRoutes(routes)
+	f.cache.put(query, makeTestResponse(t, domain, dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1")))
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: "127.0.0.1:53"}},
+	})
+	if _, ok := f.cache.get(query, "udp"); !ok {
+		t.Error("cache flushed without a route change")
+	}
+
+	f.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: "127.0.0.2:53"}},
+	})
+	if _, ok := f.cache.get(query, "udp"); ok {
+		t.Error("cache not flushed on route change")
+	}
+}
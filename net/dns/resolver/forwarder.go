@@ -8,15 +8,18 @@
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -39,6 +42,7 @@
 	"tailscale.com/util/cloudenv"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/race"
+	"tailscale.com/util/singleflight"
 	"tailscale.com/version"
 )
 
@@ -226,13 +230,27 @@ type forwarder struct {
 	ctx       context.Context    // good until Close
 	ctxCancel context.CancelFunc // closes ctx
 
+	// cache caches responses to queries forwarded using routes, or is
+	// nil if disabled by TS_DNS_FORWARD_DISABLE_CACHE.
+	cache *dnsCache
+
 	mu sync.Mutex // guards following
 
 	dohClient map[string]*http.Client // urlBase -> client
+	dotConns  map[string]*dotConn     // resolver Addr -> conn
+
+	dotDials singleflight.Group[string, *dotConn] // by resolver Addr
+
+	// dotRootCAs, if non-nil, replaces the system roots for verifying
+	// DNS-over-TLS resolvers. It's only set in tests.
+	dotRootCAs *x509.CertPool
 
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
 	routes []route
+	// routesBySuffix is the argument of the last setRoutes call, to
+	// detect route changes.
+	routesBySuffix map[dnsname.FQDN][]*dnstype.Resolver
 	// cloudHostFallback are last resort resolvers to use if no per-suffix
 	// resolver matches. These are only populated on cloud hosts where the
 	// platform provides a well-known recursive resolver.
@@ -264,12 +282,16 @@ func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel ForwardLinkS
 		controlKnobs:            knobs,
 		missingUpstreamRecovery: func() {},
 	}
+	if !disableCache() {
+		f.cache = newDNSCache()
+	}
 	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
 	return f
 }
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	f.closeDoTConns()
 	return nil
 }
 
@@ -391,6 +413,14 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.cache != nil && !maps.EqualFunc(f.routesBySuffix, routesBySuffix, func(a, b []*dnstype.Resolver) bool {
+		return slices.EqualFunc(a, b, (*dnstype.Resolver).Equal)
+	}) {
+		// Responses from the old upstreams may not be valid anymore,
+		// such as for split DNS routes that were removed.
+		f.cache.flush()
+	}
+	f.routesBySuffix = routesBySuffix
 	f.routes = routes
 	f.cloudHostFallback = cloudHostFallback
 }
@@ -510,6 +540,7 @@ func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client,
 var (
 	verboseDNSForward = envknob.RegisterBool("TS_DEBUG_DNS_FORWARD_SEND")
 	skipTCPRetry      = envknob.RegisterBool("TS_DNS_FORWARD_SKIP_TCP_RETRY")
+	disableCache      = envknob.RegisterBool("TS_DNS_FORWARD_DISABLE_CACHE")
 
 	// For correlating log messages in the send() function; only used when
 	// verboseDNSForward() is true.
@@ -546,8 +577,9 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDe
 		return nil, fmt.Errorf("arbitrary https:// resolvers not supported yet")
 	}
 	if strings.HasPrefix(rr.name.Addr, "tls://") {
-		metricDNSFwdErrorType.Add(1)
-		return nil, fmt.Errorf("tls:// resolvers not supported yet")
+		// DNS-over-TLS resolvers are only queried over TLS, without
+		// falling back to plaintext UDP or TCP.
+		return f.sendDoT(ctx, fq, rr)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -842,24 +874,25 @@ func (f *forwarder) sendTCP(ctx context.Context, fq *forwardQuery, rr resolverAn
 	return out, nil
 }
 
-// resolvers returns the resolvers to use for domain.
-func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+// resolvers returns the resolvers to use for domain, and the suffix of the
+// route they're from, which is empty for the cloud host fallback.
+func (f *forwarder) resolvers(domain dnsname.FQDN) (route dnsname.FQDN, _ []resolverAndDelay) {
 	f.mu.Lock()
 	routes := f.routes
 	cloudHostFallback := f.cloudHostFallback
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix, route.Resolvers
 		}
 	}
-	return cloudHostFallback // or nil if no fallback
+	return "", cloudHostFallback // or nil if no fallback
 }
 
 // GetUpstreamResolvers returns the resolvers that would be used to resolve
 // the given FQDN.
 func (f *forwarder) GetUpstreamResolvers(name dnsname.FQDN) []*dnstype.Resolver {
-	resolvers := f.resolvers(name)
+	_, resolvers := f.resolvers(name)
 	upstreamResolvers := make([]*dnstype.Resolver, 0, len(resolvers))
 	for _, r := range resolvers {
 		upstreamResolvers = append(upstreamResolvers, r.name)
@@ -892,6 +925,13 @@ type forwardQuery struct {
 	// ...
 }
 
+// forwardResult is a response to a forwarded query, and the address of the
+// upstream resolver that sent it.
+type forwardResult struct {
+	bs       []byte
+	upstream string
+}
+
 // forwardWithDestChan forwards the query to all upstream nameservers
 // and waits for the first response.
 //
@@ -900,6 +940,8 @@ type forwardQuery struct {
 //
 // If resolvers is non-empty, it's used explicitly (notably, for exit
 // node DNS proxy queries), otherwise f.resolvers is used.
+//
+// If query.trace is non-nil, it's filled in before a response is sent.
 func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, responseChan chan<- packet, resolvers ...resolverAndDelay) error {
 	metricDNSFwd.Add(1)
 	domain, typ, err := nameFromQuery(query.bs)
@@ -936,8 +978,13 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 
 	clampEDNSSize(query.bs, maxResponseBytes)
 
+	var cache *dnsCache // non-nil if the response should be cached
 	if len(resolvers) == 0 {
-		resolvers = f.resolvers(domain)
+		var route dnsname.FQDN
+		route, resolvers = f.resolvers(domain)
+		if query.trace != nil {
+			query.trace.route = route
+		}
 		if len(resolvers) == 0 {
 			metricDNSFwdErrorNoUpstream.Add(1)
 			f.health.SetUnhealthy(dnsForwarderFailing, health.Args{health.ArgDNSServers: ""})
@@ -963,6 +1010,25 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 		} else {
 			f.health.SetHealthy(dnsForwarderFailing)
 		}
+
+		// Queries using the configured routes (rather than explicit
+		// resolvers, as for exit node DNS) may be answered from the
+		// cache.
+		if f.cache != nil {
+			if res, ok := f.cache.get(query.bs, query.family); ok {
+				if query.trace != nil {
+					query.trace.cached = true
+				}
+				select {
+				case <-ctx.Done():
+					return fmt.Errorf("waiting to send cached response: %w", ctx.Err())
+				case responseChan <- packet{bs: res, family: query.family, addr: query.addr}:
+					metricDNSFwdSuccess.Add(1)
+					return nil
+				}
+			}
+			cache = f.cache
+		}
 	}
 
 	fq := &forwardQuery{
@@ -979,8 +1045,8 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 		f.logf("request(%d, %v, %d, %s) %d...", fq.txid, typ, len(domain), domainSig, len(fq.packet))
 	}
 
-	resc := make(chan []byte, 1) // it's fine buffered or not
-	errc := make(chan error, 1)  // it's fine buffered or not too
+	resc := make(chan forwardResult, 1) // it's fine buffered or not
+	errc := make(chan error, 1)         // it's fine buffered or not too
 	for i := range resolvers {
 		go func(rr *resolverAndDelay) {
 			if rr.startDelay > 0 {
@@ -1002,7 +1068,7 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- forwardResult{resb, rr.name.Addr}:
 			case <-ctx.Done():
 			}
 		}(&resolvers[i])
@@ -1012,12 +1078,19 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	var numErr int
 	for {
 		select {
-		case v := <-resc:
+		case fr := <-resc:
+			v := fr.bs
+			if cache != nil {
+				cache.put(query.bs, v)
+			}
+			if query.trace != nil {
+				query.trace.upstream = fr.upstream
+			}
 			select {
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
 				return fmt.Errorf("waiting to send response: %w", ctx.Err())
-			case responseChan <- packet{v, query.family, query.addr}:
+			case responseChan <- packet{bs: v, family: query.family, addr: query.addr}:
 				if verboseDNSForward() {
 					f.logf("response(%d, %v, %d) = %d, nil", fq.txid, typ, len(domain), len(v))
 				}
@@ -0,0 +1,426 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/sockstats"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/mak"
+)
+
+const (
+	// dotDefaultPort is the port of DNS-over-TLS resolvers whose address
+	// doesn't specify one (RFC 7858, section 3.1).
+	dotDefaultPort = "853"
+
+	// dotIdleConnTimeout is how long to keep an idle connection to a
+	// DNS-over-TLS resolver open for reuse.
+	dotIdleConnTimeout = 30 * time.Second
+)
+
+// dotResolver is the parsed form of a DNS-over-TLS resolver address, of
+// the form:
+//
+//	tls://host[:port][?sni=name][&pin=spki-hash...]
+//
+// The host is an IP address or a hostname. A hostname is dialed at the
+// resolver's BootstrapResolution addresses, if any, or else looked up
+// using the system resolver.
+//
+// The resolver's certificate is verified for the sni name, which defaults
+// to the host, using the system roots. Alternatively, one or more pin
+// parameters require that the resolver's certificate matches one of them
+// instead. A pin is the standard or URL-safe base64 encoding of the
+// SHA-256 hash of a certificate's DER-encoded SubjectPublicKeyInfo (an
+// RFC 7858 SPKI pin).
+type dotResolver struct {
+	dialAddrs  []string // host:port addresses to try dialing, in order
+	serverName string   // to send as SNI and verify the certificate for
+	pins       [][sha256.Size]byte
+}
+
+// parseDoTResolver parses r, whose Addr has a "tls://" prefix.
+func parseDoTResolver(r *dnstype.Resolver) (*dotResolver, error) {
+	u, err := url.Parse(r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tls" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.User != nil || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid DNS-over-TLS resolver address %q", r.Addr)
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = dotDefaultPort
+	}
+
+	d := &dotResolver{serverName: host}
+	if len(r.BootstrapResolution) > 0 {
+		if _, err := netip.ParseAddr(host); err == nil {
+			return nil, fmt.Errorf("DNS-over-TLS resolver %q has an IP address and BootstrapResolution", r.Addr)
+		}
+		for _, ip := range r.BootstrapResolution {
+			d.dialAddrs = append(d.dialAddrs, net.JoinHostPort(ip.String(), port))
+		}
+	} else {
+		d.dialAddrs = []string{net.JoinHostPort(host, port)}
+	}
+
+	for k, vs := range u.Query() {
+		switch k {
+		case "sni":
+			if len(vs) != 1 || vs[0] == "" {
+				return nil, fmt.Errorf("invalid sni in DNS-over-TLS resolver %q", r.Addr)
+			}
+			d.serverName = vs[0]
+		case "pin":
+			for _, v := range vs {
+				b, err := decodePin(v)
+				if err != nil || len(b) != sha256.Size {
+					return nil, fmt.Errorf("invalid pin %q in DNS-over-TLS resolver %q", v, r.Addr)
+				}
+				d.pins = append(d.pins, [sha256.Size]byte(b))
+			}
+		default:
+			return nil, fmt.Errorf("unknown parameter %q in DNS-over-TLS resolver %q", k, r.Addr)
+		}
+	}
+	return d, nil
+}
+
+// decodePin decodes an SPKI pin, in either standard or URL-safe base64.
+// A "+" that wasn't escaped in the resolver address arrives as a space.
+func decodePin(v string) ([]byte, error) {
+	v = strings.ReplaceAll(v, " ", "+")
+	if strings.ContainsAny(v, "-_") {
+		return base64.URLEncoding.DecodeString(v)
+	}
+	return base64.StdEncoding.DecodeString(v)
+}
+
+// tlsConfig returns the TLS config for connecting to d, using roots (or
+// nil for the system roots) unless d has pins.
+func (d *dotResolver) tlsConfig(roots *x509.CertPool) *tls.Config {
+	conf := &tls.Config{
+		ServerName: d.serverName,
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(d.pins) > 0 {
+		// The pins replace the usual chain verification, so that pinned
+		// resolvers may use self-signed certificates.
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate from DNS-over-TLS resolver")
+			}
+			got := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			for _, pin := range d.pins {
+				if got == pin {
+					return nil
+				}
+			}
+			return fmt.Errorf("DNS-over-TLS resolver certificate doesn't match any pin")
+		}
+	}
+	return conf
+}
+
+var errDoTConnClosed = errors.New("DNS-over-TLS connection closed")
+
+// dotConn is a connection to a DNS-over-TLS resolver, which may be used
+// by several queries at once (RFC 7766 pipelining). Each query is sent
+// with a txid that's unique among the connection's pending queries, so
+// that queries from different clients with the same txid don't collide.
+type dotConn struct {
+	f    *forwarder
+	key  string // in f.dotConns; the resolver's Addr
+	conn *tls.Conn
+
+	writeMu sync.Mutex // serializes writes to conn
+
+	mu        sync.Mutex // guards the following
+	pending   map[uint16]chan []byte
+	nextTxID  uint16
+	closed    bool
+	idleTimer *time.Timer // running while there are no pending queries
+}
+
+// sendDoT sends fq to the DNS-over-TLS resolver rr, reusing a connection
+// to it if possible.
+func (f *forwarder) sendDoT(ctx context.Context, fq *forwardQuery, rr resolverAndDelay) ([]byte, error) {
+	metricDNSFwdDoT.Add(1)
+	ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, f.logf)
+	ctx, cancel := context.WithTimeout(ctx, tcpQueryTimeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		dc, reused, err := f.getDoTConn(ctx, rr.name)
+		if err != nil {
+			return nil, err
+		}
+		out, err := dc.query(ctx, fq.packet)
+		if err != nil {
+			// The resolver may have closed a reused connection while
+			// it was idle; retry once on a new connection.
+			if reused && attempt == 0 && errors.Is(err, errDoTConnClosed) && ctx.Err() == nil {
+				continue
+			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
+		if getRCode(out) == dns.RCodeServerFailure {
+			f.logf("sendDoT: response code indicating server failure")
+			metricDNSFwdDoTErrorServer.Add(1)
+			return nil, errServerFailure
+		}
+		metricDNSFwdDoTSuccess.Add(1)
+		return out, nil
+	}
+}
+
+// getDoTConn returns a connection to the DNS-over-TLS resolver r, and
+// whether it's an existing one.
+func (f *forwarder) getDoTConn(ctx context.Context, r *dnstype.Resolver) (_ *dotConn, reused bool, _ error) {
+	f.mu.Lock()
+	dc := f.dotConns[r.Addr]
+	f.mu.Unlock()
+	if dc != nil && !dc.isClosed() {
+		metricDNSFwdDoTReused.Add(1)
+		return dc, true, nil
+	}
+
+	// Dial at most one connection at a time to each resolver, so that
+	// concurrent queries share it.
+	res := <-f.dotDials.DoChanContext(ctx, r.Addr, func(ctx context.Context) (*dotConn, error) {
+		ctx = sockstats.WithSockStats(ctx, sockstats.LabelDNSForwarderDoT, f.logf)
+		ctx, cancel := context.WithTimeout(ctx, tcpQueryTimeout)
+		defer cancel()
+		return f.dialDoT(ctx, r)
+	})
+	return res.Val, false, res.Err
+}
+
+// dialDoT returns a new connection to the DNS-over-TLS resolver r.
+func (f *forwarder) dialDoT(ctx context.Context, r *dnstype.Resolver) (*dotConn, error) {
+	d, err := parseDoTResolver(r)
+	if err != nil {
+		metricDNSFwdErrorType.Add(1)
+		return nil, err
+	}
+	var conn net.Conn
+	for _, addr := range d.dialAddrs {
+		conn, err = f.getDialerType()(ctx, "tcp", addr)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		metricDNSFwdDoTErrorDial.Add(1)
+		return nil, err
+	}
+	tc := tls.Client(conn, d.tlsConfig(f.dotRootCAs))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		metricDNSFwdDoTErrorTLS.Add(1)
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+
+	dc := &dotConn{
+		f:       f,
+		key:     r.Addr,
+		conn:    tc,
+		pending: map[uint16]chan []byte{},
+	}
+	dc.idleTimer = time.AfterFunc(dotIdleConnTimeout, dc.closeIfIdle)
+	f.mu.Lock()
+	if f.ctx.Err() != nil {
+		f.mu.Unlock()
+		dc.idleTimer.Stop()
+		tc.Close()
+		return nil, errDoTConnClosed
+	}
+	mak.Set(&f.dotConns, r.Addr, dc)
+	f.mu.Unlock()
+	go dc.readLoop()
+	return dc, nil
+}
+
+func (dc *dotConn) isClosed() bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.closed
+}
+
+// query sends the DNS query packet on dc and waits for its response.
+func (dc *dotConn) query(ctx context.Context, packet []byte) ([]byte, error) {
+	if len(packet) < headerBytes {
+		return nil, errors.New("query too short")
+	}
+	origTxID := getTxID(packet)
+
+	dc.mu.Lock()
+	if dc.closed {
+		dc.mu.Unlock()
+		return nil, errDoTConnClosed
+	}
+	if len(dc.pending) >= 1<<16 {
+		dc.mu.Unlock()
+		return nil, errors.New("too many pending DNS-over-TLS queries")
+	}
+	id := dc.nextTxID
+	for _, ok := dc.pending[id]; ok; _, ok = dc.pending[id] {
+		id++
+	}
+	dc.nextTxID = id + 1
+	resc := make(chan []byte, 1)
+	dc.pending[id] = resc
+	dc.idleTimer.Stop()
+	dc.mu.Unlock()
+
+	msg := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(msg, uint16(len(packet)))
+	copy(msg[2:], packet)
+	binary.BigEndian.PutUint16(msg[2:], id)
+
+	dc.writeMu.Lock()
+	dl, _ := ctx.Deadline() // or the zero value, for no deadline
+	dc.conn.SetWriteDeadline(dl)
+	_, err := dc.conn.Write(msg)
+	dc.writeMu.Unlock()
+	if err != nil {
+		metricDNSFwdDoTErrorWrite.Add(1)
+		dc.close()
+		return nil, fmt.Errorf("%w: %w", errDoTConnClosed, err)
+	}
+	metricDNSFwdDoTWrote.Add(1)
+
+	select {
+	case out, ok := <-resc:
+		if !ok {
+			metricDNSFwdDoTErrorRead.Add(1)
+			return nil, errDoTConnClosed
+		}
+		binary.BigEndian.PutUint16(out, uint16(origTxID))
+		return out, nil
+	case <-ctx.Done():
+		// Only this query gives up. Other queries pipelined on dc may
+		// still be answered, and a late response to this one is
+		// discarded by readLoop. A dead connection is closed when reads
+		// fail or once it's idle.
+		dc.mu.Lock()
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+		dc.noteMaybeIdle()
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop reads responses from dc's connection, delivering each to the
+// pending query with its txid, until the connection fails.
+func (dc *dotConn) readLoop() {
+	defer dc.close()
+	var lenBuf [2]byte
+	for {
+		if _, err := io.ReadFull(dc.conn, lenBuf[:]); err != nil {
+			return
+		}
+		out := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(dc.conn, out); err != nil {
+			return
+		}
+		if len(out) < headerBytes {
+			dc.f.logf("sendDoT: packet too small (%d bytes)", len(out))
+			continue
+		}
+		id := binary.BigEndian.Uint16(out)
+		dc.mu.Lock()
+		resc, ok := dc.pending[id]
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+		if !ok {
+			// A response to a query that timed out or was canceled, or
+			// a misbehaving resolver.
+			metricDNSFwdDoTErrorTxID.Add(1)
+			continue
+		}
+		resc <- out
+		dc.noteMaybeIdle()
+	}
+}
+
+// noteMaybeIdle starts dc's idle timer if it has no pending queries.
+func (dc *dotConn) noteMaybeIdle() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if !dc.closed && len(dc.pending) == 0 {
+		dc.idleTimer.Reset(dotIdleConnTimeout)
+	}
+}
+
+// closeIfIdle closes dc if it has no pending queries.
+func (dc *dotConn) closeIfIdle() {
+	dc.mu.Lock()
+	idle := len(dc.pending) == 0
+	dc.mu.Unlock()
+	if idle {
+		dc.close()
+	}
+}
+
+// close closes dc, failing its pending queries, and removes it from its
+// forwarder.
+func (dc *dotConn) close() {
+	dc.mu.Lock()
+	if dc.closed {
+		dc.mu.Unlock()
+		return
+	}
+	dc.closed = true
+	for _, resc := range dc.pending {
+		close(resc)
+	}
+	dc.pending = nil
+	dc.idleTimer.Stop()
+	dc.mu.Unlock()
+	dc.conn.Close()
+
+	f := dc.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dotConns[dc.key] == dc {
+		delete(f.dotConns, dc.key)
+	}
+}
+
+// closeDoTConns closes all of f's DNS-over-TLS connections.
+func (f *forwarder) closeDoTConns() {
+	f.mu.Lock()
+	var conns []*dotConn
+	for _, dc := range f.dotConns {
+		conns = append(conns, dc)
+	}
+	f.mu.Unlock()
+	for _, dc := range conns {
+		dc.close()
+	}
+}
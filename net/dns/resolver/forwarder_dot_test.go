@@ -0,0 +1,308 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/health"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/tstest"
+	"tailscale.com/types/dnstype"
+)
+
+func TestParseDoTResolver(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		addr      string
+		bootstrap []netip.Addr
+		wantDial  []string
+		wantSNI   string
+		wantPins  int
+		wantErr   bool
+	}{
+		{addr: "tls://10.0.0.53", wantDial: []string{"10.0.0.53:853"}, wantSNI: "10.0.0.53"},
+		{addr: "tls://[fd7a::53]:8853", wantDial: []string{"[fd7a::53]:8853"}, wantSNI: "fd7a::53"},
+		{addr: "tls://dns.corp.example", wantDial: []string{"dns.corp.example:853"}, wantSNI: "dns.corp.example"},
+		{
+			addr:      "tls://dns.corp.example:8853",
+			bootstrap: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")},
+			wantDial:  []string{"10.0.0.1:8853", "10.0.0.2:8853"},
+			wantSNI:   "dns.corp.example",
+		},
+		{addr: "tls://10.0.0.53?sni=dns.corp.example&pin=" + pin + "&pin=" + pin, wantDial: []string{"10.0.0.53:853"}, wantSNI: "dns.corp.example", wantPins: 2},
+		{addr: "tls://10.0.0.53?pin=bm9wZQ==", wantErr: true},
+		{addr: "tls://10.0.0.53?sni=", wantErr: true},
+		{addr: "tls://10.0.0.53?foo=bar", wantErr: true},
+		{addr: "tls://10.0.0.53/path", wantErr: true},
+		{addr: "tls://10.0.0.53", bootstrap: []netip.Addr{netip.MustParseAddr("10.0.0.1")}, wantErr: true},
+		{addr: "tls://", wantErr: true},
+	}
+	for _, tt := range tests {
+		d, err := parseDoTResolver(&dnstype.Resolver{Addr: tt.addr, BootstrapResolution: tt.bootstrap})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDoTResolver(%q) error = %v; want error %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if fmt.Sprint(d.dialAddrs) != fmt.Sprint(tt.wantDial) || d.serverName != tt.wantSNI || len(d.pins) != tt.wantPins {
+			t.Errorf("parseDoTResolver(%q) = %+v; want dial %v, sni %q, %d pins", tt.addr, d, tt.wantDial, tt.wantSNI, tt.wantPins)
+		}
+	}
+}
+
+// testDoTServer is a DNS-over-TLS server for tests, which answers each
+// query with response (with the query's txid), buffering queries until
+// batch of them arrived and answering them in reverse order, to exercise
+// pipelining.
+type testDoTServer struct {
+	addr  netip.AddrPort
+	cert  *x509.Certificate
+	pin   string // of cert
+	conns atomic.Int32
+}
+
+func runDoTServer(tb testing.TB, response []byte, batch int) *testDoTServer {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	s := &testDoTServer{
+		addr: ln.Addr().(*net.TCPAddr).AddrPort(),
+		cert: cert,
+		pin:  base64.StdEncoding.EncodeToString(pin[:]),
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go func() {
+				defer c.Close()
+				var queries [][]byte
+				for {
+					var n uint16
+					if err := binary.Read(c, binary.BigEndian, &n); err != nil {
+						return
+					}
+					q := make([]byte, n)
+					if _, err := io.ReadFull(c, q); err != nil {
+						return
+					}
+					queries = append(queries, q)
+					if len(queries) < batch {
+						continue
+					}
+					for i := len(queries) - 1; i >= 0; i-- {
+						out := make([]byte, 2+len(response))
+						binary.BigEndian.PutUint16(out, uint16(len(response)))
+						copy(out[2:], response)
+						copy(out[2:4], queries[i][:2]) // txid
+						if _, err := c.Write(out); err != nil {
+							return
+						}
+					}
+					queries = nil
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func newTestForwarder(tb testing.TB) *forwarder {
+	logf := tstest.WhileTestRunningLogger(tb)
+	netMon, err := netmon.New(logf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+	f := newForwarder(logf, netMon, nil, &dialer, new(health.Tracker), nil)
+	tb.Cleanup(func() { f.Close() })
+	return f
+}
+
+func sendTestDoTQuery(f *forwarder, addr string, request []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return sendTestDoTQueryContext(ctx, f, addr, request)
+}
+
+func sendTestDoTQueryContext(ctx context.Context, f *forwarder, addr string, request []byte) ([]byte, error) {
+	fq := &forwardQuery{
+		txid:           getTxID(request),
+		packet:         request,
+		family:         "udp",
+		closeOnCtxDone: new(closePool),
+	}
+	defer fq.closeOnCtxDone.Close()
+	return f.send(ctx, fq, resolverAndDelay{name: &dnstype.Resolver{Addr: addr}})
+}
+
+func TestForwarderDoT(t *testing.T) {
+	const domain = "dot.tailscale.com."
+	response := makeTestResponse(t, domain, dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1"))
+	s := runDoTServer(t, response, 2)
+	f := newTestForwarder(t)
+	addr := fmt.Sprintf("tls://%v?pin=%s", s.addr, s.pin)
+
+	// Send two concurrent queries with the same txid, which need to be
+	// pipelined on one connection for the server to answer them.
+	request := makeTestRequest(t, domain)
+	binary.BigEndian.PutUint16(request, 1234)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := sendTestDoTQuery(f, addr, request)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := getTxID(res); got != 1234 {
+				t.Errorf("response txid = %d; want 1234", got)
+			}
+			if string(res[2:]) != string(response[2:]) {
+				t.Errorf("unexpected response %x", res)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("server got %d connections; want 1", got)
+	}
+}
+
+func TestForwarderDoTVerify(t *testing.T) {
+	const domain = "dot.tailscale.com."
+	response := makeTestResponse(t, domain, dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1"))
+	request := makeTestRequest(t, domain)
+	s := runDoTServer(t, response, 1)
+	f := newTestForwarder(t)
+	f.dotRootCAs = x509.NewCertPool()
+	f.dotRootCAs.AddCert(s.cert)
+
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{fmt.Sprintf("tls://%v?sni=dns.test", s.addr), false},
+		{fmt.Sprintf("tls://%v?sni=other.test", s.addr), true},
+		{fmt.Sprintf("tls://%v", s.addr), true}, // no IP SAN
+		{fmt.Sprintf("tls://%v?sni=other.test&pin=%s&pin=%s", s.addr, otherPin, s.pin), false},
+		{fmt.Sprintf("tls://%v?sni=dns.test&pin=%s", s.addr, otherPin), true},
+	}
+	for _, tt := range tests {
+		_, err := sendTestDoTQuery(f, tt.addr, request)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v; want error %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestForwarderDoTReconnect(t *testing.T) {
+	const domain = "dot.tailscale.com."
+	response := makeTestResponse(t, domain, dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1"))
+	request := makeTestRequest(t, domain)
+	s := runDoTServer(t, response, 1)
+	f := newTestForwarder(t)
+	addr := fmt.Sprintf("tls://%v?pin=%s", s.addr, s.pin)
+
+	if _, err := sendTestDoTQuery(f, addr, request); err != nil {
+		t.Fatal(err)
+	}
+	// Break the connection behind the forwarder's back, as if the server
+	// closed it, and check that the next query reconnects.
+	f.mu.Lock()
+	dc := f.dotConns[addr]
+	f.mu.Unlock()
+	dc.conn.NetConn().Close()
+	if _, err := sendTestDoTQuery(f, addr, request); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.conns.Load(); got != 2 {
+		t.Errorf("server got %d connections; want 2", got)
+	}
+}
+
+func TestForwarderDoTQueryTimeout(t *testing.T) {
+	const domain = "dot.tailscale.com."
+	response := makeTestResponse(t, domain, dns.RCodeSuccess, netip.MustParseAddr("127.0.0.1"))
+	request := makeTestRequest(t, domain)
+	// The server only answers once it has two queries, so the first one
+	// times out.
+	s := runDoTServer(t, response, 2)
+	f := newTestForwarder(t)
+	addr := fmt.Sprintf("tls://%v?pin=%s", s.addr, s.pin)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := sendTestDoTQueryContext(ctx, f, addr, request); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("first query error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	// The timeout must not close the connection, which the second query
+	// needs to reuse for the server to answer it.
+	if _, err := sendTestDoTQuery(f, addr, request); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("server got %d connections; want 1", got)
+	}
+}
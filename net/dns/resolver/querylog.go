@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/util/set"
+)
+
+// queryLogSize is the number of most recent queries kept in the query log.
+const queryLogSize = 1000
+
+// queryTrace records how a query was handled, for the query log. It's
+// filled in by the Resolver and the forwarder as they handle the query.
+type queryTrace struct {
+	local    bool         // answered by the Resolver itself (MagicDNS)
+	route    dnsname.FQDN // suffix of the route used to forward it, if any
+	upstream string       // Addr of the upstream resolver that answered, if any
+	cached   bool         // answered from the forwarder's cache
+}
+
+// QueryPeer identifies the peer a DNS query came from, for the query log.
+type QueryPeer struct {
+	Node string // the peer's node name
+	User string // the login name of the peer's user
+}
+
+type queryPeerKey struct{}
+
+// WithQueryPeer returns a copy of ctx recording that the DNS query it's
+// used for (with HandlePeerDNSQuery) came from peer.
+func WithQueryPeer(ctx context.Context, peer QueryPeer) context.Context {
+	return context.WithValue(ctx, queryPeerKey{}, peer)
+}
+
+// queryLog is an opt-in, bounded log of the most recent DNS queries
+// handled by a Resolver.
+//
+// Queries are only logged while the log is enabled or has registered taps,
+// as with "tailscale dns log --follow".
+type queryLog struct {
+	active atomic.Bool // enabled || len(taps) > 0
+
+	mu      sync.Mutex
+	enabled bool
+	entries []apitype.DNSQueryLogEntry // ring buffer of at most queryLogSize
+	next    int                        // index in entries of the oldest entry, once full
+	taps    set.HandleSet[chan<- apitype.DNSQueryLogEntry]
+}
+
+func (l *queryLog) updateActiveLocked() {
+	l.active.Store(l.enabled || len(l.taps) > 0)
+}
+
+// setEnabled sets whether queries are logged when there are no taps.
+// Disabling the log also clears it.
+func (l *queryLog) setEnabled(v bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enabled = v
+	if !v {
+		l.entries = nil
+		l.next = 0
+	}
+	l.updateActiveLocked()
+}
+
+// snapshotLocked returns the logged entries, oldest first.
+func (l *queryLog) snapshotLocked() []apitype.DNSQueryLogEntry {
+	ret := make([]apitype.DNSQueryLogEntry, 0, len(l.entries))
+	ret = append(ret, l.entries[l.next:]...)
+	return append(ret, l.entries[:l.next]...)
+}
+
+// registerTap registers dst to be sent new entries as they're logged. It
+// returns the entries logged so far. Entries are dropped rather than block
+// if dst isn't ready to receive them. The caller must call unregister when
+// done watching.
+func (l *queryLog) registerTap(dst chan<- apitype.DNSQueryLogEntry) (past []apitype.DNSQueryLogEntry, unregister func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.taps.Add(dst)
+	l.updateActiveLocked()
+	return l.snapshotLocked(), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.taps, h)
+		if !l.enabled && len(l.taps) == 0 {
+			l.entries = nil
+			l.next = 0
+		}
+		l.updateActiveLocked()
+	}
+}
+
+// add logs e.
+func (l *queryLog) add(e apitype.DNSQueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < queryLogSize {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+		l.next = (l.next + 1) % queryLogSize
+	}
+	for _, dst := range l.taps {
+		select {
+		case dst <- e:
+		default:
+		}
+	}
+}
+
+// record logs the handling of query, which arrived from from at start and
+// resulted in res or err. tr is how it was handled.
+func (l *queryLog) record(ctx context.Context, query []byte, from netip.AddrPort, start time.Time, tr *queryTrace, res []byte, err error) {
+	e := apitype.DNSQueryLogEntry{
+		Time:     start,
+		Client:   from,
+		Local:    tr.local,
+		Route:    string(tr.route),
+		Upstream: tr.upstream,
+		Cached:   tr.cached,
+		Duration: time.Since(start),
+	}
+	if name, typ, err := nameFromQuery(query); err == nil {
+		e.Name = name.WithoutTrailingDot()
+		e.Type = strings.TrimPrefix(typ.String(), "Type")
+	}
+	if peer, ok := ctx.Value(queryPeerKey{}).(QueryPeer); ok {
+		e.PeerNode = peer.Node
+		e.PeerUser = peer.User
+	}
+	if err != nil {
+		e.Error = err.Error()
+	} else if len(res) >= headerBytes {
+		e.RCode = strings.TrimPrefix(getRCode(res).String(), "RCode")
+	}
+	l.add(e)
+}
+
+// SetQueryLogEnabled sets whether r logs the DNS queries it handles. The
+// log is bounded, keeping only the most recent queries, and disabling it
+// clears it.
+//
+// Queries are also logged, regardless of this setting, while there are
+// registered query log taps.
+func (r *Resolver) SetQueryLogEnabled(v bool) {
+	r.queryLog.setEnabled(v)
+}
+
+// QueryLogEnabled reports whether the query log is enabled.
+func (r *Resolver) QueryLogEnabled() bool {
+	r.queryLog.mu.Lock()
+	defer r.queryLog.mu.Unlock()
+	return r.queryLog.enabled
+}
+
+// RegisterQueryLogTap registers dst to be sent the DNS queries r handles,
+// as they're handled, and returns those in the query log so far, oldest
+// first. Entries are dropped if dst isn't ready to receive them. The
+// caller must call unregister when done watching.
+func (r *Resolver) RegisterQueryLogTap(dst chan<- apitype.DNSQueryLogEntry) (past []apitype.DNSQueryLogEntry, unregister func()) {
+	return r.queryLog.registerTap(dst)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+func TestQueryLog(t *testing.T) {
+	server1 := serveDNS(t, "127.0.0.1:0",
+		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
+	defer server1.Shutdown()
+	server2 := serveDNS(t, "127.0.0.1:0",
+		"test.other.", resolveToIP(testipv4, testipv6, "dns.other."))
+	defer server2.Shutdown()
+	addr1 := server1.PacketConn.LocalAddr().String()
+	addr2 := server2.PacketConn.LocalAddr().String()
+
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".":      {{Addr: addr1}},
+		"other.": {{Addr: addr2}},
+	}
+	r.SetConfig(cfg)
+
+	client := netip.MustParseAddrPort("100.64.0.1:5353")
+	query := func(ctx context.Context, name dnsname.FQDN) {
+		t.Helper()
+		if _, err := r.Query(ctx, dnspacket(name, dns.TypeA, noEdns), "udp", client); err != nil {
+			t.Fatalf("query %q: %v", name, err)
+		}
+	}
+
+	// Nothing is logged until the log is enabled.
+	ctx := context.Background()
+	query(ctx, "test1.ipn.dev.")
+	r.SetQueryLogEnabled(true)
+	query(ctx, "test1.ipn.dev.")
+	query(ctx, "test.site.")
+	query(WithQueryPeer(ctx, QueryPeer{Node: "peer.ts.net.", User: "user@example.com"}), "test.other.")
+	if r.forwarder.cache != nil {
+		const cached = "cached.site."
+		r.forwarder.cache.put(dnspacket(cached, dns.TypeA, noEdns), makeTestResponse(t, cached, dns.RCodeSuccess, testipv4))
+		query(ctx, cached)
+	}
+
+	entc := make(chan apitype.DNSQueryLogEntry, 1)
+	past, unregister := r.RegisterQueryLogTap(entc)
+	defer unregister()
+
+	type entry struct {
+		name, rcode, route, upstream string
+		local, cached                bool
+		peerNode, peerUser           string
+	}
+	want := []entry{
+		{name: "test1.ipn.dev", rcode: "Success", local: true},
+		{name: "test.site", rcode: "Success", route: ".", upstream: addr1},
+		{name: "test.other", rcode: "Success", route: "other.", upstream: addr2, peerNode: "peer.ts.net.", peerUser: "user@example.com"},
+	}
+	if r.forwarder.cache != nil {
+		want = append(want, entry{name: "cached.site", rcode: "Success", route: ".", cached: true})
+	}
+	if len(past) != len(want) {
+		t.Fatalf("got %d entries; want %d: %+v", len(past), len(want), past)
+	}
+	for i, e := range past {
+		got := entry{e.Name, e.RCode, e.Route, e.Upstream, e.Local, e.Cached, e.PeerNode, e.PeerUser}
+		if got != want[i] {
+			t.Errorf("entry %d = %+v; want %+v", i, got, want[i])
+		}
+		if e.Client != client || e.Type != "A" || e.Error != "" {
+			t.Errorf("entry %d = %+v; want client %v, type A, no error", i, e, client)
+		}
+	}
+
+	// Taps are sent new entries, and keep queries logged after the log is
+	// disabled.
+	r.SetQueryLogEnabled(false)
+	query(ctx, "test2.ipn.dev.")
+	if e := <-entc; e.Name != "test2.ipn.dev" || !e.Local {
+		t.Errorf("tapped entry = %+v; want local test2.ipn.dev", e)
+	}
+	unregister()
+	query(ctx, "test1.ipn.dev.")
+	if past, unregister := r.RegisterQueryLogTap(entc); len(past) != 0 {
+		t.Errorf("got %d entries after disabling log; want 0", len(past))
+	} else {
+		unregister()
+	}
+}
+
+func TestQueryLogBounded(t *testing.T) {
+	var l queryLog
+	l.setEnabled(true)
+	for i := range queryLogSize + 10 {
+		l.add(apitype.DNSQueryLogEntry{Duration: 1 + time.Duration(i)})
+	}
+	l.mu.Lock()
+	got := l.snapshotLocked()
+	l.mu.Unlock()
+	if len(got) != queryLogSize {
+		t.Fatalf("got %d entries; want %d", len(got), queryLogSize)
+	}
+	for i, e := range got {
+		if want := time.Duration(i + 11); e.Duration != want {
+			t.Fatalf("entry %d has Duration %v; want %v", i, e.Duration, want)
+		}
+	}
+}
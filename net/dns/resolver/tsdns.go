@@ -23,6 +23,7 @@
 	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/control/controlknobs"
 	"tailscale.com/envknob"
 	"tailscale.com/health"
@@ -58,6 +59,10 @@ type packet struct {
 	bs     []byte
 	family string         // either "tcp" or "udp"
 	addr   netip.AddrPort // src for a request, dst for a response
+
+	// trace, if non-nil in a request, is where the forwarder records how
+	// it handled the request, for the query log.
+	trace *queryTrace
 }
 
 // Config is a resolver configuration.
@@ -211,6 +216,8 @@ type Resolver struct {
 	// closed signals all goroutines to stop.
 	closed chan struct{}
 
+	queryLog queryLog
+
 	// mu guards the following fields from being updated while used.
 	mu           sync.Mutex
 	localDomains []dnsname.FQDN
@@ -304,7 +311,7 @@ func (r *Resolver) Close() {
 // bound on per-query resource usage.
 const dnsQueryTimeout = 10 * time.Second
 
-func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) ([]byte, error) {
+func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from netip.AddrPort) (out []byte, err error) {
 	metricDNSQueryLocal.Add(1)
 	select {
 	case <-r.closed:
@@ -313,22 +320,48 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 	default:
 	}
 
-	out, err := r.respond(bs)
+	var tr *queryTrace
+	if r.queryLog.active.Load() {
+		tr = new(queryTrace)
+		start := time.Now()
+		defer func() { r.queryLog.record(ctx, bs, from, start, tr, out, err) }()
+	}
+
+	out, err = r.respond(bs)
 	if err == errNotOurName {
 		responses := make(chan packet, 1)
 		ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
 		defer close(responses)
 		defer cancel()
-		err = r.forwarder.forwardWithDestChan(ctx, packet{bs, family, from}, responses)
+		err = r.forwarder.forwardWithDestChan(ctx, packet{bs: bs, family: family, addr: from, trace: tr}, responses)
 		if err != nil {
 			return nil, err
 		}
 		return (<-responses).bs, nil
 	}
+	if tr != nil {
+		tr.local = true
+	}
 
 	return out, err
 }
 
+// CacheStatus returns the state of the response cache of the forwarder,
+// or nil if caching is disabled.
+func (r *Resolver) CacheStatus() *apitype.DNSCacheStatus {
+	if r.forwarder.cache == nil {
+		return nil
+	}
+	return r.forwarder.cache.status()
+}
+
+// FlushCache removes all responses from the forwarder's cache.
+func (r *Resolver) FlushCache() {
+	if r.forwarder.cache != nil {
+		r.forwarder.cache.flush()
+	}
+}
+
 // GetUpstreamResolvers returns the resolvers that would be used to resolve
 // the given FQDN.
 func (r *Resolver) GetUpstreamResolvers(name dnsname.FQDN) []*dnstype.Resolver {
@@ -355,6 +388,9 @@ func parseExitNodeQuery(q []byte) *response {
 // The provided allowName callback is whether a DNS query for a name
 // (as found by parsing q) is allowed.
 //
+// If ctx has a QueryPeer (see WithQueryPeer), it's recorded in the query
+// log along with the query.
+//
 // In most (all?) cases, err will be nil. A bogus DNS query q will
 // still result in a response DNS packet (saying there's a failure)
 // and a nil error.
@@ -363,6 +399,13 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 	metricDNSExitProxyQuery.Add(1)
 	ch := make(chan packet, 1)
 
+	var tr *queryTrace
+	if r.queryLog.active.Load() {
+		tr = new(queryTrace)
+		start := time.Now()
+		defer func() { r.queryLog.record(ctx, q, from, start, tr, res, err) }()
+	}
+
 	resp := parseExitNodeQuery(q)
 	if resp == nil {
 		return nil, errors.New("bad query")
@@ -408,7 +451,7 @@ func (r *Resolver) HandlePeerDNSQuery(ctx context.Context, q []byte, from netip.
 			}}
 		}
 
-		err = r.forwarder.forwardWithDestChan(ctx, packet{q, "tcp", from}, ch, resolvers...)
+		err = r.forwarder.forwardWithDestChan(ctx, packet{bs: q, family: "tcp", addr: from, trace: tr}, ch, resolvers...)
 		if err != nil {
 			metricDNSExitProxyErrorForward.Add(1)
 			return nil, err
@@ -1359,6 +1402,9 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdErrorContext         = clientmetric.NewCounter("dns_query_fwd_error_context")
 	metricDNSFwdErrorContextGotError = clientmetric.NewCounter("dns_query_fwd_error_context_got_error")
 
+	metricDNSFwdCacheHit  = clientmetric.NewCounter("dns_query_fwd_cache_hit")
+	metricDNSFwdCacheMiss = clientmetric.NewCounter("dns_query_fwd_cache_miss")
+
 	metricDNSFwdErrorType = clientmetric.NewCounter("dns_query_fwd_error_type")
 	metricDNSFwdTruncated = clientmetric.NewCounter("dns_query_fwd_truncated")
 
@@ -1384,6 +1430,17 @@ func unARPA(a string) (ipStr string, ok bool) {
 	metricDNSFwdDoHErrorTransport = clientmetric.NewCounter("dns_query_fwd_doh_error_transport")
 	metricDNSFwdDoHErrorBody      = clientmetric.NewCounter("dns_query_fwd_doh_error_body")
 
+	metricDNSFwdDoT            = clientmetric.NewCounter("dns_query_fwd_dot")        // on entry
+	metricDNSFwdDoTReused      = clientmetric.NewCounter("dns_query_fwd_dot_reused") // reused an open connection
+	metricDNSFwdDoTWrote       = clientmetric.NewCounter("dns_query_fwd_dot_wrote")
+	metricDNSFwdDoTErrorDial   = clientmetric.NewCounter("dns_query_fwd_dot_error_dial")
+	metricDNSFwdDoTErrorTLS    = clientmetric.NewCounter("dns_query_fwd_dot_error_tls")
+	metricDNSFwdDoTErrorWrite  = clientmetric.NewCounter("dns_query_fwd_dot_error_write")
+	metricDNSFwdDoTErrorServer = clientmetric.NewCounter("dns_query_fwd_dot_error_server")
+	metricDNSFwdDoTErrorTxID   = clientmetric.NewCounter("dns_query_fwd_dot_error_txid")
+	metricDNSFwdDoTErrorRead   = clientmetric.NewCounter("dns_query_fwd_dot_error_read")
+	metricDNSFwdDoTSuccess     = clientmetric.NewCounter("dns_query_fwd_dot_success")
+
 	metricDNSResolveLocal             = clientmetric.NewCounter("dns_resolve_local")
 	metricDNSResolveLocalErrorOnion   = clientmetric.NewCounter("dns_resolve_local_error_onion")
 	metricDNSResolveLocalErrorMissing = clientmetric.NewCounter("dns_resolve_local_error_missing")
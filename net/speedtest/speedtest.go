@@ -14,7 +14,8 @@
 	MinDuration     = 5 * time.Second       // minimum duration for a test
 	DefaultDuration = MinDuration           // default duration for a test
 	MaxDuration     = 30 * time.Second      // maximum duration for a test
-	version         = 2                     // value used when comparing client and server versions
+	version         = 3                     // value used when comparing client and server versions; sent by UDP clients
+	tcpVersion      = 2                     // version sent by TCP clients, so servers from before UDP tests accept them
 	increment       = time.Second           // increment to display results for, in seconds
 	minInterval     = 10 * time.Millisecond // minimum interval length for a result to be included
 	DefaultPort     = 20333
@@ -26,12 +27,19 @@ type config struct {
 	Version      int           `json:"version"`
 	TestDuration time.Duration `json:"time"`
 	Direction    Direction     `json:"direction"`
+
+	// The following fields are only used by UDP tests, since version 3.
+	Mode       string `json:"mode,omitempty"`       // "udp", or empty for TCP
+	Rate       int    `json:"rate,omitempty"`       // packets per second
+	PacketSize int    `json:"packetSize,omitempty"` // bytes per packet
+	Session    uint64 `json:"session,omitempty"`    // identifies the test's packets
 }
 
 // configResponse is the response to the testConfig message. If the server has an
 // error with the config, the Error variable will hold that error value.
 type configResponse struct {
-	Error string `json:"error,omitempty"`
+	Error   string `json:"error,omitempty"`
+	UDPPort int    `json:"udpPort,omitempty"` // server's port for a UDP test
 }
 
 // This represents the Result of a speedtest within a specific interval
@@ -63,6 +71,7 @@ func (r Result) Interval() time.Duration {
 const (
 	Download Direction = iota
 	Upload
+	Bidirectional // simultaneous download and upload; UDP tests only
 )
 
 func (d Direction) String() string {
@@ -71,6 +80,8 @@ func (d Direction) String() string {
 		return "upload"
 	case Download:
 		return "download"
+	case Bidirectional:
+		return "bidirectional"
 	default:
 		return ""
 	}
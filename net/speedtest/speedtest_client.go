@@ -14,12 +14,15 @@
 // It returns any errors that come up in the tests.
 // If there are no errors in the test, it returns a slice of results.
 func RunClient(direction Direction, duration time.Duration, host string) ([]Result, error) {
+	if direction == Bidirectional {
+		return nil, errors.New("bidirectional tests are only supported over UDP")
+	}
 	conn, err := net.Dial("tcp", host)
 	if err != nil {
 		return nil, err
 	}
 
-	conf := config{TestDuration: duration, Version: version, Direction: direction}
+	conf := config{TestDuration: duration, Version: tcpVersion, Direction: direction}
 
 	defer conn.Close()
 	encoder := json.NewEncoder(conn)
@@ -55,12 +55,27 @@ func handleConnection(conn net.Conn) error {
 	// The server should always be doing the opposite of what the client is doing.
 	conf.Direction.Reverse()
 
-	if conf.Version != version {
+	if conf.Version < tcpVersion || conf.Version > version {
 		err = fmt.Errorf("version mismatch! Server is version %d, client is version %d", version, conf.Version)
 		encoder.Encode(configResponse{Error: err.Error()})
 		return err
 	}
 
+	switch conf.Mode {
+	case "":
+		if conf.Direction == Bidirectional {
+			err = errors.New("bidirectional tests are only supported over UDP")
+			encoder.Encode(configResponse{Error: err.Error()})
+			return err
+		}
+	case "udp":
+		return serveUDPTest(conn, encoder, conf)
+	default:
+		err = fmt.Errorf("unknown test mode %q", conf.Mode)
+		encoder.Encode(configResponse{Error: err.Error()})
+		return err
+	}
+
 	// Start the test
 	encoder.Encode(configResponse{})
 	_, err = doTest(conn, conf)
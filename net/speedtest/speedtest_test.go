@@ -4,6 +4,7 @@
 package speedtest
 
 import (
+	"encoding/json"
 	"net"
 	"testing"
 	"time"
@@ -81,3 +82,84 @@ type state struct {
 		t.Error("server error:", err)
 	}
 }
+
+func TestUDP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Serve(l)
+
+	for _, dir := range []Direction{Download, Upload, Bidirectional} {
+		t.Run(dir.String(), func(t *testing.T) {
+			res, err := RunUDPClient(UDPOptions{
+				Direction:  dir,
+				Duration:   MinDuration,
+				Rate:       200,
+				PacketSize: 100,
+			}, l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (res.Upload != nil) != (dir != Download) || (res.Download != nil) != (dir != Upload) {
+				t.Fatalf("got upload %v, download %v for a %v test", res.Upload, res.Download, dir)
+			}
+			for _, s := range []*UDPStats{res.Upload, res.Download} {
+				if s == nil {
+					continue
+				}
+				t.Logf("%v", s)
+				// At 200 packets per second, at least a few hundred
+				// packets must be sent in MinDuration.
+				if s.Sent < 100 {
+					t.Errorf("sent %d packets; want at least 100", s.Sent)
+				}
+				if s.Received == 0 || s.RTT.Count == 0 {
+					t.Errorf("received %d packets and %d echoes; want some", s.Received, s.RTT.Count)
+				}
+				if s.Received > s.Sent {
+					t.Errorf("received %d packets of %d sent", s.Received, s.Sent)
+				}
+			}
+		})
+	}
+
+	t.Run("bad-options", func(t *testing.T) {
+		if _, err := RunUDPClient(UDPOptions{Duration: MinDuration, PacketSize: MaxUDPPacketSize + 1}, l.Addr().String()); err == nil {
+			t.Error("oversized packets accepted")
+		}
+	})
+
+	t.Run("tcp-bidirectional", func(t *testing.T) {
+		if _, err := RunClient(Bidirectional, MinDuration, l.Addr().String()); err == nil {
+			t.Error("bidirectional TCP test accepted")
+		}
+	})
+}
+
+func TestTCPClientVersion(t *testing.T) {
+	// Servers from before UDP tests require version 2 exactly, so TCP
+	// clients must keep sending it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan config, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var conf config
+		json.NewDecoder(c).Decode(&conf)
+		got <- conf
+		json.NewEncoder(c).Encode(configResponse{Error: "done"})
+	}()
+	RunClient(Download, MinDuration, l.Addr().String())
+	if conf := <-got; conf.Version != 2 || conf.Mode != "" {
+		t.Errorf("TCP client sent version %d, mode %q; want 2, \"\"", conf.Version, conf.Mode)
+	}
+}
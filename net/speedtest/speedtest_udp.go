@@ -0,0 +1,474 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package speedtest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+const (
+	DefaultUDPRate       = 50 // default packets per second, like a 20ms VoIP stream
+	MaxUDPRate           = 10000
+	DefaultUDPPacketSize = 200  // default bytes per packet
+	MaxUDPPacketSize     = 1200 // fits in the tailnet MTU without fragmentation
+
+	udpHandshakeTimeout = 5 * time.Second        // how long to wait for the other side's UDP packets
+	udpHelloInterval    = 100 * time.Millisecond // how often the client retries its hello
+	udpDrainTime        = time.Second            // how long to receive after sending stops
+)
+
+// UDP packet header, in network byte order:
+//
+//	magic   [4]byte
+//	type    uint8
+//	_       [3]byte
+//	session uint64
+//	seq     uint32
+//	sent    int64 // sender's clock, in Unix nanoseconds
+//
+// Data packets are padded to the test's packet size. Echoes are the
+// header of a received data packet, returned to the sender so it can
+// measure the round trip time.
+const (
+	udpHeaderSize = 28
+
+	udpHello    = 1 // client to server, to establish the path
+	udpHelloAck = 2 // server to client, in reply to a hello
+	udpData     = 3
+	udpEcho     = 4
+)
+
+var udpMagic = [4]byte{'t', 's', 's', 't'}
+
+type udpHeader struct {
+	typ     byte
+	session uint64
+	seq     uint32
+	sent    time.Time
+}
+
+func (h udpHeader) appendTo(b []byte) []byte {
+	be := binary.BigEndian
+	b = append(b, udpMagic[:]...)
+	b = append(b, h.typ, 0, 0, 0)
+	b = be.AppendUint64(b, h.session)
+	b = be.AppendUint32(b, h.seq)
+	return be.AppendUint64(b, uint64(h.sent.UnixNano()))
+}
+
+func parseUDPHeader(b []byte) (h udpHeader, ok bool) {
+	if len(b) < udpHeaderSize || [4]byte(b[:4]) != udpMagic {
+		return h, false
+	}
+	be := binary.BigEndian
+	h.typ = b[4]
+	h.session = be.Uint64(b[8:])
+	h.seq = be.Uint32(b[16:])
+	h.sent = time.Unix(0, int64(be.Uint64(b[20:])))
+	return h, true
+}
+
+// UDPOptions configures a UDP test.
+type UDPOptions struct {
+	Direction  Direction     // Download, Upload or Bidirectional
+	Duration   time.Duration // between MinDuration and MaxDuration
+	Rate       int           // packets per second; DefaultUDPRate if zero
+	PacketSize int           // bytes of UDP payload per packet; DefaultUDPPacketSize if zero
+}
+
+func (o UDPOptions) withDefaults() UDPOptions {
+	if o.Rate == 0 {
+		o.Rate = DefaultUDPRate
+	}
+	if o.PacketSize == 0 {
+		o.PacketSize = DefaultUDPPacketSize
+	}
+	return o
+}
+
+func checkUDPOptions(d time.Duration, rate, size int) error {
+	if d < MinDuration || d > MaxDuration {
+		return fmt.Errorf("test duration must be within %v and %v", MinDuration, MaxDuration)
+	}
+	if rate < 1 || rate > MaxUDPRate {
+		return fmt.Errorf("packet rate must be within 1 and %d", MaxUDPRate)
+	}
+	if size < udpHeaderSize || size > MaxUDPPacketSize {
+		return fmt.Errorf("packet size must be within %d and %d", udpHeaderSize, MaxUDPPacketSize)
+	}
+	return nil
+}
+
+// RTTStats is the distribution of round trip times.
+type RTTStats struct {
+	Count  int           `json:"count"` // number of samples
+	Min    time.Duration `json:"min"`
+	Mean   time.Duration `json:"mean"`
+	Median time.Duration `json:"median"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+	Max    time.Duration `json:"max"`
+}
+
+func newRTTStats(rtts []time.Duration) RTTStats {
+	if len(rtts) == 0 {
+		return RTTStats{}
+	}
+	slices.Sort(rtts)
+	var sum time.Duration
+	for _, d := range rtts {
+		sum += d
+	}
+	pct := func(p float64) time.Duration {
+		return rtts[int(p*float64(len(rtts)-1))]
+	}
+	return RTTStats{
+		Count:  len(rtts),
+		Min:    rtts[0],
+		Mean:   sum / time.Duration(len(rtts)),
+		Median: pct(0.5),
+		P90:    pct(0.9),
+		P99:    pct(0.99),
+		Max:    rtts[len(rtts)-1],
+	}
+}
+
+// UDPStats are the results of a UDP test in one direction.
+type UDPStats struct {
+	Sent       int           `json:"sent"`       // packets sent
+	Received   int           `json:"received"`   // distinct packets received
+	Duplicates int           `json:"duplicates"` // packets received more than once
+	Reordered  int           `json:"reordered"`  // packets received after a later packet
+	Jitter     time.Duration `json:"jitter"`     // one-way interarrival jitter, as in RFC 3550
+	RTT        RTTStats      `json:"rtt"`        // round trip times of the echoed packets
+}
+
+// Lost returns the number of packets sent but not received.
+func (s UDPStats) Lost() int {
+	return max(s.Sent-s.Received, 0)
+}
+
+// LossPercent returns the percentage of packets sent but not received.
+func (s UDPStats) LossPercent() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return 100 * float64(s.Lost()) / float64(s.Sent)
+}
+
+func (s UDPStats) String() string {
+	return fmt.Sprintf("%d sent, %d received, %.1f%% loss, %d reordered, %d duplicates, jitter %v, rtt min/median/p90/p99/max %v/%v/%v/%v/%v",
+		s.Sent, s.Received, s.LossPercent(), s.Reordered, s.Duplicates, s.Jitter.Round(time.Microsecond),
+		s.RTT.Min.Round(time.Microsecond), s.RTT.Median.Round(time.Microsecond), s.RTT.P90.Round(time.Microsecond),
+		s.RTT.P99.Round(time.Microsecond), s.RTT.Max.Round(time.Microsecond))
+}
+
+// UDPResult is the result of a UDP test.
+type UDPResult struct {
+	Upload   *UDPStats `json:"upload,omitempty"`   // client to server, or nil if not tested
+	Download *UDPStats `json:"download,omitempty"` // server to client, or nil if not tested
+}
+
+// udpReport is the server's half of the results of a UDP test, sent to the
+// client over the test's TCP connection.
+type udpReport struct {
+	Error string   `json:"error,omitempty"`
+	Out   UDPStats `json:"out"` // sender's stats of the server's stream
+	In    UDPStats `json:"in"`  // receiver's stats of the client's stream
+}
+
+// combineUDPStats returns the stats of a stream from the sender's half, out,
+// and the receiver's half, in.
+func combineUDPStats(out, in UDPStats) *UDPStats {
+	in.Sent = out.Sent
+	in.RTT = out.RTT
+	return &in
+}
+
+// udpTest is one side of a UDP test.
+type udpTest struct {
+	conn    *net.UDPConn
+	peer    netip.AddrPort // or zero if conn is connected
+	session uint64
+	rate    int
+	size    int
+	send    bool // whether this side sends a stream
+}
+
+func (t *udpTest) write(b []byte) error {
+	var err error
+	if t.peer.IsValid() {
+		_, err = t.conn.WriteToUDPAddrPort(b, t.peer)
+	} else {
+		_, err = t.conn.Write(b)
+	}
+	return err
+}
+
+// run runs the test for duration d and returns the stats of the stream it
+// sent, out, and the stream it received, in. Only the sender's fields of
+// out and the receiver's fields of in are set.
+func (t *udpTest) run(d time.Duration) (out, in UDPStats) {
+	start := time.Now()
+	end := start.Add(d)
+	sent := make(chan int, 1)
+	if t.send {
+		go func() { sent <- t.sendLoop(start, end) }()
+	} else {
+		sent <- 0
+	}
+	t.conn.SetReadDeadline(end.Add(udpDrainTime))
+	in, rtts := t.receiveLoop()
+	out.Sent = <-sent
+	out.RTT = newRTTStats(rtts)
+	return out, in
+}
+
+// sendLoop sends data packets at t's rate from start until end, and
+// returns the number sent.
+func (t *udpTest) sendLoop(start, end time.Time) int {
+	interval := time.Second / time.Duration(t.rate)
+	tick := time.NewTicker(max(interval, time.Millisecond))
+	defer tick.Stop()
+	b := make([]byte, 0, t.size)
+	var seq int
+	for {
+		now := time.Now()
+		if !now.Before(end) {
+			return seq
+		}
+		for due := int(now.Sub(start)/interval) + 1; seq < due; seq++ {
+			b = udpHeader{udpData, t.session, uint32(seq), time.Now()}.appendTo(b[:0])
+			b = b[:t.size]
+			// Errors, such as from an ICMP unreachable, count as loss.
+			t.write(b)
+		}
+		<-tick.C
+	}
+}
+
+// receiveLoop receives packets until the read deadline, echoing data
+// packets. It returns the receiver's stats of the stream it received, and
+// the round trip times of its own packets.
+func (t *udpTest) receiveLoop() (in UDPStats, rtts []time.Duration) {
+	var (
+		b       = make([]byte, MaxUDPPacketSize+1)
+		echo    = make([]byte, 0, udpHeaderSize)
+		seen    = make(map[uint32]bool)
+		maxSeq  = -1
+		jitter  float64 // in nanoseconds
+		transit time.Duration
+	)
+	for {
+		n, src, err := t.conn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			continue // such as ECONNREFUSED before the peer is ready
+		}
+		now := time.Now()
+		if t.peer.IsValid() && src != t.peer {
+			continue
+		}
+		h, ok := parseUDPHeader(b[:n])
+		if !ok || h.session != t.session {
+			continue
+		}
+		switch h.typ {
+		case udpHello:
+			// The client resends its hello until it sees our ack.
+			t.write(udpHeader{typ: udpHelloAck, session: t.session}.appendTo(echo[:0]))
+		case udpEcho:
+			rtts = append(rtts, now.Sub(h.sent))
+		case udpData:
+			h.typ = udpEcho
+			t.write(h.appendTo(echo[:0]))
+			if seen[h.seq] {
+				in.Duplicates++
+				continue
+			}
+			seen[h.seq] = true
+			in.Received++
+			if int(h.seq) < maxSeq {
+				in.Reordered++
+			}
+			maxSeq = max(maxSeq, int(h.seq))
+
+			// Interarrival jitter (RFC 3550, section 6.4.1). Clock
+			// offsets between the two sides cancel out.
+			tr := now.Sub(h.sent)
+			if in.Received > 1 {
+				d := float64(tr - transit)
+				if d < 0 {
+					d = -d
+				}
+				jitter += (d - jitter) / 16
+			}
+			transit = tr
+		}
+	}
+	in.Jitter = time.Duration(jitter)
+	return in, rtts
+}
+
+// RunUDPClient runs a UDP test with the speed test server at host, which
+// must be reachable over UDP on the port the server chooses (usually the
+// same port as host). It returns the stats of each direction tested.
+func RunUDPClient(opts UDPOptions, host string) (*UDPResult, error) {
+	opts = opts.withDefaults()
+	if err := checkUDPOptions(opts.Duration, opts.Rate, opts.PacketSize); err != nil {
+		return nil, err
+	}
+	var session [8]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return nil, err
+	}
+	conf := config{
+		Version:      version,
+		TestDuration: opts.Duration,
+		Direction:    opts.Direction,
+		Mode:         "udp",
+		Rate:         opts.Rate,
+		PacketSize:   opts.PacketSize,
+		Session:      binary.BigEndian.Uint64(session[:]),
+	}
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(conf); err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(conn)
+	var response configResponse
+	if err := decoder.Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+
+	serverIP := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+	uc, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(serverIP, uint16(response.UDPPort))))
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	t := &udpTest{
+		conn:    uc,
+		session: conf.Session,
+		rate:    conf.Rate,
+		size:    conf.PacketSize,
+		send:    opts.Direction != Download,
+	}
+	if err := t.clientHandshake(); err != nil {
+		return nil, err
+	}
+	out, in := t.run(opts.Duration)
+
+	conn.SetReadDeadline(time.Now().Add(udpHandshakeTimeout + udpDrainTime))
+	var report udpReport
+	if err := decoder.Decode(&report); err != nil {
+		return nil, fmt.Errorf("reading server results: %w", err)
+	}
+	if report.Error != "" {
+		return nil, errors.New(report.Error)
+	}
+	res := new(UDPResult)
+	if opts.Direction != Download {
+		res.Upload = combineUDPStats(out, report.In)
+	}
+	if opts.Direction != Upload {
+		res.Download = combineUDPStats(report.Out, in)
+	}
+	return res, nil
+}
+
+// clientHandshake sends hellos to the server until it acknowledges one,
+// which establishes the UDP path (through NATs, if any) before the test.
+func (t *udpTest) clientHandshake() error {
+	hello := udpHeader{typ: udpHello, session: t.session}.appendTo(nil)
+	b := make([]byte, MaxUDPPacketSize+1)
+	for deadline := time.Now().Add(udpHandshakeTimeout); time.Now().Before(deadline); {
+		t.write(hello)
+		next := time.Now().Add(udpHelloInterval)
+		t.conn.SetReadDeadline(next)
+		for {
+			n, err := t.conn.Read(b)
+			if err != nil {
+				break
+			}
+			if h, ok := parseUDPHeader(b[:n]); ok && h.session == t.session && h.typ == udpHelloAck {
+				return nil
+			}
+		}
+		time.Sleep(time.Until(next)) // if Read failed early, such as with ECONNREFUSED
+	}
+	return errors.New("no UDP response from the speed test server")
+}
+
+// serveUDPTest runs the server side of the UDP test described by conf, on
+// a UDP socket on the address of conn, then reports its results over conn.
+func serveUDPTest(conn net.Conn, encoder *json.Encoder, conf config) error {
+	if err := checkUDPOptions(conf.TestDuration, conf.Rate, conf.PacketSize); err != nil {
+		encoder.Encode(configResponse{Error: err.Error()})
+		return err
+	}
+
+	// Prefer the same port as the TCP listener, which is more likely to
+	// be allowed by firewalls and tailnet policy.
+	laddr := conn.LocalAddr().(*net.TCPAddr)
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP, Port: laddr.Port, Zone: laddr.Zone})
+	if err != nil {
+		uc, err = net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP, Zone: laddr.Zone})
+	}
+	if err != nil {
+		encoder.Encode(configResponse{Error: err.Error()})
+		return err
+	}
+	defer uc.Close()
+	encoder.Encode(configResponse{UDPPort: uc.LocalAddr().(*net.UDPAddr).Port})
+
+	t := &udpTest{
+		conn:    uc,
+		session: conf.Session,
+		rate:    conf.Rate,
+		size:    conf.PacketSize,
+		send:    conf.Direction != Download, // conf.Direction is the server's, reversed from the client's
+	}
+	if err := t.serverHandshake(); err != nil {
+		encoder.Encode(udpReport{Error: err.Error()})
+		return err
+	}
+	out, in := t.run(conf.TestDuration)
+	return encoder.Encode(udpReport{Out: out, In: in})
+}
+
+// serverHandshake waits for the client's hello and acknowledges it.
+func (t *udpTest) serverHandshake() error {
+	b := make([]byte, MaxUDPPacketSize+1)
+	t.conn.SetReadDeadline(time.Now().Add(udpHandshakeTimeout))
+	for {
+		n, src, err := t.conn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			return fmt.Errorf("waiting for UDP hello: %w", err)
+		}
+		if h, ok := parseUDPHeader(b[:n]); ok && h.session == t.session && h.typ == udpHello {
+			t.peer = src
+			return t.write(udpHeader{typ: udpHelloAck, session: t.session}.appendTo(nil))
+		}
+	}
+}
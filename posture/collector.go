@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package posture
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"time"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/util/syspolicy"
+)
+
+// collector gathers a set of posture attributes, such as whether the disk
+// is encrypted, from the local system.
+type collector struct {
+	name string
+
+	// policy is the syspolicy setting controlling whether the collector
+	// runs. It runs unless the policy is set to "never".
+	policy syspolicy.Key
+
+	// collect returns the collector's attributes. Attribute names are
+	// prefixed by the OS they're specific to, such as "linux:", and values
+	// are formatted as described in [tailcfg.C2NPostureIdentityResponse].
+	// Attributes that can't be determined are omitted.
+	collect func(env *collectEnv) (map[string]string, error)
+}
+
+// collectEnv is the system that collectors gather attributes from.
+type collectEnv struct {
+	fs  fs.FS     // the root filesystem, with paths relative to "/"
+	now time.Time // the current time
+}
+
+// collectors are the registered collectors, in order of registration.
+var collectors []*collector
+
+// registerCollector registers c to run in CollectAttributes.
+// It panics if a collector with the same name is already registered.
+func registerCollector(c *collector) {
+	for _, o := range collectors {
+		if o.name == c.name {
+			panic(fmt.Sprintf("duplicate posture collector %q", c.name))
+		}
+	}
+	collectors = append(collectors, c)
+}
+
+// CollectAttributes returns the posture attributes gathered by each of the
+// platform's collectors, such as disk encryption, firewall and OS patch
+// level, that syspolicy allows. Collectors that fail are logged and skipped.
+// It returns nil if there are no attributes.
+func CollectAttributes(logf logger.Logf) map[string]string {
+	return collectAttributes(logf, &collectEnv{fs: os.DirFS("/"), now: time.Now()})
+}
+
+func collectAttributes(logf logger.Logf, env *collectEnv) map[string]string {
+	var attrs map[string]string
+	for _, c := range collectors {
+		choice, err := syspolicy.GetPreferenceOption(c.policy)
+		if err != nil {
+			logf("posture: reading %s policy: %v", c.policy, err)
+		}
+		if !choice.ShouldEnable(true) {
+			continue
+		}
+		a, err := c.collect(env)
+		if err != nil {
+			logf("posture: %s: %v", c.name, err)
+			continue
+		}
+		if len(a) > 0 {
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			maps.Copy(attrs, a)
+		}
+	}
+	return attrs
+}
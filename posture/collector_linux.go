@@ -0,0 +1,399 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux && !android
+
+package posture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/util/lineiter"
+	"tailscale.com/util/syspolicy"
+)
+
+func init() {
+	registerCollector(&collector{
+		name:    "disk-encryption",
+		policy:  syspolicy.PostureDiskEncryption,
+		collect: collectDiskEncryption,
+	})
+	registerCollector(&collector{
+		name:    "firewall",
+		policy:  syspolicy.PostureFirewall,
+		collect: collectFirewall,
+	})
+	registerCollector(&collector{
+		name:    "os-patch-level",
+		policy:  syspolicy.PostureOSPatchLevel,
+		collect: collectOSPatchLevel,
+	})
+	registerCollector(&collector{
+		name:    "screen-lock",
+		policy:  syspolicy.PostureScreenLock,
+		collect: collectScreenLock,
+	})
+	registerCollector(&collector{
+		name:    "auto-update",
+		policy:  syspolicy.PostureAutoUpdate,
+		collect: collectAutoUpdate,
+	})
+	registerCollector(&collector{
+		name:    "edr-agents",
+		policy:  syspolicy.PostureEDRAgents,
+		collect: collectEDRAgents,
+	})
+}
+
+// keyValues parses the KEY=value lines of b, as in /etc/os-release, with
+// values optionally quoted. Later keys override earlier ones.
+func keyValues(b []byte) map[string]string {
+	m := map[string]string{}
+	for line := range lineiter.Bytes(b) {
+		k, v, ok := bytes.Cut(bytes.TrimSpace(line), []byte("="))
+		if !ok || bytes.HasPrefix(k, []byte("#")) {
+			continue
+		}
+		m[string(bytes.TrimSpace(k))] = strings.Trim(string(bytes.TrimSpace(v)), `"'`)
+	}
+	return m
+}
+
+// exists reports whether name exists in fsys.
+func exists(fsys fs.FS, name string) bool {
+	_, err := fs.Stat(fsys, name)
+	return err == nil
+}
+
+// processNames returns the set of names (as in /proc/<pid>/comm, so
+// truncated to 15 bytes) of the running processes.
+func processNames(fsys fs.FS) (map[string]bool, error) {
+	ents, err := fs.ReadDir(fsys, "proc")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, e := range ents {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		// Processes may exit while we're looking.
+		if b, err := fs.ReadFile(fsys, path.Join("proc", e.Name(), "comm")); err == nil {
+			names[string(bytes.TrimSpace(b))] = true
+		}
+	}
+	return names, nil
+}
+
+// collectDiskEncryption reports whether the root filesystem is on a
+// dm-crypt (LUKS or plain) device, possibly beneath LVM or other
+// device-mapper layers.
+func collectDiskEncryption(env *collectEnv) (map[string]string, error) {
+	dev, err := rootBlockDevice(env.fs)
+	if err != nil {
+		return nil, err
+	}
+	typ := cryptType(env.fs, dev, 0)
+	attrs := map[string]string{"linux:rootEncrypted": strconv.FormatBool(typ != "")}
+	if typ != "" {
+		attrs["linux:rootEncryption"] = typ
+	}
+	return attrs, nil
+}
+
+// rootBlockDevice returns the name in /sys/class/block of the block
+// device holding the root filesystem.
+func rootBlockDevice(fsys fs.FS) (string, error) {
+	b, err := fs.ReadFile(fsys, "proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	// Fields are: ID, parent ID, major:minor, root, mount point, options,
+	// optional fields, "-", filesystem type, source, superblock options.
+	// The last mount of "/" is the one in use.
+	var devNum, source string
+	for line := range lineiter.Bytes(b) {
+		f := strings.Fields(string(line))
+		if len(f) < 5 || f[4] != "/" {
+			continue
+		}
+		devNum, source = f[2], ""
+		if i := slices.Index(f, "-"); i >= 0 && i+2 < len(f) {
+			source = f[i+2]
+		}
+	}
+	if devNum == "" {
+		return "", errors.New("no root filesystem in mountinfo")
+	}
+
+	ents, err := fs.ReadDir(fsys, "sys/class/block")
+	if err != nil {
+		return "", err
+	}
+	// Filesystems like btrfs report an anonymous device number (major 0),
+	// so also match the mount source, such as /dev/sda2, /dev/dm-0 or
+	// /dev/mapper/root.
+	mapperName, isMapper := strings.CutPrefix(source, "/dev/mapper/")
+	for _, e := range ents {
+		name := e.Name()
+		if b, err := fs.ReadFile(fsys, path.Join("sys/class/block", name, "dev")); err == nil && string(bytes.TrimSpace(b)) == devNum {
+			return name, nil
+		}
+		if source == "/dev/"+name {
+			return name, nil
+		}
+		if isMapper {
+			if b, err := fs.ReadFile(fsys, path.Join("sys/class/block", name, "dm/name")); err == nil && string(bytes.TrimSpace(b)) == mapperName {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("root filesystem %s (%s) is not on a block device", source, devNum)
+}
+
+// cryptType returns the dm-crypt type, such as "LUKS2" or "PLAIN", of the
+// block device dev or of the first encrypted device beneath it, or the
+// empty string if dev isn't encrypted.
+func cryptType(fsys fs.FS, dev string, depth int) string {
+	if depth > 8 {
+		return "" // device-mapper stacks aren't this deep
+	}
+	dir := path.Join("sys/class/block", dev)
+	if b, err := fs.ReadFile(fsys, path.Join(dir, "dm/uuid")); err == nil {
+		// dm-crypt device UUIDs are like "CRYPT-LUKS2-<uuid>-<name>".
+		if rest, ok := strings.CutPrefix(string(bytes.TrimSpace(b)), "CRYPT-"); ok {
+			typ, _, _ := strings.Cut(rest, "-")
+			return typ
+		}
+	}
+	slaves, _ := fs.ReadDir(fsys, path.Join(dir, "slaves"))
+	for _, s := range slaves {
+		if typ := cryptType(fsys, s.Name(), depth+1); typ != "" {
+			return typ
+		}
+	}
+	return ""
+}
+
+// collectFirewall reports whether a host firewall is enabled: ufw,
+// firewalld, or the nftables service.
+func collectFirewall(env *collectEnv) (map[string]string, error) {
+	var fw string
+	if b, err := fs.ReadFile(env.fs, "etc/ufw/ufw.conf"); err == nil && strings.EqualFold(keyValues(b)["ENABLED"], "yes") {
+		fw = "ufw"
+	} else if procs, err := processNames(env.fs); err == nil && procs["firewalld"] {
+		fw = "firewalld"
+	} else if exists(env.fs, "etc/systemd/system/sysinit.target.wants/nftables.service") ||
+		exists(env.fs, "etc/systemd/system/multi-user.target.wants/nftables.service") {
+		fw = "nftables"
+	}
+	attrs := map[string]string{"linux:firewallEnabled": strconv.FormatBool(fw != "")}
+	if fw != "" {
+		attrs["linux:firewall"] = fw
+	}
+	return attrs, nil
+}
+
+// packageDBs are the package databases of common package managers,
+// which are modified when packages are installed or upgraded.
+var packageDBs = []string{
+	"var/lib/dpkg/status",               // dpkg
+	"var/lib/rpm/rpmdb.sqlite",          // rpm
+	"var/lib/rpm/Packages",              // rpm, before rpmdb.sqlite
+	"usr/lib/sysimage/rpm/rpmdb.sqlite", // rpm, on openSUSE and newer Fedora
+	"var/lib/pacman/local",              // pacman
+	"lib/apk/db/installed",              // apk
+}
+
+// collectOSPatchLevel reports the OS distribution and version, and when
+// packages were last installed or upgraded.
+func collectOSPatchLevel(env *collectEnv) (map[string]string, error) {
+	attrs := map[string]string{}
+	b, err := fs.ReadFile(env.fs, "etc/os-release")
+	if err != nil {
+		b, err = fs.ReadFile(env.fs, "usr/lib/os-release")
+	}
+	if err == nil {
+		osr := keyValues(b)
+		if v := osr["ID"]; v != "" {
+			attrs["linux:osID"] = v
+		}
+		if v := osr["VERSION_ID"]; v != "" {
+			attrs["linux:osVersion"] = v
+		}
+	}
+
+	var updated time.Time
+	for _, name := range packageDBs {
+		if fi, err := fs.Stat(env.fs, name); err == nil && fi.ModTime().After(updated) {
+			updated = fi.ModTime()
+		}
+	}
+	if !updated.IsZero() {
+		attrs["linux:packagesUpdated"] = updated.UTC().Format(time.RFC3339)
+		attrs["linux:packagesUpdatedDaysAgo"] = strconv.Itoa(int(max(env.now.Sub(updated), 0) / (24 * time.Hour)))
+	}
+	if len(attrs) == 0 {
+		return nil, errors.New("no os-release or package database")
+	}
+	return attrs, nil
+}
+
+// collectScreenLock reports the system-wide screen lock settings of
+// GNOME (dconf) and KDE Plasma. Per-user settings aren't visible to
+// tailscaled, so only settings made by an administrator are reported.
+func collectScreenLock(env *collectEnv) (map[string]string, error) {
+	attrs := map[string]string{}
+
+	// GNOME: dconf keyfiles in /etc/dconf/db/<db>.d/, with keys that users
+	// can't override listed in /etc/dconf/db/<db>.d/locks/.
+	files, _ := fs.Glob(env.fs, "etc/dconf/db/*.d/*")
+	slices.Sort(files) // later files take precedence
+	locked := map[string]bool{}
+	for _, name := range files {
+		b, err := fs.ReadFile(env.fs, name)
+		if err != nil {
+			continue // such as the locks directory
+		}
+		section := ""
+		for line := range lineiter.Bytes(b) {
+			line = bytes.TrimSpace(line)
+			if s, ok := bytes.CutPrefix(line, []byte("[")); ok {
+				section = string(bytes.TrimSuffix(s, []byte("]")))
+				continue
+			}
+			k, v, ok := strings.Cut(string(line), "=")
+			if !ok {
+				continue
+			}
+			k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+			switch section + "/" + k {
+			case "org/gnome/desktop/screensaver/lock-enabled":
+				attrs["linux:screenLockEnabled"] = strconv.FormatBool(v == "true")
+			case "org/gnome/desktop/session/idle-delay":
+				// Like "uint32 300".
+				if f := strings.Fields(v); len(f) > 0 {
+					if n, err := strconv.Atoi(f[len(f)-1]); err == nil {
+						attrs["linux:screenLockIdleSeconds"] = strconv.Itoa(n)
+					}
+				}
+			}
+		}
+	}
+	locks, _ := fs.Glob(env.fs, "etc/dconf/db/*.d/locks/*")
+	for _, name := range locks {
+		b, _ := fs.ReadFile(env.fs, name)
+		for line := range lineiter.Bytes(b) {
+			locked[string(bytes.TrimSpace(line))] = true
+		}
+	}
+	if _, ok := attrs["linux:screenLockEnabled"]; ok {
+		attrs["linux:screenLockEnforced"] = strconv.FormatBool(locked["/org/gnome/desktop/screensaver/lock-enabled"])
+	}
+
+	// KDE Plasma: /etc/xdg/kscreenlockerrc, with Timeout in minutes.
+	if b, err := fs.ReadFile(env.fs, "etc/xdg/kscreenlockerrc"); err == nil {
+		kv := keyValues(b)
+		if v, ok := kv["Autolock"]; ok {
+			attrs["linux:screenLockEnabled"] = strconv.FormatBool(v == "true")
+		}
+		if n, err := strconv.Atoi(kv["Timeout"]); err == nil {
+			attrs["linux:screenLockIdleSeconds"] = strconv.Itoa(n * 60)
+		}
+	}
+
+	if len(attrs) == 0 {
+		return nil, nil // not set system-wide
+	}
+	return attrs, nil
+}
+
+// collectAutoUpdate reports whether automatic OS updates are enabled with
+// unattended-upgrades (Debian and Ubuntu) or dnf-automatic (Fedora and
+// RHEL).
+func collectAutoUpdate(env *collectEnv) (map[string]string, error) {
+	var tool string
+
+	// apt reads its configuration files in lexical order, with later
+	// settings overriding earlier ones.
+	files, _ := fs.Glob(env.fs, "etc/apt/apt.conf.d/*")
+	slices.Sort(files)
+	unattended := false
+	for _, name := range files {
+		b, err := fs.ReadFile(env.fs, name)
+		if err != nil {
+			continue
+		}
+		for line := range lineiter.Bytes(b) {
+			// Like: APT::Periodic::Unattended-Upgrade "1";
+			if v, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte(`APT::Periodic::Unattended-Upgrade `)); ok {
+				v = bytes.Trim(bytes.TrimSpace(v), `";`)
+				unattended = string(v) != "0" && len(v) > 0
+			}
+		}
+	}
+	if unattended && exists(env.fs, "usr/bin/unattended-upgrade") {
+		tool = "unattended-upgrades"
+	}
+
+	const wants = "etc/systemd/system/timers.target.wants/"
+	if tool == "" {
+		if exists(env.fs, wants+"dnf-automatic-install.timer") || exists(env.fs, wants+"dnf5-automatic.timer") {
+			tool = "dnf-automatic"
+		} else if exists(env.fs, wants+"dnf-automatic.timer") {
+			// The generic timer only applies updates if configured to.
+			if b, err := fs.ReadFile(env.fs, "etc/dnf/automatic.conf"); err == nil && keyValues(b)["apply_updates"] == "yes" {
+				tool = "dnf-automatic"
+			}
+		}
+	}
+
+	attrs := map[string]string{"linux:autoUpdateEnabled": strconv.FormatBool(tool != "")}
+	if tool != "" {
+		attrs["linux:autoUpdate"] = tool
+	}
+	return attrs, nil
+}
+
+// edrProcesses maps the process names of endpoint detection and response
+// agents, as in /proc/<pid>/comm, to their products.
+var edrProcesses = map[string]string{
+	"falcon-sensor":   "crowdstrike",
+	"s1-agent":        "sentinelone",
+	"wdavdaemon":      "microsoft-defender",
+	"elastic-endpoin": "elastic", // elastic-endpoint
+	"cbagentd":        "carbon-black",
+	"sophos_threat_d": "sophos", // sophos_threat_detector
+	"ds_agent":        "trend-micro",
+	"wazuh-agentd":    "wazuh",
+	"osqueryd":        "osquery",
+	"qualys-cloud-ag": "qualys", // qualys-cloud-agent
+}
+
+// collectEDRAgents reports the endpoint detection and response agents
+// that are running, as a sorted, comma-separated list of products.
+func collectEDRAgents(env *collectEnv) (map[string]string, error) {
+	procs, err := processNames(env.fs)
+	if err != nil {
+		return nil, err
+	}
+	var agents []string
+	for name, product := range edrProcesses {
+		if procs[name] {
+			agents = append(agents, product)
+		}
+	}
+	slices.Sort(agents)
+	return map[string]string{
+		"linux:edrRunning": strconv.FormatBool(len(agents) > 0),
+		"linux:edrAgents":  strings.Join(slices.Compact(agents), ","),
+	}, nil
+}
@@ -0,0 +1,214 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux && !android
+
+package posture
+
+import (
+	"io/fs"
+	"maps"
+	"strconv"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var testNow = time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+func file(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+
+func TestCollectors(t *testing.T) {
+	// A root filesystem on LVM on LUKS, like the Debian and Ubuntu
+	// installers' encrypted LVM option.
+	encryptedLVM := fstest.MapFS{
+		"proc/self/mountinfo": file(
+			"22 1 0:21 / /sys rw,nosuid - sysfs sysfs rw\n" +
+				"26 1 253:1 / / rw,relatime shared:1 - ext4 /dev/mapper/vg-root rw\n"),
+		"sys/class/block/nvme0n1p3/dev":         file("259:3\n"),
+		"sys/class/block/dm-0/dev":              file("253:0\n"),
+		"sys/class/block/dm-0/dm/name":          file("nvme0n1p3_crypt\n"),
+		"sys/class/block/dm-0/dm/uuid":          file("CRYPT-LUKS2-0123456789abcdef-nvme0n1p3_crypt\n"),
+		"sys/class/block/dm-0/slaves/nvme0n1p3": &fstest.MapFile{Mode: fs.ModeDir},
+		"sys/class/block/dm-1/dev":              file("253:1\n"),
+		"sys/class/block/dm-1/dm/name":          file("vg-root\n"),
+		"sys/class/block/dm-1/dm/uuid":          file("LVM-abc\n"),
+		"sys/class/block/dm-1/slaves/dm-0":      &fstest.MapFile{Mode: fs.ModeDir},
+	}
+	// An unencrypted btrfs root, which has an anonymous device number.
+	plainBtrfs := fstest.MapFS{
+		"proc/self/mountinfo":      file("30 1 0:26 /@ / rw,relatime shared:1 - btrfs /dev/sda2 rw,subvol=/@\n"),
+		"sys/class/block/sda/dev":  file("8:0\n"),
+		"sys/class/block/sda2/dev": file("8:2\n"),
+	}
+
+	procs := func(names ...string) fstest.MapFS {
+		m := fstest.MapFS{"proc/self/comm": file("tailscaled\n")}
+		for i, n := range names {
+			m["proc/"+strconv.Itoa(i+1)+"/comm"] = file(n + "\n")
+		}
+		return m
+	}
+	with := func(m fstest.MapFS, files map[string]string) fstest.MapFS {
+		m = maps.Clone(m)
+		for name, data := range files {
+			m[name] = file(data)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		collect func(*collectEnv) (map[string]string, error)
+		fs      fstest.MapFS
+		want    map[string]string // or nil for an error
+	}{
+		{
+			name:    "encrypted-lvm",
+			collect: collectDiskEncryption,
+			fs:      encryptedLVM,
+			want:    map[string]string{"linux:rootEncrypted": "true", "linux:rootEncryption": "LUKS2"},
+		},
+		{
+			name:    "plain-btrfs",
+			collect: collectDiskEncryption,
+			fs:      plainBtrfs,
+			want:    map[string]string{"linux:rootEncrypted": "false"},
+		},
+		{
+			name:    "overlay-root",
+			collect: collectDiskEncryption,
+			fs: fstest.MapFS{
+				"proc/self/mountinfo":     file("500 400 0:50 / / rw - overlay overlay rw,lowerdir=/a\n"),
+				"sys/class/block/sda/dev": file("8:0\n"),
+			},
+			want: nil,
+		},
+		{
+			name:    "ufw",
+			collect: collectFirewall,
+			fs: with(procs("sshd"), map[string]string{
+				"etc/ufw/ufw.conf": "# comment\nENABLED=yes\nLOGLEVEL=low\n",
+			}),
+			want: map[string]string{"linux:firewallEnabled": "true", "linux:firewall": "ufw"},
+		},
+		{
+			name:    "ufw-disabled-firewalld",
+			collect: collectFirewall,
+			fs: with(procs("firewalld"), map[string]string{
+				"etc/ufw/ufw.conf": "ENABLED=no\n",
+			}),
+			want: map[string]string{"linux:firewallEnabled": "true", "linux:firewall": "firewalld"},
+		},
+		{
+			name:    "no-firewall",
+			collect: collectFirewall,
+			fs:      procs("sshd", "cron"),
+			want:    map[string]string{"linux:firewallEnabled": "false"},
+		},
+		{
+			name:    "os-patch-level",
+			collect: collectOSPatchLevel,
+			fs: fstest.MapFS{
+				"etc/os-release": file(`PRETTY_NAME="Ubuntu 24.04 LTS"` + "\nID=ubuntu\nVERSION_ID=\"24.04\"\n"),
+				"var/lib/dpkg/status": &fstest.MapFile{
+					Data:    []byte("Package: tailscale\n"),
+					ModTime: testNow.Add(-3*24*time.Hour - time.Hour),
+				},
+			},
+			want: map[string]string{
+				"linux:osID":                   "ubuntu",
+				"linux:osVersion":              "24.04",
+				"linux:packagesUpdated":        "2024-06-12T11:00:00Z",
+				"linux:packagesUpdatedDaysAgo": "3",
+			},
+		},
+		{
+			name:    "os-patch-level-missing",
+			collect: collectOSPatchLevel,
+			fs:      fstest.MapFS{},
+			want:    nil,
+		},
+		{
+			name:    "gnome-screen-lock",
+			collect: collectScreenLock,
+			fs: fstest.MapFS{
+				"etc/dconf/db/local.d/00-screensaver":    file("[org/gnome/desktop/session]\nidle-delay=uint32 600\n\n[org/gnome/desktop/screensaver]\nlock-enabled=false\n"),
+				"etc/dconf/db/local.d/10-override":       file("[org/gnome/desktop/screensaver]\nlock-enabled=true\n"),
+				"etc/dconf/db/local.d/locks/screensaver": file("/org/gnome/desktop/screensaver/lock-enabled\n"),
+			},
+			want: map[string]string{
+				"linux:screenLockEnabled":     "true",
+				"linux:screenLockIdleSeconds": "600",
+				"linux:screenLockEnforced":    "true",
+			},
+		},
+		{
+			name:    "kde-screen-lock",
+			collect: collectScreenLock,
+			fs: fstest.MapFS{
+				"etc/xdg/kscreenlockerrc": file("[Daemon]\nAutolock=true\nTimeout=5\n"),
+			},
+			want: map[string]string{
+				"linux:screenLockEnabled":     "true",
+				"linux:screenLockIdleSeconds": "300",
+			},
+		},
+		{
+			name:    "unattended-upgrades",
+			collect: collectAutoUpdate,
+			fs: fstest.MapFS{
+				"usr/bin/unattended-upgrade":         file(""),
+				"etc/apt/apt.conf.d/10periodic":      file(`APT::Periodic::Unattended-Upgrade "0";` + "\n"),
+				"etc/apt/apt.conf.d/20auto-upgrades": file(`APT::Periodic::Update-Package-Lists "1";` + "\n" + `APT::Periodic::Unattended-Upgrade "1";` + "\n"),
+			},
+			want: map[string]string{"linux:autoUpdateEnabled": "true", "linux:autoUpdate": "unattended-upgrades"},
+		},
+		{
+			name:    "dnf-automatic-download-only",
+			collect: collectAutoUpdate,
+			fs: fstest.MapFS{
+				"etc/systemd/system/timers.target.wants/dnf-automatic.timer": file(""),
+				"etc/dnf/automatic.conf": file("[commands]\nupgrade_type = default\napply_updates = no\n"),
+			},
+			want: map[string]string{"linux:autoUpdateEnabled": "false"},
+		},
+		{
+			name:    "dnf-automatic-install",
+			collect: collectAutoUpdate,
+			fs: fstest.MapFS{
+				"etc/systemd/system/timers.target.wants/dnf-automatic-install.timer": file(""),
+			},
+			want: map[string]string{"linux:autoUpdateEnabled": "true", "linux:autoUpdate": "dnf-automatic"},
+		},
+		{
+			name:    "edr-agents",
+			collect: collectEDRAgents,
+			fs:      procs("wdavdaemon", "sshd", "falcon-sensor", "falcon-sensor"),
+			want:    map[string]string{"linux:edrRunning": "true", "linux:edrAgents": "crowdstrike,microsoft-defender"},
+		},
+		{
+			name:    "no-edr-agents",
+			collect: collectEDRAgents,
+			fs:      procs("sshd"),
+			want:    map[string]string{"linux:edrRunning": "false", "linux:edrAgents": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.collect(&collectEnv{fs: tt.fs, now: testNow})
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("got %v; want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package posture
+
+import (
+	"errors"
+	"maps"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"tailscale.com/util/syspolicy"
+	"tailscale.com/util/syspolicy/setting"
+	"tailscale.com/util/syspolicy/source"
+)
+
+func TestCollectAttributesPolicy(t *testing.T) {
+	old := collectors
+	t.Cleanup(func() { collectors = old })
+	collectors = nil
+
+	registerCollector(&collector{
+		name:   "a",
+		policy: syspolicy.PostureFirewall,
+		collect: func(*collectEnv) (map[string]string, error) {
+			return map[string]string{"test:a": "true"}, nil
+		},
+	})
+	registerCollector(&collector{
+		name:   "b",
+		policy: syspolicy.PostureEDRAgents,
+		collect: func(*collectEnv) (map[string]string, error) {
+			return map[string]string{"test:b": "x"}, nil
+		},
+	})
+	registerCollector(&collector{
+		name:   "failing",
+		policy: syspolicy.PostureScreenLock,
+		collect: func(*collectEnv) (map[string]string, error) {
+			return map[string]string{"test:failing": "1"}, errors.New("oops")
+		},
+	})
+
+	syspolicy.RegisterWellKnownSettingsForTest(t)
+	env := &collectEnv{fs: fstest.MapFS{}, now: time.Now()}
+
+	got := collectAttributes(t.Logf, env)
+	if want := map[string]string{"test:a": "true", "test:b": "x"}; !maps.Equal(got, want) {
+		t.Errorf("without policy, got %v; want %v", got, want)
+	}
+
+	store := source.NewTestStoreOf(t, source.TestSettingOf(syspolicy.PostureEDRAgents, "never"))
+	syspolicy.MustRegisterStoreForTest(t, "TestStore", setting.DeviceScope, store)
+	got = collectAttributes(t.Logf, env)
+	if want := map[string]string{"test:a": "true"}; !maps.Equal(got, want) {
+		t.Errorf("with PostureEDRAgents=never, got %v; want %v", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate collector didn't panic")
+		}
+	}()
+	registerCollector(&collector{name: "a"})
+}
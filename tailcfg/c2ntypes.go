@@ -66,6 +66,13 @@ type C2NPostureIdentityResponse struct {
 	// of the client machine's network interfaces.
 	IfaceHardwareAddrs []string `json:",omitempty"`
 
+	// Attributes are other posture attributes of the client machine, such
+	// as "linux:rootEncrypted" or "linux:firewallEnabled", keyed by name.
+	// Booleans are "true" or "false", and integers are in decimal. They're
+	// only reported if requested, and each kind may be disabled by system
+	// policy.
+	Attributes map[string]string `json:",omitempty"`
+
 	// PostureDisabled indicates if the machine has opted out of
 	// device posture collection.
 	PostureDisabled bool `json:",omitempty"`
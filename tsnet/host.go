@@ -0,0 +1,657 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsnet
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/disco"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/stun"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/magicsock"
+)
+
+// Host holds resources shared by many Servers in one process, for
+// programs that run a large number of tailnet nodes, such as one per
+// tenant.
+//
+// All Servers with the same Host send and receive their WireGuard and
+// peer-to-peer traffic on one UDP socket per address family, and share a
+// network monitor and a pool of DERP TLS sessions. Each Server still has
+// its own node key, state, network map, netstack and listeners.
+//
+// A DERP server authenticates each connection as a single node key, so
+// each Server has its own DERP connections. But only the first Server to
+// connect to a DERP server does a full TLS handshake; the others resume
+// its TLS session.
+//
+// The zero value is ready to use. A Host is started by the first Server
+// that uses it, or by Start.
+type Host struct {
+	// Port is the UDP port to listen on for the WireGuard and
+	// peer-to-peer traffic of all Servers using the Host. If zero, a port
+	// is automatically selected. The Port field of those Servers is
+	// ignored.
+	Port uint16
+
+	// Logf, if non-nil, is used for logging the Host's own activity, such
+	// as network changes. If nil, log.Printf is used.
+	Logf logger.Logf
+
+	initOnce sync.Once
+	initErr  error
+
+	mu     sync.Mutex
+	netMon *netmon.Monitor
+	mux4   *udpMux
+	mux6   *udpMux // or nil if IPv6 is unavailable
+	closed bool
+
+	// derpTLS is the base TLS config of the Servers' DERP connections,
+	// holding the TLS session cache they share.
+	derpTLS *tls.Config
+}
+
+// derpSessionCacheSize is the number of DERP servers whose TLS sessions
+// a Host keeps for resumption. It's well above the number of DERP regions.
+const derpSessionCacheSize = 256
+
+// Start opens the Host's shared UDP sockets and starts its network
+// monitor. It's called automatically by the first Server that uses h.
+func (h *Host) Start() error {
+	h.initOnce.Do(h.doInit)
+	return h.initErr
+}
+
+func (h *Host) doInit() {
+	if err := h.start(); err != nil {
+		h.initErr = fmt.Errorf("tsnet: host: %w", err)
+	}
+}
+
+func (h *Host) start() (reterr error) {
+	var closePool closeOnErrorPool
+	defer closePool.closeAllIfError(&reterr)
+
+	netMon, err := netmon.New(h.logf)
+	if err != nil {
+		return err
+	}
+	closePool.add(netMon)
+
+	pc4, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(h.Port)})
+	if err != nil {
+		return err
+	}
+	mux4 := newUDPMux(pc4, h.logf)
+	closePool.add(mux4)
+
+	// Use the same port for IPv6, as peers expect a node's endpoints to
+	// share a port. It's fine to go without IPv6 if that port is taken or
+	// the system has no IPv6 support.
+	var mux6 *udpMux
+	port := pc4.LocalAddr().(*net.UDPAddr).Port
+	if pc6, err := net.ListenUDP("udp6", &net.UDPAddr{Port: port}); err != nil {
+		h.logf("tsnet: host: no IPv6 socket on port %d: %v", port, err)
+	} else {
+		mux6 = newUDPMux(pc6, h.logf)
+		closePool.add(mux6)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return net.ErrClosed
+	}
+	h.netMon, h.mux4, h.mux6 = netMon, mux4, mux6
+	h.derpTLS = &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(derpSessionCacheSize),
+	}
+	netMon.Start()
+	return nil
+}
+
+// LocalPort returns the UDP port shared by the Servers using h, or zero if
+// h hasn't been started.
+func (h *Host) LocalPort() uint16 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.mux4 == nil {
+		return 0
+	}
+	return h.mux4.localAddr.AddrPort().Port()
+}
+
+// Close closes the Host's shared sockets and network monitor.
+//
+// It should only be called after all Servers using h have been closed.
+func (h *Host) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return fmt.Errorf("tsnet: host: %w", net.ErrClosed)
+	}
+	h.closed = true
+	if h.mux4 != nil {
+		h.mux4.Close()
+	}
+	if h.mux6 != nil {
+		h.mux6.Close()
+	}
+	if h.netMon != nil {
+		h.netMon.Close()
+	}
+	return nil
+}
+
+func (h *Host) logf(format string, a ...any) {
+	if h.Logf != nil {
+		h.Logf(format, a...)
+		return
+	}
+	log.Printf(format, a...)
+}
+
+// packetListener returns a PacketListener for a Server to pass to magicsock
+// to use the Host's shared sockets.
+func (h *Host) packetListener() *hostPacketListener {
+	return &hostPacketListener{h: h}
+}
+
+// hostPacketListener is a PacketListener returning virtual connections on
+// a Host's shared sockets for one Server. The requested port is ignored.
+type hostPacketListener struct {
+	h *Host
+
+	// magicConn is the Server's magicsock, once it's been created. It
+	// claims the handshake initiations and disco messages addressed to
+	// the Server.
+	magicConn atomic.Pointer[magicsock.Conn]
+}
+
+// isPacketForMe reports whether the Server's magicsock claims b.
+func (l *hostPacketListener) isPacketForMe(b []byte) bool {
+	ms := l.magicConn.Load()
+	return ms != nil && ms.IsPacketForMe(b)
+}
+
+func (l *hostPacketListener) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	var mux *udpMux
+	l.h.mu.Lock()
+	switch network {
+	case "udp4":
+		mux = l.h.mux4
+	case "udp6":
+		mux = l.h.mux6
+	}
+	l.h.mu.Unlock()
+	if network != "udp4" && network != "udp6" {
+		return nil, fmt.Errorf("tsnet: host: unsupported network %q", network)
+	}
+	if mux == nil {
+		return nil, fmt.Errorf("tsnet: host: no %s socket", network)
+	}
+	c, err := mux.newConn(l.isPacketForMe)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+const (
+	// muxRecvQueue is the number of received packets buffered for each
+	// virtual connection before packets are dropped.
+	muxRecvQueue = 256
+
+	// muxIndexTTL is how long a WireGuard session index is routed to a
+	// virtual connection after the connection last sent a handshake
+	// using it. WireGuard rekeys sessions every two minutes, and rejects
+	// sessions older than three.
+	muxIndexTTL = 5 * time.Minute
+)
+
+// udpMux demultiplexes packets received on a UDP socket among the virtual
+// connections of the Servers sharing it.
+//
+// WireGuard handshake responses, cookie replies and transport data are
+// routed by their receiver index, which the mux learns from the sender
+// index of the handshakes each connection sends, or else delivered to every
+// connection. STUN responses are routed by the transaction ID of the
+// request a connection sent. Handshake initiations and disco messages go
+// to the connection that claims them, checked with the connection that
+// last claimed a packet from the same source first. Other packets are
+// dropped.
+type udpMux struct {
+	pc        *net.UDPConn
+	localAddr *net.UDPAddr
+	logf      logger.Logf
+
+	mu        sync.Mutex
+	conns     map[*muxConn]bool
+	indexes   map[uint32]muxIndex         // by WireGuard session index
+	stunTxs   map[stun.TxID]muxIndex      // by transaction ID of sent requests
+	lastClaim map[netip.AddrPort]muxIndex // by source of claimed packets
+	lastPrune time.Time
+	closed    bool
+}
+
+// muxIndex is the connection a received packet is routed to.
+type muxIndex struct {
+	conn *muxConn
+	seen time.Time // when the route was last learned
+}
+
+func newUDPMux(pc *net.UDPConn, logf logger.Logf) *udpMux {
+	m := &udpMux{
+		pc:        pc,
+		localAddr: pc.LocalAddr().(*net.UDPAddr),
+		logf:      logf,
+		conns:     make(map[*muxConn]bool),
+		indexes:   make(map[uint32]muxIndex),
+		stunTxs:   make(map[stun.TxID]muxIndex),
+		lastClaim: make(map[netip.AddrPort]muxIndex),
+	}
+	go m.readLoop()
+	return m
+}
+
+// newConn returns a new virtual connection, which receives the handshake
+// initiations and disco messages for which forMe reports true.
+func (m *udpMux) newConn(forMe func([]byte) bool) (*muxConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, net.ErrClosed
+	}
+	c := &muxConn{
+		mux:    m,
+		forMe:  forMe,
+		recv:   make(chan muxPacket, muxRecvQueue),
+		closed: make(chan struct{}),
+		wake:   make(chan struct{}),
+	}
+	m.conns[c] = true
+	return c, nil
+}
+
+// Close closes the shared socket and all of its virtual connections.
+func (m *udpMux) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	conns := m.conns
+	m.conns = nil
+	m.indexes = nil
+	m.stunTxs = nil
+	m.lastClaim = nil
+	m.mu.Unlock()
+
+	for c := range conns {
+		c.closeOnce.Do(func() { close(c.closed) })
+	}
+	return m.pc.Close()
+}
+
+func (m *udpMux) readLoop() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, src, err := m.pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			m.logf("tsnet: host: read error on %v: %v", m.localAddr, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		m.deliver(buf[:n], src)
+	}
+}
+
+// deliver routes the packet b from src to its virtual connection, if any.
+// WireGuard messages for unknown session indexes are delivered to every
+// connection, as the handshake that chose the index may have been sent over
+// DERP rather than the shared socket.
+func (m *udpMux) deliver(b []byte, src netip.AddrPort) {
+	if c := m.route(b, src); c != nil {
+		c.enqueue(b, src)
+		return
+	}
+	if _, ok := wireGuardReceiverIndex(b); !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c := range m.conns {
+		c.enqueue(b, src)
+	}
+}
+
+// route returns the virtual connection that the packet b from src is
+// addressed to, or nil if it's unknown.
+func (m *udpMux) route(b []byte, src netip.AddrPort) *muxConn {
+	m.mu.Lock()
+	if idx, ok := wireGuardReceiverIndex(b); ok {
+		e := m.indexes[idx]
+		m.mu.Unlock()
+		return e.conn
+	}
+	if stun.Is(b) {
+		tx := stunTxID(b)
+		e := m.stunTxs[tx]
+		delete(m.stunTxs, tx)
+		m.mu.Unlock()
+		return e.conn
+	}
+	if wireGuardType(b) != wgHandshakeInitiation && !isDisco(b) {
+		m.mu.Unlock()
+		return nil
+	}
+	last := m.lastClaim[src].conn
+	m.mu.Unlock()
+
+	// Ask the connection that claimed the last packet from src first, as
+	// peers mostly talk to one Server at a time. The claims are checked
+	// without m.mu held, as they take magicsock's lock, which is held
+	// while it sends.
+	if last != nil && last.forMe(b) {
+		m.learnClaim(last, src)
+		return last
+	}
+	m.mu.Lock()
+	conns := make([]*muxConn, 0, len(m.conns))
+	for c := range m.conns {
+		if c != last {
+			conns = append(conns, c)
+		}
+	}
+	m.mu.Unlock()
+	for _, c := range conns {
+		if c.forMe(b) {
+			m.learnClaim(c, src)
+			return c
+		}
+	}
+	return nil
+}
+
+// learnClaim records that c claimed a packet from src.
+func (m *udpMux) learnClaim(c *muxConn, src netip.AddrPort) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || !m.conns[c] {
+		return
+	}
+	m.lastClaim[src] = muxIndex{c, time.Now()}
+}
+
+// learnSent records the sender index of the WireGuard handshake b, or the
+// transaction ID of the STUN request b, if it is one, as belonging to c.
+func (m *udpMux) learnSent(c *muxConn, b []byte) {
+	idx, isHandshake := wireGuardSenderIndex(b)
+	isSTUN := !isHandshake && stun.Is(b)
+	if !isHandshake && !isSTUN {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	if isHandshake {
+		m.indexes[idx] = muxIndex{c, now}
+	} else {
+		m.stunTxs[stunTxID(b)] = muxIndex{c, now}
+	}
+	if now.Sub(m.lastPrune) < time.Minute {
+		return
+	}
+	m.lastPrune = now
+	pruneMuxIndexes(m.indexes, now)
+	pruneMuxIndexes(m.stunTxs, now)
+	pruneMuxIndexes(m.lastClaim, now)
+}
+
+// pruneMuxIndexes deletes the entries of routes not learned within
+// muxIndexTTL of now.
+func pruneMuxIndexes[K comparable](routes map[K]muxIndex, now time.Time) {
+	for k, e := range routes {
+		if now.Sub(e.seen) > muxIndexTTL {
+			delete(routes, k)
+		}
+	}
+}
+
+// remove forgets c and its routes.
+func (m *udpMux) remove(c *muxConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns, c)
+	removeMuxIndexes(m.indexes, c)
+	removeMuxIndexes(m.stunTxs, c)
+	removeMuxIndexes(m.lastClaim, c)
+}
+
+// removeMuxIndexes deletes the entries of routes that go to c.
+func removeMuxIndexes[K comparable](routes map[K]muxIndex, c *muxConn) {
+	for k, e := range routes {
+		if e.conn == c {
+			delete(routes, k)
+		}
+	}
+}
+
+// WireGuard message types and sizes, from the WireGuard whitepaper.
+const (
+	wgHandshakeInitiation     = 1
+	wgHandshakeResponse       = 2
+	wgCookieReply             = 3
+	wgTransportData           = 4
+	wgHandshakeInitiationSize = 148
+	wgHandshakeResponseSize   = 92
+	wgCookieReplySize         = 64
+	wgTransportDataMinSize    = 32
+)
+
+// wireGuardType returns the message type of b, or zero if b isn't a
+// WireGuard message.
+func wireGuardType(b []byte) byte {
+	if len(b) < 4 || b[1] != 0 || b[2] != 0 || b[3] != 0 {
+		return 0
+	}
+	switch t := b[0]; t {
+	case wgHandshakeInitiation, wgHandshakeResponse, wgCookieReply, wgTransportData:
+		return t
+	}
+	return 0
+}
+
+// wireGuardSenderIndex returns the session index chosen by the sender of
+// the WireGuard handshake message b.
+func wireGuardSenderIndex(b []byte) (idx uint32, ok bool) {
+	switch wireGuardType(b) {
+	case wgHandshakeInitiation:
+		ok = len(b) == wgHandshakeInitiationSize
+	case wgHandshakeResponse:
+		ok = len(b) == wgHandshakeResponseSize
+	}
+	if !ok {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(b[4:8]), true
+}
+
+// wireGuardReceiverIndex returns the session index of the receiver of the
+// WireGuard message b, for the message types that carry one.
+func wireGuardReceiverIndex(b []byte) (idx uint32, ok bool) {
+	switch wireGuardType(b) {
+	case wgHandshakeResponse:
+		if len(b) == wgHandshakeResponseSize {
+			return binary.LittleEndian.Uint32(b[8:12]), true
+		}
+	case wgCookieReply:
+		if len(b) == wgCookieReplySize {
+			return binary.LittleEndian.Uint32(b[4:8]), true
+		}
+	case wgTransportData:
+		if len(b) >= wgTransportDataMinSize {
+			return binary.LittleEndian.Uint32(b[4:8]), true
+		}
+	}
+	return 0, false
+}
+
+// isDisco reports whether b looks like a disco message.
+func isDisco(b []byte) bool {
+	return len(b) >= len(disco.Magic)+key.DiscoPublicRawLen && string(b[:len(disco.Magic)]) == disco.Magic
+}
+
+// stunTxID returns the transaction ID of the STUN message b, which must
+// satisfy stun.Is.
+func stunTxID(b []byte) stun.TxID {
+	var tx stun.TxID
+	copy(tx[:], b[8:20])
+	return tx
+}
+
+type muxPacket struct {
+	b   []byte
+	src netip.AddrPort
+}
+
+// muxConn is a virtual connection on a udpMux's shared socket. It
+// implements nettype.PacketConn and net.PacketConn.
+type muxConn struct {
+	mux       *udpMux
+	forMe     func([]byte) bool // claims handshake initiations and disco
+	recv      chan muxPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	wake         chan struct{} // closed when readDeadline changes
+}
+
+// enqueue queues a copy of b for reading, dropping it if c is too far
+// behind.
+func (c *muxConn) enqueue(b []byte, src netip.AddrPort) {
+	select {
+	case c.recv <- muxPacket{append([]byte(nil), b...), src}:
+	default:
+	}
+}
+
+func (c *muxConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.readDeadline, c.wake
+		c.mu.Unlock()
+
+		var t *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+			}
+			t = time.NewTimer(d)
+			timeout = t.C
+		}
+		var (
+			n   int
+			src netip.AddrPort
+			err error
+		)
+		select {
+		case p := <-c.recv:
+			n, src = copy(b, p.b), p.src
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			// The deadline changed; start over with the new one.
+			if t != nil {
+				t.Stop()
+			}
+			continue
+		}
+		if t != nil {
+			t.Stop()
+		}
+		return n, src, err
+	}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, src, err := c.ReadFromUDPAddrPort(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, net.UDPAddrFromAddrPort(src), nil
+}
+
+func (c *muxConn) WriteToUDPAddrPort(b []byte, dst netip.AddrPort) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mux.learnSent(c, b)
+	return c.mux.pc.WriteToUDPAddrPort(b, dst)
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("tsnet: host: unsupported address type %T", addr)
+	}
+	return c.WriteToUDPAddrPort(b, ua.AddrPort())
+}
+
+func (c *muxConn) LocalAddr() net.Addr { return c.mux.localAddr }
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes go straight to the shared
+// socket.
+func (c *muxConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Close closes c, leaving the shared socket open for other connections.
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mux.remove(c)
+	})
+	return nil
+}
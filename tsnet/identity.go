@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsnet
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/ctxkey"
+)
+
+// PeerIdentity is the identity of a tailnet peer, as known from the
+// Server's network map.
+type PeerIdentity struct {
+	// Node is the peer's node.
+	Node tailcfg.NodeView
+
+	// UserProfile is the profile of the user owning Node, or of the
+	// tagged-devices user if Node is tagged.
+	UserProfile tailcfg.UserProfile
+
+	// CapMap is the capabilities granted to the peer by the tailnet
+	// policy file when connecting to this Server.
+	CapMap tailcfg.PeerCapMap
+}
+
+// PeerConn is implemented by the connections accepted from tailnet peers
+// by a Server's TCP listeners when Server.PeerConns is set.
+type PeerConn interface {
+	net.Conn
+
+	// PeerIdentity returns the identity of the peer as of when the
+	// connection was accepted.
+	PeerIdentity() PeerIdentity
+}
+
+// peerConn is a PeerConn wrapping a connection from a tailnet peer.
+type peerConn struct {
+	net.Conn
+	id PeerIdentity
+}
+
+func (c *peerConn) PeerIdentity() PeerIdentity { return c.id }
+
+// peerIdentity returns the identity of the peer at src, or false if it's
+// not a known peer.
+func (s *Server) peerIdentity(src netip.AddrPort) (PeerIdentity, bool) {
+	if s.lb == nil {
+		return PeerIdentity{}, false
+	}
+	n, u, ok := s.lb.WhoIs("tcp", src)
+	if !ok {
+		return PeerIdentity{}, false
+	}
+	return PeerIdentity{
+		Node:        n,
+		UserProfile: u,
+		CapMap:      s.lb.PeerCaps(src.Addr()),
+	}, true
+}
+
+// withPeerIdentity returns handle wrapped to pass connections from src as
+// a PeerConn, if the peer at src is known.
+func (s *Server) withPeerIdentity(src netip.AddrPort, handle func(net.Conn)) func(net.Conn) {
+	return func(c net.Conn) {
+		if id, ok := s.peerIdentity(src); ok {
+			c = &peerConn{c, id}
+		}
+		handle(c)
+	}
+}
+
+var peerIdentityKey = ctxkey.New[*PeerIdentity]("tsnet.PeerIdentity", nil)
+
+// PeerIdentityFromContext returns the identity of the tailnet peer that
+// made the HTTP request with context ctx, as added by
+// Server.PeerIdentityMiddleware.
+func PeerIdentityFromContext(ctx context.Context) (PeerIdentity, bool) {
+	id := peerIdentityKey.Value(ctx)
+	if id == nil {
+		return PeerIdentity{}, false
+	}
+	return *id, true
+}
+
+// PeerIdentityMiddleware returns an http.Handler that adds the identity of
+// the tailnet peer making each request to the request's context, for h to
+// retrieve with PeerIdentityFromContext.
+//
+// The peer is looked up in s's network map by the request's RemoteAddr, so
+// the middleware works with any of s's listeners without a LocalAPI call.
+// Requests from unknown peers, such as through Funnel, are passed to h
+// without an identity.
+func (s *Server) PeerIdentityMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if src, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			if id, ok := s.peerIdentity(src); ok {
+				r = r.WithContext(peerIdentityKey.WithValue(r.Context(), &id))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
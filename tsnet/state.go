@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"tailscale.com/ipn"
+)
+
+// globalStateKeys are the keys of node state that aren't specific to a
+// login profile.
+var globalStateKeys = []ipn.StateKey{
+	ipn.MachineKeyStateKey,
+	ipn.KnownProfilesStateKey,
+	ipn.CurrentProfileStateKey,
+	ipn.LegacyGlobalDaemonStateKey,
+	ipn.ServerModeStartKey,
+	ipn.TaildropReceivedKey,
+}
+
+// stateKeys returns the keys of the node state in st: the machine key,
+// the login profiles and their prefs and serve configs, and so on. State
+// stores can't list their keys, so keys written by other programs sharing
+// st aren't included.
+//
+// Nor are the TLS certificates and keys ("<domain>.crt" and "<domain>.key")
+// and ACME account key that a Server kept in st rather than in a
+// directory (on Kubernetes): the certificate domains aren't recorded in
+// st, and the certificates are fetched again when next needed.
+func stateKeys(st ipn.StateStore) ([]ipn.StateKey, error) {
+	keys := append([]ipn.StateKey(nil), globalStateKeys...)
+	b, err := st.ReadState(ipn.KnownProfilesStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[ipn.ProfileID]ipn.LoginProfile
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ipn.KnownProfilesStateKey, err)
+	}
+	for id, p := range profiles {
+		keys = append(keys,
+			p.Key,
+			ipn.ServeConfigKey(id),
+			ipn.RouteInfoKey(p.Key),
+		)
+	}
+	return keys, nil
+}
+
+// CopyState copies the node state in src, such as its machine key, node
+// key and login profiles, to dst. It's used to move a node between state
+// stores, such as from a state file to a Kubernetes secret or AWS SSM
+// parameter (see [tailscale.com/ipn/store.New]), without logging in again.
+//
+// TLS certificates aren't copied; the new node fetches them again when it
+// needs them. Neither store may be in use by a running Server, except src
+// of one exporting its state with Server.ExportState. State in dst that
+// src doesn't have is left alone.
+func CopyState(dst, src ipn.StateStore) error {
+	keys, err := stateKeys(src)
+	if err != nil {
+		return fmt.Errorf("tsnet: %w", err)
+	}
+	for _, k := range keys {
+		b, err := src.ReadState(k)
+		if errors.Is(err, ipn.ErrStateNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("tsnet: reading %s: %w", k, err)
+		}
+		if err := dst.WriteState(k, b); err != nil {
+			return fmt.Errorf("tsnet: writing %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// ExportState copies the node state of s to dst, such that a Server using
+// dst as its Store, or importing it with ImportState, is the same node.
+//
+// The two Servers must not run at the same time. s must have been started,
+// or have a Store.
+func (s *Server) ExportState(dst ipn.StateStore) error {
+	if s.Store == nil {
+		return errors.New("tsnet: ExportState: server has no state store yet")
+	}
+	return CopyState(dst, s.Store)
+}
+
+// ImportState arranges for s to start with the node state in src, as
+// exported by another Server's ExportState or written by CopyState. The
+// state is copied into s's Store, or its state file in Dir if Store is nil,
+// when s starts.
+//
+// It must be called before s is started. Errors copying the state are
+// returned by Start.
+func (s *Server) ImportState(src ipn.StateStore) {
+	s.importState = src
+}
+
+// RotateNodeKey replaces the node key of s with a newly generated one,
+// keeping the node's identity, and waits until s is using the new key or
+// ctx is done. On a tailnet with Tailnet Lock, the new key is signed with
+// s's network-lock key, which requires the current key's signature to
+// allow rotation, as those made by "tailscale lock sign" do.
+//
+// Control decides whether the rotation needs the node to be authenticated
+// again, in which case RotateNodeKey waits for that too. Rotating without
+// authenticating again requires control to accept a registration of a new
+// node key whose OldNodeKey is the node's current key as a rotation of the
+// same node's key.
+//
+// It will start the server if it has not been started yet.
+func (s *Server) RotateNodeKey(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	oldKey := s.lb.NodeKey()
+	if err := s.lb.RotateNodeKey(); err != nil {
+		return fmt.Errorf("tsnet: %w", err)
+	}
+	rotated := false
+	s.lb.WatchNotifications(ctx, ipn.NotifyInitialNetMap, nil, func(*ipn.Notify) (keepGoing bool) {
+		nm := s.lb.NetMap()
+		rotated = nm != nil && nm.NodeKey != oldKey && nm.NodeKey == s.lb.NodeKey() && s.lb.State() == ipn.Running
+		return !rotated
+	})
+	if !rotated {
+		return fmt.Errorf("tsnet: waiting for node key rotation: %w", ctx.Err())
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tsnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/tstest"
+	"tailscale.com/types/key"
+	"tailscale.com/util/must"
+)
+
+func TestCopyState(t *testing.T) {
+	src := new(mem.Store)
+	src.LoadFromMap(map[string][]byte{
+		"_machinekey":      []byte("machine"),
+		"_profiles":        []byte(`{"abcd":{"ID":"abcd","Key":"profile-abcd"}}`),
+		"_current-profile": []byte("profile-abcd"),
+		"profile-abcd":     []byte("prefs"),
+		"_serve/abcd":      []byte("serve"),
+		"unrelated":        []byte("not node state"),
+	})
+	dst := new(mem.Store)
+	dst.WriteState("profile-abcd", []byte("old prefs"))
+	dst.WriteState("dst-only", []byte("kept"))
+	if err := CopyState(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[ipn.StateKey]string{
+		"_machinekey":      "machine",
+		"_current-profile": "profile-abcd",
+		"profile-abcd":     "prefs",
+		"_serve/abcd":      "serve",
+		"dst-only":         "kept",
+	} {
+		got, err := dst.ReadState(k)
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", k, got, err, want)
+		}
+	}
+	if _, err := dst.ReadState("unrelated"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Errorf("unrelated key was copied: %v", err)
+	}
+
+	src.WriteState(ipn.KnownProfilesStateKey, []byte("not json"))
+	if err := CopyState(dst, src); err == nil {
+		t.Error("CopyState with bad profiles succeeded")
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, _ := startControl(t)
+	s1, s1ip, s1Key := startServer(t, ctx, controlURL, "s1")
+
+	exported := new(mem.Store)
+	if err := s1.ExportState(exported); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new Server with another store and directory is the same node.
+	s2 := &Server{
+		Dir:        filepath.Join(t.TempDir(), "s2"),
+		ControlURL: controlURL,
+		Hostname:   "s1",
+		Store:      new(mem.Store),
+		Ephemeral:  true,
+	}
+	defer s2.Close()
+	s2.ImportState(exported)
+	st, err := s2.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Self.PublicKey != s1Key || st.TailscaleIPs[0] != s1ip {
+		t.Errorf("imported node is %v at %v; want %v at %v", st.Self.PublicKey, st.TailscaleIPs[0], s1Key, s1ip)
+	}
+}
+
+func TestRotateNodeKey(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, control := startControl(t)
+	s2, _, _ := startServer(t, ctx, controlURL, "s2")
+
+	// Require s1 to log in interactively, to check that rotating its key
+	// doesn't need another login.
+	control.RequireAuth = true
+	s1 := &Server{
+		Dir:        filepath.Join(t.TempDir(), "s1"),
+		ControlURL: controlURL,
+		Hostname:   "s1",
+		Store:      new(mem.Store),
+		Ephemeral:  true,
+	}
+	defer s1.Close()
+	if err := s1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Complete the interactive login that control requires.
+	lc1, err := s1.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		st, err := lc1.StatusWithoutPeers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.AuthURL != "" {
+			if !control.CompleteAuth(st.AuthURL) {
+				t.Fatalf("CompleteAuth(%q) failed", st.AuthURL)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st, err := s1.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, s1ip := st.Self.PublicKey, st.TailscaleIPs[0]
+
+	if err := s1.RotateNodeKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	st, err = s1.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Self.PublicKey == oldKey {
+		t.Fatal("node key didn't change")
+	}
+	if st.TailscaleIPs[0] != s1ip {
+		t.Errorf("IP changed from %v to %v", s1ip, st.TailscaleIPs[0])
+	}
+
+	// The new key is persisted.
+	b, err := s1.Store.ReadState(ipn.CurrentProfileStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = s1.Store.ReadState(ipn.StateKey(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefs ipn.Prefs
+	if err := ipn.PrefsFromBytes(b, &prefs); err != nil {
+		t.Fatal(err)
+	}
+	if got := prefs.Persist.PublicNodeKey(); got != st.Self.PublicKey {
+		t.Errorf("stored node key = %v; want %v", got, st.Self.PublicKey)
+	}
+
+	// Peers can still reach the node.
+	lc2, err := s2.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lc2.Ping(ctx, s1ip, tailcfg.PingICMP); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateNodeKeyTailnetLock(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, control := startControl(t)
+	s1, _, oldKey := startServer(t, ctx, controlURL, "s1")
+
+	lockPriv := key.NewNLPrivate()
+	authority, _, err := tka.Create(&tka.Mem{}, tka.State{
+		Keys:               []tka.Key{{Kind: tka.Key25519, Public: lockPriv.Public().Verifier(), Votes: 1}},
+		DisablementSecrets: [][]byte{bytes.Repeat([]byte{0xa5}, 32)},
+	}, lockPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign s1's node key, allowing s1 to rotate it with its network-lock
+	// key, as "tailscale lock sign" does.
+	lc1, err := s1.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := lc1.NetworkLockStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := tka.NodeKeySignature{
+		SigKind:        tka.SigDirect,
+		KeyID:          lockPriv.KeyID(),
+		Pubkey:         must.Get(oldKey.MarshalBinary()),
+		WrappingPubkey: st.PublicKey.Verifier(),
+	}
+	sig.Signature = must.Get(lockPriv.SignNKS(sig.SigHash()))
+	control.SetNodeKeySignature(oldKey, sig.Serialize())
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		if nm := s1.lb.NetMap(); nm == nil || nm.SelfNode.KeySignature().Len() == 0 {
+			return errors.New("no key signature in netmap yet")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s1.RotateNodeKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	newKey := s1.lb.NodeKey()
+	if newKey == oldKey {
+		t.Fatal("node key didn't change")
+	}
+	n := control.Node(newKey)
+	if n == nil {
+		t.Fatalf("control has no node with key %v", newKey)
+	}
+	if err := authority.NodeKeyAuthorized(newKey, n.KeySignature); err != nil {
+		t.Errorf("rotated node key not authorized: %v", err)
+	}
+}
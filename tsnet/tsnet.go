@@ -122,7 +122,18 @@ type Server struct {
 	// field at zero unless you know what you are doing.
 	Port uint16
 
+	// Host optionally specifies resources to share with other Servers in
+	// the process, such as the UDP socket for WireGuard and peer-to-peer
+	// traffic. If nil, the Server has its own.
+	Host *Host
+
+	// PeerConns, if true, makes the connections accepted from tailnet
+	// peers by the Server's TCP listeners implement PeerConn, identifying
+	// the peer without a call to LocalClient.WhoIs.
+	PeerConns bool
+
 	getCertForTesting func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	importState       ipn.StateStore // or nil; see ImportState
 
 	initOnce         sync.Once
 	initErr          error
@@ -147,6 +158,7 @@ type Server struct {
 	mu                  sync.Mutex
 	listeners           map[listenKey]*listener
 	fallbackTCPHandlers set.HandleSet[FallbackTCPHandler]
+	fallbackUDPHandlers set.HandleSet[FallbackUDPHandler]
 	dialer              *tsdial.Dialer
 	closed              bool
 }
@@ -164,6 +176,20 @@ type Server struct {
 // over the TCP conn.
 type FallbackTCPHandler func(src, dst netip.AddrPort) (handler func(net.Conn), intercept bool)
 
+// FallbackUDPHandler describes the callback which conditionally handles an
+// incoming UDP flow for the provided (src/port, dst/port) 4-tuple. These
+// are registered as handlers of last resort, and are called only if no
+// listener could handle the incoming flow.
+//
+// If the callback returns intercept=false, the flow's packets are dropped.
+//
+// When intercept=true, the behavior depends on whether the returned handler
+// is non-nil: if nil, the packets are dropped. If non-nil, handler takes
+// over the flow, receiving a conn whose Read and Write exchange datagrams
+// with src. The handler must close the conn when done, such as after the
+// flow has been idle for a while.
+type FallbackUDPHandler func(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool)
+
 // Dial connects to the address on the tailnet.
 // It will start the server if it has not been started yet.
 func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
@@ -416,7 +442,7 @@ func (s *Server) Close() error {
 	if s.lb != nil {
 		s.lb.Shutdown()
 	}
-	if s.netMon != nil {
+	if s.netMon != nil && s.Host == nil {
 		s.netMon.Close()
 	}
 	if s.dialer != nil {
@@ -556,21 +582,38 @@ func (s *Server) start() (reterr error) {
 		return err
 	}
 
-	s.netMon, err = netmon.New(tsLogf)
-	if err != nil {
-		return err
+	var (
+		packetListener nettype.PacketListener
+		hostListener   *hostPacketListener
+		derpTLSConfig  *tls.Config
+	)
+	if s.Host != nil {
+		if err := s.Host.Start(); err != nil {
+			return err
+		}
+		s.netMon = s.Host.netMon
+		hostListener = s.Host.packetListener()
+		packetListener = hostListener
+		derpTLSConfig = s.Host.derpTLS
+	} else {
+		s.netMon, err = netmon.New(tsLogf)
+		if err != nil {
+			return err
+		}
+		closePool.add(s.netMon)
 	}
-	closePool.add(s.netMon)
 
 	s.dialer = &tsdial.Dialer{Logf: tsLogf} // mutated below (before used)
 	eng, err := wgengine.NewUserspaceEngine(tsLogf, wgengine.Config{
-		ListenPort:    s.Port,
-		NetMon:        s.netMon,
-		Dialer:        s.dialer,
-		SetSubsystem:  sys.Set,
-		ControlKnobs:  sys.ControlKnobs(),
-		HealthTracker: sys.HealthTracker(),
-		Metrics:       sys.UserMetricsRegistry(),
+		ListenPort:     s.Port,
+		NetMon:         s.netMon,
+		PacketListener: packetListener,
+		DERPTLSConfig:  derpTLSConfig,
+		Dialer:         s.dialer,
+		SetSubsystem:   sys.Set,
+		ControlKnobs:   sys.ControlKnobs(),
+		HealthTracker:  sys.HealthTracker(),
+		Metrics:        sys.UserMetricsRegistry(),
 	})
 	if err != nil {
 		return err
@@ -578,6 +621,9 @@ func (s *Server) start() (reterr error) {
 	closePool.add(s.dialer)
 	sys.Set(eng)
 	sys.HealthTracker().SetMetricsRegistry(sys.UserMetricsRegistry())
+	if hostListener != nil {
+		hostListener.magicConn.Store(sys.MagicSock.Get())
+	}
 
 	s.dialer.UserDialCustomResolver = dns.Quad100Resolver(context.Background(), sys.DNSManager.Get())
 
@@ -626,6 +672,11 @@ func (s *Server) start() (reterr error) {
 			return err
 		}
 	}
+	if s.importState != nil {
+		if err := CopyState(s.Store, s.importState); err != nil {
+			return err
+		}
+	}
 	sys.Set(s.Store)
 
 	loginFlags := controlclient.LoginDefault
@@ -873,12 +924,23 @@ func (s *Server) getTCPHandlerForFlow(src, dst netip.AddrPort) (handler func(net
 		}
 		return nil, true // don't handle, don't forward to localhost
 	}
+	if s.PeerConns {
+		return s.withPeerIdentity(src, ln.handle), true
+	}
 	return ln.handle, true
 }
 
 func (s *Server) getUDPHandlerForFlow(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool) {
 	ln, ok := s.listenerForDstAddr("udp", dst, false)
 	if !ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, handler := range s.fallbackUDPHandlers {
+			connHandler, intercept := handler(src, dst)
+			if intercept {
+				return connHandler, intercept
+			}
+		}
 		return nil, true // don't handle, don't forward to localhost
 	}
 	return func(c nettype.ConnPacketConn) { ln.handle(c) }, true
@@ -1030,6 +1092,24 @@ func (s *Server) RegisterFallbackTCPHandler(cb FallbackTCPHandler) func() {
 	}
 }
 
+// RegisterFallbackUDPHandler registers a callback which will be called
+// to handle a UDP flow to this tsnet node, for which no listeners will handle.
+//
+// If multiple fallback handlers are registered, they will be called in an
+// undefined order. See FallbackUDPHandler for details on handling a flow.
+//
+// The returned function can be used to deregister this callback.
+func (s *Server) RegisterFallbackUDPHandler(cb FallbackUDPHandler) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hnd := s.fallbackUDPHandlers.Add(cb)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.fallbackUDPHandlers, hnd)
+	}
+}
+
 // getCert is the GetCertificate function used by ListenTLS.
 //
 // It calls GetCertificate on the localClient, passing in the ClientHelloInfo.
@@ -1288,11 +1368,12 @@ type listener struct {
 }
 
 func (ln *listener) Accept() (net.Conn, error) {
-	c, ok := <-ln.conn
-	if !ok {
+	select {
+	case c := <-ln.conn:
+		return c, nil
+	case <-ln.closedc:
 		return nil, fmt.Errorf("tsnet: %w", net.ErrClosed)
 	}
-	return c, nil
 }
 
 func (ln *listener) Addr() net.Addr { return addr{ln} }
@@ -13,6 +13,7 @@
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
@@ -38,15 +39,19 @@
 	"golang.org/x/net/proxy"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/cmd/testwrapper/flakytest"
+	"tailscale.com/disco"
+	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/stun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/integration"
 	"tailscale.com/tstest/integration/testcontrol"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/nettype"
 	"tailscale.com/util/must"
 )
 
@@ -757,6 +762,65 @@ func TestFallbackTCPHandler(t *testing.T) {
 	}
 }
 
+func TestFallbackUDPHandler(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, _ := startControl(t)
+	s1, s1ip, _ := startServer(t, ctx, controlURL, "s1")
+	s2, _, _ := startServer(t, ctx, controlURL, "s2")
+
+	lc2, err := s2.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ping to make sure the connection is up.
+	res, err := lc2.Ping(ctx, s1ip, tailcfg.PingICMP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("ping success: %#+v", res)
+
+	gotDst := make(chan netip.AddrPort, 1)
+	deregister := s1.RegisterFallbackUDPHandler(func(src, dst netip.AddrPort) (handler func(nettype.ConnPacketConn), intercept bool) {
+		gotDst <- dst
+		return func(c nettype.ConnPacketConn) {
+			defer c.Close()
+			buf := make([]byte, 1500)
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Errorf("fallback handler read: %v", err)
+				return
+			}
+			c.Write(append([]byte("echo: "), buf[:n]...))
+		}, true
+	})
+	defer deregister()
+
+	c, err := s2.Dial(ctx, "udp", fmt.Sprintf("%s:8081", s1ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "echo: hello"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got, want := <-gotDst, netip.AddrPortFrom(s1ip, 8081); got != want {
+		t.Errorf("fallback handler dst = %v; want %v", got, want)
+	}
+}
+
 func TestCapturePcap(t *testing.T) {
 	const timeLimit = 120
 	ctx, cancel := context.WithTimeout(context.Background(), timeLimit*time.Second)
@@ -1270,3 +1334,426 @@ func mustDirect(t *testing.T, logf logger.Logf, lc1, lc2 *tailscale.LocalClient)
 	}
 	t.Error("magicsock did not find a direct path from lc1 to lc2")
 }
+
+func TestHostMode(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	controlURL, _ := startControl(t)
+	host := &Host{Logf: t.Logf}
+	defer host.Close()
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sessions := &countingSessionCache{ClientSessionCache: host.derpTLS.ClientSessionCache}
+	host.derpTLS.ClientSessionCache = sessions
+
+	const n = 3
+	var (
+		servers [n]*Server
+		ips     [n]netip.Addr
+	)
+	for i := range n {
+		hostname := fmt.Sprintf("s%d", i)
+		s := &Server{
+			Dir:        filepath.Join(t.TempDir(), hostname),
+			ControlURL: controlURL,
+			Hostname:   hostname,
+			Store:      new(mem.Store),
+			Ephemeral:  true,
+			Host:       host,
+		}
+		if *verboseNodes {
+			s.Logf = log.Printf
+		}
+		defer s.Close()
+		status, err := s.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i], ips[i] = s, status.TailscaleIPs[0]
+	}
+
+	// All servers share the host's port, but have their own identities.
+	port := host.LocalPort()
+	if port == 0 {
+		t.Fatal("host has no port")
+	}
+	for i, s := range servers {
+		if got := s.sys.MagicSock.Get().LocalPort(); got != port {
+			t.Errorf("s%d magicsock port = %d; want %d", i, got, port)
+		}
+		for j := range i {
+			if ips[i] == ips[j] {
+				t.Errorf("s%d and s%d have the same IP %v", i, j, ips[i])
+			}
+		}
+	}
+
+	for i, s := range servers {
+		ln, err := s.Listen("tcp", ":8081")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			// Each server is dialed once by every other server.
+			for range n - 1 {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(c, "s%d", i)
+				c.Close()
+			}
+		}()
+	}
+
+	for i, from := range servers {
+		lc, err := from.LocalClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, to := range servers {
+			if i == j {
+				continue
+			}
+			if _, err := lc.Ping(ctx, ips[j], tailcfg.PingICMP); err != nil {
+				t.Fatalf("ping s%d -> s%d: %v", i, j, err)
+			}
+			c, err := from.Dial(ctx, "tcp", fmt.Sprintf("%s:8081", ips[j]))
+			if err != nil {
+				t.Fatalf("dial s%d -> s%d: %v", i, j, err)
+			}
+			got, err := io.ReadAll(c)
+			c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("s%d", j); string(got) != want {
+				t.Errorf("s%d -> s%d: got %q; want %q", i, j, got, want)
+			}
+			lcTo, err := to.LocalClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustDirect(t, t.Logf, lc, lcTo)
+		}
+	}
+
+	// The servers after the first resumed its DERP TLS session.
+	if sessions.hits.Load() == 0 {
+		t.Error("no DERP TLS session was resumed from the host's cache")
+	}
+}
+
+// countingSessionCache is a tls.ClientSessionCache that counts the
+// sessions found in it.
+type countingSessionCache struct {
+	tls.ClientSessionCache
+	hits atomic.Int32
+}
+
+func (c *countingSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	cs, ok := c.ClientSessionCache.Get(sessionKey)
+	if ok {
+		c.hits.Add(1)
+	}
+	return cs, ok
+}
+
+// TestHostModeExternalPeer tests an ordinary peer, with its own magicsock,
+// talking to two Servers that share a Host's ip:port. The external peer's
+// magicsock maps each ip:port to a single peer, so traffic from one Server
+// may be attributed to the other; WireGuard must still see it as coming from
+// the right peer and bring that peer's lazily configured WireGuard state up.
+func TestHostModeExternalPeer(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// Only configure peers in WireGuard once there's activity for them,
+	// which is the default, but don't depend on it.
+	envknob.Setenv("TS_DEBUG_TRIM_WIREGUARD", "true")
+	defer envknob.Setenv("TS_DEBUG_TRIM_WIREGUARD", "")
+
+	controlURL, _ := startControl(t)
+	ext, extIP, _ := startServer(t, ctx, controlURL, "ext")
+	host := &Host{Logf: t.Logf}
+	defer host.Close()
+
+	const n = 2
+	var (
+		servers [n]*Server
+		ips     [n]netip.Addr
+	)
+	for i := range n {
+		hostname := fmt.Sprintf("s%d", i)
+		s := &Server{
+			Dir:        filepath.Join(t.TempDir(), hostname),
+			ControlURL: controlURL,
+			Hostname:   hostname,
+			Store:      new(mem.Store),
+			Ephemeral:  true,
+			Host:       host,
+		}
+		if *verboseNodes {
+			s.Logf = log.Printf
+		}
+		defer s.Close()
+		status, err := s.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i], ips[i] = s, status.TailscaleIPs[0]
+	}
+
+	// serve accepts n connections on s, writing name to each.
+	serve := func(s *Server, name string, n int) {
+		ln, err := s.Listen("tcp", ":8081")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for range n {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				io.WriteString(c, name)
+				c.Close()
+			}
+		}()
+	}
+	dial := func(from *Server, fromName string, to netip.Addr, toName string) {
+		t.Helper()
+		c, err := from.Dial(ctx, "tcp", fmt.Sprintf("%s:8081", to))
+		if err != nil {
+			t.Fatalf("dial %s -> %s: %v", fromName, toName, err)
+		}
+		got, err := io.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatalf("read %s -> %s: %v", fromName, toName, err)
+		}
+		if string(got) != toName {
+			t.Errorf("%s -> %s: got %q; want %q", fromName, toName, got, toName)
+		}
+	}
+	serve(ext, "ext", 2*n)
+	for i, s := range servers {
+		serve(s, fmt.Sprintf("s%d", i), 2)
+	}
+
+	extLC, err := ext.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range servers {
+		lc, err := s.LocalClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("s%d", i)
+		// The external peer starts the first session with s0, and s1
+		// starts the first session with the external peer, so the
+		// external peer sees traffic for a new session from the Host's
+		// ip:port in both directions.
+		if i == 0 {
+			dial(ext, "ext", ips[i], name)
+			dial(s, name, extIP, "ext")
+		} else {
+			dial(s, name, extIP, "ext")
+			dial(ext, "ext", ips[i], name)
+		}
+		mustDirect(t, t.Logf, extLC, lc)
+		mustDirect(t, t.Logf, lc, extLC)
+	}
+
+	// Once both Servers have a direct path from the same ip:port, the
+	// external peer can still reach each of them.
+	for i, s := range servers {
+		name := fmt.Sprintf("s%d", i)
+		dial(ext, "ext", ips[i], name)
+		dial(s, name, extIP, "ext")
+	}
+}
+
+func TestUDPMuxRoute(t *testing.T) {
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newUDPMux(pc, t.Logf)
+	defer m.Close()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// Each connection claims the packets ending in its name.
+	newConn := func(name byte) *muxConn {
+		c, err := m.newConn(func(b []byte) bool { return b[len(b)-1] == name })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	a, b := newConn('a'), newConn('b')
+
+	send := func(pkt []byte) {
+		t.Helper()
+		if _, err := peer.WriteToUDPAddrPort(pkt, m.localAddr.AddrPort()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(c *muxConn, name string, want []byte) {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := c.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("%s got %q; want %q", name, buf[:n], want)
+		}
+	}
+	discoMsg := func(to byte) []byte {
+		return append([]byte(disco.Magic+strings.Repeat("k", key.DiscoPublicRawLen)+"box"), to)
+	}
+	wgMsg := func(typ byte, size int, idxOff int, idx uint32, last byte) []byte {
+		pkt := make([]byte, size)
+		pkt[0] = typ
+		binary.LittleEndian.PutUint32(pkt[idxOff:], idx)
+		pkt[size-1] = last
+		return pkt
+	}
+
+	// Disco messages and handshake initiations go to whoever claims them.
+	send(discoMsg('a'))
+	recv(a, "a", discoMsg('a'))
+	send(discoMsg('b'))
+	recv(b, "b", discoMsg('b'))
+	initiation := wgMsg(wgHandshakeInitiation, wgHandshakeInitiationSize, 4, 1, 'b')
+	send(initiation)
+	recv(b, "b", initiation)
+
+	// Transport data follows the session index of a handshake response
+	// sent by a, regardless of claims.
+	if _, err := a.WriteToUDPAddrPort(wgMsg(wgHandshakeResponse, wgHandshakeResponseSize, 4, 7, 0), peerAddr); err != nil {
+		t.Fatal(err)
+	}
+	data := wgMsg(wgTransportData, wgTransportDataMinSize, 4, 7, 'b')
+	send(data)
+	recv(a, "a", data)
+
+	// STUN responses go to the sender of the request.
+	tx := stun.NewTxID()
+	if _, err := b.WriteToUDPAddrPort(stun.Request(tx), peerAddr); err != nil {
+		t.Fatal(err)
+	}
+	res := stun.Response(tx, peerAddr)
+	send(res)
+	recv(b, "b", res)
+
+	// Transport data for an unknown session goes to everyone, as its
+	// handshake may have been sent over DERP.
+	unknown := wgMsg(wgTransportData, wgTransportDataMinSize, 4, 8, 'a')
+	send(unknown)
+	recv(a, "a", unknown)
+	recv(b, "b", unknown)
+
+	// Other packets nobody claims or knows the route for are dropped.
+	send([]byte("junk-a"))
+	send(res) // its transaction is done
+	send(discoMsg('c'))
+	send(discoMsg('a'))
+	recv(a, "a", discoMsg('a'))
+	send(discoMsg('b'))
+	recv(b, "b", discoMsg('b'))
+}
+
+func TestPeerConns(t *testing.T) {
+	tstest.ResourceCheck(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	controlURL, _ := startControl(t)
+	s1 := &Server{
+		Dir:        filepath.Join(t.TempDir(), "s1"),
+		ControlURL: controlURL,
+		Hostname:   "s1",
+		Store:      new(mem.Store),
+		Ephemeral:  true,
+		PeerConns:  true,
+	}
+	defer s1.Close()
+	st, err := s1.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1ip := st.TailscaleIPs[0]
+	s2, _, s2PubKey := startServer(t, ctx, controlURL, "s2")
+
+	ln, err := s1.Listen("tcp", ":8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	w, err := s2.Dial(ctx, "tcp", fmt.Sprintf("%s:8081", s1ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	pc, ok := r.(PeerConn)
+	if !ok {
+		t.Fatalf("accepted %T; want PeerConn", r)
+	}
+	id := pc.PeerIdentity()
+	if got := id.Node.Key(); got != s2PubKey {
+		t.Errorf("peer node key = %v; want %v", got, s2PubKey)
+	}
+	if id.UserProfile.LoginName == "" {
+		t.Error("peer has no user profile")
+	}
+
+	httpLn, err := s1.Listen("tcp", ":8082")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpLn.Close()
+	hs := &http.Server{Handler: s1.PeerIdentityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := PeerIdentityFromContext(r.Context())
+		if !ok {
+			http.Error(w, "no identity", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, id.Node.Key().String())
+	}))}
+	go hs.Serve(httpLn)
+	defer hs.Close()
+
+	res, err := s2.HTTPClient().Get(fmt.Sprintf("http://%s:8082/", s1ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || string(body) != s2PubKey.String() {
+		t.Errorf("got %v %q; want %q", res.Status, body, s2PubKey.String())
+	}
+}
@@ -34,6 +34,7 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/ptr"
+	"tailscale.com/types/tkatype"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
 	"tailscale.com/util/rands"
@@ -422,6 +423,19 @@ func (s *Server) SetNodeCapMap(nodeKey key.NodePublic, capMap tailcfg.NodeCapMap
 	s.updateLocked("SetNodeCapMap", s.nodeIDsLocked(0))
 }
 
+// SetNodeKeySignature sets the Tailnet Lock signature of the node with
+// nodeKey, as sent to it and its peers in MapResponses.
+func (s *Server) SetNodeKeySignature(nodeKey key.NodePublic, sig tkatype.MarshaledSignature) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[nodeKey]
+	if !ok {
+		return
+	}
+	n.KeySignature = slices.Clone(sig)
+	s.updateLocked("SetNodeKeySignature", s.nodeIDsLocked(0))
+}
+
 // nodeIDsLocked returns the node IDs of all nodes in the server, except
 // for the node with the given ID.
 func (s *Server) nodeIDsLocked(except tailcfg.NodeID) []tailcfg.NodeID {
@@ -540,6 +554,26 @@ func (s *Server) getUser(nodeKey key.NodePublic) (*tailcfg.User, *tailcfg.Login)
 	return user, login
 }
 
+// rotateNodeKey moves the user, login and authentication of the node with
+// oldKey to newKey, so that the node keeps its identity and addresses.
+func (s *Server) rotateNodeKey(oldKey, newKey key.NodePublic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[oldKey]
+	if !ok {
+		return
+	}
+	s.users[newKey] = u
+	s.logins[newKey] = s.logins[oldKey]
+	delete(s.users, oldKey)
+	delete(s.logins, oldKey)
+	delete(s.nodes, oldKey)
+	if s.nodeKeyAuthed[oldKey] {
+		s.nodeKeyAuthed[newKey] = true
+		delete(s.nodeKeyAuthed, oldKey)
+	}
+}
+
 // authPathDone returns a close-only struct that's closed when the
 // authPath ("/auth/XXXXXX") has authenticated.
 func (s *Server) authPathDone(authPath string) <-chan struct{} {
@@ -639,6 +673,9 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 	}
 
 	nk := req.NodeKey
+	if !req.OldNodeKey.IsZero() && req.OldNodeKey != nk {
+		s.rotateNodeKey(req.OldNodeKey, nk)
+	}
 
 	user, login := s.getUser(nk)
 	s.mu.Lock()
@@ -648,6 +685,12 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 
 	machineAuthorized := true // TODO: add Server.RequireMachineAuth
 
+	keySignature := req.NodeKeySignature
+	if n, ok := s.nodes[nk]; ok && len(keySignature) == 0 {
+		// Re-registrations of a key needn't sign it again.
+		keySignature = n.KeySignature
+	}
+
 	v4Prefix := netip.PrefixFrom(netaddr.IPv4(100, 64, uint8(tailcfg.NodeID(user.ID)>>8), uint8(tailcfg.NodeID(user.ID))), 32)
 	v6Prefix := netip.PrefixFrom(tsaddr.Tailscale4To6(v4Prefix.Addr()), 128)
 
@@ -662,6 +705,7 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 		User:              user.ID,
 		Machine:           mkey,
 		Key:               req.NodeKey,
+		KeySignature:      keySignature,
 		MachineAuthorized: machineAuthorized,
 		Addresses:         allowedIPs,
 		AllowedIPs:        allowedIPs,
@@ -53,8 +53,13 @@ type SNIProxyConfig struct {
 	// forwarded. IP specifications are of the form "tcp/80", "udp/53", etc.
 	IP []tailcfg.ProtoPortRange `json:",omitempty"`
 
-	// AllowedDomains is a list of domains that are allowed to be proxied. If
-	// the domain starts with a `.` that means any subdomain of the suffix.
+	// AllowedDomains is a list of domain patterns that are allowed to be
+	// proxied, such as "example.com", "*.example.com" or "!internal.example.com".
+	// If the domain starts with a `.` that means the suffix and any subdomain
+	// of it. A pattern may be restricted to a port or port range, such as
+	// "*.example.com:443". See package domainmatch for the full syntax. If
+	// empty, all domains are allowed. Invalid patterns are ignored, but an
+	// invalid exclusion disables the proxy.
 	AllowedDomains []string `json:",omitempty"`
 }
 
@@ -64,7 +69,8 @@ type AppConnectorAttr struct {
 	// Name is the name of this collection of domains.
 	Name string `json:"name,omitempty"`
 	// Domains enumerates the domains serviced by the specified app connectors.
-	// Domains can be of the form: example.com, or *.example.com.
+	// Domains can be of the form: example.com, or *.example.com. See package
+	// domainmatch for a matcher of this form.
 	Domains []string `json:"domains,omitempty"`
 	// Routes enumerates the predetermined routes to be advertised by the specified app connectors.
 	Routes []netip.Prefix `json:"routes,omitempty"`
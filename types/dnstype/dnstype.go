@@ -23,7 +23,10 @@ type Resolver struct {
 	//    known ahead of time, so bootstrap DNS resolution is not required.
 	//  - "http://node-address:port/path" for DNS over HTTP over WireGuard. This
 	//    is implemented in the PeerAPI for exit nodes and app connectors.
-	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
+	//  - "tls://resolver.com[:port]" for DNS over TCP+TLS. The
+	//    optional "sni" and "pin" query parameters set the TLS server
+	//    name to verify and pin the resolver's certificate; see
+	//    net/dns/resolver for details.
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -33,7 +36,7 @@ type Resolver struct {
 	// look up the DoT/DoH server using their local "classic" DNS
 	// resolver.
 	//
-	// As of 2022-09-08, BootstrapResolution is not yet used.
+	// BootstrapResolution is used for DoT resolvers only.
 	BootstrapResolution []netip.Addr `json:",omitempty"`
 }
 
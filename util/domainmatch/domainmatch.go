@@ -0,0 +1,266 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package domainmatch matches domain names against lists of exact,
+// wildcard and suffix patterns, as used to configure app connectors.
+//
+// A pattern has the form [!]name[:ports], where name is one of:
+//
+//   - "example.com", matching only example.com
+//   - "*.example.com", matching any subdomain of example.com, but not
+//     example.com itself
+//   - ".example.com", matching example.com and any subdomain of it
+//   - "*", matching any domain
+//
+// The optional ports are a single port ("443"), a range ("8000-8100") or
+// "*" for all ports, the default. Repeating a name with different ports
+// allows each of the ports. A leading "!" excludes the matching domains;
+// exclusions can't have ports.
+//
+// When several patterns match a domain, the most specific one takes
+// precedence: an exact name, then the wildcard or suffix pattern with the
+// longest name, then "*". A "*.example.com" pattern takes precedence over
+// ".example.com". Only the ports of the most specific pattern apply, so
+// "*.example.com:443" and "api.example.com:8443" allow only port 8443 for
+// api.example.com.
+package domainmatch
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tailscale.com/util/dnsname"
+)
+
+// Rule is a parsed pattern, or several patterns for the same name with
+// different ports.
+type Rule struct {
+	// Pattern is the pattern's name, with its "!" prefix if any but
+	// without ports, such as "*.example.com". It's suitable as a metric
+	// label.
+	Pattern string
+
+	// Exclude is whether the pattern excludes the domains it matches.
+	Exclude bool
+
+	ports []portRange // or nil for all ports
+}
+
+type portRange struct {
+	first, last uint16
+}
+
+// AllowsPort reports whether r allows connections to port. Exclusions
+// allow no ports.
+func (r *Rule) AllowsPort(port uint16) bool {
+	if r.Exclude {
+		return false
+	}
+	if r.ports == nil {
+		return true
+	}
+	for _, pr := range r.ports {
+		if pr.first <= port && port <= pr.last {
+			return true
+		}
+	}
+	return false
+}
+
+// Matcher matches domain names against a list of patterns. The zero value
+// and a nil Matcher match nothing.
+type Matcher struct {
+	patterns []string // as passed to Parse
+
+	exact     map[string]*Rule // "example.com", keyed by name
+	subdomain map[string]*Rule // "*.example.com", keyed by "example.com"
+	suffix    map[string]*Rule // ".example.com", keyed by "example.com"
+	any       *Rule            // "*", or nil
+}
+
+// Parse returns a Matcher for the provided patterns. See the package
+// documentation for their syntax.
+func Parse(patterns []string) (*Matcher, error) {
+	m := &Matcher{
+		patterns:  slices.Clone(patterns),
+		exact:     map[string]*Rule{},
+		subdomain: map[string]*Rule{},
+		suffix:    map[string]*Rule{},
+	}
+	for _, p := range patterns {
+		if err := m.add(p); err != nil {
+			return nil, fmt.Errorf("domain pattern %q: %w", p, err)
+		}
+	}
+	return m, nil
+}
+
+// MustParse is like Parse, but panics on error.
+func MustParse(patterns ...string) *Matcher {
+	m, err := Parse(patterns)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (m *Matcher) add(pattern string) error {
+	p := strings.ToLower(strings.TrimSpace(pattern))
+	exclude := false
+	if rest, ok := strings.CutPrefix(p, "!"); ok {
+		p, exclude = rest, true
+	}
+	name, portStr, hasPorts := strings.Cut(p, ":")
+	if n := strings.TrimSuffix(name, "."); n != "*" {
+		name = n
+	}
+	var ports []portRange
+	if hasPorts {
+		if exclude {
+			return fmt.Errorf("exclusions can't have ports")
+		}
+		pr, all, err := parsePorts(portStr)
+		if err != nil {
+			return err
+		}
+		if !all {
+			ports = []portRange{pr}
+		}
+	}
+
+	var rules map[string]*Rule
+	key := name
+	switch {
+	case name == "*":
+	case strings.HasPrefix(name, "*."):
+		rules, key = m.subdomain, name[len("*."):]
+	case strings.HasPrefix(name, "."):
+		rules, key = m.suffix, name[len("."):]
+	default:
+		rules = m.exact
+	}
+	if name != "*" {
+		if err := dnsname.ValidHostname(key); err != nil {
+			return err
+		}
+	}
+
+	r := m.any
+	if rules != nil {
+		r = rules[key]
+	}
+	if r == nil {
+		r = &Rule{Pattern: name, Exclude: exclude, ports: ports}
+		if exclude {
+			r.Pattern = "!" + name
+		}
+		if rules != nil {
+			rules[key] = r
+		} else {
+			m.any = r
+		}
+		return nil
+	}
+	// A repeated name: merge the ports.
+	if r.Exclude != exclude {
+		return fmt.Errorf("both included and excluded")
+	}
+	if r.ports == nil || ports == nil {
+		r.ports = nil // all ports
+	} else {
+		r.ports = append(r.ports, ports...)
+	}
+	return nil
+}
+
+// parsePorts parses a port specification, reporting whether it's "*".
+func parsePorts(s string) (_ portRange, all bool, err error) {
+	if s == "*" {
+		return portRange{}, true, nil
+	}
+	firstStr, lastStr, isRange := strings.Cut(s, "-")
+	first, err := strconv.ParseUint(firstStr, 10, 16)
+	if err != nil {
+		return portRange{}, false, fmt.Errorf("invalid port %q", firstStr)
+	}
+	last := first
+	if isRange {
+		last, err = strconv.ParseUint(lastStr, 10, 16)
+		if err != nil {
+			return portRange{}, false, fmt.Errorf("invalid port %q", lastStr)
+		}
+		if last < first {
+			return portRange{}, false, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return portRange{uint16(first), uint16(last)}, false, nil
+}
+
+// Rule returns the most specific rule matching domain, which may be an
+// exclusion, or nil if none does.
+func (m *Matcher) Rule(domain string) *Rule {
+	if m == nil {
+		return nil
+	}
+	d := strings.TrimSuffix(strings.ToLower(domain), ".")
+	if r, ok := m.exact[d]; ok {
+		return r
+	}
+	if r, ok := m.suffix[d]; ok {
+		return r
+	}
+	for parent := d; ; {
+		_, rest, ok := strings.Cut(parent, ".")
+		if !ok {
+			break
+		}
+		parent = rest
+		if r, ok := m.subdomain[parent]; ok {
+			return r
+		}
+		if r, ok := m.suffix[parent]; ok {
+			return r
+		}
+	}
+	return m.any
+}
+
+// Match reports whether domain is matched by a pattern that isn't an
+// exclusion, returning the most specific such pattern.
+func (m *Matcher) Match(domain string) (pattern string, ok bool) {
+	r := m.Rule(domain)
+	if r == nil || r.Exclude {
+		return "", false
+	}
+	return r.Pattern, true
+}
+
+// MatchPort is like Match, but also requires that the most specific
+// pattern allows port.
+func (m *Matcher) MatchPort(domain string, port uint16) (pattern string, ok bool) {
+	r := m.Rule(domain)
+	if r == nil || !r.AllowsPort(port) {
+		return "", false
+	}
+	return r.Pattern, true
+}
+
+// Patterns returns the patterns m was parsed from.
+func (m *Matcher) Patterns() []string {
+	if m == nil {
+		return nil
+	}
+	return slices.Clone(m.patterns)
+}
+
+// Equal reports whether m and m2 were parsed from the same patterns.
+func (m *Matcher) Equal(m2 *Matcher) bool {
+	return slices.Equal(m.Patterns(), m2.Patterns())
+}
+
+// String returns the patterns as a comma-separated list.
+func (m *Matcher) String() string {
+	return strings.Join(m.Patterns(), ",")
+}
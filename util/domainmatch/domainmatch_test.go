@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package domainmatch
+
+import "testing"
+
+func TestMatcher(t *testing.T) {
+	m := MustParse(
+		"example.com",
+		"*.example.com:443",
+		"*.example.com:8000-8100",
+		"api.example.com:8443",
+		"!internal.example.com",
+		".example.org",
+		"*.example.org:80",
+		"Upper.Example.NET.",
+	)
+	tests := []struct {
+		domain      string
+		port        uint16
+		wantPattern string // or empty for no match
+	}{
+		{"example.com", 22, "example.com"},
+		{"EXAMPLE.com.", 22, "example.com"},
+		{"www.example.com", 443, "*.example.com"},
+		{"www.example.com", 8050, "*.example.com"},
+		{"www.example.com", 80, ""},
+		{"a.b.example.com", 443, "*.example.com"},
+		{"api.example.com", 8443, "api.example.com"},
+		{"api.example.com", 443, ""}, // exact match takes precedence
+		{"internal.example.com", 443, ""},
+		{"x.internal.example.com", 443, "*.example.com"},
+		{"notexample.com", 443, ""},
+		{"example.org", 22, ".example.org"},
+		{"www.example.org", 80, "*.example.org"}, // wildcard beats suffix
+		{"www.example.org", 443, ""},
+		{"upper.example.net", 1, "upper.example.net"},
+		{"com", 443, ""},
+		{"", 443, ""},
+	}
+	for _, tt := range tests {
+		got, ok := m.MatchPort(tt.domain, tt.port)
+		if ok != (tt.wantPattern != "") || got != tt.wantPattern {
+			t.Errorf("MatchPort(%q, %d) = %q, %v; want %q", tt.domain, tt.port, got, ok, tt.wantPattern)
+		}
+	}
+
+	if got, ok := m.Match("api.example.com"); !ok || got != "api.example.com" {
+		t.Errorf("Match(api.example.com) = %q, %v", got, ok)
+	}
+	if r := m.Rule("internal.example.com"); r == nil || r.Pattern != "!internal.example.com" {
+		t.Errorf("Rule(internal.example.com) = %+v", r)
+	}
+}
+
+func TestMatcherAny(t *testing.T) {
+	m := MustParse("*", "!example.com", "*.example.com:443")
+	for _, tt := range []struct {
+		domain string
+		want   string
+	}{
+		{"foo.test", "*"},
+		{"example.com", ""},
+		{"www.example.com", "*.example.com"},
+	} {
+		got, _ := m.Match(tt.domain)
+		if got != tt.want {
+			t.Errorf("Match(%q) = %q; want %q", tt.domain, got, tt.want)
+		}
+	}
+
+	var nilMatcher *Matcher
+	if _, ok := nilMatcher.Match("example.com"); ok {
+		t.Error("nil Matcher matched")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, p := range []string{
+		"",
+		"*.",
+		"exa mple.com",
+		"example.com:http",
+		"example.com:100-10",
+		"example.com:70000",
+		"!example.com:443",
+		"**.example.com",
+	} {
+		if _, err := Parse([]string{p}); err == nil {
+			t.Errorf("Parse(%q) succeeded; want error", p)
+		}
+	}
+	if _, err := Parse([]string{"example.com", "!example.com"}); err == nil {
+		t.Error("Parse of included and excluded name succeeded; want error")
+	}
+}
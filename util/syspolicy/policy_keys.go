@@ -95,6 +95,16 @@
 	// Key is a string value that specifies an option: "always", "never", "user-decides".
 	// The default is "user-decides" unless otherwise stated.
 	PostureChecking Key = "PostureChecking"
+	// The following keys control which device posture attributes are collected
+	// when posture checking is enabled and control requests them. Each is a
+	// string value that specifies an option: "always", "never", "user-decides".
+	// The attributes are collected unless the option is "never".
+	PostureDiskEncryption Key = "PostureDiskEncryption" // whether the root filesystem is encrypted
+	PostureFirewall       Key = "PostureFirewall"       // whether a host firewall is enabled
+	PostureOSPatchLevel   Key = "PostureOSPatchLevel"   // OS version and when packages were last updated
+	PostureScreenLock     Key = "PostureScreenLock"     // screen lock settings
+	PostureAutoUpdate     Key = "PostureAutoUpdate"     // automatic OS update settings
+	PostureEDRAgents      Key = "PostureEDRAgents"      // running endpoint detection and response agents
 	// DeviceSerialNumber is the serial number of the device that is running Tailscale.
 	// This is used on iOS/tvOS to allow IT administrators to manually give us a serial number via MDM.
 	// We are unable to programmatically get the serial number from IOKit due to sandboxing restrictions.
@@ -131,6 +141,11 @@
 	// Keys with a string array value.
 	// AllowedSuggestedExitNodes's string array value is a list of exit node IDs that restricts which exit nodes are considered when generating suggestions for exit nodes.
 	AllowedSuggestedExitNodes Key = "AllowedSuggestedExitNodes"
+	// LogSinks's string array value is a list of local destinations, such as
+	// files, syslog servers or OpenTelemetry collectors, that logs are
+	// delivered to in addition to the log server. See logsink.Parse for the
+	// syntax of each entry.
+	LogSinks Key = "LogSinks"
 )
 
 // implicitDefinitions is a list of [setting.Definition] that will be registered
@@ -155,9 +170,16 @@
 	setting.NewDefinition(FlushDNSOnSessionUnlock, setting.DeviceSetting, setting.BooleanValue),
 	setting.NewDefinition(Hostname, setting.DeviceSetting, setting.StringValue),
 	setting.NewDefinition(LogSCMInteractions, setting.DeviceSetting, setting.BooleanValue),
+	setting.NewDefinition(LogSinks, setting.DeviceSetting, setting.StringListValue),
 	setting.NewDefinition(LogTarget, setting.DeviceSetting, setting.StringValue),
 	setting.NewDefinition(MachineCertificateSubject, setting.DeviceSetting, setting.StringValue),
+	setting.NewDefinition(PostureAutoUpdate, setting.DeviceSetting, setting.PreferenceOptionValue),
 	setting.NewDefinition(PostureChecking, setting.DeviceSetting, setting.PreferenceOptionValue),
+	setting.NewDefinition(PostureDiskEncryption, setting.DeviceSetting, setting.PreferenceOptionValue),
+	setting.NewDefinition(PostureEDRAgents, setting.DeviceSetting, setting.PreferenceOptionValue),
+	setting.NewDefinition(PostureFirewall, setting.DeviceSetting, setting.PreferenceOptionValue),
+	setting.NewDefinition(PostureOSPatchLevel, setting.DeviceSetting, setting.PreferenceOptionValue),
+	setting.NewDefinition(PostureScreenLock, setting.DeviceSetting, setting.PreferenceOptionValue),
 	setting.NewDefinition(Tailnet, setting.DeviceSetting, setting.StringValue),
 
 	// User policy settings (can be configured on a user- or device-basis):
@@ -8,14 +8,17 @@
 	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"sync"
 	"time"
 
 	_ "embed"
 
 	"tailscale.com/net/packet"
+	"tailscale.com/types/key"
 	"tailscale.com/util/set"
 )
 
@@ -78,6 +81,68 @@ func writePktHeader(w *bytes.Buffer, when time.Time, length int) {
 	PathDisco Path = 254
 )
 
+func (p Path) String() string {
+	switch p {
+	case FromLocal:
+		return "FromLocal"
+	case FromPeer:
+		return "FromPeer"
+	case SynthesizedToLocal:
+		return "SynthesizedToLocal"
+	case SynthesizedToPeer:
+		return "SynthesizedToPeer"
+	case PathDisco:
+		return "Disco"
+	}
+	return fmt.Sprintf("Path(%d)", uint8(p))
+}
+
+// Format is the file format of a capture stream.
+type Format string
+
+const (
+	// FormatPcap is the classic pcap format. Packets carry a custom
+	// prefix with their path and NAT information, and need
+	// ts-dissector.lua to be decoded by Wireshark.
+	FormatPcap Format = "pcap"
+	// FormatPcapng is the pcapng format. Each Path is a separate
+	// interface, and packets carry comments with their peer and NAT
+	// information.
+	FormatPcapng Format = "pcapng"
+)
+
+// ParseFormat parses a capture format name. The empty string is
+// FormatPcap.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case "":
+		return FormatPcap, nil
+	case FormatPcap, FormatPcapng:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown capture format %q", s)
+}
+
+// OutputOptions are the options of an output registered with
+// Sink.RegisterOutputWithOptions.
+type OutputOptions struct {
+	// Format is the format of the stream. The zero value is FormatPcap.
+	Format Format
+	// Filter, if non-nil, selects which packets are written.
+	Filter *Filter
+}
+
+// PeerInfo describes the peer that a logged packet was sent to or received
+// from.
+type PeerInfo struct {
+	NodeKey    key.NodePublic
+	Name       string // MagicDNS name, if known
+	DERPRegion int    // home DERP region ID, or 0 if unknown
+}
+
+// PeerLookupFunc returns the peer owning ip, if any.
+type PeerLookupFunc func(ip netip.Addr) (_ PeerInfo, ok bool)
+
 // New creates a new capture sink.
 func New() *Sink {
 	ctx, c := context.WithCancel(context.Background())
@@ -95,8 +160,23 @@ type Sink struct {
 	ctxCancel context.CancelFunc
 
 	mu         sync.Mutex
-	outputs    set.HandleSet[io.Writer]
-	flushTimer *time.Timer // or nil if none running
+	outputs    set.HandleSet[*output]
+	peerLookup PeerLookupFunc // or nil
+	flushTimer *time.Timer    // or nil if none running
+}
+
+// output is an output registered with a Sink.
+type output struct {
+	w    io.Writer
+	opts OutputOptions
+}
+
+// SetPeerLookup sets the function used to find the peer of logged packets,
+// for pcapng comments and peer filters.
+func (s *Sink) SetPeerLookup(f PeerLookupFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peerLookup = f
 }
 
 // RegisterOutput connects an output to this sink, which
@@ -108,15 +188,25 @@ type Sink struct {
 // or when the sink is closed. If w implements http.Flusher,
 // it will be flushed periodically.
 func (s *Sink) RegisterOutput(w io.Writer) (unregister func()) {
+	return s.RegisterOutputWithOptions(w, OutputOptions{})
+}
+
+// RegisterOutputWithOptions is like RegisterOutput, but with the stream's
+// format and filter given by opts.
+func (s *Sink) RegisterOutputWithOptions(w io.Writer, opts OutputOptions) (unregister func()) {
 	select {
 	case <-s.ctx.Done():
 		return func() {}
 	default:
 	}
 
-	writePcapHeader(w)
+	if opts.Format == FormatPcapng {
+		writePcapngHeader(w)
+	} else {
+		writePcapHeader(w)
+	}
 	s.mu.Lock()
-	hnd := s.outputs.Add(w)
+	hnd := s.outputs.Add(&output{w: w, opts: opts})
 	s.mu.Unlock()
 
 	return func() {
@@ -146,8 +236,8 @@ func (s *Sink) Close() error {
 	}
 
 	for _, o := range s.outputs {
-		if o, ok := o.(io.Closer); ok {
-			o.Close()
+		if c, ok := o.w.(io.Closer); ok {
+			c.Close()
 		}
 	}
 	s.outputs = nil
@@ -181,44 +271,65 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 	default:
 	}
 
-	extraLen := customDataLen(meta)
-	b := bufferPool.Get().(*bytes.Buffer)
-	b.Reset()
-	b.Grow(16 + extraLen + len(data)) // 16b pcap header + len(metadata) + len(payload)
-	defer bufferPool.Put(b)
-
-	writePktHeader(b, when, len(data)+extraLen)
+	var pkt filterPacket
+	var parsed packet.Parsed
+	pkt.path = path
+	if path != PathDisco {
+		parsed.Decode(data)
+		pkt.p = &parsed
+	}
 
-	// Custom tailscale debugging data
-	binary.Write(b, binary.LittleEndian, uint16(path))
-	if meta.DidSNAT {
-		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalSrc.Addr().BitLen()/8))
-		b.Write(meta.OriginalSrc.Addr().AsSlice())
-	} else {
-		binary.Write(b, binary.LittleEndian, uint8(0)) // SNAT addr len == 0
+	// Look up the peer before taking s.mu for writing, as the lookup may
+	// need to take other locks.
+	s.mu.Lock()
+	lookup, needPeer := s.peerLookup, false
+	for _, o := range s.outputs {
+		needPeer = needPeer || o.opts.Format == FormatPcapng || o.opts.Filter.usesPeer()
 	}
-	if meta.DidDNAT {
-		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalDst.Addr().BitLen()/8))
-		b.Write(meta.OriginalDst.Addr().AsSlice())
-	} else {
-		binary.Write(b, binary.LittleEndian, uint8(0)) // DNAT addr len == 0
+	s.mu.Unlock()
+	if needPeer && lookup != nil && pkt.p != nil {
+		if ip := peerAddr(path, pkt.p); ip.IsValid() {
+			pkt.peer, pkt.hasPeer = lookup(ip)
+		}
 	}
 
-	b.Write(data)
+	var pcapBuf, pcapngBuf *bytes.Buffer // or nil if not yet formatted
+	defer func() {
+		for _, b := range []*bytes.Buffer{pcapBuf, pcapngBuf} {
+			if b != nil {
+				bufferPool.Put(b)
+			}
+		}
+	}()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	var hadError []set.Handle
 	for hnd, o := range s.outputs {
-		if _, err := o.Write(b.Bytes()); err != nil {
+		if o.opts.Filter != nil && !o.opts.Filter.match(&pkt) {
+			continue
+		}
+		var b *bytes.Buffer
+		if o.opts.Format == FormatPcapng {
+			if pcapngBuf == nil {
+				pcapngBuf = formatPcapngPacket(path, when, data, meta, pkt.peer, pkt.hasPeer)
+			}
+			b = pcapngBuf
+		} else {
+			if pcapBuf == nil {
+				pcapBuf = formatPcapPacket(path, when, data, meta)
+			}
+			b = pcapBuf
+		}
+		if _, err := o.w.Write(b.Bytes()); err != nil {
 			hadError = append(hadError, hnd)
 			continue
 		}
 	}
 	for _, hnd := range hadError {
-		if o, ok := s.outputs[hnd].(io.Closer); ok {
-			o.Close()
+		if c, ok := s.outputs[hnd].w.(io.Closer); ok {
+			c.Close()
 		}
 		delete(s.outputs, hnd)
 	}
@@ -228,7 +339,7 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 			s.mu.Lock()
 			defer s.mu.Unlock()
 			for _, o := range s.outputs {
-				if f, ok := o.(http.Flusher); ok {
+				if f, ok := o.w.(http.Flusher); ok {
 					f.Flush()
 				}
 			}
@@ -236,3 +347,87 @@ func (s *Sink) LogPacket(path Path, when time.Time, data []byte, meta packet.Cap
 		})
 	}
 }
+
+// peerAddr returns the address of the peer in the packet p logged on path,
+// or the zero value if the path has no peer.
+func peerAddr(path Path, p *packet.Parsed) netip.Addr {
+	switch path {
+	case FromPeer, SynthesizedToLocal:
+		return p.Src.Addr()
+	case FromLocal, SynthesizedToPeer:
+		return p.Dst.Addr()
+	}
+	return netip.Addr{}
+}
+
+// formatPcapPacket returns a buffer from bufferPool holding the pcap record
+// of a packet.
+func formatPcapPacket(path Path, when time.Time, data []byte, meta packet.CaptureMeta) *bytes.Buffer {
+	extraLen := customDataLen(meta)
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(16 + extraLen + len(data)) // 16b pcap header + len(metadata) + len(payload)
+
+	writePktHeader(b, when, len(data)+extraLen)
+	writeCustomData(b, path, meta)
+	b.Write(data)
+	return b
+}
+
+// writeCustomData writes the custom Tailscale prefix of a packet, holding
+// its path and NAT information, to b.
+func writeCustomData(b *bytes.Buffer, path Path, meta packet.CaptureMeta) {
+	binary.Write(b, binary.LittleEndian, uint16(path))
+	if meta.DidSNAT {
+		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalSrc.Addr().BitLen()/8))
+		b.Write(meta.OriginalSrc.Addr().AsSlice())
+	} else {
+		binary.Write(b, binary.LittleEndian, uint8(0)) // SNAT addr len == 0
+	}
+	if meta.DidDNAT {
+		binary.Write(b, binary.LittleEndian, uint8(meta.OriginalDst.Addr().BitLen()/8))
+		b.Write(meta.OriginalDst.Addr().AsSlice())
+	} else {
+		binary.Write(b, binary.LittleEndian, uint8(0)) // DNAT addr len == 0
+	}
+}
+
+// formatPcapngPacket returns a buffer from bufferPool holding the pcapng
+// enhanced packet block of a packet, commented with its peer and NAT
+// information. Disco frames keep the custom Tailscale prefix.
+func formatPcapngPacket(path Path, when time.Time, data []byte, meta packet.CaptureMeta, peer PeerInfo, hasPeer bool) *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+
+	ifID, ok := pcapngInterfaceID(path)
+	if !ok || path == PathDisco {
+		// Unknown paths are logged on the disco interface, whose link
+		// type carries the path in the custom prefix.
+		ifID, _ = pcapngInterfaceID(PathDisco)
+		var framed bytes.Buffer
+		framed.Grow(customDataLen(meta) + len(data))
+		writeCustomData(&framed, path, meta)
+		framed.Write(data)
+		data = framed.Bytes()
+	}
+
+	var comments []string
+	if hasPeer {
+		c := "peer " + peer.NodeKey.String()
+		if peer.Name != "" {
+			c += " (" + peer.Name + ")"
+		}
+		comments = append(comments, c)
+		if peer.DERPRegion != 0 {
+			comments = append(comments, fmt.Sprintf("derp region %d", peer.DERPRegion))
+		}
+	}
+	if meta.DidSNAT {
+		comments = append(comments, "snat from "+meta.OriginalSrc.Addr().String())
+	}
+	if meta.DidDNAT {
+		comments = append(comments, "dnat from "+meta.OriginalDst.Addr().String())
+	}
+	writePcapngPacket(b, ifID, when, data, comments)
+	return b
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
+)
+
+func TestParseFilter(t *testing.T) {
+	peerKey := key.NewNode().Public()
+	tcp := &packet.Parsed{
+		IPVersion: 4,
+		IPProto:   ipproto.TCP,
+		Src:       netip.MustParseAddrPort("100.64.0.1:1234"),
+		Dst:       netip.MustParseAddrPort("100.64.0.2:443"),
+	}
+	icmp6 := &packet.Parsed{
+		IPVersion: 6,
+		IPProto:   ipproto.ICMPv6,
+		Src:       netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:0"),
+		Dst:       netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:0"),
+	}
+	peer := PeerInfo{NodeKey: peerKey, Name: "server.tail-scale.ts.net."}
+
+	pkts := map[string]*filterPacket{
+		"tcp":   {path: FromLocal, p: tcp, peer: peer, hasPeer: true},
+		"icmp6": {path: FromPeer, p: icmp6},
+		"disco": {path: PathDisco},
+	}
+	tests := []struct {
+		filter string
+		want   []string // names of the matching pkts
+	}{
+		{"tcp", []string{"tcp"}},
+		{"icmp6 or disco", []string{"disco", "icmp6"}},
+		{"ip6", []string{"icmp6"}},
+		{"port 443", []string{"tcp"}},
+		{"src port 443", nil},
+		{"dst port 443", []string{"tcp"}},
+		{"host 100.64.0.2", []string{"tcp"}},
+		{"src host 100.64.0.2", nil},
+		{"net fd7a:115c:a1e0::/48", []string{"icmp6"}},
+		{"proto tcp", []string{"tcp"}},
+		{"proto 58", []string{"icmp6"}},
+		{"peer server", []string{"tcp"}},
+		{"peer SERVER.tail-scale.ts.net", []string{"tcp"}},
+		{"peer " + peerKey.String(), []string{"tcp"}},
+		{"peer other", nil},
+		{"not tcp", []string{"disco", "icmp6"}},
+		{"!tcp&&!disco", []string{"icmp6"}},
+		{"(tcp or icmp6) and not port 443", []string{"icmp6"}},
+		{"tcp or icmp6 and disco", []string{"tcp"}},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		if got := f.String(); got != tt.filter {
+			t.Errorf("ParseFilter(%q).String() = %q", tt.filter, got)
+		}
+		var got []string
+		for name, pkt := range pkts {
+			if f.match(pkt) {
+				got = append(got, name)
+			}
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("filter %q matched %q; want %q", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"bogus",
+		"host",
+		"host example.com",
+		"port 70000",
+		"src tcp",
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"tcp & udp",
+		"peer nodekey:zz",
+	} {
+		if _, err := ParseFilter(bad); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+// ipv4UDP returns an IPv4 UDP packet from src to dst.
+func ipv4UDP(src, dst string) []byte {
+	return packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netip.MustParseAddr(src),
+			Dst: netip.MustParseAddr(dst),
+		},
+		SrcPort: 1234,
+		DstPort: 53,
+	}, []byte("payload"))
+}
+
+// pcapngBlocks splits a pcapng stream into the types and bodies of its
+// blocks.
+func pcapngBlocks(t *testing.T, b []byte) (types []uint32, bodies [][]byte) {
+	t.Helper()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block header: %x", b)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		n := binary.LittleEndian.Uint32(b[4:])
+		if n%4 != 0 || int(n) > len(b) || binary.LittleEndian.Uint32(b[n-4:]) != n {
+			t.Fatalf("bad block length %d", n)
+		}
+		types = append(types, typ)
+		bodies = append(bodies, b[8:n-4])
+		b = b[n:]
+	}
+	return types, bodies
+}
+
+func TestSinkPcapng(t *testing.T) {
+	peerKey := key.NewNode().Public()
+	s := New()
+	defer s.Close()
+	s.SetPeerLookup(func(ip netip.Addr) (PeerInfo, bool) {
+		if ip == netip.MustParseAddr("100.64.0.2") {
+			return PeerInfo{NodeKey: peerKey, Name: "peer.ts.net.", DERPRegion: 7}, true
+		}
+		return PeerInfo{}, false
+	})
+
+	var pcapng, pcap, filtered bytes.Buffer
+	s.RegisterOutputWithOptions(&pcapng, OutputOptions{Format: FormatPcapng})
+	s.RegisterOutput(&pcap)
+	f, err := ParseFilter("peer peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterOutputWithOptions(&filtered, OutputOptions{Format: FormatPcapng, Filter: f})
+
+	toPeer := ipv4UDP("100.64.0.1", "100.64.0.2")
+	toOther := ipv4UDP("100.64.0.1", "100.64.0.3")
+	now := time.Now()
+	s.LogPacket(FromLocal, now, toPeer, packet.CaptureMeta{})
+	s.LogPacket(FromLocal, now, toOther, packet.CaptureMeta{})
+	s.LogPacket(PathDisco, now, []byte("disco"), packet.CaptureMeta{})
+
+	types, bodies := pcapngBlocks(t, pcapng.Bytes())
+	wantTypes := []uint32{pcapngSectionHeaderBlock}
+	for range pcapngInterfaces {
+		wantTypes = append(wantTypes, pcapngInterfaceDescriptionBlock)
+	}
+	wantTypes = append(wantTypes, pcapngEnhancedPacketBlock, pcapngEnhancedPacketBlock, pcapngEnhancedPacketBlock)
+	if !slices.Equal(types, wantTypes) {
+		t.Fatalf("block types = %x; want %x", types, wantTypes)
+	}
+	if got := binary.LittleEndian.Uint32(bodies[0]); got != pcapngByteOrderMagic {
+		t.Errorf("byte order magic = %x", got)
+	}
+	if !bytes.Contains(bodies[1], []byte("FromLocal")) {
+		t.Errorf("first interface not named FromLocal: %q", bodies[1])
+	}
+
+	epb := bodies[1+len(pcapngInterfaces)]
+	if ifID := binary.LittleEndian.Uint32(epb); ifID != 0 {
+		t.Errorf("interface ID = %d; want 0", ifID)
+	}
+	if capLen := binary.LittleEndian.Uint32(epb[12:]); int(capLen) != len(toPeer) {
+		t.Errorf("captured length = %d; want %d", capLen, len(toPeer))
+	}
+	if !bytes.Equal(epb[20:20+len(toPeer)], toPeer) {
+		t.Errorf("packet data not written verbatim")
+	}
+	for _, want := range []string{"peer " + peerKey.String() + " (peer.ts.net.)", "derp region 7"} {
+		if !bytes.Contains(epb, []byte(want)) {
+			t.Errorf("packet missing comment %q", want)
+		}
+	}
+	if bytes.Contains(bodies[2+len(pcapngInterfaces)], []byte("peer ")) {
+		t.Errorf("packet to unknown peer has a peer comment")
+	}
+	discoID, _ := pcapngInterfaceID(PathDisco)
+	if ifID := binary.LittleEndian.Uint32(bodies[3+len(pcapngInterfaces)]); ifID != discoID {
+		t.Errorf("disco interface ID = %d; want %d", ifID, discoID)
+	}
+
+	types, _ = pcapngBlocks(t, filtered.Bytes())
+	if n := len(types) - 1 - len(pcapngInterfaces); n != 1 {
+		t.Errorf("filtered output has %d packets; want 1", n)
+	}
+
+	// The classic pcap output is unchanged: a 24 byte header, then each
+	// packet with a 16 byte record header and 4 byte custom prefix.
+	wantLen := 24 + 3*(16+4) + len(toPeer) + len(toOther) + len("disco")
+	if pcap.Len() != wantLen {
+		t.Errorf("pcap output is %d bytes; want %d", pcap.Len(), wantLen)
+	}
+}
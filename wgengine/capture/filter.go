@@ -0,0 +1,379 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
+)
+
+// Filter is a parsed capture filter expression, selecting which packets are
+// written to an output. See ParseFilter for the syntax.
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// String returns the expression f was parsed from.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// filterPacket is a logged packet, as seen by filters.
+type filterPacket struct {
+	path Path
+	p    *packet.Parsed // nil for disco frames
+
+	peer    PeerInfo
+	hasPeer bool
+}
+
+// match reports whether pkt matches f.
+func (f *Filter) match(pkt *filterPacket) bool {
+	return f.root.match(pkt)
+}
+
+// filterNode is a node of a parsed filter expression.
+type filterNode interface {
+	match(*filterPacket) bool
+}
+
+type (
+	filterAnd  struct{ a, b filterNode }
+	filterOr   struct{ a, b filterNode }
+	filterNot  struct{ a filterNode }
+	filterFunc func(*filterPacket) bool
+	filterPeer func(*filterPacket) bool // a filterFunc using peer information
+)
+
+func (n filterAnd) match(pkt *filterPacket) bool  { return n.a.match(pkt) && n.b.match(pkt) }
+func (n filterOr) match(pkt *filterPacket) bool   { return n.a.match(pkt) || n.b.match(pkt) }
+func (n filterNot) match(pkt *filterPacket) bool  { return !n.a.match(pkt) }
+func (f filterFunc) match(pkt *filterPacket) bool { return f(pkt) }
+func (f filterPeer) match(pkt *filterPacket) bool { return f(pkt) }
+
+// ParseFilter parses a capture filter expression. The syntax is a subset of
+// tcpdump's, made of these primitives:
+//
+//	[src|dst] host <ip>
+//	[src|dst] net <prefix>
+//	[src|dst] port <port>
+//	proto <name|number>
+//	tcp, udp, icmp, icmp6, sctp
+//	ip, ip6
+//	peer <name|nodekey>
+//	disco
+//
+// combined with "and" (or "&&"), "or" (or "||"), "not" (or "!") and
+// parentheses. A peer matches either its full MagicDNS name or its first
+// label. Only the disco primitive matches disco frames.
+func ParseFilter(s string) (*Filter, error) {
+	p := &filterParser{toks: tokenizeFilter(s)}
+	if len(p.toks) == 0 {
+		return nil, errors.New("empty filter")
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return &Filter{expr: s, root: n}, nil
+}
+
+// tokenizeFilter splits a filter expression into words and operators.
+func tokenizeFilter(s string) []string {
+	var toks []string
+	for _, f := range strings.Fields(s) {
+		for f != "" {
+			switch {
+			case strings.HasPrefix(f, "&&"), strings.HasPrefix(f, "||"):
+				toks = append(toks, f[:2])
+				f = f[2:]
+			case f[0] == '(' || f[0] == ')' || f[0] == '!':
+				toks = append(toks, f[:1])
+				f = f[1:]
+			default:
+				i := strings.IndexAny(f, "()!&|")
+				if i == 0 {
+					// A lone '&' or '|'; let the parser reject it.
+					i = 1
+				} else if i < 0 {
+					i = len(f)
+				}
+				toks = append(toks, f[:i])
+				f = f[i:]
+			}
+		}
+	}
+	return toks
+}
+
+type filterParser struct {
+	toks []string
+}
+
+func (p *filterParser) peek() (string, bool) {
+	if len(p.toks) == 0 {
+		return "", false
+	}
+	return p.toks[0], true
+}
+
+func (p *filterParser) next() (string, bool) {
+	tok, ok := p.peek()
+	if ok {
+		p.toks = p.toks[1:]
+	}
+	return tok, ok
+}
+
+// arg returns the argument of the primitive named by kw.
+func (p *filterParser) arg(kw string) (string, error) {
+	tok, ok := p.next()
+	if !ok {
+		return "", fmt.Errorf("missing argument to %q", kw)
+	}
+	return tok, nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	n, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _ := p.peek(); tok != "or" && tok != "||" {
+			return n, nil
+		}
+		p.next()
+		m, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		n = filterOr{n, m}
+	}
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _ := p.peek(); tok != "and" && tok != "&&" {
+			return n, nil
+		}
+		p.next()
+		m, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		n = filterAnd{n, m}
+	}
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	tok, ok := p.next()
+	if !ok {
+		return nil, errors.New("unexpected end of filter")
+	}
+	switch tok {
+	case "not", "!":
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{n}, nil
+	case "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, _ := p.next(); tok != ")" {
+			return nil, errors.New("missing )")
+		}
+		return n, nil
+	}
+	return p.parsePrimitive(tok)
+}
+
+// Address directions of host, net and port primitives.
+const (
+	dirAny = iota
+	dirSrc
+	dirDst
+)
+
+func (p *filterParser) parsePrimitive(kw string) (filterNode, error) {
+	dir := dirAny
+	switch kw {
+	case "src", "dst":
+		dir = dirSrc
+		if kw == "dst" {
+			dir = dirDst
+		}
+		tok, ok := p.next()
+		if !ok || (tok != "host" && tok != "net" && tok != "port") {
+			return nil, fmt.Errorf("%q must be followed by host, net or port", kw)
+		}
+		kw = tok
+	}
+
+	switch kw {
+	case "host":
+		arg, err := p.arg(kw)
+		if err != nil {
+			return nil, err
+		}
+		ip, err := netip.ParseAddr(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q: %w", arg, err)
+		}
+		return matchAddr(dir, func(a netip.AddrPort) bool { return a.Addr() == ip }), nil
+	case "net":
+		arg, err := p.arg(kw)
+		if err != nil {
+			return nil, err
+		}
+		pfx, err := netip.ParsePrefix(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q: %w", arg, err)
+		}
+		pfx = pfx.Masked()
+		return matchAddr(dir, func(a netip.AddrPort) bool { return pfx.Contains(a.Addr()) }), nil
+	case "port":
+		arg, err := p.arg(kw)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		n := matchAddr(dir, func(a netip.AddrPort) bool { return a.Port() == uint16(port) })
+		return filterAnd{matchProto(ipproto.TCP, ipproto.UDP, ipproto.SCTP), n}, nil
+	case "proto":
+		arg, err := p.arg(kw)
+		if err != nil {
+			return nil, err
+		}
+		var proto ipproto.Proto
+		if err := proto.UnmarshalText([]byte(arg)); err != nil {
+			return nil, fmt.Errorf("invalid proto %q", arg)
+		}
+		return matchProto(proto), nil
+	case "tcp":
+		return matchProto(ipproto.TCP), nil
+	case "udp":
+		return matchProto(ipproto.UDP), nil
+	case "icmp":
+		return matchProto(ipproto.ICMPv4), nil
+	case "icmp6":
+		return matchProto(ipproto.ICMPv6), nil
+	case "sctp":
+		return matchProto(ipproto.SCTP), nil
+	case "ip", "ip6":
+		v := uint8(4)
+		if kw == "ip6" {
+			v = 6
+		}
+		return filterFunc(func(pkt *filterPacket) bool {
+			return pkt.p != nil && pkt.p.IPVersion == v
+		}), nil
+	case "peer":
+		arg, err := p.arg(kw)
+		if err != nil {
+			return nil, err
+		}
+		return matchPeer(arg)
+	case "disco":
+		return filterFunc(func(pkt *filterPacket) bool {
+			return pkt.path == PathDisco
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown filter primitive %q", kw)
+}
+
+// matchAddr returns a filter matching IP packets whose source and/or
+// destination, per dir, satisfy f.
+func matchAddr(dir int, f func(netip.AddrPort) bool) filterNode {
+	return filterFunc(func(pkt *filterPacket) bool {
+		if pkt.p == nil || pkt.p.IPVersion == 0 {
+			return false
+		}
+		switch dir {
+		case dirSrc:
+			return f(pkt.p.Src)
+		case dirDst:
+			return f(pkt.p.Dst)
+		}
+		return f(pkt.p.Src) || f(pkt.p.Dst)
+	})
+}
+
+// matchProto returns a filter matching IP packets of any of protos.
+func matchProto(protos ...ipproto.Proto) filterNode {
+	return filterFunc(func(pkt *filterPacket) bool {
+		if pkt.p == nil || pkt.p.IPVersion == 0 {
+			return false
+		}
+		for _, proto := range protos {
+			if pkt.p.IPProto == proto {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// matchPeer returns a filter matching packets to or from the peer named by
+// arg, a MagicDNS name or node key.
+func matchPeer(arg string) (filterNode, error) {
+	if strings.HasPrefix(arg, "nodekey:") {
+		var k key.NodePublic
+		if err := k.UnmarshalText([]byte(arg)); err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %w", arg, err)
+		}
+		return filterPeer(func(pkt *filterPacket) bool {
+			return pkt.hasPeer && pkt.peer.NodeKey == k
+		}), nil
+	}
+	name := strings.TrimSuffix(arg, ".")
+	return filterPeer(func(pkt *filterPacket) bool {
+		if !pkt.hasPeer {
+			return false
+		}
+		full := strings.TrimSuffix(pkt.peer.Name, ".")
+		short, _, _ := strings.Cut(full, ".")
+		return strings.EqualFold(name, full) || strings.EqualFold(name, short)
+	}), nil
+}
+
+// usesPeer reports whether matching f requires peer information.
+func (f *Filter) usesPeer() bool {
+	return f != nil && nodeUsesPeer(f.root)
+}
+
+func nodeUsesPeer(n filterNode) bool {
+	switch n := n.(type) {
+	case filterAnd:
+		return nodeUsesPeer(n.a) || nodeUsesPeer(n.b)
+	case filterOr:
+		return nodeUsesPeer(n.a) || nodeUsesPeer(n.b)
+	case filterNot:
+		return nodeUsesPeer(n.a)
+	case filterPeer:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types and options, from
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-03.html.
+const (
+	pcapngSectionHeaderBlock        = 0x0A0D0D0A
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEndOfOpt  = 0
+	pcapngOptComment   = 1
+	pcapngOptIfName    = 2 // in interface description blocks
+	pcapngOptShbUserAp = 4 // in section header blocks
+
+	linkTypeRaw   = 101 // LINKTYPE_RAW: raw IPv4 or IPv6 packets
+	linkTypeUser0 = 147 // LINKTYPE_USER0: Tailscale's custom framing
+)
+
+// pcapngInterfaces are the paths given an interface in pcapng captures, in
+// interface ID order. Packets from each path are logged as coming from a
+// different interface, named by the path.
+var pcapngInterfaces = []Path{FromLocal, FromPeer, SynthesizedToLocal, SynthesizedToPeer, PathDisco}
+
+// pcapngInterfaceID returns the ID of the pcapng interface for path, and
+// whether it has one.
+func pcapngInterfaceID(path Path) (uint32, bool) {
+	for i, p := range pcapngInterfaces {
+		if p == path {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// pcapngOption appends a pcapng option with code and value to b, padded to
+// a multiple of 4 bytes.
+func pcapngOption(b *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(b, binary.LittleEndian, code)
+	binary.Write(b, binary.LittleEndian, uint16(len(value)))
+	b.Write(value)
+	pcapngPad(b, len(value))
+}
+
+// pcapngPad pads b after n bytes of variable-length data to a multiple of 4
+// bytes.
+func pcapngPad(b *bytes.Buffer, n int) {
+	b.Write(make([]byte, (4-n%4)%4))
+}
+
+// pcapngBlock appends a block of the given type with body to b.
+func pcapngBlock(b *bytes.Buffer, typ uint32, body []byte) {
+	totalLen := uint32(12 + len(body))
+	binary.Write(b, binary.LittleEndian, typ)
+	binary.Write(b, binary.LittleEndian, totalLen)
+	b.Write(body)
+	binary.Write(b, binary.LittleEndian, totalLen)
+}
+
+// writePcapngHeader writes a pcapng section header block to w, followed by
+// an interface description block for each of pcapngInterfaces.
+func writePcapngHeader(w io.Writer) {
+	var b, body bytes.Buffer
+
+	binary.Write(&body, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	binary.Write(&body, binary.LittleEndian, uint16(1)) // version major
+	binary.Write(&body, binary.LittleEndian, uint16(0)) // version minor
+	binary.Write(&body, binary.LittleEndian, int64(-1)) // section length: unspecified
+	pcapngOption(&body, pcapngOptShbUserAp, []byte("tailscaled"))
+	pcapngOption(&body, pcapngOptEndOfOpt, nil)
+	pcapngBlock(&b, pcapngSectionHeaderBlock, body.Bytes())
+
+	for _, path := range pcapngInterfaces {
+		body.Reset()
+		linkType := uint16(linkTypeRaw)
+		if path == PathDisco {
+			linkType = linkTypeUser0
+		}
+		binary.Write(&body, binary.LittleEndian, linkType)
+		binary.Write(&body, binary.LittleEndian, uint16(0))     // reserved
+		binary.Write(&body, binary.LittleEndian, uint32(65535)) // snap len
+		pcapngOption(&body, pcapngOptIfName, []byte(path.String()))
+		pcapngOption(&body, pcapngOptEndOfOpt, nil)
+		pcapngBlock(&b, pcapngInterfaceDescriptionBlock, body.Bytes())
+	}
+	w.Write(b.Bytes())
+}
+
+// writePcapngPacket appends an enhanced packet block to b for the packet
+// data logged at when on the interface with ID ifID, with the given
+// comments.
+func writePcapngPacket(b *bytes.Buffer, ifID uint32, when time.Time, data []byte, comments []string) {
+	var body bytes.Buffer
+	body.Grow(20 + len(data) + 3)
+
+	ts := uint64(when.UnixMicro())
+	binary.Write(&body, binary.LittleEndian, ifID)
+	binary.Write(&body, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(&body, binary.LittleEndian, uint32(ts))
+	binary.Write(&body, binary.LittleEndian, uint32(len(data))) // captured length
+	binary.Write(&body, binary.LittleEndian, uint32(len(data))) // original length
+	body.Write(data)
+	pcapngPad(&body, len(data))
+	if len(comments) > 0 {
+		for _, c := range comments {
+			pcapngOption(&body, pcapngOptComment, []byte(c))
+		}
+		pcapngOption(&body, pcapngOptEndOfOpt, nil)
+	}
+	pcapngBlock(b, pcapngEnhancedPacketBlock, body.Bytes())
+}
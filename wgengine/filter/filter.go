@@ -343,13 +343,24 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 // Check determines whether traffic from srcIP to dstIP:dstPort is allowed
 // using protocol proto.
 func (f *Filter) Check(srcIP, dstIP netip.Addr, dstPort uint16, proto ipproto.Proto) Response {
-	pkt := &packet.Parsed{}
-	pkt.Decode(dummyPacket) // initialize private fields
-	switch {
-	case (srcIP.Is4() && dstIP.Is6()) || (srcIP.Is6() && srcIP.Is4()):
+	pkt, ok := checkPacket(srcIP, dstIP, dstPort, proto)
+	if !ok {
 		// Mismatched address families, no filters will
 		// match.
 		return Drop
+	}
+	return f.RunIn(pkt, 0)
+}
+
+// checkPacket returns a synthesized packet from srcIP to dstIP:dstPort using
+// protocol proto, for evaluating whether such traffic is allowed. It reports
+// false if srcIP and dstIP are of different address families.
+func checkPacket(srcIP, dstIP netip.Addr, dstPort uint16, proto ipproto.Proto) (_ *packet.Parsed, ok bool) {
+	pkt := &packet.Parsed{}
+	pkt.Decode(dummyPacket) // initialize private fields
+	switch {
+	case (srcIP.Is4() && dstIP.Is6()) || (srcIP.Is6() && dstIP.Is4()):
+		return nil, false
 	case srcIP.Is4():
 		pkt.IPVersion = 4
 	case srcIP.Is6():
@@ -363,8 +374,73 @@ func (f *Filter) Check(srcIP, dstIP netip.Addr, dstPort uint16, proto ipproto.Pr
 	if proto == ipproto.TCP {
 		pkt.TCPFlags = packet.TCPSyn
 	}
+	return pkt, true
+}
 
-	return f.RunIn(pkt, 0)
+// CheckResult is the result of Filter.Explain.
+type CheckResult struct {
+	// Response is the filter's verdict, as returned by Check.
+	Response Response
+	// Why is the reason for the verdict, as used in the filter's logs.
+	Why string
+	// Match is the rule that allowed the traffic, or nil if the traffic
+	// was dropped or allowed without a rule (such as ICMP responses). It
+	// contains only the parts of the rule of the traffic's address family.
+	Match *Match
+	// Caps are the peer capabilities granted to the source when talking
+	// to the destination, as returned by CapsWithValues.
+	Caps tailcfg.PeerCapMap
+}
+
+// Explain is like Check, but also reports why the traffic is allowed or
+// dropped, and the capabilities granted to srcIP.
+func (f *Filter) Explain(srcIP, dstIP netip.Addr, dstPort uint16, proto ipproto.Proto) CheckResult {
+	pkt, ok := checkPacket(srcIP, dstIP, dstPort, proto)
+	if !ok {
+		return CheckResult{Response: Drop, Why: "mismatched address families"}
+	}
+	res := CheckResult{Caps: f.CapsWithValues(srcIP, dstIP)}
+
+	r, why := f.preCheck(pkt)
+	if r == noVerdict {
+		ms := f.matches4
+		if pkt.IPVersion == 4 {
+			r, why = f.runIn4(pkt)
+		} else {
+			ms = f.matches6
+			r, why = f.runIn6(pkt)
+		}
+		if r == Accept {
+			if i := f.acceptingMatchIndex(ms, pkt); i >= 0 {
+				res.Match = &ms[i]
+			}
+		}
+	}
+	res.Response, res.Why = r, why
+	return res
+}
+
+// acceptingMatchIndex returns the index of the Match in ms, the matches of
+// q's address family, that caused the filter to accept q, or -1 if q wasn't
+// accepted by a Match.
+func (f *Filter) acceptingMatchIndex(ms matches, q *packet.Parsed) int {
+	switch q.IPProto {
+	case ipproto.ICMPv4, ipproto.ICMPv6:
+		if q.IsEchoResponse() || q.IsError() {
+			return -1
+		}
+		return ms.matchIPsOnlyIndex(q, f.srcIPHasCap)
+	case ipproto.TCP:
+		if !q.IsTCPSyn() {
+			return -1
+		}
+		return ms.matchIndex(q, f.srcIPHasCap)
+	case ipproto.UDP, ipproto.SCTP:
+		return ms.matchIndex(q, f.srcIPHasCap)
+	case ipproto.TSMP:
+		return -1
+	}
+	return ms.matchProtoAndIPsOnlyIfAllPortsIndex(q)
 }
 
 // CheckTCP determines whether TCP traffic from srcIP to dstIP:dstPort
@@ -615,28 +691,34 @@ func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
 		// wireguard keepalive packet, always permit.
 		return Accept
 	}
+	r, why := f.preCheck(q)
+	if r != noVerdict {
+		f.logRateLimit(rf, q, dir, r, why)
+	}
+	return r
+}
+
+// preCheck is the part of pre that applies to non-empty packets. It returns
+// noVerdict if the rest of the filter needs to run.
+func (f *Filter) preCheck(q *packet.Parsed) (r Response, why string) {
 	if len(q.Buffer()) < 20 {
-		f.logRateLimit(rf, q, dir, Drop, "too short")
-		return Drop
+		return Drop, "too short"
 	}
 
 	if q.Dst.Addr().IsMulticast() {
-		f.logRateLimit(rf, q, dir, Drop, "multicast")
-		return Drop
+		return Drop, "multicast"
 	}
 	if q.Dst.Addr().IsLinkLocalUnicast() && q.Dst.Addr() != gcpDNSAddr {
-		f.logRateLimit(rf, q, dir, Drop, "link-local-unicast")
-		return Drop
+		return Drop, "link-local-unicast"
 	}
 
 	if q.IPProto == ipproto.Fragment {
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by Parsed.
-		f.logRateLimit(rf, q, dir, Accept, "fragment")
-		return Accept
+		return Accept, "fragment"
 	}
 
-	return noVerdict
+	return noVerdict, ""
 }
 
 // loggingAllowed reports whether p can appear in logs at all.
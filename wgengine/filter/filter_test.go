@@ -1007,6 +1007,96 @@ func TestPeerCaps(t *testing.T) {
 	}
 }
 
+func TestExplain(t *testing.T) {
+	filt := newFilter(t.Logf)
+	tests := []struct {
+		name      string
+		src, dst  string
+		port      uint16
+		proto     ipproto.Proto
+		want      Response
+		wantWhy   string
+		wantMatch string // "Srcs=>Dsts" of the matching rule, if any
+	}{
+		{
+			name:      "tcp_ok",
+			src:       "8.1.1.1",
+			dst:       "5.6.7.8",
+			port:      27,
+			proto:     ipproto.TCP,
+			want:      Accept,
+			wantWhy:   "tcp ok",
+			wantMatch: "[8.1.1.1/32 8.2.2.2/32]=>[5.6.7.8/32:27-28]",
+		},
+		{
+			name:    "tcp_no_rule",
+			src:     "8.1.1.1",
+			dst:     "5.6.7.8",
+			port:    29,
+			proto:   ipproto.TCP,
+			want:    Drop,
+			wantWhy: "no rules matched",
+		},
+		{
+			name:    "not_local",
+			src:     "8.1.1.1",
+			dst:     "7.7.7.7",
+			port:    22,
+			proto:   ipproto.TCP,
+			want:    Drop,
+			wantWhy: "destination not allowed",
+		},
+		{
+			name:      "sctp",
+			src:       "9.1.1.1",
+			dst:       "1.2.3.4",
+			port:      22,
+			proto:     ipproto.SCTP,
+			want:      Accept,
+			wantWhy:   "ok",
+			wantMatch: "[9.1.1.1/32 9.2.2.2/32]=>[1.2.3.4/32:22 5.6.7.8/32:23-24]",
+		},
+		{
+			name:      "v6",
+			src:       "::1",
+			dst:       "2001::1",
+			port:      22,
+			proto:     ipproto.UDP,
+			want:      Accept,
+			wantWhy:   "ok",
+			wantMatch: "[::1/128 ::2/128]=>[2001::1/128:22 2001::2/128:22]",
+		},
+		{
+			name:    "mismatched_families",
+			src:     "::1",
+			dst:     "1.2.3.4",
+			port:    22,
+			proto:   ipproto.TCP,
+			want:    Drop,
+			wantWhy: "mismatched address families",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := netip.MustParseAddr(tt.src), netip.MustParseAddr(tt.dst)
+			got := filt.Explain(src, dst, tt.port, tt.proto)
+			if got.Response != tt.want || got.Why != tt.wantWhy {
+				t.Errorf("got %v (%q); want %v (%q)", got.Response, got.Why, tt.want, tt.wantWhy)
+			}
+			if got.Response != filt.Check(src, dst, tt.port, tt.proto) {
+				t.Errorf("Explain and Check disagree")
+			}
+			var gotMatch string
+			if got.Match != nil {
+				gotMatch = fmt.Sprintf("%v=>%v", got.Match.Srcs, got.Match.Dsts)
+			}
+			if gotMatch != tt.wantMatch {
+				t.Errorf("match = %q; want %q", gotMatch, tt.wantMatch)
+			}
+		})
+	}
+}
+
 var (
 	filterMatchFile = flag.String("filter-match-file", "", "JSON file of []filter.Match to benchmark")
 )
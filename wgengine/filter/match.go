@@ -15,6 +15,12 @@
 type matches []filtertype.Match
 
 func (ms matches) match(q *packet.Parsed, hasCap CapTestFunc) bool {
+	return ms.matchIndex(q, hasCap) >= 0
+}
+
+// matchIndex is like match, but returns the index of the first Match in ms
+// that matches q, or -1 if none do.
+func (ms matches) matchIndex(q *packet.Parsed, hasCap CapTestFunc) int {
 	for i := range ms {
 		m := &ms[i]
 		if !views.SliceContains(m.IPProto, q.IPProto) {
@@ -30,10 +36,10 @@ func (ms matches) match(q *packet.Parsed, hasCap CapTestFunc) bool {
 			if !dst.Ports.Contains(q.Dst.Port()) {
 				continue
 			}
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
 
 // srcMatches reports whether srcAddr matche the src requirements in m, either
@@ -60,34 +66,46 @@ func srcMatches(m *filtertype.Match, srcAddr netip.Addr, hasCap CapTestFunc) boo
 type CapTestFunc = func(srcIP netip.Addr, cap tailcfg.NodeCapability) bool
 
 func (ms matches) matchIPsOnly(q *packet.Parsed, hasCap CapTestFunc) bool {
+	return ms.matchIPsOnlyIndex(q, hasCap) >= 0
+}
+
+// matchIPsOnlyIndex is like matchIPsOnly, but returns the index of the Match
+// in ms that matches q, or -1 if none do.
+func (ms matches) matchIPsOnlyIndex(q *packet.Parsed, hasCap CapTestFunc) int {
 	srcAddr := q.Src.Addr()
-	for _, m := range ms {
+	for i, m := range ms {
 		if !m.SrcsContains(srcAddr) {
 			continue
 		}
 		for _, dst := range m.Dsts {
 			if dst.Net.Contains(q.Dst.Addr()) {
-				return true
+				return i
 			}
 		}
 	}
 	if hasCap != nil {
-		for _, m := range ms {
+		for i, m := range ms {
 			for _, c := range m.SrcCaps {
 				if hasCap(srcAddr, c) {
-					return true
+					return i
 				}
 			}
 		}
 	}
-	return false
+	return -1
 }
 
 // matchProtoAndIPsOnlyIfAllPorts reports q matches any Match in ms where the
 // Match if for the right IP Protocol and IP address, but ports are
 // ignored, as long as the match is for the entire uint16 port range.
 func (ms matches) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) bool {
-	for _, m := range ms {
+	return ms.matchProtoAndIPsOnlyIfAllPortsIndex(q) >= 0
+}
+
+// matchProtoAndIPsOnlyIfAllPortsIndex is like matchProtoAndIPsOnlyIfAllPorts,
+// but returns the index of the Match in ms that matches q, or -1 if none do.
+func (ms matches) matchProtoAndIPsOnlyIfAllPortsIndex(q *packet.Parsed) int {
+	for i, m := range ms {
 		if !views.SliceContains(m.IPProto, q.IPProto) {
 			continue
 		}
@@ -99,9 +117,9 @@ func (ms matches) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) bool {
 				continue
 			}
 			if dst.Net.Contains(q.Dst.Addr()) {
-				return true
+				return i
 			}
 		}
 	}
-	return false
+	return -1
 }
@@ -402,6 +402,7 @@ func (c *Conn) derpWriteChanForRegion(regionID int, peer key.NodePublic) chan<-
 		return derpMap.Regions[regionID]
 	})
 	dc.HealthTracker = c.health
+	dc.TLSConfig = c.derpTLSConfig
 
 	dc.SetCanAckPings(true)
 	dc.NotePreferred(c.myDerp == regionID)
@@ -9,6 +9,8 @@
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"expvar"
 	"fmt"
@@ -25,6 +27,7 @@
 	"time"
 
 	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/device"
 	"go4.org/mem"
 	"golang.org/x/net/ipv6"
 
@@ -142,6 +145,8 @@ type Conn struct {
 	derpActiveFunc         func()
 	idleFunc               func() time.Duration // nil means unknown
 	testOnlyPacketListener nettype.PacketListener
+	packetListener         nettype.PacketListener
+	derpTLSConfig          *tls.Config          // or nil, see Options.DERPTLSConfig
 	noteRecvActivity       func(key.NodePublic) // or nil, see Options.NoteRecvActivity
 	netMon                 *netmon.Monitor      // must be non-nil
 	health                 *health.Tracker      // or nil
@@ -218,6 +223,10 @@ type Conn struct {
 	// havePrivateKey is whether privateKey is non-zero.
 	havePrivateKey  atomic.Bool
 	publicKeyAtomic syncs.AtomicValue[key.NodePublic] // or NodeKey zero value if !havePrivateKey
+	// handshakeMAC1 checks the first MAC of WireGuard handshake
+	// initiations, which is keyed by the receiver's public key, for
+	// IsPacketForMe. It's reinitialized when the private key changes.
+	handshakeMAC1 device.CookieChecker
 
 	// derpMapAtomic is the same as derpMap, but without requiring
 	// sync.Mutex. For use with NewRegionClient's callback, to avoid
@@ -422,6 +431,19 @@ type Options struct {
 	// Only used by tests.
 	TestOnlyPacketListener nettype.PacketListener
 
+	// PacketListener optionally specifies how to create the UDP PacketConns
+	// used for WireGuard and disco traffic, instead of the OS. It's used to
+	// share one UDP socket between several Conns, in which case the
+	// PacketConns must deliver each Conn the packets addressed to it. Conns
+	// can tell which handshake initiations and disco messages are theirs
+	// with IsPacketForMe.
+	PacketListener nettype.PacketListener
+
+	// DERPTLSConfig optionally specifies the base TLS config for DERP
+	// connections. It's used to share a TLS session cache between several
+	// Conns, so that DERP servers resume their TLS sessions.
+	DERPTLSConfig *tls.Config
+
 	// NoteRecvActivity, if provided, is a func for magicsock to call
 	// whenever it receives a packet from a a peer if it's been more
 	// than ~10 seconds since the last one. (10 seconds is somewhat
@@ -532,6 +554,8 @@ func NewConn(opts Options) (*Conn, error) {
 	c.derpActiveFunc = opts.derpActiveFunc()
 	c.idleFunc = opts.IdleFunc
 	c.testOnlyPacketListener = opts.TestOnlyPacketListener
+	c.packetListener = opts.PacketListener
+	c.derpTLSConfig = opts.DERPTLSConfig
 	c.noteRecvActivity = opts.NoteRecvActivity
 	portMapOpts := &portmapper.DebugKnobs{
 		DisableAll: func() bool { return opts.DisablePortMapper || c.onlyTCP443.Load() },
@@ -1619,6 +1643,30 @@ func (c *Conn) sendDiscoMessage(dst netip.AddrPort, dstKey key.NodePublic, dstDi
 	discoRXPathRawSocket discoRXPath = "raw socket"
 )
 
+// IsPacketForMe reports whether b, a packet received on a UDP socket
+// shared with other Conns (see Options.PacketListener), is addressed to c.
+// It can only tell for WireGuard handshake initiations, whose first MAC is
+// keyed by c's node key, and for disco messages from known peers, which are
+// sealed for c's disco key. It reports false for all other packets.
+func (c *Conn) IsPacketForMe(b []byte) bool {
+	if len(b) == device.MessageInitiationSize && binary.LittleEndian.Uint32(b) == device.MessageInitiationType {
+		return c.havePrivateKey.Load() && c.handshakeMAC1.CheckMAC1(b)
+	}
+	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
+	if len(b) < headerLen || string(b[:len(disco.Magic)]) != disco.Magic {
+		return false
+	}
+	sender := key.DiscoPublicFromRaw32(mem.B(b[len(disco.Magic):headerLen]))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.privateKey.IsZero() || !c.peerMap.knownPeerDiscoKey(sender) {
+		return false
+	}
+	_, ok := c.discoInfoLocked(sender).sharedKey.Open(b[headerLen:])
+	return ok
+}
+
 // handleDiscoMessage handles a discovery message and reports whether
 // msg was a Tailscale inter-node discovery message.
 //
@@ -2010,6 +2058,9 @@ func (c *Conn) SetPrivateKey(privateKey key.NodePrivate) error {
 		return nil
 	}
 	c.privateKey = newKey
+	if !newKey.IsZero() {
+		c.handshakeMAC1.Init(device.NoisePublicKey(newKey.Public().Raw32()))
+	}
 	c.havePrivateKey.Store(!newKey.IsZero())
 
 	if newKey.IsZero() {
@@ -2619,6 +2670,9 @@ func (c *Conn) listenPacket(network string, port uint16) (nettype.PacketConn, er
 	if c.testOnlyPacketListener != nil {
 		return nettype.MakePacketListenerWithNetIP(c.testOnlyPacketListener).ListenPacket(ctx, network, addr)
 	}
+	if c.packetListener != nil {
+		return nettype.MakePacketListenerWithNetIP(c.packetListener).ListenPacket(ctx, network, addr)
+	}
 	return nettype.MakePacketListenerWithNetIP(netns.Listener(c.logf, c.netMon)).ListenPacket(ctx, network, addr)
 }
 
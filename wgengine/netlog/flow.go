@@ -0,0 +1,289 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+	"tailscale.com/util/multierr"
+)
+
+// flowVersion is the version number of a flow export protocol.
+type flowVersion uint16
+
+const (
+	flowVersionNetFlow9 flowVersion = 9  // RFC 3954
+	flowVersionIPFIX    flowVersion = 10 // RFC 7011
+)
+
+// Field types, which are the same numbers in NetFlow v9 and IPFIX
+// (where they're called information elements).
+const (
+	fieldOctetDeltaCount          = 1
+	fieldPacketDeltaCount         = 2
+	fieldProtocolIdentifier       = 4
+	fieldSourceTransportPort      = 7
+	fieldSourceIPv4Address        = 8
+	fieldDestinationTransportPort = 11
+	fieldDestinationIPv4Address   = 12
+	fieldLastSwitched             = 21 // NetFlow v9 only
+	fieldFirstSwitched            = 22 // NetFlow v9 only
+	fieldSourceIPv6Address        = 27
+	fieldDestinationIPv6Address   = 28
+	fieldFlowDirection            = 61
+	fieldFlowStartMilliseconds    = 152 // IPFIX only
+	fieldFlowEndMilliseconds      = 153 // IPFIX only
+)
+
+const (
+	flowTemplateIPv4 = 256
+	flowTemplateIPv6 = 257
+
+	// flowMaxPacketSize is the maximum size of an export packet, chosen to
+	// avoid fragmentation on typical paths.
+	flowMaxPacketSize = 1400
+)
+
+type flowField struct {
+	id     uint16
+	length uint16
+}
+
+// template returns the template ID and fields of flow records for IPv4 or
+// IPv6 addresses.
+func (v flowVersion) template(is6 bool) (id uint16, fields []flowField) {
+	id = flowTemplateIPv4
+	fields = []flowField{{fieldProtocolIdentifier, 1}}
+	if is6 {
+		id = flowTemplateIPv6
+		fields = append(fields, flowField{fieldSourceIPv6Address, 16}, flowField{fieldDestinationIPv6Address, 16})
+	} else {
+		fields = append(fields, flowField{fieldSourceIPv4Address, 4}, flowField{fieldDestinationIPv4Address, 4})
+	}
+	fields = append(fields,
+		flowField{fieldSourceTransportPort, 2},
+		flowField{fieldDestinationTransportPort, 2},
+		flowField{fieldOctetDeltaCount, 8},
+		flowField{fieldPacketDeltaCount, 8},
+		flowField{fieldFlowDirection, 1},
+	)
+	if v == flowVersionIPFIX {
+		fields = append(fields, flowField{fieldFlowStartMilliseconds, 8}, flowField{fieldFlowEndMilliseconds, 8})
+	} else {
+		fields = append(fields, flowField{fieldFirstSwitched, 4}, flowField{fieldLastSwitched, 4})
+	}
+	return id, fields
+}
+
+// flowRecord is the traffic in one direction of a connection.
+type flowRecord struct {
+	proto    ipproto.Proto
+	src, dst netip.AddrPort
+	bytes    uint64
+	packets  uint64
+	egress   bool
+}
+
+// is6 reports whether r needs the IPv6 template, which is the case unless
+// both of its addresses are IPv4 or were scrubbed.
+func (r *flowRecord) is6() bool {
+	return r.src.Addr().Is6() || r.dst.Addr().Is6()
+}
+
+// appendFlowAddr appends a as an IPv4 or IPv6 address field, or zeros if a
+// is invalid.
+func appendFlowAddr(b []byte, a netip.Addr, is6 bool) []byte {
+	switch {
+	case is6:
+		a16 := a.As16() // IPv4 addresses are mapped, and invalid ones zero
+		if !a.IsValid() {
+			a16 = [16]byte{}
+		}
+		return append(b, a16[:]...)
+	case a.IsValid():
+		a4 := a.As4()
+		return append(b, a4[:]...)
+	default:
+		return append(b, 0, 0, 0, 0)
+	}
+}
+
+// flowRecords returns the flow records of all connections in m, with
+// transmitted counts as egress flows and received counts as ingress flows
+// in the reverse direction.
+func flowRecords(m *netlogtype.Message) (v4, v6 []flowRecord) {
+	for _, traffic := range [][]netlogtype.ConnectionCounts{m.VirtualTraffic, m.SubnetTraffic, m.ExitTraffic, m.PhysicalTraffic} {
+		for _, cc := range traffic {
+			var recs [2]flowRecord
+			n := 0
+			if cc.TxPackets > 0 || cc.TxBytes > 0 {
+				recs[n] = flowRecord{cc.Proto, cc.Src, cc.Dst, cc.TxBytes, cc.TxPackets, true}
+				n++
+			}
+			if cc.RxPackets > 0 || cc.RxBytes > 0 {
+				recs[n] = flowRecord{cc.Proto, cc.Dst, cc.Src, cc.RxBytes, cc.RxPackets, false}
+				n++
+			}
+			for _, r := range recs[:n] {
+				if r.is6() {
+					v6 = append(v6, r)
+				} else {
+					v4 = append(v4, r)
+				}
+			}
+		}
+	}
+	return v4, v6
+}
+
+// flowExporter is a Sink that exports flow records to an IPFIX or
+// NetFlow v9 collector over UDP.
+//
+// Every export packet carries the template of its records, so collectors
+// can decode them regardless of when they started listening.
+type flowExporter struct {
+	version flowVersion
+	domain  uint32    // observation domain (IPFIX) or source ID (NetFlow v9)
+	start   time.Time // system start time for NetFlow v9 uptimes
+	conn    net.Conn
+
+	mu  sync.Mutex
+	seq uint32 // data records (IPFIX) or packets (NetFlow v9) sent
+	buf []byte
+}
+
+func newFlowExporter(version flowVersion, addr string, domain uint32) (*flowExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &flowExporter{
+		version: version,
+		domain:  domain,
+		start:   time.Now(),
+		conn:    conn,
+	}, nil
+}
+
+// WriteMessage exports the flow records of m in one or more packets.
+func (e *flowExporter) WriteMessage(m *netlogtype.Message) error {
+	v4, v6 := flowRecords(m)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var errs []error
+	for _, recs := range [][]flowRecord{v4, v6} {
+		if len(recs) == 0 {
+			continue
+		}
+		is6 := recs[0].is6()
+		_, fields := e.version.template(is6)
+		recLen := 0
+		for _, f := range fields {
+			recLen += int(f.length)
+		}
+		perPacket := (flowMaxPacketSize - 20 - (8 + 4*len(fields)) - (4 + 3)) / recLen
+		for len(recs) > 0 {
+			n := min(len(recs), perPacket)
+			e.buf = e.appendPacket(e.buf[:0], time.Now(), is6, recs[:n], m.Start, m.End)
+			if _, err := e.conn.Write(e.buf); err != nil {
+				errs = append(errs, err)
+			}
+			recs = recs[n:]
+		}
+	}
+	return multierr.New(errs...)
+}
+
+// appendPacket appends an export packet with a template set and a data set
+// of recs, all of which are IPv6 if is6 and IPv4 otherwise, for traffic
+// between start and end.
+func (e *flowExporter) appendPacket(b []byte, now time.Time, is6 bool, recs []flowRecord, start, end time.Time) []byte {
+	be := binary.BigEndian
+	templateID, fields := e.version.template(is6)
+
+	// Message (IPFIX) or packet (NetFlow v9) header.
+	b = be.AppendUint16(b, uint16(e.version))
+	if e.version == flowVersionIPFIX {
+		b = be.AppendUint16(b, 0) // length, set below
+		b = be.AppendUint32(b, uint32(now.Unix()))
+		b = be.AppendUint32(b, e.seq)
+		e.seq += uint32(len(recs))
+	} else {
+		b = be.AppendUint16(b, uint16(1+len(recs))) // the template and data records
+		b = be.AppendUint32(b, uint32(e.uptime(now)))
+		b = be.AppendUint32(b, uint32(now.Unix()))
+		b = be.AppendUint32(b, e.seq)
+		e.seq++
+	}
+	b = be.AppendUint32(b, e.domain)
+
+	// Template set.
+	setID := uint16(2) // IPFIX template set
+	if e.version == flowVersionNetFlow9 {
+		setID = 0 // NetFlow v9 template flowset
+	}
+	b = be.AppendUint16(b, setID)
+	b = be.AppendUint16(b, uint16(8+4*len(fields)))
+	b = be.AppendUint16(b, templateID)
+	b = be.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		b = be.AppendUint16(b, f.id)
+		b = be.AppendUint16(b, f.length)
+	}
+
+	// Data set.
+	setStart := len(b)
+	b = be.AppendUint16(b, templateID)
+	b = be.AppendUint16(b, 0) // length, set below
+	for _, r := range recs {
+		b = append(b, byte(r.proto))
+		b = appendFlowAddr(b, r.src.Addr(), is6)
+		b = appendFlowAddr(b, r.dst.Addr(), is6)
+		b = be.AppendUint16(b, r.src.Port())
+		b = be.AppendUint16(b, r.dst.Port())
+		b = be.AppendUint64(b, r.bytes)
+		b = be.AppendUint64(b, r.packets)
+		var direction byte // ingress
+		if r.egress {
+			direction = 1
+		}
+		b = append(b, direction)
+		if e.version == flowVersionIPFIX {
+			b = be.AppendUint64(b, uint64(start.UnixMilli()))
+			b = be.AppendUint64(b, uint64(end.UnixMilli()))
+		} else {
+			b = be.AppendUint32(b, uint32(e.uptime(start)))
+			b = be.AppendUint32(b, uint32(e.uptime(end)))
+		}
+	}
+	if e.version == flowVersionNetFlow9 {
+		// NetFlow v9 flowsets are padded to a 32-bit boundary.
+		for (len(b)-setStart)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	be.PutUint16(b[setStart+2:], uint16(len(b)-setStart))
+	if e.version == flowVersionIPFIX {
+		be.PutUint16(b[2:], uint16(len(b)))
+	}
+	return b
+}
+
+// uptime returns the milliseconds from the exporter's start until t, which
+// NetFlow v9 uses for timestamps.
+func (e *flowExporter) uptime(t time.Time) int64 {
+	return max(t.Sub(e.start).Milliseconds(), 0)
+}
+
+// Close closes the connection to the collector.
+func (e *flowExporter) Close() error {
+	return e.conn.Close()
+}
@@ -24,6 +24,7 @@
 	"tailscale.com/net/sockstats"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netlogtype"
 	"tailscale.com/util/multierr"
@@ -33,6 +34,9 @@
 // pollPeriod specifies how often to poll for network traffic.
 const pollPeriod = 5 * time.Second
 
+// sinkErrLogf logs sink errors, at most once per minute per format string.
+var sinkErrLogf = logger.RateLimitedFn(log.Printf, time.Minute, 1, 10)
+
 // Device is an abstraction over a tunnel device or a magic socket.
 // Both *tstun.Wrapper and *magicsock.Conn implement this interface.
 type Device interface {
@@ -50,7 +54,8 @@ func (noopDevice) SetStatistics(*connstats.Statistics) {}
 type Logger struct {
 	mu sync.Mutex // protects all fields below
 
-	logger *logtail.Logger
+	logger *logtail.Logger // or nil if only logging to sinks
+	sinks  []Sink
 	stats  *connstats.Statistics
 	tun    Device
 	sock   Device
@@ -63,7 +68,16 @@ type Logger struct {
 func (nl *Logger) Running() bool {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	return nl.logger != nil
+	return nl.stats != nil
+}
+
+// SetSinks sets the local sinks that the logger records statistics to,
+// in addition to the logs service, while it's running.
+// The sinks are closed by [Logger.Close].
+func (nl *Logger) SetSinks(sinks []Sink) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	nl.sinks = sinks
 }
 
 var testClient *http.Client
@@ -93,45 +107,55 @@ func (nl *Logger) Running() bool {
 // The IP protocol and source port are always zero.
 // The sock is used to populated the PhysicalTraffic field in Message.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
+//
+// If nodeLogID is zero, statistics are only recorded to the sinks
+// set by [Logger.SetSinks], and not uploaded to the logs service.
 func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor, health *health.Tracker, logExitFlowEnabledEnabled bool) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger != nil {
+	if nl.stats != nil {
+		if nl.logger == nil {
+			return fmt.Errorf("network logger already running for local sinks")
+		}
 		return fmt.Errorf("network logger already running for %v", nl.logger.PrivateID().Public())
 	}
 
 	// Startup a log stream to Tailscale's logging service.
-	logf := log.Printf
-	httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
-	if testClient != nil {
-		httpc = testClient
+	if !nodeLogID.IsZero() {
+		logf := log.Printf
+		httpc := &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost, netMon, health, logf)}
+		if testClient != nil {
+			httpc = testClient
+		}
+		nl.logger = logtail.NewLogger(logtail.Config{
+			Collection:    "tailtraffic.log.tailscale.io",
+			PrivateID:     nodeLogID,
+			CopyPrivateID: domainLogID,
+			Stderr:        io.Discard,
+			CompressLogs:  true,
+			HTTPC:         httpc,
+			// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
+
+			// Include process sequence numbers to identify missing samples.
+			IncludeProcID:       true,
+			IncludeProcSequence: true,
+		}, logf)
+		nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
 	}
-	nl.logger = logtail.NewLogger(logtail.Config{
-		Collection:    "tailtraffic.log.tailscale.io",
-		PrivateID:     nodeLogID,
-		CopyPrivateID: domainLogID,
-		Stderr:        io.Discard,
-		CompressLogs:  true,
-		HTTPC:         httpc,
-		// TODO(joetsai): Set Buffer? Use an in-memory buffer for now.
-
-		// Include process sequence numbers to identify missing samples.
-		IncludeProcID:       true,
-		IncludeProcSequence: true,
-	}, logf)
-	nl.logger.SetSockstatsLabel(sockstats.LabelNetlogLogger)
 
 	// Startup a data structure to track per-connection statistics.
 	// There is a maximum size for individual log messages that logtail
 	// can upload to the Tailscale log service, so stay below this limit.
 	const maxLogSize = 256 << 10
 	const maxConns = (maxLogSize - netlogtype.MaxMessageJSONSize) / netlogtype.MaxConnectionCountsJSONSize
+	logger := nl.logger
 	nl.stats = connstats.NewStatistics(pollPeriod, maxConns, func(start, end time.Time, virtual, physical map[netlogtype.Connection]netlogtype.Counts) {
 		nl.mu.Lock()
 		addrs := nl.addrs
 		prefixes := nl.prefixes
+		sinks := nl.sinks
 		nl.mu.Unlock()
-		recordStatistics(nl.logger, nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
+		recordStatistics(logger, sinks, nodeID, start, end, virtual, physical, addrs, prefixes, logExitFlowEnabledEnabled)
 	})
 
 	// Register the connection tracker into the TUN device.
@@ -151,7 +175,7 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	return nil
 }
 
-func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) {
+func recordStatistics(logger *logtail.Logger, sinks []Sink, nodeID tailcfg.StableNodeID, start, end time.Time, connstats, sockStats map[netlogtype.Connection]netlogtype.Counts, addrs map[netip.Addr]bool, prefixes map[netip.Prefix]bool, logExitFlowEnabled bool) {
 	m := netlogtype.Message{NodeID: nodeID, Start: start.UTC(), End: end.UTC()}
 
 	classifyAddr := func(a netip.Addr) (isTailscale, withinRoute bool) {
@@ -202,10 +226,17 @@ func recordStatistics(logger *logtail.Logger, nodeID tailcfg.StableNodeID, start
 	}
 
 	if len(m.VirtualTraffic)+len(m.SubnetTraffic)+len(m.ExitTraffic)+len(m.PhysicalTraffic) > 0 {
-		if b, err := json.Marshal(m); err != nil {
-			logger.Logf("json.Marshal error: %v", err)
-		} else {
-			logger.Logf("%s", b)
+		if logger != nil {
+			if b, err := json.Marshal(m); err != nil {
+				logger.Logf("json.Marshal error: %v", err)
+			} else {
+				logger.Logf("%s", b)
+			}
+		}
+		for _, s := range sinks {
+			if err := s.WriteMessage(&m); err != nil {
+				sinkErrLogf("netlog: sink error: %v", err)
+			}
 		}
 	}
 }
@@ -249,7 +280,7 @@ func (nl *Logger) ReconfigRoutes(cfg *router.Config) {
 func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
-	if nl.logger == nil {
+	if nl.stats == nil {
 		return nil
 	}
 
@@ -259,7 +290,10 @@ func (nl *Logger) Shutdown(ctx context.Context) error {
 	nl.sock.SetStatistics(nil)
 	nl.tun.SetStatistics(nil)
 	err1 := nl.stats.Shutdown(ctx)
-	err2 := nl.logger.Shutdown(ctx)
+	var err2 error
+	if nl.logger != nil {
+		err2 = nl.logger.Shutdown(ctx)
+	}
 	nl.mu.Lock()
 
 	// Purge state.
@@ -272,3 +306,17 @@ func (nl *Logger) Shutdown(ctx context.Context) error {
 
 	return multierr.New(err1, err2)
 }
+
+// Close shuts down the network logger, like [Logger.Shutdown], and closes
+// its sinks.
+func (nl *Logger) Close(ctx context.Context) error {
+	err := nl.Shutdown(ctx)
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	errs := []error{err}
+	for _, s := range nl.sinks {
+		errs = append(errs, s.Close())
+	}
+	nl.sinks = nil
+	return multierr.New(errs...)
+}
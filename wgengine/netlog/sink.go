@@ -0,0 +1,146 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/logtail/logsink"
+	"tailscale.com/types/netlogtype"
+)
+
+// Sink is a local destination for network flow logs, such as a file or a
+// flow collector. Sinks receive every message that is uploaded to the
+// logs service, and continue to receive messages if uploading is disabled.
+type Sink interface {
+	// WriteMessage records the traffic in m, which must not be retained.
+	// It's called from a single goroutine every poll period, and should
+	// not block for long.
+	WriteMessage(m *netlogtype.Message) error
+	io.Closer
+}
+
+// ParseSink returns the sink described by spec, which is one of:
+//
+//	file:<path>[?max_size=<bytes>&max_backups=<n>]
+//	unix:<path>
+//	ipfix://<host>:<port>[?domain=<id>]
+//	netflow9://<host>:<port>[?domain=<id>]
+//
+// File and unix socket sinks write one JSON object per line, in the format
+// of [netlogtype.Message] with an added "logged" time, as understood by
+// cmd/netlogfmt. Files are rotated like [logsink.File], and unix sockets
+// are reconnected like [logsink.Socket]. IPFIX (RFC 7011) and
+// NetFlow v9 (RFC 3954) sinks export each connection's transmitted and
+// received counts as egress and ingress flow records over UDP, with the
+// observation domain (or source ID) domain.
+func ParseSink(spec string) (Sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid netlog sink %q: %w", spec, err)
+	}
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	switch u.Scheme {
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("invalid netlog sink %q: missing path", spec)
+		}
+		opts, err := logsink.ParseFileOptions(u.Query())
+		if err != nil {
+			return nil, fmt.Errorf("invalid netlog sink %q: %w", spec, err)
+		}
+		f, err := logsink.NewFile(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewJSONSink(f), nil
+	case "unix":
+		if path == "" {
+			return nil, fmt.Errorf("invalid netlog sink %q: missing path", spec)
+		}
+		return NewJSONSink(logsink.NewSocket("unix", path)), nil
+	case "ipfix", "netflow9":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid netlog sink %q: missing address", spec)
+		}
+		var domain uint32
+		if v := u.Query().Get("domain"); v != "" {
+			d, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid netlog sink %q: bad domain", spec)
+			}
+			domain = uint32(d)
+		}
+		version := flowVersionIPFIX
+		if u.Scheme == "netflow9" {
+			version = flowVersionNetFlow9
+		}
+		return newFlowExporter(version, u.Host, domain)
+	}
+	return nil, fmt.Errorf("invalid netlog sink %q: unknown type %q", spec, u.Scheme)
+}
+
+// ParseSinks parses the comma-separated list of sink specs, as accepted by
+// [ParseSink]. If any spec is invalid, the sinks already opened are closed.
+func ParseSinks(specs string) ([]Sink, error) {
+	var sinks []Sink
+	for _, spec := range strings.Split(specs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		s, err := ParseSink(spec)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// JSONSink is a Sink that writes messages as JSON lines.
+type JSONSink struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	buf []byte
+}
+
+// NewJSONSink returns a JSONSink writing to w, which it closes when closed.
+func NewJSONSink(w io.WriteCloser) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// WriteMessage writes m, with the current time as its "logged" time, as a
+// single line of JSON.
+func (s *JSONSink) WriteMessage(m *netlogtype.Message) error {
+	b, err := json.Marshal(struct {
+		Logged time.Time `json:"logged"`
+		*netlogtype.Message
+	}{time.Now().UTC(), m})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(append(s.buf[:0], b...), '\n')
+	_, err = s.w.Write(s.buf)
+	return err
+}
+
+// Close closes the underlying writer.
+func (s *JSONSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,345 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/netlogtype"
+)
+
+var (
+	testStart = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testEnd   = testStart.Add(5 * time.Second)
+)
+
+func testMessage() *netlogtype.Message {
+	return &netlogtype.Message{
+		NodeID: "n123456CNTRL",
+		Start:  testStart,
+		End:    testEnd,
+		VirtualTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{
+				Proto: ipproto.TCP,
+				Src:   netip.MustParseAddrPort("100.64.0.1:22"),
+				Dst:   netip.MustParseAddrPort("100.64.0.2:40000"),
+			},
+			Counts: netlogtype.Counts{TxPackets: 2, TxBytes: 200, RxPackets: 1, RxBytes: 60},
+		}},
+		PhysicalTraffic: []netlogtype.ConnectionCounts{{
+			Connection: netlogtype.Connection{
+				Src: netip.MustParseAddrPort("100.64.0.2:0"),
+				Dst: netip.MustParseAddrPort("[2001:db8::1]:41641"),
+			},
+			Counts: netlogtype.Counts{TxPackets: 3, TxBytes: 300},
+		}},
+	}
+}
+
+func checkJSONMessage(t *testing.T, line []byte) {
+	t.Helper()
+	var got struct {
+		Logged time.Time `json:"logged"`
+		netlogtype.Message
+	}
+	if err := json.Unmarshal(line, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Logged.IsZero() {
+		t.Error("missing logged time")
+	}
+	want := testMessage()
+	if got.NodeID != want.NodeID || !got.Start.Equal(want.Start) || len(got.VirtualTraffic) != 1 || got.VirtualTraffic[0] != want.VirtualTraffic[0] {
+		t.Errorf("got %+v; want %+v", got.Message, *want)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.json")
+	s, err := ParseSink("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := s.WriteMessage(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	n := 0
+	for sc.Scan() {
+		checkJSONMessage(t, sc.Bytes())
+		n++
+	}
+	if n != 2 {
+		t.Errorf("got %d lines; want 2", n)
+	}
+}
+
+func TestUnixSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netlog.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unsupported: %v", err)
+	}
+	defer ln.Close()
+
+	lines := make(chan []byte, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		sc := bufio.NewScanner(c)
+		for sc.Scan() {
+			lines <- append([]byte(nil), sc.Bytes()...)
+		}
+	}()
+
+	s, err := ParseSink("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.WriteMessage(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-lines:
+		checkJSONMessage(t, line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+}
+
+func TestParseSinkErrors(t *testing.T) {
+	for _, spec := range []string{
+		"file:",
+		"unix:",
+		"ipfix://",
+		"ipfix://127.0.0.1:4739?domain=x",
+		"sflow://127.0.0.1:6343",
+	} {
+		if s, err := ParseSink(spec); err == nil {
+			s.Close()
+			t.Errorf("ParseSink(%q) succeeded; want error", spec)
+		}
+	}
+	if _, err := ParseSinks("ipfix://127.0.0.1:4739,bogus:x"); err == nil {
+		t.Error("ParseSinks with a bad spec succeeded")
+	}
+	sinks, err := ParseSinks(" ipfix://127.0.0.1:4739 , netflow9://127.0.0.1:2055,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks) != 2 {
+		t.Errorf("got %d sinks; want 2", len(sinks))
+	}
+	for _, s := range sinks {
+		s.Close()
+	}
+}
+
+// flowPacket is a decoded IPFIX or NetFlow v9 export packet.
+type flowPacket struct {
+	version   uint16
+	seq       uint32
+	domain    uint32
+	templates map[uint16][]flowField
+	records   map[uint16][][]byte // raw data records by template ID
+}
+
+func readFlowPacket(t *testing.T, pc net.PacketConn) flowPacket {
+	t.Helper()
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf[:n]
+	be := binary.BigEndian
+
+	p := flowPacket{
+		version:   be.Uint16(b),
+		templates: map[uint16][]flowField{},
+		records:   map[uint16][][]byte{},
+	}
+	var templateSetID uint16
+	switch p.version {
+	case 10:
+		if got := int(be.Uint16(b[2:])); got != n {
+			t.Fatalf("IPFIX length = %d; want %d", got, n)
+		}
+		p.seq, p.domain = be.Uint32(b[8:]), be.Uint32(b[12:])
+		b = b[16:]
+		templateSetID = 2
+	case 9:
+		p.seq, p.domain = be.Uint32(b[12:]), be.Uint32(b[16:])
+		b = b[20:]
+		templateSetID = 0
+	default:
+		t.Fatalf("unknown version %d", p.version)
+	}
+	for len(b) > 0 {
+		setID, setLen := be.Uint16(b), int(be.Uint16(b[2:]))
+		if setLen < 4 || setLen > len(b) {
+			t.Fatalf("bad set length %d", setLen)
+		}
+		set := b[4:setLen]
+		b = b[setLen:]
+		if setID == templateSetID {
+			id, count := be.Uint16(set), int(be.Uint16(set[2:]))
+			set = set[4:]
+			for range count {
+				p.templates[id] = append(p.templates[id], flowField{be.Uint16(set), be.Uint16(set[2:])})
+				set = set[4:]
+			}
+			continue
+		}
+		fields, ok := p.templates[setID]
+		if !ok {
+			t.Fatalf("data set %d without template", setID)
+		}
+		recLen := 0
+		for _, f := range fields {
+			recLen += int(f.length)
+		}
+		for len(set) >= recLen {
+			p.records[setID] = append(p.records[setID], set[:recLen])
+			set = set[recLen:]
+		}
+	}
+	return p
+}
+
+func TestFlowExporter(t *testing.T) {
+	for _, tt := range []struct {
+		scheme  string
+		version uint16
+	}{
+		{"ipfix", 10},
+		{"netflow9", 9},
+	} {
+		t.Run(tt.scheme, func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+
+			s, err := ParseSink(tt.scheme + "://" + pc.LocalAddr().String() + "?domain=7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if err := s.WriteMessage(testMessage()); err != nil {
+				t.Fatal(err)
+			}
+
+			// The IPv4 records (TCP egress and ingress) come first,
+			// then the IPv6 record (physical egress).
+			p4 := readFlowPacket(t, pc)
+			p6 := readFlowPacket(t, pc)
+			for _, p := range []flowPacket{p4, p6} {
+				if p.version != tt.version || p.domain != 7 {
+					t.Errorf("version, domain = %d, %d; want %d, 7", p.version, p.domain, tt.version)
+				}
+			}
+			if tt.version == 10 && (p4.seq != 0 || p6.seq != 2) {
+				t.Errorf("IPFIX sequence numbers = %d, %d; want 0, 2", p4.seq, p6.seq)
+			}
+			if tt.version == 9 && (p4.seq != 0 || p6.seq != 1) {
+				t.Errorf("NetFlow v9 sequence numbers = %d, %d; want 0, 1", p4.seq, p6.seq)
+			}
+
+			recs := p4.records[flowTemplateIPv4]
+			if len(recs) != 2 {
+				t.Fatalf("got %d IPv4 records; want 2", len(recs))
+			}
+			be := binary.BigEndian
+			// proto(1) src(4) dst(4) sport(2) dport(2) bytes(8) packets(8) direction(1) ...
+			egress, ingress := recs[0], recs[1]
+			if egress[0] != byte(ipproto.TCP) ||
+				netip.AddrFrom4([4]byte(egress[1:5])) != netip.MustParseAddr("100.64.0.1") ||
+				be.Uint16(egress[9:]) != 22 || be.Uint16(egress[11:]) != 40000 ||
+				be.Uint64(egress[13:]) != 200 || be.Uint64(egress[21:]) != 2 || egress[29] != 1 {
+				t.Errorf("bad egress record % x", egress)
+			}
+			if netip.AddrFrom4([4]byte(ingress[1:5])) != netip.MustParseAddr("100.64.0.2") ||
+				be.Uint16(ingress[9:]) != 40000 ||
+				be.Uint64(ingress[13:]) != 60 || be.Uint64(ingress[21:]) != 1 || ingress[29] != 0 {
+				t.Errorf("bad ingress record % x", ingress)
+			}
+			if tt.version == 10 {
+				if got := be.Uint64(egress[30:]); got != uint64(testStart.UnixMilli()) {
+					t.Errorf("flowStartMilliseconds = %d; want %d", got, testStart.UnixMilli())
+				}
+			}
+
+			recs = p6.records[flowTemplateIPv6]
+			if len(recs) != 1 {
+				t.Fatalf("got %d IPv6 records; want 1", len(recs))
+			}
+			if src := netip.AddrFrom16([16]byte(recs[0][1:17])).Unmap(); src != netip.MustParseAddr("100.64.0.2") {
+				t.Errorf("IPv6 record source = %v; want mapped 100.64.0.2", src)
+			}
+		})
+	}
+}
+
+type memSink struct{ msgs []netlogtype.Message }
+
+func (s *memSink) WriteMessage(m *netlogtype.Message) error {
+	s.msgs = append(s.msgs, *m)
+	return nil
+}
+
+func (s *memSink) Close() error { return nil }
+
+func TestRecordStatisticsSinks(t *testing.T) {
+	sink := new(memSink)
+	tsIP := netip.MustParseAddr("100.64.0.1")
+	addrs := map[netip.Addr]bool{tsIP: true, netip.MustParseAddr("100.64.0.2"): true}
+	virtual := map[netlogtype.Connection]netlogtype.Counts{
+		{Proto: ipproto.TCP, Src: netip.AddrPortFrom(tsIP, 22), Dst: netip.MustParseAddrPort("100.64.0.2:40000")}: {TxPackets: 1},
+		{Proto: ipproto.TCP, Src: netip.AddrPortFrom(tsIP, 1234), Dst: netip.MustParseAddrPort("8.8.8.8:443")}:    {TxPackets: 2},
+	}
+	recordStatistics(nil, []Sink{sink}, "n123", testStart, testEnd, virtual, nil, addrs, nil, false)
+	if len(sink.msgs) != 1 {
+		t.Fatalf("got %d messages; want 1", len(sink.msgs))
+	}
+	m := sink.msgs[0]
+	if len(m.VirtualTraffic) != 1 || len(m.ExitTraffic) != 1 {
+		t.Fatalf("got %+v; want one virtual and one exit connection", m)
+	}
+	if got := m.ExitTraffic[0].Dst; got.IsValid() {
+		t.Errorf("exit traffic destination %v was not scrubbed", got)
+	}
+
+	// No traffic means no message.
+	recordStatistics(nil, []Sink{sink}, "n123", testStart, testEnd, nil, nil, addrs, nil, false)
+	if len(sink.msgs) != 1 {
+		t.Errorf("got %d messages; want 1", len(sink.msgs))
+	}
+}
@@ -7,6 +7,7 @@
 	"bufio"
 	"context"
 	crand "crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -42,7 +43,9 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/nettype"
 	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/deephash"
@@ -152,6 +155,8 @@ type userspaceEngine struct {
 
 	// networkLogger logs statistics about network connections.
 	networkLogger netlog.Logger
+	// hasNetLogSinks is whether networkLogger has local sinks.
+	hasNetLogSinks bool
 
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
@@ -228,6 +233,23 @@ type Config struct {
 	// DriveForLocal, if populated, will cause the engine to expose a Taildrive
 	// listener at 100.100.100.100:8080.
 	DriveForLocal drive.FileSystemForLocal
+
+	// NetworkLogSinks are optional local destinations for network flow
+	// logs. If non-empty, the network logger runs whenever the engine is
+	// configured, recording to these sinks even if the control plane hasn't
+	// enabled network logging or log uploads are disabled.
+	// The engine closes the sinks when it's closed.
+	NetworkLogSinks []netlog.Sink
+
+	// PacketListener optionally specifies how magicsock creates its UDP
+	// sockets. If nil, it binds its own sockets on ListenPort.
+	// See magicsock.Options.PacketListener.
+	PacketListener nettype.PacketListener
+
+	// DERPTLSConfig optionally specifies the base TLS config for
+	// magicsock's DERP connections.
+	// See magicsock.Options.DERPTLSConfig.
+	DERPTLSConfig *tls.Config
 }
 
 // NewFakeUserspaceEngine returns a new userspace engine for testing.
@@ -335,7 +357,9 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		controlKnobs:   conf.ControlKnobs,
 		reconfigureVPN: conf.ReconfigureVPN,
 		health:         conf.HealthTracker,
+		hasNetLogSinks: len(conf.NetworkLogSinks) > 0,
 	}
+	e.networkLogger.SetSinks(conf.NetworkLogSinks)
 
 	if e.birdClient != nil {
 		// Disable the protocol at start time.
@@ -402,6 +426,8 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		ControlKnobs:     conf.ControlKnobs,
 		OnPortUpdate:     onPortUpdate,
 		PeerByKeyFunc:    e.PeerByKey,
+		PacketListener:   conf.PacketListener,
+		DERPTLSConfig:    conf.DERPTLSConfig,
 	}
 
 	var err error
@@ -916,10 +942,12 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	netLogIDsNowValid := !newLogIDs.NodeID.IsZero() && !newLogIDs.DomainID.IsZero()
 	netLogIDsWasValid := !oldLogIDs.NodeID.IsZero() && !oldLogIDs.DomainID.IsZero()
 	netLogIDsChanged := netLogIDsNowValid && netLogIDsWasValid && newLogIDs != oldLogIDs
-	netLogRunning := netLogIDsNowValid && !routerCfg.Equal(&router.Config{})
-	if envknob.NoLogsNoSupport() {
-		netLogRunning = false
+	if e.hasNetLogSinks && netLogIDsNowValid != netLogIDsWasValid {
+		// Restart the logger to start or stop uploading to the logs service.
+		netLogIDsChanged = true
 	}
+	netLogUpload := netLogIDsNowValid && !envknob.NoLogsNoSupport()
+	netLogRunning := (netLogUpload || e.hasNetLogSinks) && !routerCfg.Equal(&router.Config{})
 
 	// TODO(bradfitz,danderson): maybe delete this isDNSIPOverTailscale
 	// field and delete the resolver.ForwardLinkSelector hook and
@@ -984,8 +1012,11 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	// Startup the network logger.
 	// Do this before configuring the router so that we capture initial packets.
 	if netLogRunning && !e.networkLogger.Running() {
-		nid := cfg.NetworkLogging.NodeID
-		tid := cfg.NetworkLogging.DomainID
+		var nid, tid logid.PrivateID // zero for only logging to local sinks
+		if netLogUpload {
+			nid = cfg.NetworkLogging.NodeID
+			tid = cfg.NetworkLogging.DomainID
+		}
 		logExitFlowEnabled := cfg.NetworkLogging.LogExitFlowEnabled
 		e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
 		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon, e.health, logExitFlowEnabled); err != nil {
@@ -1198,7 +1229,7 @@ func (e *userspaceEngine) Close() {
 
 	ctx, cancel := context.WithTimeout(context.Background(), networkLoggerUploadTimeout)
 	defer cancel()
-	if err := e.networkLogger.Shutdown(ctx); err != nil {
+	if err := e.networkLogger.Close(ctx); err != nil {
 		e.logf("wgengine: Close: error shutting down network logger: %v", err)
 	}
 }